@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/gospotcheck/protofact/pkg/api"
+)
+
+// runBuild runs the build subcommand, which asks a running Protofact
+// server to package a commit as if it had been pushed. It returns the
+// exit code of the process.
+func runBuild(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	server := flags.String("server", "http://localhost:8080", "base url of the protofact server")
+	token := flags.String("token", os.Getenv("PF_API_TOKEN"), "api token of the server, default is PF_API_TOKEN")
+	repository := flags.String("repo", "", "full name of the repository to build, such as org/protos")
+	ref := flags.String("ref", "", "branch or ref to build, its current commit is built if no sha is passed")
+	sha := flags.String("sha", "", "commit to build")
+	languages := flags.StringSlice("language", nil, "languages to build, default is every language of the server")
+	allowBreaking := flags.Bool("allow-breaking", false, "release the commit even if its schema has breaking changes")
+	force := flags.Bool("force", false, "build languages already published from the commit again")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var langs []string
+	for _, l := range *languages {
+		if l = strings.TrimSpace(l); l != "" {
+			langs = append(langs, l)
+		}
+	}
+
+	client := api.NewClient(*server, *token)
+	resp, err := client.Build(context.Background(), api.BuildRequest{
+		Repository:    *repository,
+		Ref:           *ref,
+		SHA:           *sha,
+		Languages:     langs,
+		AllowBreaking: *allowBreaking,
+		Force:         *force,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Printf("queued job %s, status at %s%s\n", resp.JobID, strings.TrimSuffix(*server, "/"), resp.StatusURL)
+	return 0
+}
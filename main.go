@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
@@ -21,33 +23,86 @@ import (
 	jaeger "github.com/uber/jaeger-client-go/config"
 	"gopkg.in/go-playground/webhooks.v5/github"
 
+	"github.com/gospotcheck/protofact/pkg/api"
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/ci"
 	"github.com/gospotcheck/protofact/pkg/config"
+	"github.com/gospotcheck/protofact/pkg/dispatch"
+	"github.com/gospotcheck/protofact/pkg/event"
 	"github.com/gospotcheck/protofact/pkg/filesys"
 	"github.com/gospotcheck/protofact/pkg/git"
+	"github.com/gospotcheck/protofact/pkg/joblog"
 	"github.com/gospotcheck/protofact/pkg/metrics"
+	"github.com/gospotcheck/protofact/pkg/queue"
+	"github.com/gospotcheck/protofact/pkg/reconcile"
 	"github.com/gospotcheck/protofact/pkg/services/npm"
 	"github.com/gospotcheck/protofact/pkg/services/release"
 	"github.com/gospotcheck/protofact/pkg/services/ruby"
 	"github.com/gospotcheck/protofact/pkg/services/scala"
+	"github.com/gospotcheck/protofact/pkg/status"
+	"github.com/gospotcheck/protofact/pkg/versioning"
 	"github.com/gospotcheck/protofact/pkg/webhook"
 )
 
 var configFilePath string
 
+// defaultGracePeriod is how long a shutdown waits for running builds
+// when no grace period is configured.
+const defaultGracePeriod = 5 * time.Minute
+
+// defaultRetryAfter is how long a push turned away by a full queue is
+// told to wait when no retry after is configured.
+const defaultRetryAfter = time.Minute
+
 func init() {
 	flag.StringVarP(&configFilePath, "config", "c", "", "path to config file, default is none")
 }
 
-type languageProcessor interface {
-	Process(ctx context.Context, payload github.PushPayload)
+// webhookResponse is the body returned to Github for an accepted push event.
+type webhookResponse struct {
+	JobID     string `json:"job_id"`
+	StatusURL string `json:"status_url"`
+	// Jobs lists the job of every ref of a delivery that pushed several,
+	// the first of which is the job above.
+	Jobs []webhookResponse `json:"jobs,omitempty"`
+}
+
+// respondWebhook answers a delivery with the jobs it was accepted as.
+// The job ids are sent back so a delivery can be traced to its build
+// through the jobs api.
+func respondWebhook(w http.ResponseWriter, accepted []webhookResponse) {
+	if len(accepted) == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	response := accepted[0]
+	if len(accepted) > 1 {
+		response.Jobs = accepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
 }
 
 type parser interface {
-	ValidateAndParsePushEvent(r *http.Request) (github.PushPayload, error)
+	ValidateAndParseProviderEvent(provider string, r *http.Request) (interface{}, error)
 	IsPingEvent(r *http.Request) bool
 }
 
 func main() {
+	// protofact build asks a running server to package a commit, and
+	// protofact package packages a local directory without a server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "build":
+			os.Exit(runBuild(os.Args[2:]))
+		case "package":
+			os.Exit(runPackage(os.Args[2:]))
+		}
+	}
+
 	conf, err := config.Read(configFilePath)
 	if err != nil {
 		errors.Wrap(err, "could not read in config:\n")
@@ -69,39 +124,62 @@ func main() {
 		"language": conf.Language,
 	})
 
+	// one process can package several languages, or all of them
+	languages, err := conf.Languages()
+	if err != nil {
+		logger.Fatalf("%+v\n", err)
+	}
+
+	// the branch policy decides how each push is released
+	branches, err := branch.New(conf.Branches)
+	if err != nil {
+		logger.Fatalf("%+v\n", err)
+	}
+
 	// set up a context that can be passed to all goroutines
-	// with cancel so they can be cleaned up if a sig is received
-	var ctx context.Context
-	{
-		var cancel context.CancelFunc
-		ctx = context.Background()
-		ctx, cancel = context.WithCancel(ctx)
-		defer cancel()
-
-		// if we receive a sigint or sigterm, we call cancel,
-		// which should cause all goroutines to return
-		// then we kill the app
-		sigc := make(chan os.Signal, 1)
-		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
-		go func() {
-			sig := <-sigc
-			cancel()
-			fmt.Println("received a SIGINT or SIGTERM")
-			logger.Fatal(sig)
-		}()
-	}
-
-	// setup prometheus
+	// with cancel so they can be cleaned up on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// sigint and sigterm start a graceful shutdown, see the end of main
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+
+	// pushes turned away by a full queue are told to come back after this
+	retryAfter := conf.Queue.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+
+	gracePeriod := conf.GracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = defaultGracePeriod
+	}
+
+	// setup prometheus, each language adds its own language label
 	var counters *metrics.Counters
+	var gauges *metrics.Gauges
 	{
 		// only custom metric for now, but setup provides for more to be added as needed
 		counters = &metrics.Counters{
 			PackagingErrorCounter: promauto.NewCounterVec(prometheus.CounterOpts{
 				Name: "error_total",
-			}, []string{"language", "type", "app"}).MustCurryWith(prometheus.Labels{"language": conf.Language, "app": "proto-pkg"}),
+			}, []string{"language", "type", "app"}).MustCurryWith(prometheus.Labels{"app": "proto-pkg"}),
 			PackagingProcessDuration: promauto.NewCounterVec(prometheus.CounterOpts{
 				Name: "bulk_process_duration_secs",
-			}, []string{"language", "app"}).MustCurryWith(prometheus.Labels{"language": conf.Language, "app": "proto-pkg"}),
+			}, []string{"language", "app"}).MustCurryWith(prometheus.Labels{"app": "proto-pkg"}),
+		}
+		// how much work is waiting and how much is running
+		gauges = &metrics.Gauges{
+			QueueDepth: promauto.NewGaugeVec(prometheus.GaugeOpts{
+				Name: "queue_depth",
+			}, []string{"app"}).MustCurryWith(prometheus.Labels{"app": "proto-pkg"}),
+			ActiveWorkers: promauto.NewGaugeVec(prometheus.GaugeOpts{
+				Name: "active_workers",
+			}, []string{"app"}).MustCurryWith(prometheus.Labels{"app": "proto-pkg"}),
+			ActiveLanguageWorkers: promauto.NewGaugeVec(prometheus.GaugeOpts{
+				Name: "active_language_workers",
+			}, []string{"language", "app"}).MustCurryWith(prometheus.Labels{"app": "proto-pkg"}),
 		}
 	}
 	http.Handle("/metrics", promhttp.Handler())
@@ -132,55 +210,170 @@ func main() {
 		opentracing.SetGlobalTracer(tracer)
 	}
 
-	// setup webhook parser
+	// setup webhook parser, which checks the signature of every delivery
+	// unless told not to
 	var prsr parser
 	{
+		if conf.Webhook.Insecure {
+			logger.Warn("webhook.insecure is set, webhook deliveries are accepted without checking their signatures")
+		} else if conf.Webhook.Secret == "" && len(conf.Webhook.Secrets) == 0 {
+			logger.Warn("webhook.secret is not set, Github deliveries are refused")
+		}
 		var err error
-		prsr, err = webhook.NewParser(false, conf.Webhook)
+		prsr, err = webhook.NewParser(!conf.Webhook.Insecure, conf.Webhook)
 		if err != nil {
 			err = errors.Wrap(err, "error creating new parser")
 			logger.Fatalf("%+v\n", err)
 		}
 	}
 
+	// open the job store, which also counts builds for versioning.
+	// Finished jobs are kept for the configured retention period
+	store, err := queue.Open(conf.Queue)
+	if err != nil {
+		err = errors.Wrap(err, "error opening job store")
+		logger.Fatalf("%+v\n", err)
+	}
+	defer store.Close()
+	go store.RunPruner(ctx, logger)
+
+	// every language versions a commit the same way
+	versions, err := versioning.New(conf.Versioning, branches, store)
+	if err != nil {
+		logger.Fatalf("%+v\n", err)
+	}
+
 	// set up other service dependencies
 	fs := &filesys.FS{}
 	repo := git.New(ctx, conf.Git, logger)
 
-	// based on language of container, setup the processor to use the correct service
-	var svc languageProcessor
-	{
-		var err error
-		switch conf.Language {
+	// every configured language is registered with the dispatcher, which
+	// clones each push once and runs the languages against that checkout,
+	// and the coordinator makes sure an older push to a branch is never
+	// published after a newer one. Each language can be limited to a
+	// number of builds at a time, on top of the number of workers.
+	coordinator := dispatch.NewCoordinator()
+	reporter, err := status.New(conf.Status, repo, logger)
+	if err != nil {
+		logger.Fatalf("%+v\n", err)
+	}
+	dispatcher := dispatch.New(fs, repo, coordinator, versions, conf.Timeouts.Clone, logger, counters, gauges, opentracing.GlobalTracer())
+
+	// the timeouts of each language fall back to the top level ones
+	conf.NPM.Timeouts = conf.NPM.Timeouts.Merge(conf.Timeouts)
+	conf.Ruby.Timeouts = conf.Ruby.Timeouts.Merge(conf.Timeouts)
+	conf.Scala.Timeouts = conf.Scala.Timeouts.Merge(conf.Timeouts)
+	conf.Release.Timeouts = conf.Release.Timeouts.Merge(conf.Timeouts)
+
+	for _, language := range languages {
+		langLogger := logger.WithField("language", language)
+		workers := conf.Queue.LanguageWorkers[language]
+		switch language {
 		case "npm":
-			svc = npm.New(conf.NPM, fs, repo, logger, counters, opentracing.GlobalTracer())
+			svc := npm.New(conf.NPM, fs, versions, langLogger, counters, opentracing.GlobalTracer())
+			dispatcher.Register(language, svc, workers)
+			reporter.Register(language, svc)
 		case "scala":
-			svc = scala.New(conf.Scala, fs, repo, logger, counters, opentracing.GlobalTracer())
+			svc := scala.New(conf.Scala, fs, versions, langLogger, counters, opentracing.GlobalTracer())
+			dispatcher.Register(language, svc, workers)
+			reporter.Register(language, svc)
 		case "ruby":
-			svc = ruby.New(conf.Ruby, fs, repo, logger, counters, opentracing.GlobalTracer())
+			svc := ruby.New(conf.Ruby, fs, versions, langLogger, counters, opentracing.GlobalTracer())
+			dispatcher.Register(language, svc, workers)
+			reporter.Register(language, svc)
 		case "release":
-			svc = release.New(fs, repo, logger, counters, opentracing.GlobalTracer())
-			err = repo.SetGitConfig()
+			svc := release.New(conf.Release, repo, versions, langLogger, counters, opentracing.GlobalTracer())
+			dispatcher.Register(language, svc, workers)
+			reporter.Register(language, svc)
+			err := repo.SetGitConfig()
 			if err != nil {
-				logger.Fatal("%+v\n", err)
+				logger.Fatalf("%+v\n", err)
 			}
-		default:
-			err = errors.New("LANGUAGE configuration did not match any supported language")
+		}
+	}
+
+	// put back any job a previous run was part way through so it
+	// gets picked up again
+	{
+		recovered, err := store.Recover()
+		if err != nil {
 			logger.Fatalf("%+v\n", err)
 		}
+		if recovered > 0 {
+			logger.Warnf("requeued %d jobs interrupted by a previous shutdown", recovered)
+		}
+
+		// let the coordinator know of every waiting push, so older
+		// pushes to a branch are skipped in favour of newer ones
+		jobs, err := store.List()
+		if err != nil {
+			logger.Fatalf("%+v\n", err)
+		}
+		for _, job := range jobs {
+			if job.State == queue.Queued && !job.Requested {
+				coordinator.Observe(job.Payload)
+			}
+		}
+	}
+
+	// every job gets a log file holding the output of its build,
+	// which is kept for the configured retention period
+	var logs *joblog.Dir
+	{
+		var err error
+		logs, err = joblog.New(conf.JobLogs, logger)
+		if err != nil {
+			err = errors.Wrap(err, "error setting up job logs")
+			logger.Fatalf("%+v\n", err)
+		}
+		go logs.RunPruner(ctx)
+	}
+
+	// anything left in the build directory was left by a build killed
+	// along with a previous run, as nothing is running yet
+	if err := build.RemoveWorkDirs(); err != nil {
+		logger.Errorf("%+v\n", err)
 	}
 
-	// one route that receives all webhook requests
-	http.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
-		// start a span that can be added to the context for reference in the goroutine
+	// workers pull jobs from the store and retry them on failure, and
+	// hold each off until the CI of its commit has passed
+	waiter := ci.New(conf.CI, repo)
+	pool := queue.NewPool(conf.Queue, store, dispatcher, reporter, waiter, logs, gauges, logger, opentracing.GlobalTracer())
+	poolDone := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(poolDone)
+	}()
+
+	// the api also takes builds on request, which go through the same
+	// queue as pushes and are limited to the languages packaged here
+	api.New(conf.API, store, pool, repo, branches, languages, logs, logger).Register(http.DefaultServeMux)
+
+	// pushes made while we were down are never delivered again, so the
+	// tracked branches are checked for commits missing a language at
+	// startup and periodically after
+	go reconcile.New(conf.Reconcile, repo, store, pool, coordinator, branches, languages, logger).Run(ctx)
+
+	// webhook deliveries are queued as jobs by the accepter, which
+	// also acknowledges those that were accepted before
+	accepter := webhook.NewAccepter(conf.Branches.Tags, repo, branches, store, coordinator, pool, languages, logger)
+
+	// webhook requests are received on /webhook, which tells the provider
+	// of each from its headers, or on /webhook/<provider> for a provider
+	// set on the webhook's url
+	handleWebhook := func(w http.ResponseWriter, r *http.Request) {
 		requestID := uuid.NewV4()
 		span := opentracing.StartSpan("handle_webhook")
 		span.SetTag("request_id", requestID)
 		defer span.Finish()
-		ctx = opentracing.ContextWithSpan(ctx, span)
 
-		// check push event
-		payload, err := prsr.ValidateAndParsePushEvent(r)
+		provider := webhook.Provider(r)
+		if p := strings.TrimPrefix(r.URL.Path, "/webhook/"); p != r.URL.Path {
+			provider = p
+		}
+
+		// check push or pull request event
+		parsed, err := prsr.ValidateAndParseProviderEvent(provider, r)
 		if err != nil {
 			// if the request is bad log it and send it back
 			// so Github can register the error
@@ -189,31 +382,93 @@ func main() {
 			logger.Errorf("%+v\n", err)
 			return
 		}
-		// if the request is good set 200 header and send it back
-		// Github may not wait as long as it takes to do this processing
-		// so we want to handle failures in the app separately from
-		// failures in receiving the event
-		w.WriteHeader(http.StatusOK)
 
-		// ignore tags, as the release package pushes them, so otherwise
-		// it gets into a loop, and we end up packaging everything
-		// in other languages twice.
-		if strings.Contains(payload.Ref, "tags") {
-			return
+		var pushes []event.Push
+		switch e := parsed.(type) {
+		case event.Push:
+			pushes = []event.Push{e}
+		case []event.Push:
+			pushes = e
+		case github.PullRequestPayload:
+			// a pull request whose head changed is packaged as a preview,
+			// the push of its head to its ref, if previews are on
+			if conf.Branches.Previews && webhook.Previewed(e) {
+				pushes = []event.Push{webhook.PullRequestPush(e)}
+			}
 		}
 
-		// this is spun off as a cancelable goroutine
-		// so it is not blocking on the response to Github
-		go svc.Process(ctx, payload)
+		// a Bitbucket delivery may push several refs, each of which gets
+		// a job of its own
+		ids, err := accepter.Accept(r.Context(), webhook.DeliveryID(provider, r), requestID.String(), pushes)
+		if err == queue.ErrQueueFull {
+			w.Header().Set("Retry-After", fmt.Sprintf("%.0f", retryAfter.Seconds()))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			// the provider shows the delivery as failed so it can be
+			// redelivered
+			logger.Errorf("%+v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
-		return
-	})
+		var accepted []webhookResponse
+		for _, id := range ids {
+			accepted = append(accepted, webhookResponse{
+				JobID:     id,
+				StatusURL: fmt.Sprintf("/jobs/%s", id),
+			})
+		}
+		respondWebhook(w, accepted)
+	}
+	http.HandleFunc("/webhook", handleWebhook)
+	http.HandleFunc("/webhook/", handleWebhook)
 
 	// basic health check endpoint
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	port := fmt.Sprintf(":%s", conf.Port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", conf.Port),
+		Handler: http.DefaultServeMux,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			logger.Fatalf("%+v\n", errors.WithStack(err))
+		}
+	}()
+
+	sig := <-sigc
+	fmt.Printf("received %s, shutting down\n", sig)
+
+	// a second signal skips the rest of the grace period
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancelShutdown()
+	go func() {
+		select {
+		case <-sigc:
+			cancelShutdown()
+		case <-shutdownCtx.Done():
+		}
+	}()
+
+	// stop taking webhooks first so nothing new is queued, then give
+	// the running builds the rest of the grace period to finish
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("%+v\n", errors.Wrap(err, "error shutting down http server"))
+	}
+	if err := pool.Shutdown(shutdownCtx); err != nil {
+		// cancelling the builds still running puts their jobs back in
+		// the store, to be run again after a restart
+		logger.Errorf("grace period of %s ran out, handing running builds back to the queue", gracePeriod)
+		cancel()
+		<-poolDone
+	}
+	cancel()
+
+	if err := build.RemoveWorkDirs(); err != nil {
+		logger.Errorf("%+v\n", err)
+	}
 }
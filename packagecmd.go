@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	logrus "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/config"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/filesys"
+	"github.com/gospotcheck/protofact/pkg/metrics"
+	"github.com/gospotcheck/protofact/pkg/schema"
+	"github.com/gospotcheck/protofact/pkg/services/npm"
+	"github.com/gospotcheck/protofact/pkg/services/ruby"
+	"github.com/gospotcheck/protofact/pkg/services/scala"
+	"github.com/gospotcheck/protofact/pkg/versioning"
+)
+
+type processor interface {
+	Process(ctx context.Context, src build.Source) error
+}
+
+// runPackage runs the package subcommand, which packages a local
+// directory the way a push would be packaged, without a server or a
+// clone. The artifacts are left in the output directory rather than
+// published. It returns the exit code of the process.
+func runPackage(args []string) int {
+	flags := flag.NewFlagSet("package", flag.ContinueOnError)
+	configPath := flags.StringP("config", "c", "", "path to config file, default is none")
+	language := flags.String("language", "", "languages to package, a comma separated list or all, default is the language of the config")
+	source := flags.String("source", ".", "directory holding the generated code, laid out like the repository")
+	out := flags.String("out", "./artifacts", "directory to leave the artifacts in")
+	ref := flags.String("ref", "refs/heads/local", "ref to version the artifacts as if pushed to")
+	sha := flags.String("sha", "", "commit sha to record in the artifacts")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	conf, err := config.Read(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read in config: %v\n", err)
+		return 1
+	}
+	if *language != "" {
+		conf.Language = *language
+	}
+	languages, err := conf.Languages()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	if conf.LogLevel == "debug" {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.ErrorLevel)
+	}
+	logger := logrus.WithField("language", conf.Language)
+
+	src, err := filepath.Abs(*source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", errors.WithStack(err))
+		return 1
+	}
+	dest, err := filepath.Abs(*out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", errors.WithStack(err))
+		return 1
+	}
+	if err := os.MkdirAll(dest, 0750); err != nil {
+		fmt.Fprintf(os.Stderr, "could not create output directory: %v\n", err)
+		return 1
+	}
+
+	// the metrics are never served, they are only there for the services
+	counters := &metrics.Counters{
+		PackagingErrorCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "error_total",
+		}, []string{"language", "type"}),
+		PackagingProcessDuration: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bulk_process_duration_secs",
+		}, []string{"language"}),
+	}
+
+	// stop the command a build is running on ctrl-c
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	span := opentracing.StartSpan("package")
+	defer span.Finish()
+	ctx = opentracing.ContextWithSpan(ctx, span)
+	ctx = build.WithArtifactDir(ctx, dest)
+	ctx = build.WithOutput(ctx, os.Stdout)
+
+	var payload event.Push
+	payload.Ref = *ref
+	payload.After = *sha
+	payload.Repository.PushedAt = time.Now().Unix()
+
+	// nothing is published, whatever the config says
+	conf.NPM.Publish = false
+	conf.Ruby.Publish = false
+	conf.Scala.Publish = false
+	conf.NPM.Timeouts = conf.NPM.Timeouts.Merge(conf.Timeouts)
+	conf.Ruby.Timeouts = conf.Ruby.Timeouts.Merge(conf.Timeouts)
+	conf.Scala.Timeouts = conf.Scala.Timeouts.Merge(conf.Timeouts)
+
+	branches, err := branch.New(conf.Branches)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	// there is no job store to count builds or record releases in
+	// without a server, so schemas are not compared either
+	conf.Versioning.Detect = false
+	conf.Versioning.Gate = false
+	versions, err := versioning.New(conf.Versioning, branches, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	fs := &filesys.FS{}
+	failed := false
+	for _, l := range languages {
+		langLogger := logger.WithField("language", l)
+		var svc processor
+		switch l {
+		case "npm":
+			svc = npm.New(conf.NPM, fs, versions, langLogger, counters, opentracing.GlobalTracer())
+		case "ruby":
+			svc = ruby.New(conf.Ruby, fs, versions, langLogger, counters, opentracing.GlobalTracer())
+		case "scala":
+			svc = scala.New(conf.Scala, fs, versions, langLogger, counters, opentracing.GlobalTracer())
+		default:
+			// release only tags and releases on Github, it has no artifact
+			fmt.Printf("%s: skipped, it has nothing to package locally\n", l)
+			continue
+		}
+
+		fmt.Printf("%s: packaging %s\n", l, src)
+		langCtx := build.WithRecorder(ctx, stagePrinter{language: l})
+		err := svc.Process(langCtx, build.Source{Payload: payload, Dir: src})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: failed: %v\n", l, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: succeeded\n", l)
+	}
+
+	if failed {
+		return 1
+	}
+	fmt.Printf("artifacts are in %s\n", dest)
+	return 0
+}
+
+// stagePrinter is a build.Recorder printing the progress of a language
+// to stdout.
+type stagePrinter struct {
+	language string
+}
+
+func (p stagePrinter) BuildID(id string) {}
+
+func (p stagePrinter) Version(version string) {
+	fmt.Printf("%s: version %s\n", p.language, version)
+}
+
+func (p stagePrinter) Schema(report schema.Report) {}
+
+func (p stagePrinter) StageStarted(stage string) {
+	fmt.Printf("%s: %s started\n", p.language, stage)
+}
+
+func (p stagePrinter) StageFinished(stage string, err error) {
+	if err != nil {
+		fmt.Printf("%s: %s failed: %v\n", p.language, stage, err)
+		return
+	}
+	fmt.Printf("%s: %s finished\n", p.language, stage)
+}
@@ -0,0 +1,149 @@
+// Package api provides the HTTP endpoints used to inspect and manage
+// packaging jobs.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+type store interface {
+	Get(id string) (*queue.Job, error)
+	List() ([]*queue.Job, error)
+	Dead() ([]*queue.Job, error)
+	Requeue(id string) (*queue.Job, error)
+	Enqueue(job *queue.Job) error
+}
+
+type notifier interface {
+	Notify()
+}
+
+type policy interface {
+	Decide(ref string) branch.Decision
+}
+
+type resolver interface {
+	ResolveRef(ctx context.Context, owner, repo, ref string) (string, error)
+}
+
+type logs interface {
+	Open(id string) (*os.File, error)
+}
+
+// Handler owns the job store and serves the job management endpoints.
+// Builds started on request are limited to the languages it is passed,
+// which are those the process packages.
+type Handler struct {
+	config    Config
+	store     store
+	pool      notifier
+	repo      resolver
+	branches  policy
+	languages []string
+	logs      logs
+	logger    log.FieldLogger
+}
+
+// New returns a pointer to a Handler configured with the parameters passed in.
+func New(config Config, store store, pool notifier, repo resolver, branches policy, languages []string, logs logs, logger log.FieldLogger) *Handler {
+	return &Handler{
+		config:    config,
+		store:     store,
+		pool:      pool,
+		repo:      repo,
+		branches:  branches,
+		languages: languages,
+		logs:      logs,
+		logger:    logger,
+	}
+}
+
+// Register adds all the api routes to the passed mux.
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/builds", h.createBuild)
+	mux.HandleFunc("/jobs", h.listJobs)
+	mux.HandleFunc("/jobs/", h.job)
+	mux.HandleFunc("/dead-letters", h.listDead)
+	mux.HandleFunc("/dead-letters/", h.requeueDead)
+}
+
+// listDead serves GET /dead-letters, returning every job that ran out of attempts.
+func (h *Handler) listDead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobs, err := h.store.Dead()
+	if err != nil {
+		h.logger.Errorf("%+v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	statuses := []jobStatus{}
+	for _, job := range jobs {
+		statuses = append(statuses, newJobStatus(job))
+	}
+
+	h.writeJSON(w, http.StatusOK, statuses)
+}
+
+// requeueDead serves POST /dead-letters/{id}/requeue, putting a dead job
+// back on the queue with its attempts reset. As the job is built and
+// published again, it needs the same token as a build on request.
+func (h *Handler) requeueDead(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/dead-letters/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "requeue" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if h.config.Token == "" {
+		http.Error(w, "requeueing dead jobs is turned off, set api.token to turn it on", http.StatusForbidden)
+		return
+	}
+	if !h.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	job, err := h.store.Requeue(parts[0])
+	if err == queue.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Errorf("%+v\n", errors.Wrap(err, "could not requeue job"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.pool.Notify()
+
+	h.writeJSON(w, http.StatusAccepted, newJobStatus(job))
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		h.logger.Errorf("%+v\n", errors.Wrap(err, "could not marshal response"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(content)
+}
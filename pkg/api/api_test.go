@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/joblog"
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+type fakeStore struct {
+	mu   sync.Mutex
+	jobs map[string]*queue.Job
+	dead map[string]bool
+	full bool
+}
+
+func (f *fakeStore) put(job *queue.Job) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.jobs[job.ID] = job
+}
+
+func (f *fakeStore) Get(id string) (*queue.Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, ok := f.jobs[id]
+	if !ok {
+		return nil, queue.ErrNotFound
+	}
+	return job, nil
+}
+
+func (f *fakeStore) List() ([]*queue.Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	jobs := []*queue.Job{}
+	for _, job := range f.jobs {
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (f *fakeStore) Dead() ([]*queue.Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	jobs := []*queue.Job{}
+	for id := range f.dead {
+		jobs = append(jobs, f.jobs[id])
+	}
+	return jobs, nil
+}
+
+func (f *fakeStore) Requeue(id string) (*queue.Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dead[id] {
+		return nil, queue.ErrNotFound
+	}
+	delete(f.dead, id)
+	job := f.jobs[id]
+	job.State = queue.Queued
+	return job, nil
+}
+
+func (f *fakeStore) Enqueue(job *queue.Job) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.full {
+		return queue.ErrQueueFull
+	}
+	f.jobs[job.ID] = job
+	return nil
+}
+
+type fakeNotifier struct {
+	notified int
+}
+
+func (f *fakeNotifier) Notify() {
+	f.notified++
+}
+
+func newTestMux(t *testing.T) (*http.ServeMux, *fakeStore, *fakeNotifier, *joblog.Dir) {
+	created := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	started := created.Add(time.Second)
+	cloned := started.Add(2 * time.Second)
+	finished := started.Add(5 * time.Second)
+
+	succeeded := &queue.Job{
+		ID:         "b",
+		State:      queue.Succeeded,
+		Version:    "1.0.1530281075",
+		CreatedAt:  created.Add(time.Minute),
+		StartedAt:  &started,
+		FinishedAt: &finished,
+		Stages: []queue.Stage{
+			{Name: "clone", StartedAt: started, FinishedAt: &cloned},
+			{Name: "create", StartedAt: cloned},
+		},
+		Languages: []queue.Language{
+			{
+				Name:       "npm",
+				State:      queue.Succeeded,
+				Version:    "1.0.1530281075",
+				StartedAt:  &cloned,
+				FinishedAt: &finished,
+				Stages: []queue.Stage{
+					{Name: "publish", StartedAt: cloned, FinishedAt: &finished},
+				},
+			},
+			{
+				Name:        "ruby",
+				State:       queue.Failed,
+				Error:       "publish stage failed: publish timed out after 10m0s: signal: killed",
+				FailedStage: "publish",
+				TimedOut:    true,
+			},
+		},
+	}
+	succeeded.Payload.Ref = "refs/heads/master"
+	succeeded.Payload.After = "da6b8c5af1dbbd3f03a49b6d8b5fdf3b3bca9c8c"
+
+	store := &fakeStore{
+		jobs: map[string]*queue.Job{
+			"a": {ID: "a", State: queue.Failed, LastError: "publish stage failed", FailedStage: "publish", CreatedAt: created},
+			"b": succeeded,
+		},
+		dead: map[string]bool{"a": true},
+	}
+	pool := &fakeNotifier{}
+
+	dir, err := ioutil.TempDir("", "protofact-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	logger := log.WithField("test", t.Name())
+	logs, err := joblog.New(joblog.Config{Dir: dir}, logger)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	mux := http.NewServeMux()
+	New(Config{Token: "secret"}, store, pool, &fakeResolver{}, newTestPolicy(t), []string{"npm", "ruby"}, logs, logger).Register(mux)
+	return mux, store, pool, logs
+}
+
+func Test_ListDead(t *testing.T) {
+	mux, _, _, _ := newTestMux(t)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/dead-letters", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var jobs []jobStatus
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &jobs))
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, "a", jobs[0].ID)
+}
+
+func postRequeue(mux *http.ServeMux, token, id string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/dead-letters/"+id+"/requeue", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	return rec
+}
+
+func Test_RequeueDead(t *testing.T) {
+	mux, store, pool, _ := newTestMux(t)
+
+	// requeueing rebuilds and publishes the job, so it needs the token
+	rec := postRequeue(mux, "", "a")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = postRequeue(mux, "wrong", "a")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Len(t, store.dead, 1)
+	assert.Equal(t, 0, pool.notified)
+
+	rec = postRequeue(mux, "secret", "a")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Len(t, store.dead, 0)
+	assert.Equal(t, 1, pool.notified)
+
+	rec = postRequeue(mux, "secret", "a")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/dead-letters/a/requeue", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func Test_RequeueDead_TurnedOff(t *testing.T) {
+	store := &fakeStore{jobs: map[string]*queue.Job{"a": {ID: "a", State: queue.Failed}}, dead: map[string]bool{"a": true}}
+	pool := &fakeNotifier{}
+	mux := http.NewServeMux()
+	New(Config{}, store, pool, &fakeResolver{}, newTestPolicy(t), []string{"npm"}, nil, log.WithField("test", t.Name())).Register(mux)
+
+	rec := postRequeue(mux, "", "a")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Len(t, store.dead, 1)
+	assert.Equal(t, 0, pool.notified)
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+// BuildRequest is the body of POST /builds. Repository is the full name
+// of a Github repository, such as org/protos. It needs a Ref, a SHA or
+// both: a ref alone builds the commit it points to now, and a SHA alone
+// is built as a prerelease named after the commit rather than a branch.
+// Languages limits the build to some of the languages of the server, by
+// default every one of them is built. AllowBreaking lets a stable
+// release of the commit through the breaking change gate. Force builds
+// languages that were already published from the commit and ref again,
+// which are otherwise acknowledged without being rebuilt.
+type BuildRequest struct {
+	Repository    string   `json:"repository"`
+	Ref           string   `json:"ref,omitempty"`
+	SHA           string   `json:"sha,omitempty"`
+	Languages     []string `json:"languages,omitempty"`
+	AllowBreaking bool     `json:"allow_breaking,omitempty"`
+	Force         bool     `json:"force,omitempty"`
+}
+
+// BuildResponse is the body returned for an accepted build, naming the
+// job created for it.
+type BuildResponse struct {
+	JobID     string `json:"job_id"`
+	StatusURL string `json:"status_url"`
+}
+
+// createBuild serves POST /builds, queueing a build of any commit as
+// if it had been pushed.
+func (h *Handler) createBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if h.config.Token == "" {
+		http.Error(w, "builds on request are turned off, set api.token to turn them on", http.StatusForbidden)
+		return
+	}
+	if !h.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var req BuildRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "body must be a json build request", http.StatusBadRequest)
+		return
+	}
+	owner, name, err := h.validate(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ref := req.Ref
+	if ref != "" && !strings.HasPrefix(ref, "refs/") {
+		ref = fmt.Sprintf("refs/heads/%s", ref)
+	}
+	sha := req.SHA
+	if sha == "" {
+		sha, err = h.repo.ResolveRef(r.Context(), owner, name, ref)
+		if err != nil {
+			h.logger.Errorf("%+v\n", err)
+			http.Error(w, fmt.Sprintf("could not find %s in %s", ref, req.Repository), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if ref == "" {
+		ref = fmt.Sprintf("refs/commits/%s", sha)
+	}
+	if h.branches.Decide(ref).Skipped() {
+		http.Error(w, fmt.Sprintf("%s is skipped by the branch policy", ref), http.StatusUnprocessableEntity)
+		return
+	}
+
+	payload := event.GithubPush(owner, name, ref, sha, time.Now().UTC())
+	job := queue.NewJob(uuid.NewV4().String(), payload)
+	job.Only = req.Languages
+	job.AllowBreaking = req.AllowBreaking
+	job.Force = req.Force
+	// a build on request may be of an older commit than the head of its
+	// branch, so it is not seen as a push to it, which would supersede
+	// the builds of the newer pushes
+	job.Requested = true
+	err = h.store.Enqueue(job)
+	if err == queue.ErrQueueFull {
+		http.Error(w, "job queue is full, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		h.logger.Errorf("%+v\n", errors.Wrap(err, "error enqueueing build"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.pool.Notify()
+
+	h.writeJSON(w, http.StatusAccepted, BuildResponse{
+		JobID:     job.ID,
+		StatusURL: fmt.Sprintf("/jobs/%s", job.ID),
+	})
+}
+
+// authorized reports whether the request carries the configured token
+// as a bearer token.
+func (h *Handler) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.config.Token)) == 1
+}
+
+// validate checks a build request, returning the owner and name of its repository.
+func (h *Handler) validate(req BuildRequest) (string, string, error) {
+	parts := strings.Split(req.Repository, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("repository must be the full name of a repository, such as org/protos")
+	}
+	if req.Ref == "" && req.SHA == "" {
+		return "", "", errors.New("a ref or a sha is needed")
+	}
+	for _, l := range req.Languages {
+		if !h.packages(l) {
+			return "", "", errors.Errorf("language %q is not packaged by this server, it packages %s", l, strings.Join(h.languages, ", "))
+		}
+	}
+	return parts[0], parts[1], nil
+}
+
+func (h *Handler) packages(language string) bool {
+	for _, l := range h.languages {
+		if l == language {
+			return true
+		}
+	}
+	return false
+}
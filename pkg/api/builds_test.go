@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+type fakeResolver struct{}
+
+func (f *fakeResolver) ResolveRef(ctx context.Context, owner, repo, ref string) (string, error) {
+	if ref != "refs/heads/master" {
+		return "", errors.New("no such ref")
+	}
+	return "da6b8c5af1dbbd3f03a49b6d8b5fdf3b3bca9c8c", nil
+}
+
+func newTestPolicy(t *testing.T) *branch.Policy {
+	policy, err := branch.New(branch.Config{
+		Rules: []branch.Rule{{Glob: "wip/*", Channel: "skip"}},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return policy
+}
+
+func newBuildsMux(t *testing.T, token string) (*http.ServeMux, *fakeStore, *fakeNotifier) {
+	store := &fakeStore{jobs: map[string]*queue.Job{}, dead: map[string]bool{}}
+	pool := &fakeNotifier{}
+	logger := log.WithField("test", t.Name())
+
+	mux := http.NewServeMux()
+	New(Config{Token: token}, store, pool, &fakeResolver{}, newTestPolicy(t), []string{"npm", "ruby"}, nil, logger).Register(mux)
+	return mux, store, pool
+}
+
+func postBuild(mux *http.ServeMux, token string, req BuildRequest) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(req)
+	r := httptest.NewRequest("POST", "/builds", bytes.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	return rec
+}
+
+func Test_CreateBuild(t *testing.T) {
+	mux, store, pool := newBuildsMux(t, "secret")
+
+	rec := postBuild(mux, "secret", BuildRequest{
+		Repository:    "org/protos",
+		Ref:           "master",
+		Languages:     []string{"ruby"},
+		AllowBreaking: true,
+		Force:         true,
+	})
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	var resp BuildResponse
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "/jobs/"+resp.JobID, resp.StatusURL)
+
+	job, err := store.Get(resp.JobID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ruby"}, job.Only)
+	assert.True(t, job.AllowBreaking)
+	assert.True(t, job.Force)
+	assert.Equal(t, "refs/heads/master", job.Payload.Ref)
+	assert.Equal(t, "da6b8c5af1dbbd3f03a49b6d8b5fdf3b3bca9c8c", job.Payload.After)
+	assert.Equal(t, "org/protos", job.Payload.Repository.FullName)
+	assert.Equal(t, "https://github.com/org/protos.git", job.Payload.Repository.CloneURL)
+	assert.NotZero(t, job.Payload.Repository.PushedAt)
+	assert.Equal(t, 1, pool.notified)
+	// it is not seen as a push to the branch, so it cannot supersede
+	// the builds of newer pushes to it
+	assert.True(t, job.Requested)
+
+	// a commit on its own is named after itself rather than a branch
+	rec = postBuild(mux, "secret", BuildRequest{Repository: "org/protos", SHA: "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"})
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	job, err = store.Get(resp.JobID)
+	assert.Nil(t, err)
+	assert.Equal(t, "refs/commits/0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c", job.Payload.Ref)
+	assert.Empty(t, job.Only)
+	assert.False(t, job.AllowBreaking)
+	assert.False(t, job.Force)
+}
+
+func Test_CreateBuild_Rejected(t *testing.T) {
+	mux, store, _ := newBuildsMux(t, "secret")
+	valid := BuildRequest{Repository: "org/protos", Ref: "master"}
+
+	assert.Equal(t, http.StatusUnauthorized, postBuild(mux, "", valid).Code)
+	assert.Equal(t, http.StatusUnauthorized, postBuild(mux, "wrong", valid).Code)
+
+	cases := []BuildRequest{
+		{Repository: "protos", Ref: "master"},
+		{Repository: "org/protos"},
+		{Repository: "org/protos", Ref: "master", Languages: []string{"scala"}},
+	}
+	for _, req := range cases {
+		assert.Equal(t, http.StatusBadRequest, postBuild(mux, "secret", req).Code)
+	}
+
+	assert.Equal(t, http.StatusUnprocessableEntity, postBuild(mux, "secret", BuildRequest{Repository: "org/protos", Ref: "missing"}).Code)
+	skipped := BuildRequest{Repository: "org/protos", Ref: "wip/idea", SHA: "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"}
+	assert.Equal(t, http.StatusUnprocessableEntity, postBuild(mux, "secret", skipped).Code)
+
+	store.full = true
+	assert.Equal(t, http.StatusServiceUnavailable, postBuild(mux, "secret", valid).Code)
+	assert.Len(t, store.jobs, 0)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/builds", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func Test_CreateBuild_Disabled(t *testing.T) {
+	mux, _, _ := newBuildsMux(t, "")
+
+	rec := postBuild(mux, "", BuildRequest{Repository: "org/protos", Ref: "master"})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func Test_Client_Build(t *testing.T) {
+	mux, store, _ := newBuildsMux(t, "secret")
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := NewClient(server.URL+"/", "secret").Build(context.Background(), BuildRequest{Repository: "org/protos", Ref: "master"})
+	assert.Nil(t, err)
+	_, err = store.Get(resp.JobID)
+	assert.Nil(t, err)
+
+	_, err = NewClient(server.URL, "wrong").Build(context.Background(), BuildRequest{Repository: "org/protos", Ref: "master"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Client starts builds on a running Protofact server through its api.
+type Client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+// NewClient returns a pointer to a Client for the server at the passed
+// base url, authenticating with token.
+func NewClient(server, token string) *Client {
+	return &Client{
+		server: strings.TrimSuffix(server, "/"),
+		token:  token,
+		http:   http.DefaultClient,
+	}
+}
+
+// Build asks the server to build a commit, returning the job queued for it.
+func (c *Client) Build(ctx context.Context, req BuildRequest) (BuildResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return BuildResponse{}, errors.Wrap(err, "could not marshal build request")
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/builds", c.server), bytes.NewReader(body))
+	if err != nil {
+		return BuildResponse{}, errors.WithStack(err)
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return BuildResponse{}, errors.Wrap(err, fmt.Sprintf("could not reach %s", c.server))
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return BuildResponse{}, errors.Wrap(err, "could not read build response")
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return BuildResponse{}, errors.Errorf("build was not accepted: %s: %s", resp.Status, strings.TrimSpace(string(content)))
+	}
+
+	var build BuildResponse
+	if err := json.Unmarshal(content, &build); err != nil {
+		return BuildResponse{}, errors.Wrap(err, "could not unmarshal build response")
+	}
+	return build, nil
+}
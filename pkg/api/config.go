@@ -0,0 +1,9 @@
+package api
+
+// Config represents config values for the api.
+type Config struct {
+	// Token is the bearer token needed to start builds on request
+	// through POST /builds and to requeue dead jobs. Both are turned off
+	// while it is empty.
+	Token string
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gospotcheck/protofact/pkg/queue"
+	"github.com/gospotcheck/protofact/pkg/schema"
+)
+
+// defaultListLimit is the number of jobs GET /jobs returns without a limit parameter.
+const defaultListLimit = 50
+
+// jobStatus is the view of a job returned by the api. It leaves out
+// the full push payload, keeping only what identifies the commit.
+type jobStatus struct {
+	ID           string         `json:"id"`
+	State        queue.State    `json:"state"`
+	Repository   string         `json:"repository"`
+	Ref          string         `json:"ref"`
+	SHA          string         `json:"sha"`
+	Version      string         `json:"version,omitempty"`
+	Schema       *schema.Report `json:"schema,omitempty"`
+	CI           string         `json:"ci,omitempty"`
+	WaitingSince *time.Time     `json:"waiting_since,omitempty"`
+	BuildID      string         `json:"build_id,omitempty"`
+	Attempts     int            `json:"attempts"`
+	NextAttempt  *time.Time     `json:"next_attempt,omitempty"`
+	Error        string         `json:"error,omitempty"`
+	FailedStage  string         `json:"failed_stage,omitempty"`
+	TimedOut     bool           `json:"timed_out,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+	StartedAt    *time.Time     `json:"started_at,omitempty"`
+	FinishedAt   *time.Time     `json:"finished_at,omitempty"`
+	DurationSecs float64        `json:"duration_secs,omitempty"`
+	Stages       []stageStatus  `json:"stages"`
+	Languages    []langStatus   `json:"languages"`
+}
+
+type stageStatus struct {
+	Name         string     `json:"name"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	DurationSecs float64    `json:"duration_secs,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// langStatus is the view of one language of a job.
+type langStatus struct {
+	Name         string        `json:"name"`
+	State        queue.State   `json:"state"`
+	Version      string        `json:"version,omitempty"`
+	BuildID      string        `json:"build_id,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	FailedStage  string        `json:"failed_stage,omitempty"`
+	TimedOut     bool          `json:"timed_out,omitempty"`
+	StartedAt    *time.Time    `json:"started_at,omitempty"`
+	FinishedAt   *time.Time    `json:"finished_at,omitempty"`
+	DurationSecs float64       `json:"duration_secs,omitempty"`
+	PublishedBy  string        `json:"published_by,omitempty"`
+	Stages       []stageStatus `json:"stages"`
+}
+
+func newJobStatus(job *queue.Job) jobStatus {
+	status := jobStatus{
+		ID:           job.ID,
+		State:        job.State,
+		Repository:   job.Payload.Repository.FullName,
+		Ref:          job.Payload.Ref,
+		SHA:          job.Payload.After,
+		Version:      job.Version,
+		Schema:       job.Schema,
+		CI:           job.CI,
+		WaitingSince: job.WaitingSince,
+		BuildID:      job.BuildID,
+		Attempts:     job.Attempts,
+		Error:        job.LastError,
+		FailedStage:  job.FailedStage,
+		TimedOut:     job.TimedOut,
+		CreatedAt:    job.CreatedAt,
+		StartedAt:    job.StartedAt,
+		FinishedAt:   job.FinishedAt,
+		Stages:       newStageStatuses(job.Stages),
+		Languages:    []langStatus{},
+	}
+	if job.State == queue.Queued || job.State == queue.WaitingForCI {
+		next := job.NextAttempt
+		status.NextAttempt = &next
+	}
+	if job.StartedAt != nil && job.FinishedAt != nil {
+		status.DurationSecs = job.FinishedAt.Sub(*job.StartedAt).Seconds()
+	}
+
+	for _, lang := range job.Languages {
+		l := langStatus{
+			Name:        lang.Name,
+			State:       lang.State,
+			Version:     lang.Version,
+			BuildID:     lang.BuildID,
+			Error:       lang.Error,
+			FailedStage: lang.FailedStage,
+			TimedOut:    lang.TimedOut,
+			StartedAt:   lang.StartedAt,
+			FinishedAt:  lang.FinishedAt,
+			PublishedBy: lang.PublishedBy,
+			Stages:      newStageStatuses(lang.Stages),
+		}
+		if lang.StartedAt != nil && lang.FinishedAt != nil {
+			l.DurationSecs = lang.FinishedAt.Sub(*lang.StartedAt).Seconds()
+		}
+		status.Languages = append(status.Languages, l)
+	}
+
+	return status
+}
+
+func newStageStatuses(stages []queue.Stage) []stageStatus {
+	statuses := []stageStatus{}
+	for _, stage := range stages {
+		s := stageStatus{
+			Name:       stage.Name,
+			StartedAt:  stage.StartedAt,
+			FinishedAt: stage.FinishedAt,
+			Error:      stage.Error,
+		}
+		if stage.FinishedAt != nil {
+			s.DurationSecs = stage.FinishedAt.Sub(stage.StartedAt).Seconds()
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// listJobs serves GET /jobs, returning the most recent jobs first.
+// The optional state parameter filters by job state, and limit caps
+// the number of jobs returned.
+func (h *Handler) listJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := defaultListLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	state := queue.State(r.URL.Query().Get("state"))
+
+	jobs, err := h.store.List()
+	if err != nil {
+		h.logger.Errorf("%+v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+
+	statuses := []jobStatus{}
+	for _, job := range jobs {
+		if state != "" && job.State != state {
+			continue
+		}
+		statuses = append(statuses, newJobStatus(job))
+		if len(statuses) == limit {
+			break
+		}
+	}
+
+	h.writeJSON(w, http.StatusOK, statuses)
+}
+
+// job routes requests under /jobs/{id}.
+func (h *Handler) job(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	if parts[0] == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "logs") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, err := h.store.Get(parts[0])
+	if err == queue.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Errorf("%+v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(parts) == 2 {
+		h.getJobLogs(w, r, job)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, newJobStatus(job))
+}
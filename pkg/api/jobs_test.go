@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+func Test_ListJobs(t *testing.T) {
+	mux, _, _, _ := newTestMux(t)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/jobs", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var jobs []jobStatus
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &jobs))
+	assert.Len(t, jobs, 2)
+	// newest first
+	assert.Equal(t, "b", jobs[0].ID)
+	assert.Equal(t, "a", jobs[1].ID)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/jobs?state=failed", nil))
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &jobs))
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, "a", jobs[0].ID)
+	assert.Equal(t, "publish", jobs[0].FailedStage)
+	assert.Equal(t, "publish stage failed", jobs[0].Error)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/jobs?limit=1", nil))
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &jobs))
+	assert.Len(t, jobs, 1)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/jobs?limit=none", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func Test_GetJob(t *testing.T) {
+	mux, _, _, _ := newTestMux(t)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/jobs/b", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var job jobStatus
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	assert.Equal(t, queue.Succeeded, job.State)
+	assert.Equal(t, "refs/heads/master", job.Ref)
+	assert.Equal(t, "da6b8c5af1dbbd3f03a49b6d8b5fdf3b3bca9c8c", job.SHA)
+	assert.Equal(t, "1.0.1530281075", job.Version)
+	assert.Equal(t, float64(5), job.DurationSecs)
+	assert.Len(t, job.Stages, 2)
+	assert.Equal(t, float64(2), job.Stages[0].DurationSecs)
+	assert.Nil(t, job.Stages[1].FinishedAt)
+
+	assert.Len(t, job.Languages, 2)
+	assert.Equal(t, "npm", job.Languages[0].Name)
+	assert.Equal(t, queue.Succeeded, job.Languages[0].State)
+	assert.Equal(t, float64(3), job.Languages[0].DurationSecs)
+	assert.Equal(t, float64(3), job.Languages[0].Stages[0].DurationSecs)
+	assert.Equal(t, queue.Failed, job.Languages[1].State)
+	assert.Equal(t, "publish", job.Languages[1].FailedStage)
+	assert.True(t, job.Languages[1].TimedOut)
+	assert.False(t, job.Languages[0].TimedOut)
+	assert.Equal(t, []stageStatus{}, job.Languages[1].Stages)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/jobs/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func Test_JobStatus_WaitingForCI(t *testing.T) {
+	job := queue.NewJob("c", event.Push{})
+	now := time.Now().UTC()
+	job.State = queue.WaitingForCI
+	job.CI = "waiting for lint"
+	job.WaitingSince = &now
+
+	status := newJobStatus(job)
+	assert.Equal(t, queue.WaitingForCI, status.State)
+	assert.Equal(t, "waiting for lint", status.CI)
+	assert.Equal(t, &now, status.WaitingSince)
+	assert.NotNil(t, status.NextAttempt)
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+// logPollInterval is how often a running job's log is checked for new output.
+const logPollInterval = 500 * time.Millisecond
+
+// getJobLogs serves GET /jobs/{id}/logs. The log written so far is sent
+// straight away, and while the job is running new output is streamed
+// to the client as it is written, until the job stops running.
+func (h *Handler) getJobLogs(w http.ResponseWriter, r *http.Request, job *queue.Job) {
+	f, err := h.logs.Open(job.ID)
+	if os.IsNotExist(err) {
+		// a job that has not run yet has no log, but one that has
+		// run and has none left had it removed by retention
+		if job.State == queue.Queued && job.Attempts == 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Error(w, "log not found, it may have been removed by retention", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Errorf("%+v\n", errors.Wrap(err, "could not open job log"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		if _, err := io.Copy(w, f); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if job.State != queue.Running {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(logPollInterval):
+		}
+
+		// the state is refreshed before the next copy, so the output
+		// written between the last copy and the job finishing is still sent
+		job, err = h.store.Get(job.ID)
+		if err != nil {
+			h.logger.Errorf("%+v\n", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+func Test_GetJobLogs(t *testing.T) {
+	mux, _, _, logs := newTestMux(t)
+
+	out, err := logs.Create("b")
+	assert.Nil(t, err)
+	out.Printf("clone started")
+	out.Write([]byte("Successfully built RubyGem\n"))
+	assert.Nil(t, out.Close())
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/jobs/b/logs", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "clone started")
+	assert.Contains(t, rec.Body.String(), "Successfully built RubyGem")
+
+	// a failed job whose log has been pruned
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/jobs/a/logs", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func Test_GetJobLogs_StreamsWhileRunning(t *testing.T) {
+	mux, store, _, logs := newTestMux(t)
+	store.put(&queue.Job{ID: "c", State: queue.Running})
+
+	out, err := logs.Create("c")
+	assert.Nil(t, err)
+	out.Write([]byte("resolving dependencies\n"))
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	go func() {
+		time.Sleep(2 * logPollInterval)
+		out.Write([]byte("published\n"))
+		out.Close()
+		store.put(&queue.Job{ID: "c", State: queue.Succeeded})
+	}()
+
+	resp, err := http.Get(server.URL + "/jobs/c/logs")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "resolving dependencies\npublished\n", string(body))
+}
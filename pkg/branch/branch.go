@@ -0,0 +1,226 @@
+// Package branch decides how a push is released from the ref it was
+// pushed to, according to the configured branch policy.
+package branch
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBranch is the default branch of a Policy with none configured.
+const DefaultBranch = "master"
+
+// Channel is how the pushes to a branch are released.
+type Channel string
+
+// The channels every policy knows. Any other channel is a custom one.
+const (
+	// Stable pushes are released with a full version.
+	Stable Channel = "stable"
+	// Prerelease pushes are released with a prerelease version
+	// labelled with their branch.
+	Prerelease Channel = "prerelease"
+	// Skip pushes are not packaged at all.
+	Skip Channel = "skip"
+	// Preview pushes are the heads of pull requests, released with a
+	// prerelease version labelled with the pull request and commit.
+	Preview Channel = "preview"
+)
+
+// refPrefixes are stripped from a ref to get its branch name. A commit
+// built on request without a branch has a refs/commits/ ref.
+var refPrefixes = []string{"refs/heads/", "refs/tags/", "refs/commits/"}
+
+// pullRef matches the ref Github keeps the head of a pull request at.
+var pullRef = regexp.MustCompile(`^refs/pull/([0-9]+)/head$`)
+
+// semverTag matches a tag naming a semantic version, such as v2.3.0 or
+// 2.3.0-rc.1, capturing its release and prerelease parts.
+var semverTag = regexp.MustCompile(`^v?([0-9]+\.[0-9]+\.[0-9]+)(?:-([0-9A-Za-z.-]+))?$`)
+
+// Decision is the channel a ref is released on.
+type Decision struct {
+	Channel Channel
+	// Label is what a prerelease is named after: the branch, or the
+	// channel for a custom channel. It is empty for a stable release.
+	Label string
+	// Version is the release a semver tag names, such as 2.3.0 for
+	// v2.3.0-rc.1, when tags are released. The ref is released with
+	// exactly that version, its prerelease part being the Label. It is
+	// empty for every other ref.
+	Version string
+}
+
+// Stable reports whether the ref is released with a full version.
+func (d Decision) Stable() bool {
+	return d.Channel == Stable
+}
+
+// Skipped reports whether the ref is not packaged at all.
+func (d Decision) Skipped() bool {
+	return d.Channel == Skip
+}
+
+// Policy maps refs to the channel they are released on.
+type Policy struct {
+	defaultBranch string
+	rules         []rule
+	tags          bool
+}
+
+type rule struct {
+	match   func(name string) bool
+	channel Channel
+}
+
+// New returns a pointer to a Policy configured with the parameters
+// passed in. It errors if a rule is not valid.
+func New(config Config) (*Policy, error) {
+	p := &Policy{
+		defaultBranch: config.Default,
+		tags:          config.Tags,
+	}
+	if p.defaultBranch == "" {
+		p.defaultBranch = DefaultBranch
+	}
+
+	for i, r := range config.Rules {
+		compiled, err := compile(r)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("branch rule %d is not valid", i+1))
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	return p, nil
+}
+
+// Default returns the branch stable versions are released from when no
+// rule matches.
+func (p *Policy) Default() string {
+	return p.defaultBranch
+}
+
+func compile(r Rule) (rule, error) {
+	channel := Channel(strings.TrimSpace(r.Channel))
+	if channel == "" {
+		return rule{}, errors.New("it has no channel")
+	}
+
+	switch {
+	case r.Glob != "" && r.Regex != "":
+		return rule{}, errors.New("it has both a glob and a regex")
+	case r.Glob != "":
+		// path.Match only reports a bad pattern when it is matched
+		if _, err := path.Match(r.Glob, ""); err != nil {
+			return rule{}, errors.Wrap(err, fmt.Sprintf("could not parse glob %q", r.Glob))
+		}
+		glob := r.Glob
+		return rule{
+			match: func(name string) bool {
+				ok, _ := path.Match(glob, name)
+				return ok
+			},
+			channel: channel,
+		}, nil
+	case r.Regex != "":
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return rule{}, errors.Wrap(err, fmt.Sprintf("could not parse regex %q", r.Regex))
+		}
+		return rule{
+			match:   re.MatchString,
+			channel: channel,
+		}, nil
+	default:
+		return rule{}, errors.New("it has neither a glob nor a regex")
+	}
+}
+
+// Decide returns the channel the passed ref is released on. The head
+// of a pull request is always a preview, and when tags are released a
+// semver tag is released as the version it names and any other tag is
+// skipped. Otherwise the first rule matching its branch decides, and
+// when none does the default branch is stable and every other branch a
+// prerelease.
+func (p *Policy) Decide(ref string) Decision {
+	if number, ok := PullRequest(ref); ok {
+		return Decision{Channel: Preview, Label: fmt.Sprintf("pr.%d", number)}
+	}
+	if tag, ok := Tag(ref); ok && p.tags {
+		match := semverTag.FindStringSubmatch(tag)
+		switch {
+		case match == nil:
+			return Decision{Channel: Skip}
+		case match[2] == "":
+			return Decision{Channel: Stable, Version: match[1]}
+		default:
+			return Decision{Channel: Prerelease, Label: match[2], Version: match[1]}
+		}
+	}
+	name := Name(ref)
+
+	channel := Prerelease
+	if name == p.defaultBranch {
+		channel = Stable
+	}
+	for _, r := range p.rules {
+		if r.match(name) {
+			channel = r.channel
+			break
+		}
+	}
+
+	switch channel {
+	case Stable, Skip:
+		return Decision{Channel: channel}
+	case Prerelease:
+		return Decision{Channel: channel, Label: name}
+	default:
+		return Decision{Channel: channel, Label: string(channel)}
+	}
+}
+
+// Name returns the branch name of a ref, such as feature/x for
+// refs/heads/feature/x.
+func Name(ref string) string {
+	for _, prefix := range refPrefixes {
+		if strings.HasPrefix(ref, prefix) {
+			return strings.TrimPrefix(ref, prefix)
+		}
+	}
+	return ref
+}
+
+// PullRef returns the ref of the head of a pull request, such as
+// refs/pull/123/head.
+func PullRef(number int64) string {
+	return fmt.Sprintf("refs/pull/%d/head", number)
+}
+
+// PullRequest returns the number of the pull request whose head the
+// ref is, and whether it is the head of one at all.
+func PullRequest(ref string) (int64, bool) {
+	match := pullRef.FindStringSubmatch(ref)
+	if match == nil {
+		return 0, false
+	}
+	number, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return number, true
+}
+
+// Tag returns the name of the tag a ref is, such as v2.3.0 for
+// refs/tags/v2.3.0, and whether it is a tag at all.
+func Tag(ref string) (string, bool) {
+	if !strings.HasPrefix(ref, "refs/tags/") {
+		return "", false
+	}
+	return strings.TrimPrefix(ref, "refs/tags/"), true
+}
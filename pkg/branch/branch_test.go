@@ -0,0 +1,111 @@
+package branch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Decide(t *testing.T) {
+	policy, err := New(Config{
+		Default: "main",
+		Rules: []Rule{
+			{Glob: "release/*", Channel: "stable"},
+			{Regex: "^dependabot/", Channel: "skip"},
+			{Glob: "develop", Channel: "beta"},
+			{Regex: "^hotfix-[0-9]+$", Channel: "prerelease"},
+		},
+	})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name string
+		ref  string
+		want Decision
+	}{
+		{"default branch", "refs/heads/main", Decision{Channel: Stable}},
+		{"other branch", "refs/heads/feature/x", Decision{Channel: Prerelease, Label: "feature/x"}},
+		{"master is not special", "refs/heads/master", Decision{Channel: Prerelease, Label: "master"}},
+		{"name containing the default", "refs/heads/feature/main-fix", Decision{Channel: Prerelease, Label: "feature/main-fix"}},
+		{"glob", "refs/heads/release/2.1", Decision{Channel: Stable}},
+		{"glob does not cross a slash", "refs/heads/release/2.1/rc", Decision{Channel: Prerelease, Label: "release/2.1/rc"}},
+		{"regex", "refs/heads/dependabot/npm/grpc", Decision{Channel: Skip}},
+		{"custom channel", "refs/heads/develop", Decision{Channel: "beta", Label: "beta"}},
+		{"anchored regex", "refs/heads/hotfix-12", Decision{Channel: Prerelease, Label: "hotfix-12"}},
+		{"anchored regex mismatch", "refs/heads/hotfix-12a", Decision{Channel: Prerelease, Label: "hotfix-12a"}},
+		{"commit without a branch", "refs/commits/da6b8c5", Decision{Channel: Prerelease, Label: "da6b8c5"}},
+		{"pull request", "refs/pull/123/head", Decision{Channel: Preview, Label: "pr.123"}},
+		{"pull request merge ref", "refs/pull/123/merge", Decision{Channel: Prerelease, Label: "refs/pull/123/merge"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, policy.Decide(tt.ref))
+		})
+	}
+}
+
+func Test_Decide_Tags(t *testing.T) {
+	policy, err := New(Config{Tags: true, Rules: []Rule{{Glob: "*", Channel: "skip"}}})
+	assert.Nil(t, err)
+
+	assert.Equal(t, Decision{Channel: Stable, Version: "2.3.0"}, policy.Decide("refs/tags/v2.3.0"))
+	assert.Equal(t, Decision{Channel: Stable, Version: "2.3.0"}, policy.Decide("refs/tags/2.3.0"))
+	assert.Equal(t, Decision{Channel: Prerelease, Label: "rc.1", Version: "2.3.0"}, policy.Decide("refs/tags/v2.3.0-rc.1"))
+	assert.Equal(t, Decision{Channel: Skip}, policy.Decide("refs/tags/v2.3"))
+	assert.Equal(t, Decision{Channel: Skip}, policy.Decide("refs/tags/nightly"))
+
+	// a tag is released like a branch named after it when tags are not
+	policy, err = New(Config{})
+	assert.Nil(t, err)
+	assert.Equal(t, Decision{Channel: Prerelease, Label: "v2.3.0"}, policy.Decide("refs/tags/v2.3.0"))
+}
+
+func Test_PullRequest(t *testing.T) {
+	number, ok := PullRequest(PullRef(42))
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), number)
+
+	_, ok = PullRequest("refs/heads/pull/42/head")
+	assert.False(t, ok)
+}
+
+func Test_Decide_FirstRuleWins(t *testing.T) {
+	policy, err := New(Config{
+		Rules: []Rule{
+			{Glob: "master", Channel: "skip"},
+			{Glob: "*", Channel: "stable"},
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.True(t, policy.Decide("refs/heads/master").Skipped())
+	assert.True(t, policy.Decide("refs/heads/anything").Stable())
+}
+
+func Test_Decide_DefaultsToMaster(t *testing.T) {
+	policy, err := New(Config{})
+	assert.Nil(t, err)
+
+	assert.True(t, policy.Decide("refs/heads/master").Stable())
+	assert.False(t, policy.Decide("refs/heads/feature/master-fix").Stable())
+	assert.Equal(t, "master", policy.Default())
+}
+
+func Test_New_InvalidRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"no channel", Rule{Glob: "main"}},
+		{"no match", Rule{Channel: "stable"}},
+		{"glob and regex", Rule{Glob: "main", Regex: "main", Channel: "stable"}},
+		{"bad glob", Rule{Glob: "[main", Channel: "stable"}},
+		{"bad regex", Rule{Regex: "(main", Channel: "stable"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(Config{Rules: []Rule{tt.rule}})
+			assert.NotNil(t, err)
+		})
+	}
+}
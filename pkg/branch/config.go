@@ -0,0 +1,35 @@
+package branch
+
+// Config represents config values for the branch policy.
+type Config struct {
+	// Default is the branch stable versions are released from when no
+	// rule matches, master if it is empty.
+	Default string
+	// Rules are tried in order against the name of every pushed branch,
+	// and the first that matches decides its channel.
+	Rules []Rule
+	// Previews packages the head of every pull request opened or
+	// updated as a preview, a prerelease labelled with the pull request
+	// and commit. Branch rules do not apply to them.
+	Previews bool
+	// Tags releases every semver tag pushed, such as v2.3.0, with
+	// exactly the version it names, and skips any other tag. Tags
+	// Protofact pushed itself are never packaged. Tag pushes are ignored
+	// while it is off.
+	Tags bool
+}
+
+// Rule maps the branches it matches to a channel. A rule matches with
+// either Glob or Regex, whichever is set.
+type Rule struct {
+	// Glob is a shell pattern matched against the whole branch name,
+	// such as release/*. A * does not match across a /.
+	Glob string
+	// Regex is a regular expression matched against the branch name,
+	// such as ^dependabot/. It is not anchored unless it says so.
+	Regex string
+	// Channel is stable, prerelease or skip, or the name of a custom
+	// channel. A custom channel is a prerelease labelled with the
+	// channel rather than the branch.
+	Channel string
+}
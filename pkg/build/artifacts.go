@@ -0,0 +1,77 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+type artifactDirKey struct{}
+
+// WithArtifactDir returns a copy of ctx asking the build it carries to
+// leave the artifacts it builds, such as .gem, .tgz and .jar files, in
+// dir. It is set for builds of a local checkout, which do not publish.
+func WithArtifactDir(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, artifactDirKey{}, dir)
+}
+
+// ArtifactDir returns the directory the build carried by ctx should
+// leave its artifacts in, or an empty string if it should not.
+func ArtifactDir(ctx context.Context) string {
+	dir, _ := ctx.Value(artifactDirKey{}).(string)
+	return dir
+}
+
+// CollectArtifacts copies every file under root accepted by match,
+// which is passed its path relative to root, into dir. It returns the
+// paths of the copies.
+func CollectArtifacts(root, dir string, match func(path string) bool) ([]string, error) {
+	var collected []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !match(rel) {
+			return nil
+		}
+		dest := filepath.Join(dir, info.Name())
+		if err := copyFile(path, dest); err != nil {
+			return err
+		}
+		collected = append(collected, dest)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not collect artifacts from %s into %s", root, dir))
+	}
+	if len(collected) == 0 {
+		return nil, errors.Errorf("no artifacts found in %s", root)
+	}
+	return collected, nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(out.Close())
+}
@@ -0,0 +1,86 @@
+// Package build holds the types shared between the language packaging
+// services and the job machinery that drives them, so that neither
+// side has to import the other.
+package build
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Stage names used when reporting which part of a Process call failed.
+// They match the "type" label used on the packaging error counter.
+const (
+	StageCI      = "ci"
+	StageMkdir   = "mkdir"
+	StageVersion = "version"
+	StageSchema  = "schema"
+	StageGate    = "gate"
+	StageClone   = "clone"
+	StageCreate  = "create"
+	StageBuild   = "build"
+	StageCollect = "collect"
+	StagePublish = "publish"
+	StageTag     = "tag"
+	StageRelease = "release"
+)
+
+// ErrSuperseded is returned in place of building a push once a newer
+// push to the same branch has been seen. It is not a failure, so a
+// superseded job is not retried.
+var ErrSuperseded = errors.New("superseded by a newer push to the branch")
+
+// IsSuperseded reports whether the cause of err is ErrSuperseded.
+func IsSuperseded(err error) bool {
+	return err != nil && errors.Cause(err) == ErrSuperseded
+}
+
+// StageError records the stage of a Process call that produced an error.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+// Error satisfies the error interface.
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s stage failed: %v", e.Stage, e.Err)
+}
+
+// Cause returns the underlying error, which lets errors.Cause from
+// github.com/pkg/errors unwrap a StageError.
+func (e *StageError) Cause() error {
+	return e.Err
+}
+
+// StageFailed wraps err in a StageError for the passed stage.
+// A nil err returns nil.
+func StageFailed(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StageError{
+		Stage: stage,
+		Err:   err,
+	}
+}
+
+// FailedStage walks the cause chain of err and returns the stage of the
+// first StageError it finds, or an empty string if there is none.
+func FailedStage(err error) string {
+	type causer interface {
+		Cause() error
+	}
+
+	for err != nil {
+		if se, ok := err.(*StageError); ok {
+			return se.Stage
+		}
+		c, ok := err.(causer)
+		if !ok {
+			return ""
+		}
+		err = c.Cause()
+	}
+	return ""
+}
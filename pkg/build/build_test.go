@@ -0,0 +1,93 @@
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FailedStage(t *testing.T) {
+	err := StageFailed(StageClone, errors.New("could not clone"))
+	assert.Equal(t, StageClone, FailedStage(err))
+
+	wrapped := errors.Wrap(errors.WithStack(err), "processing failed")
+	assert.Equal(t, StageClone, FailedStage(wrapped))
+
+	assert.Equal(t, "", FailedStage(errors.New("no stage")))
+	assert.Equal(t, "", FailedStage(nil))
+	assert.Nil(t, StageFailed(StageClone, nil))
+}
+
+func Test_Permanent(t *testing.T) {
+	err := errors.Wrap(StageFailed(StageGate, Permanent(errors.New("breaking changes"))), "dispatch failed")
+	assert.True(t, IsPermanent(err))
+	assert.Equal(t, StageGate, FailedStage(err))
+
+	assert.False(t, IsPermanent(StageFailed(StageClone, errors.New("could not clone"))))
+	assert.Nil(t, Permanent(nil))
+}
+
+func Test_TimedOut(t *testing.T) {
+	ctx, cancel := WithTimeout(context.Background(), StagePublish, time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	err := TimedOut(ctx, errors.New("signal: killed"))
+	assert.True(t, IsTimeout(StageFailed(StagePublish, errors.WithStack(err))))
+	assert.Equal(t, ErrorTypeTimeout, ErrorType(StagePublish, err))
+	assert.Nil(t, TimedOut(ctx, nil))
+
+	// a cancelled stage did not run out of time
+	ctx, cancel = WithTimeout(context.Background(), StagePublish, time.Minute)
+	cancel()
+	err = TimedOut(ctx, errors.New("signal: killed"))
+	assert.False(t, IsTimeout(err))
+	assert.Equal(t, StagePublish, ErrorType(StagePublish, err))
+
+	// a zero timeout sets no deadline
+	ctx, cancel = WithTimeout(context.Background(), StagePublish, 0)
+	defer cancel()
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+
+	timeouts := Timeouts{Build: time.Minute}.Merge(Timeouts{Build: time.Hour, Publish: time.Hour})
+	assert.Equal(t, Timeouts{Build: time.Minute, Publish: time.Hour}, timeouts)
+}
+
+func Test_CollectArtifacts(t *testing.T) {
+	root, err := ioutil.TempDir("", "protofact-build")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	out, err := ioutil.TempDir("", "protofact-artifacts")
+	assert.Nil(t, err)
+	defer os.RemoveAll(out)
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "target", "scala-2.12"), 0750))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "target", "scala-2.12", "protos_2.12-1.0.1.jar"), []byte("jar"), 0640))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "build.sbt"), []byte("sbt"), 0640))
+
+	jars := func(rel string) bool {
+		return filepath.Ext(rel) == ".jar"
+	}
+	collected, err := CollectArtifacts(root, out, jars)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(out, "protos_2.12-1.0.1.jar")}, collected)
+	content, err := ioutil.ReadFile(collected[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "jar", string(content))
+
+	_, err = CollectArtifacts(root, out, func(rel string) bool {
+		return filepath.Ext(rel) == ".gem"
+	})
+	assert.NotNil(t, err)
+
+	ctx := context.Background()
+	assert.Equal(t, "", ArtifactDir(ctx))
+	assert.Equal(t, out, ArtifactDir(WithArtifactDir(ctx, out)))
+}
@@ -0,0 +1,28 @@
+package build
+
+import "context"
+
+type languagesKey struct{}
+
+// WithLanguages returns a copy of ctx limiting the build it carries to
+// the named languages. A build started on request may only want some of
+// the languages a process packages.
+func WithLanguages(ctx context.Context, languages []string) context.Context {
+	return context.WithValue(ctx, languagesKey{}, languages)
+}
+
+// LanguageWanted reports whether the build carried by ctx packages the
+// named language. Every language is wanted unless ctx was limited to
+// some of them with WithLanguages.
+func LanguageWanted(ctx context.Context, language string) bool {
+	languages, ok := ctx.Value(languagesKey{}).([]string)
+	if !ok || len(languages) == 0 {
+		return true
+	}
+	for _, l := range languages {
+		if l == language {
+			return true
+		}
+	}
+	return false
+}
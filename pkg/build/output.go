@@ -0,0 +1,92 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+type outputKey struct{}
+
+// WithOutput returns a copy of ctx carrying w, which receives the
+// output of every subprocess run through CombinedOutput.
+func WithOutput(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, outputKey{}, w)
+}
+
+// OutputFrom returns the output writer carried by ctx, or a writer that
+// discards everything if there is none.
+func OutputFrom(ctx context.Context) io.Writer {
+	if w, ok := ctx.Value(outputKey{}).(io.Writer); ok {
+		return w
+	}
+	return ioutil.Discard
+}
+
+// CombinedOutput runs cmd and returns its combined stdout and stderr,
+// like exec.Cmd.CombinedOutput, while also copying the command line
+// and everything it writes to the output writer carried by ctx.
+// Commands should be made with exec.CommandContext and the same ctx.
+// cmd runs in a process group of its own, and if ctx is done before it
+// exits the whole group is killed. The error returned is then a
+// TimeoutError if ctx ran out of time from WithTimeout.
+func CombinedOutput(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	out := OutputFrom(ctx)
+	fmt.Fprintf(out, "$ %s\n", strings.Join(redact(cmd.Args), " "))
+
+	var buf bytes.Buffer
+	w := io.MultiWriter(&buf, out)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return buf.Bytes(), TimedOut(ctx, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if ctx.Err() != nil {
+			// exec.CommandContext got to the process first
+			killProcessGroup(cmd)
+			fmt.Fprintf(out, "killed %s: %v\n", cmd.Args[0], ctx.Err())
+			return buf.Bytes(), TimedOut(ctx, ctx.Err())
+		}
+		return buf.Bytes(), err
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		fmt.Fprintf(out, "killed %s: %v\n", cmd.Args[0], ctx.Err())
+		return buf.Bytes(), TimedOut(ctx, ctx.Err())
+	}
+}
+
+// redact returns args with the password of any url in them, such as an
+// authenticated clone url, replaced so it does not end up in a log.
+func redact(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = arg
+		if !strings.Contains(arg, "://") {
+			continue
+		}
+		u, err := url.Parse(arg)
+		if err != nil || u.User == nil {
+			continue
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+			redacted[i] = u.String()
+		}
+	}
+	return redacted
+}
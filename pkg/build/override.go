@@ -0,0 +1,18 @@
+package build
+
+import "context"
+
+type breakingKey struct{}
+
+// WithBreakingAllowed returns a copy of ctx allowing the build it
+// carries to publish a stable release with breaking schema changes.
+func WithBreakingAllowed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, breakingKey{}, true)
+}
+
+// BreakingAllowed reports whether the build carried by ctx may publish a
+// stable release with breaking schema changes.
+func BreakingAllowed(ctx context.Context) bool {
+	allowed, _ := ctx.Value(breakingKey{}).(bool)
+	return allowed
+}
@@ -0,0 +1,47 @@
+package build
+
+// PermanentError records a failure that would fail the same way however
+// often it is tried, such as a commit refused by a policy.
+type PermanentError struct {
+	Err error
+}
+
+// Error satisfies the error interface.
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error, which lets errors.Cause from
+// github.com/pkg/errors unwrap a PermanentError.
+func (e *PermanentError) Cause() error {
+	return e.Err
+}
+
+// Permanent wraps err in a PermanentError, so the job failing with it is
+// not retried. A nil err returns nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent walks the cause chain of err and reports whether it holds
+// a PermanentError.
+func IsPermanent(err error) bool {
+	type causer interface {
+		Cause() error
+	}
+
+	for err != nil {
+		if _, ok := err.(*PermanentError); ok {
+			return true
+		}
+		c, ok := err.(causer)
+		if !ok {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
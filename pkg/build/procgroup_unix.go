@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package build
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd start in a process group of its own, so
+// anything it starts, like the JVM under sbt, is killed along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills cmd and every process in its group.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,12 @@
+package build
+
+import "os/exec"
+
+// setProcessGroup does nothing, as there are no process groups to kill
+// on windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd only.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
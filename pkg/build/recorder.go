@@ -0,0 +1,56 @@
+package build
+
+import (
+	"context"
+
+	"github.com/gospotcheck/protofact/pkg/schema"
+)
+
+// Recorder receives progress from a Process call as it runs,
+// so it can be reported on while the job is still in flight.
+type Recorder interface {
+	// BuildID is called once with the id of the Process call's build directory.
+	BuildID(id string)
+	// Version is called once the artifact version has been computed.
+	Version(version string)
+	// Schema is called once the schema of the commit has been compared
+	// with that of the last stable release.
+	Schema(report schema.Report)
+	StageStarted(stage string)
+	StageFinished(stage string, err error)
+}
+
+type recorderKey struct{}
+
+// WithRecorder returns a copy of ctx carrying the passed Recorder.
+func WithRecorder(ctx context.Context, r Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, r)
+}
+
+// RecorderFrom returns the Recorder carried by ctx. If there is none,
+// a Recorder that discards everything is returned so callers never need
+// to check.
+func RecorderFrom(ctx context.Context) Recorder {
+	if r, ok := ctx.Value(recorderKey{}).(Recorder); ok {
+		return r
+	}
+	return nopRecorder{}
+}
+
+// StartStage records the start of a stage on the Recorder in ctx and
+// returns a func to call with the stage's result once it is done.
+func StartStage(ctx context.Context, stage string) func(error) {
+	r := RecorderFrom(ctx)
+	r.StageStarted(stage)
+	return func(err error) {
+		r.StageFinished(stage, err)
+	}
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) BuildID(string)              {}
+func (nopRecorder) Version(string)              {}
+func (nopRecorder) Schema(schema.Report)        {}
+func (nopRecorder) StageStarted(string)         {}
+func (nopRecorder) StageFinished(string, error) {}
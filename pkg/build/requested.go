@@ -0,0 +1,19 @@
+package build
+
+import "context"
+
+type requestedKey struct{}
+
+// WithRequested returns a copy of ctx marking the build it carries as
+// started on request rather than by a push. A build on request may be
+// of any commit, so it does not order the pushes to its branch.
+func WithRequested(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestedKey{}, true)
+}
+
+// Requested reports whether the build carried by ctx was started on
+// request.
+func Requested(ctx context.Context) bool {
+	requested, _ := ctx.Value(requestedKey{}).(bool)
+	return requested
+}
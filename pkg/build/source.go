@@ -0,0 +1,13 @@
+package build
+
+import "github.com/gospotcheck/protofact/pkg/event"
+
+// Source is a checkout of a pushed commit. It is cloned once per build
+// and shared by every language packaged from it, so a Process call must
+// only read from Dir, never write to it.
+type Source struct {
+	// Payload is the push event that triggered the build.
+	Payload event.Push
+	// Dir is the path of the checkout.
+	Dir string
+}
@@ -0,0 +1,128 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Timeouts holds the longest each stage of a build may run for. A zero
+// timeout leaves the stage unlimited.
+type Timeouts struct {
+	// Clone limits the clone of the pushed commit. The clone is shared
+	// by every language, so it is only read from the top level timeouts.
+	Clone time.Duration
+	// Template limits the create stage, where the package is templated
+	// out of the checkout.
+	Template time.Duration
+	Build    time.Duration
+	Publish  time.Duration
+	// Tag limits the tagging and pushing of the release tag.
+	Tag time.Duration
+}
+
+// Merge returns t with every zero timeout taken from defaults.
+func (t Timeouts) Merge(defaults Timeouts) Timeouts {
+	if t.Clone == 0 {
+		t.Clone = defaults.Clone
+	}
+	if t.Template == 0 {
+		t.Template = defaults.Template
+	}
+	if t.Build == 0 {
+		t.Build = defaults.Build
+	}
+	if t.Publish == 0 {
+		t.Publish = defaults.Publish
+	}
+	if t.Tag == 0 {
+		t.Tag = defaults.Tag
+	}
+	return t
+}
+
+// ErrorTypeTimeout is the type a packaging error is counted under, in
+// place of its stage, when the stage ran out of time.
+const ErrorTypeTimeout = "timeout"
+
+// TimeoutError is returned when a stage runs for longer than its timeout.
+// The commands it was running are killed.
+type TimeoutError struct {
+	Stage   string
+	Timeout time.Duration
+	Err     error
+}
+
+// Error satisfies the error interface.
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s: %v", e.Stage, e.Timeout, e.Err)
+}
+
+// Cause returns the error the stage failed with once it was stopped.
+func (e *TimeoutError) Cause() error {
+	return e.Err
+}
+
+// IsTimeout walks the cause chain of err and reports whether it holds a
+// TimeoutError.
+func IsTimeout(err error) bool {
+	type causer interface {
+		Cause() error
+	}
+
+	for err != nil {
+		if _, ok := err.(*TimeoutError); ok {
+			return true
+		}
+		c, ok := err.(causer)
+		if !ok {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
+// ErrorType returns the type label a packaging error in stage is counted
+// under: ErrorTypeTimeout if the stage ran out of time, otherwise the stage.
+func ErrorType(stage string, err error) string {
+	if IsTimeout(err) {
+		return ErrorTypeTimeout
+	}
+	return stage
+}
+
+type timeoutKey struct{}
+
+type stageTimeout struct {
+	stage   string
+	timeout time.Duration
+}
+
+// WithTimeout returns a copy of ctx for running stage, which is done once
+// timeout has passed. A zero timeout sets no deadline. Pass the error the
+// stage returns through TimedOut with the returned context.
+func WithTimeout(ctx context.Context, stage string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	ctx = context.WithValue(ctx, timeoutKey{}, stageTimeout{stage: stage, timeout: timeout})
+	return context.WithTimeout(ctx, timeout)
+}
+
+// TimedOut returns err as a TimeoutError if ctx, returned by WithTimeout,
+// ran out of time, and err as it is otherwise.
+func TimedOut(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	st, ok := ctx.Value(timeoutKey{}).(stageTimeout)
+	if !ok {
+		return err
+	}
+	return &TimeoutError{
+		Stage:   st.stage,
+		Timeout: st.timeout,
+		Err:     err,
+	}
+}
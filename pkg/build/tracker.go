@@ -0,0 +1,42 @@
+package build
+
+import "context"
+
+// Tracker receives the result of each language of a build that packages
+// several languages from one push. A job is retried as a whole, so the
+// Tracker also remembers which languages already succeeded on an earlier
+// attempt, or were already published from the same push, and should not
+// be packaged again.
+type Tracker interface {
+	// Done reports whether the language succeeded on an earlier attempt,
+	// or was already published from the same commit and ref.
+	Done(language string) bool
+	// Started is called as a language starts, and returns the Recorder
+	// that language's progress should be reported to.
+	Started(language string) Recorder
+	// Finished is called with the result of a language once it is done.
+	Finished(language string, err error)
+}
+
+type trackerKey struct{}
+
+// WithTracker returns a copy of ctx carrying the passed Tracker.
+func WithTracker(ctx context.Context, t Tracker) context.Context {
+	return context.WithValue(ctx, trackerKey{}, t)
+}
+
+// TrackerFrom returns the Tracker carried by ctx. If there is none, a
+// Tracker that never reports a language as done and discards everything
+// else is returned.
+func TrackerFrom(ctx context.Context) Tracker {
+	if t, ok := ctx.Value(trackerKey{}).(Tracker); ok {
+		return t
+	}
+	return nopTracker{}
+}
+
+type nopTracker struct{}
+
+func (nopTracker) Done(string) bool        { return false }
+func (nopTracker) Started(string) Recorder { return nopRecorder{} }
+func (nopTracker) Finished(string, error)  {}
@@ -0,0 +1,30 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// WorkRoot is the directory every build directory is created in, so
+// anything a build leaves behind can be found and removed at once.
+const WorkRoot = "/tmp/protofact-builds"
+
+// WorkDir returns the path of the build directory for the passed id.
+// The directory is not created.
+func WorkDir(id string) string {
+	return filepath.Join(WorkRoot, id)
+}
+
+// RemoveWorkDirs removes every build directory. It must only be called
+// when no build is running, such as on startup or once every build has
+// been drained on shutdown.
+func RemoveWorkDirs() error {
+	err := os.RemoveAll(WorkRoot)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not remove build directories in %s", WorkRoot))
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Package ci works out whether the CI of a commit has passed, from the
+// commit statuses and check runs it is required to have, so packages
+// are only published for commits whose protos are known to be good.
+package ci
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+
+	"github.com/gospotcheck/protofact/pkg/event"
+)
+
+// State is the state of the CI of a commit.
+type State string
+
+// The states of the CI of a commit. It is Pending until every required
+// context has succeeded, or one of them has not.
+const (
+	Pending State = "pending"
+	Passed  State = "passed"
+	Failed  State = "failed"
+)
+
+type repo interface {
+	ListStatuses(ctx context.Context, owner, repo, sha string) ([]*github.RepoStatus, error)
+	ListCheckRuns(ctx context.Context, owner, repo, sha string) ([]*github.CheckRun, error)
+}
+
+// Result is the state of the CI of a commit, with a description of it
+// such as waiting for lint.
+type Result struct {
+	State       State
+	Description string
+}
+
+// Waiter checks the CI of commits against the required contexts. It
+// fulfills the waiter interface in package queue.
+type Waiter struct {
+	config Config
+	repo   repo
+}
+
+// New returns a pointer to a Waiter configured with the parameters
+// passed in.
+func New(config Config, repo repo) *Waiter {
+	if config.Timeout <= 0 {
+		config.Timeout = time.Hour
+	}
+	if config.Interval <= 0 {
+		config.Interval = 30 * time.Second
+	}
+	return &Waiter{
+		config: config,
+		repo:   repo,
+	}
+}
+
+// Interval returns how often the CI of a waiting job is checked.
+func (w *Waiter) Interval() time.Duration {
+	return w.config.Interval
+}
+
+// Timeout returns how long a job waits for CI before it is abandoned.
+func (w *Waiter) Timeout() time.Duration {
+	return w.config.Timeout
+}
+
+// Check returns the state of the CI of the commit pushed in payload.
+// It has passed straight away if no contexts are required.
+func (w *Waiter) Check(ctx context.Context, payload event.Push) (Result, error) {
+	if len(w.config.Contexts) == 0 {
+		return Result{State: Passed, Description: "no CI required"}, nil
+	}
+	// the contexts are those of Github's statuses and checks, which other
+	// providers do not report
+	if !payload.Github() {
+		return Result{State: Passed, Description: "CI is only checked on Github"}, nil
+	}
+
+	owner, name, sha := payload.Repository.Owner.Login, payload.Repository.Name, payload.After
+	statuses, err := w.repo.ListStatuses(ctx, owner, name, sha)
+	if err != nil {
+		return Result{}, err
+	}
+	runs, err := w.repo.ListCheckRuns(ctx, owner, name, sha)
+	if err != nil {
+		return Result{}, err
+	}
+
+	states := map[string]State{}
+	for _, s := range statuses {
+		states[s.GetContext()] = statusState(s.GetState())
+	}
+	for _, r := range runs {
+		states[r.GetName()] = checkRunState(r)
+	}
+
+	var failed, pending []string
+	for _, c := range w.config.Contexts {
+		switch states[c] {
+		case Passed:
+		case Failed:
+			failed = append(failed, c)
+		default:
+			// a context not reported yet has not finished either
+			pending = append(pending, c)
+		}
+	}
+	switch {
+	case len(failed) > 0:
+		return Result{State: Failed, Description: fmt.Sprintf("%s did not succeed", strings.Join(failed, ", "))}, nil
+	case len(pending) > 0:
+		return Result{State: Pending, Description: fmt.Sprintf("waiting for %s", strings.Join(pending, ", "))}, nil
+	default:
+		return Result{State: Passed, Description: fmt.Sprintf("%s succeeded", strings.Join(w.config.Contexts, ", "))}, nil
+	}
+}
+
+func statusState(state string) State {
+	switch state {
+	case "success":
+		return Passed
+	case "failure", "error":
+		return Failed
+	default:
+		return Pending
+	}
+}
+
+func checkRunState(run *github.CheckRun) State {
+	if run.GetStatus() != "completed" {
+		return Pending
+	}
+	switch run.GetConclusion() {
+	case "success", "neutral", "skipped":
+		return Passed
+	default:
+		return Failed
+	}
+}
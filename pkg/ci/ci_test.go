@@ -0,0 +1,106 @@
+package ci
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/git"
+)
+
+const sha = "da6b8c5af1dbbd3f03a49b6d8b5fdf3b3bca9c8c"
+
+func newTestWaiter(t *testing.T, contexts []string, statuses, runs string) *Waiter {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case fmt.Sprintf("/api/v3/repos/org/protos/commits/%s/status", sha):
+			fmt.Fprintf(w, `{"state": "pending", "statuses": %s}`, statuses)
+		case fmt.Sprintf("/api/v3/repos/org/protos/commits/%s/check-runs", sha):
+			fmt.Fprintf(w, `{"check_runs": %s}`, runs)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	repo := git.New(context.Background(), git.Config{Token: "token", APIURL: srv.URL + "/api/v3"}, log.WithField("test", t.Name()))
+	return New(Config{Contexts: contexts}, repo)
+}
+
+func newTestPayload() event.Push {
+	var payload event.Push
+	payload.After = sha
+	payload.Repository.Name = "protos"
+	payload.Repository.Owner.Login = "org"
+	return payload
+}
+
+func Test_Check(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses string
+		runs     string
+		want     Result
+	}{
+		{
+			"nothing reported yet",
+			`[]`, `[]`,
+			Result{State: Pending, Description: "waiting for lint, compile"},
+		},
+		{
+			"one still running",
+			`[{"context": "lint", "state": "success"}]`,
+			`[{"name": "compile", "status": "in_progress"}]`,
+			Result{State: Pending, Description: "waiting for compile"},
+		},
+		{
+			"all succeeded",
+			`[{"context": "lint", "state": "success"}, {"context": "coverage", "state": "failure"}]`,
+			`[{"name": "compile", "status": "completed", "conclusion": "success"}]`,
+			Result{State: Passed, Description: "lint, compile succeeded"},
+		},
+		{
+			"one failed",
+			`[{"context": "lint", "state": "error"}]`,
+			`[{"name": "compile", "status": "queued"}]`,
+			Result{State: Failed, Description: "lint did not succeed"},
+		},
+		{
+			"check run failed",
+			`[{"context": "lint", "state": "success"}]`,
+			`[{"name": "compile", "status": "completed", "conclusion": "timed_out"}]`,
+			Result{State: Failed, Description: "compile did not succeed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWaiter(t, []string{"lint", "compile"}, tt.statuses, tt.runs)
+			result, err := w.Check(context.Background(), newTestPayload())
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, result)
+		})
+	}
+}
+
+func Test_Check_NothingRequired(t *testing.T) {
+	w := New(Config{}, nil)
+	result, err := w.Check(context.Background(), newTestPayload())
+	assert.Nil(t, err)
+	assert.Equal(t, Passed, result.State)
+}
+
+func Test_Check_NotGithub(t *testing.T) {
+	w := New(Config{Contexts: []string{"lint"}}, nil)
+	payload := newTestPayload()
+	payload.Provider = event.Gitlab
+	result, err := w.Check(context.Background(), payload)
+	assert.Nil(t, err)
+	assert.Equal(t, Passed, result.State)
+}
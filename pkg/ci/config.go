@@ -0,0 +1,19 @@
+package ci
+
+import "time"
+
+// Config represents config values for waiting on the CI of a commit
+// before packaging it.
+type Config struct {
+	// Contexts are the commit statuses and check runs, by context or
+	// name, that must succeed on a commit before it is packaged, such as
+	// lint and compile. Commits are packaged without waiting while it is
+	// empty.
+	Contexts []string
+	// Timeout is how long a job waits for its commit's CI before it is
+	// abandoned. It is an hour by default.
+	Timeout time.Duration
+	// Interval is how often the CI of a waiting job is checked. It is
+	// 30 seconds by default.
+	Interval time.Duration
+}
@@ -3,33 +3,74 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"github.com/imdario/mergo"
 	"github.com/jlevesy/envconfig"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 
+	"github.com/gospotcheck/protofact/pkg/api"
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/ci"
 	"github.com/gospotcheck/protofact/pkg/git"
+	"github.com/gospotcheck/protofact/pkg/joblog"
+	"github.com/gospotcheck/protofact/pkg/queue"
+	"github.com/gospotcheck/protofact/pkg/reconcile"
 	"github.com/gospotcheck/protofact/pkg/services/npm"
+	"github.com/gospotcheck/protofact/pkg/services/release"
 	"github.com/gospotcheck/protofact/pkg/services/ruby"
 	"github.com/gospotcheck/protofact/pkg/services/scala"
+	"github.com/gospotcheck/protofact/pkg/status"
+	"github.com/gospotcheck/protofact/pkg/versioning"
 	"github.com/gospotcheck/protofact/pkg/webhook"
 )
 
+// SupportedLanguages are the languages Protofact can package, in the
+// order they are run and reported.
+var SupportedLanguages = []string{"npm", "ruby", "scala", "release"}
+
 // Values represents the config values needed by the entire application.
 // In addition to top level values like Language and LogLevel,
 // it has nested config structs for each of the sub-packages like Git,
 // and all the languages supported.
 type Values struct {
+	API api.Config
+	// Branches decides which pushes are released as stable, which as
+	// prereleases and which are not packaged.
+	Branches branch.Config
+	// CI holds off packaging each commit until its required CI contexts
+	// have succeeded.
+	CI       ci.Config
 	Git      git.Config
+	JobLogs  joblog.Config
 	Language string
 	LogLevel string
 	Name     string
 	Port     string
+	// GracePeriod is how long a shutdown waits for running builds to
+	// finish before handing them back to the queue.
+	GracePeriod time.Duration
+	Queue       queue.Config
+	// Reconcile packages the commits of the tracked branches whose push
+	// was missed, at startup and periodically after.
+	Reconcile reconcile.Config
+	// Timeouts limits how long each stage of a build may run. Each
+	// language can override them with its own timeouts.
+	Timeouts build.Timeouts
+	Release  release.Config
 	Ruby     ruby.Config
 	Scala    scala.Config
-	Webhook  webhook.Config
-	NPM      npm.Config
+	// Status reports the result of every job on the pushed commit in
+	// Github.
+	Status status.Config
+	// Versioning picks how the version of each commit is worked out,
+	// which every language is released under.
+	Versioning versioning.Config
+	Webhook    webhook.Config
+	NPM        npm.Config
 }
 
 // Read will bring in config values from a YAML file at
@@ -68,3 +109,39 @@ func Read(configFilePath string) (*Values, error) {
 
 	return &yamlValues, nil
 }
+
+// Languages returns the languages this process packages. Language is
+// either a single language, a comma separated list of them, or "all"
+// for every supported language.
+func (v *Values) Languages() ([]string, error) {
+	if strings.TrimSpace(v.Language) == "all" {
+		return append([]string(nil), SupportedLanguages...), nil
+	}
+
+	var languages []string
+	seen := map[string]bool{}
+	for _, l := range strings.Split(v.Language, ",") {
+		l = strings.TrimSpace(l)
+		if l == "" || seen[l] {
+			continue
+		}
+		if !isSupported(l) {
+			return nil, errors.Errorf("language %q did not match any supported language, must be one of %s or all", l, strings.Join(SupportedLanguages, ", "))
+		}
+		seen[l] = true
+		languages = append(languages, l)
+	}
+	if len(languages) == 0 {
+		return nil, errors.New("no language configured")
+	}
+	return languages, nil
+}
+
+func isSupported(language string) bool {
+	for _, l := range SupportedLanguages {
+		if l == language {
+			return true
+		}
+	}
+	return false
+}
@@ -3,8 +3,12 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/git"
 )
 
 // Test_read strings together subtests because this is the one place
@@ -20,7 +24,44 @@ func Test_Read(t *testing.T) {
 		assert.Equal(t, conf.Language, "ruby")
 		assert.Equal(t, conf.Git.Username, "user")
 		assert.Equal(t, conf.Git.Token, "pass")
+		assert.Equal(t, conf.Git.APIURL, "http://localhost:9999/api/v3/")
+		assert.Equal(t, conf.Git.GitlabToken, "glpat")
+		assert.Equal(t, conf.Git.BitbucketServer, git.Credentials{Username: "builder", Token: "bbtoken"})
+		assert.Equal(t, conf.Status.Mode, "checks")
+		assert.Equal(t, conf.Status.URL, "https://protofact.example.com")
 		assert.Equal(t, conf.Webhook.Secret, "asupersecretkey")
+		assert.Equal(t, conf.Webhook.GitlabToken, "agitlabsecrettoken")
+		assert.Equal(t, conf.Webhook.GiteaSecret, "agiteasecret")
+		assert.Equal(t, conf.Webhook.Secrets, []string{"anewsupersecretkey"})
+		assert.False(t, conf.Webhook.Insecure)
+		assert.Equal(t, conf.API.Token, "anapitoken")
+		assert.Equal(t, conf.Versioning.Strategy, "gittag")
+		assert.Equal(t, conf.Versioning.Major, 2)
+		assert.Equal(t, conf.Versioning.Minor, 1)
+		assert.True(t, conf.Versioning.Detect)
+		assert.True(t, conf.Versioning.Gate)
+		assert.Equal(t, conf.Versioning.Protos, "proto")
+		assert.Equal(t, conf.Branches.Default, "main")
+		assert.Equal(t, conf.Branches.Rules, []branch.Rule{
+			{Glob: "release/*", Channel: "stable"},
+			{Regex: "^dependabot/", Channel: "skip"},
+		})
+		assert.True(t, conf.Branches.Previews)
+		assert.True(t, conf.Branches.Tags)
+		assert.Equal(t, conf.CI.Contexts, []string{"lint", "compile"})
+		assert.Equal(t, conf.CI.Timeout, 30*time.Minute)
+		assert.Equal(t, conf.GracePeriod, 2*time.Minute)
+		assert.Equal(t, conf.Queue.DataDir, "/tmp/protofact")
+		assert.Equal(t, conf.Queue.MaxAttempts, 3)
+		assert.Equal(t, conf.Queue.Backoff, 10*time.Second)
+		assert.Equal(t, conf.Queue.MaxQueued, 50)
+		assert.Equal(t, conf.Queue.Retention, 72*time.Hour)
+		assert.Equal(t, conf.Queue.LanguageWorkers, map[string]int{"scala": 1})
+		assert.Equal(t, conf.Reconcile.Repositories, []string{"someorg/somerepo"})
+		assert.Equal(t, conf.Reconcile.Lookback, 72*time.Hour)
+		assert.Equal(t, conf.Timeouts.Clone, 2*time.Minute)
+		assert.Equal(t, conf.Timeouts.Publish, 10*time.Minute)
+		assert.Equal(t, conf.Ruby.Timeouts.Build, 5*time.Minute)
 		assert.Equal(t, conf.Ruby.Authors, "somepeople")
 		assert.Equal(t, conf.Ruby.Email, "dev@dev.com")
 		assert.Equal(t, conf.Ruby.GemRepoUser, "user")
@@ -40,11 +81,14 @@ func Test_Read(t *testing.T) {
 		os.Setenv("PF_LANGUAGE", "ruby")
 		os.Setenv("PF_GIT_USERNAME", "envuser")
 		os.Setenv("PF_RUBY_PUBLISH", "false")
+		os.Setenv("PF_WEBHOOK_INSECURE", "true")
+		defer os.Unsetenv("PF_WEBHOOK_INSECURE")
 		conf, err := Read("")
 		assert.Nil(t, err)
 		assert.Equal(t, conf.Language, "ruby")
 		assert.Equal(t, conf.Git.Username, "envuser")
 		assert.Equal(t, conf.Ruby.Publish, false)
+		assert.True(t, conf.Webhook.Insecure)
 	})
 	t.Run("EnvOverridesFile", func(t *testing.T) {
 		os.Setenv("PF_GIT_USERNAME", "envuser")
@@ -60,3 +104,23 @@ func Test_Read(t *testing.T) {
 		assert.Equal(t, conf.Git.Token, "pass")
 	})
 }
+
+func Test_Languages(t *testing.T) {
+	languages, err := (&Values{Language: "ruby"}).Languages()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ruby"}, languages)
+
+	languages, err = (&Values{Language: "npm, scala,npm"}).Languages()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"npm", "scala"}, languages)
+
+	languages, err = (&Values{Language: "all"}).Languages()
+	assert.Nil(t, err)
+	assert.Equal(t, SupportedLanguages, languages)
+
+	_, err = (&Values{Language: "ruby,cobol"}).Languages()
+	assert.NotNil(t, err)
+
+	_, err = (&Values{Language: ""}).Languages()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,143 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/event"
+)
+
+// Coordinator orders the builds of each branch. It lets at most one
+// build run per branch and language at a time, and once it has seen a
+// push to a branch it stops builds of older pushes to that branch:
+// those not yet started are skipped, and those in flight have their
+// context cancelled. Pushes are ordered by their PushedAt time, which
+// is also what their versions are made from. A build started on request
+// may be of any commit, so it takes no part in the ordering: it is not
+// seen as a push to its branch, and it is never superseded, it only
+// waits for its turn.
+type Coordinator struct {
+	mu      sync.Mutex
+	latest  map[string]int64
+	running map[string]*slot
+	// changed is closed and replaced whenever a newer push is seen or a
+	// build finishes, waking every build waiting for its turn.
+	changed chan struct{}
+}
+
+type slot struct {
+	branch    string
+	pushedAt  int64
+	requested bool
+	cancel    context.CancelFunc
+}
+
+// NewCoordinator returns a pointer to a Coordinator that has not seen any push.
+func NewCoordinator() *Coordinator {
+	return &Coordinator{
+		latest:  map[string]int64{},
+		running: map[string]*slot{},
+		changed: make(chan struct{}),
+	}
+}
+
+// Observe records a push to a branch. If it is newer than every push
+// seen so far, the in-flight builds of older pushes to the branch are
+// cancelled.
+func (c *Coordinator) Observe(payload event.Push) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observe(payload)
+}
+
+func (c *Coordinator) observe(payload event.Push) {
+	branch := branchKey(payload)
+	pushedAt := payload.Repository.PushedAt
+	if latest, ok := c.latest[branch]; ok && pushedAt <= latest {
+		return
+	}
+	c.latest[branch] = pushedAt
+
+	for _, s := range c.running {
+		if s.branch == branch && !s.requested && s.pushedAt < pushedAt {
+			s.cancel()
+		}
+	}
+	c.broadcast()
+}
+
+// Superseded reports whether a newer push to the payload's branch has been seen.
+func (c *Coordinator) Superseded(payload event.Push) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.superseded(payload)
+}
+
+func (c *Coordinator) superseded(payload event.Push) bool {
+	return c.latest[branchKey(payload)] > payload.Repository.PushedAt
+}
+
+// Acquire waits until no other build of the branch is running for the
+// language, then claims it. It returns a context that is cancelled if
+// a newer push to the branch is seen, and a func to call once the build
+// is done. If the push is, or becomes while waiting, superseded it
+// returns build.ErrSuperseded. A build on request, told by ctx, is
+// neither observed nor superseded.
+func (c *Coordinator) Acquire(ctx context.Context, payload event.Push, language string) (context.Context, func(), error) {
+	key := fmt.Sprintf("%s %s", branchKey(payload), language)
+	requested := build.Requested(ctx)
+
+	c.mu.Lock()
+	if !requested {
+		c.observe(payload)
+	}
+	for {
+		if !requested && c.superseded(payload) {
+			c.mu.Unlock()
+			return nil, nil, build.ErrSuperseded
+		}
+		if _, busy := c.running[key]; !busy {
+			break
+		}
+
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-changed:
+		}
+		c.mu.Lock()
+	}
+
+	buildCtx, cancel := context.WithCancel(ctx)
+	c.running[key] = &slot{
+		branch:    branchKey(payload),
+		pushedAt:  payload.Repository.PushedAt,
+		requested: requested,
+		cancel:    cancel,
+	}
+	c.mu.Unlock()
+
+	release := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		cancel()
+		delete(c.running, key)
+		c.broadcast()
+	}
+	return buildCtx, release, nil
+}
+
+// broadcast wakes everything waiting on changed. It must be called
+// with mu held.
+func (c *Coordinator) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func branchKey(payload event.Push) string {
+	return fmt.Sprintf("%s %s", payload.Repository.FullName, payload.Ref)
+}
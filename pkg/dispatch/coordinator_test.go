@@ -0,0 +1,152 @@
+package dispatch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/event"
+)
+
+func pushAt(ref string, pushedAt int64) event.Push {
+	var payload event.Push
+	payload.Ref = ref
+	payload.Repository.FullName = "org/protos"
+	payload.Repository.PushedAt = pushedAt
+	return payload
+}
+
+func Test_Coordinator_OneBuildPerBranchAndLanguage(t *testing.T) {
+	c := NewCoordinator()
+	push := pushAt("refs/heads/master", 1)
+
+	_, release, err := c.Acquire(context.Background(), push, "npm")
+	assert.Nil(t, err)
+
+	// another language of the branch, or another branch, is not held up
+	_, releaseRuby, err := c.Acquire(context.Background(), push, "ruby")
+	assert.Nil(t, err)
+	releaseRuby()
+	_, releaseOther, err := c.Acquire(context.Background(), pushAt("refs/heads/feature", 1), "npm")
+	assert.Nil(t, err)
+	releaseOther()
+
+	acquired := make(chan struct{})
+	go func() {
+		_, release, err := c.Acquire(context.Background(), push, "npm")
+		assert.Nil(t, err)
+		release()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("a second build of the branch and language ran at the same time")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting build never ran")
+	}
+}
+
+func Test_Coordinator_NewerPushSupersedes(t *testing.T) {
+	c := NewCoordinator()
+	older := pushAt("refs/heads/master", 1)
+
+	ctx, release, err := c.Acquire(context.Background(), older, "npm")
+	assert.Nil(t, err)
+	defer release()
+
+	// a build of the same push waiting for its turn
+	waiting := make(chan error)
+	go func() {
+		_, _, err := c.Acquire(context.Background(), older, "npm")
+		waiting <- err
+	}()
+
+	c.Observe(pushAt("refs/heads/master", 2))
+	assert.True(t, c.Superseded(older))
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the in-flight build of the older push was not cancelled")
+	}
+	select {
+	case err := <-waiting:
+		assert.Equal(t, build.ErrSuperseded, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting build of the older push was not skipped")
+	}
+
+	_, _, err = c.Acquire(context.Background(), older, "ruby")
+	assert.Equal(t, build.ErrSuperseded, err)
+
+	// pushes to other branches are unaffected
+	assert.False(t, c.Superseded(pushAt("refs/heads/feature", 1)))
+}
+
+func Test_Coordinator_RequestedBuildsDoNotSupersede(t *testing.T) {
+	c := NewCoordinator()
+	head := pushAt("refs/heads/master", 2)
+
+	ctx, release, err := c.Acquire(context.Background(), head, "npm")
+	assert.Nil(t, err)
+
+	// a build on request of an older commit, made after the head was
+	// pushed, waits for its turn without cancelling the head
+	requested := build.WithRequested(context.Background())
+	backfill := pushAt("refs/heads/master", 3)
+	acquired := make(chan error)
+	go func() {
+		_, release, err := c.Acquire(requested, backfill, "npm")
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the build on request ran alongside the build of the head")
+	case <-ctx.Done():
+		t.Fatal("the build on request cancelled the build of the head")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// and the head, pushed before the build on request was made, is
+	// still not superseded
+	assert.False(t, c.Superseded(head))
+	release()
+	select {
+	case err := <-acquired:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the build on request never ran")
+	}
+
+	// nor is a build on request superseded by a newer push
+	reqCtx, releaseReq, err := c.Acquire(requested, pushAt("refs/heads/master", 1), "ruby")
+	assert.Nil(t, err)
+	defer releaseReq()
+	c.Observe(pushAt("refs/heads/master", 4))
+	assert.Nil(t, reqCtx.Err())
+}
+
+func Test_Coordinator_AcquireHonoursContext(t *testing.T) {
+	c := NewCoordinator()
+	push := pushAt("refs/heads/master", 1)
+
+	_, release, err := c.Acquire(context.Background(), push, "npm")
+	assert.Nil(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = c.Acquire(ctx, push, "npm")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
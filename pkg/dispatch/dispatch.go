@@ -0,0 +1,384 @@
+// Package dispatch packages every configured language from a single
+// push. The pushed commit is cloned once, and the checkout is shared by
+// the language services, which run side by side. Each language reports
+// its own progress and result, and one failing does not stop the rest.
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/schema"
+)
+
+// gateStatus is the context of the commit status the breaking change
+// gate sets on the commits it checks.
+const gateStatus = "protofact/breaking-changes"
+
+type processor interface {
+	Process(ctx context.Context, src build.Source) error
+}
+
+type fs interface {
+	CreateUniqueTmpDir(parentPath string) (string, error)
+	DeleteDir(string) error
+}
+
+type repo interface {
+	CloneWithCheckout(ctx context.Context, tmpDir string, payload event.Push) error
+	CreateStatus(ctx context.Context, owner, repo, sha, state, statusContext, description, targetURL string) error
+}
+
+type coordinator interface {
+	Acquire(ctx context.Context, payload event.Push, language string) (context.Context, func(), error)
+	Superseded(payload event.Push) bool
+}
+
+type schemas interface {
+	Compare(ctx context.Context, src build.Source) (*schema.Report, error)
+	Gate(ctx context.Context, src build.Source) (bool, error)
+	Released(ctx context.Context, src build.Source) error
+}
+
+type counters interface {
+	AddPackagingErrors(labels prometheus.Labels, count float64)
+}
+
+type gauges interface {
+	AddActiveLanguageWorkers(labels prometheus.Labels, count float64)
+}
+
+type language struct {
+	name      string
+	processor processor
+	// slots holds a value for every build of the language running, it
+	// is nil if the number of them is not limited.
+	slots chan struct{}
+}
+
+// Dispatcher runs the language services registered with it against
+// one shared checkout of each push. It fulfills the processor interface
+// in package queue.
+type Dispatcher struct {
+	languages    []language
+	cloneTimeout time.Duration
+	fs           fs
+	repo         repo
+	coordinator  coordinator
+	schemas      schemas
+	logger       log.FieldLogger
+	tracer       opentracing.Tracer
+	metrics      counters
+	gauges       gauges
+}
+
+// New returns a pointer to a Dispatcher with no languages registered.
+// Builds are ordered per branch by the passed coordinator, and a clone
+// running longer than cloneTimeout is stopped, unless it is zero. The
+// schema of each push is compared with the last release by schemas
+// before any language runs.
+func New(fs fs, repo repo, coordinator coordinator, schemas schemas, cloneTimeout time.Duration, logger log.FieldLogger, metrics counters, gauges gauges, tracer opentracing.Tracer) *Dispatcher {
+	return &Dispatcher{
+		cloneTimeout: cloneTimeout,
+		fs:           fs,
+		repo:         repo,
+		coordinator:  coordinator,
+		schemas:      schemas,
+		logger:       logger,
+		tracer:       tracer,
+		metrics:      metrics,
+		gauges:       gauges,
+	}
+}
+
+// Register adds a language service to be run for every push.
+// Languages are reported in the order they are registered. At most
+// workers builds of the language run at the same time, across every
+// push, or any number of them if workers is 0.
+func (d *Dispatcher) Register(name string, p processor, workers int) {
+	l := language{name: name, processor: p}
+	if workers > 0 {
+		l.slots = make(chan struct{}, workers)
+	}
+	d.languages = append(d.languages, l)
+}
+
+// Process clones the pushed commit, compares its schema with the last
+// release, checks it against the breaking change gate, and runs every
+// registered language that has not already succeeded for this job
+// against the checkout, all at the same time. It waits for all of them,
+// and returns an error naming each language that failed. If a newer
+// push to the branch has been seen, it returns build.ErrSuperseded
+// instead of building.
+func (d *Dispatcher) Process(ctx context.Context, payload event.Push) error {
+	// this span is a child of the job's span, but since the languages run on
+	// their own it follows from that span so it will display correctly.
+	var spanOptions []opentracing.StartSpanOption
+	if parent := opentracing.SpanFromContext(ctx); parent != nil {
+		spanOptions = append(spanOptions, opentracing.FollowsFrom(parent.Context()))
+	}
+	span := d.tracer.StartSpan("dispatch", spanOptions...)
+	defer span.Finish()
+
+	ctx = opentracing.ContextWithSpan(ctx, span)
+
+	// a retried job only runs the languages that have not yet succeeded,
+	// so nothing is published twice, and a build started on request only
+	// runs the languages asked for
+	tracker := build.TrackerFrom(ctx)
+	var pending []language
+	for _, l := range d.languages {
+		if !build.LanguageWanted(ctx, l.name) || tracker.Done(l.name) {
+			continue
+		}
+		pending = append(pending, l)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// there is no point cloning a push that will not be built
+	if !build.Requested(ctx) && d.coordinator.Superseded(payload) {
+		return build.ErrSuperseded
+	}
+
+	// create a new directory holding the shared checkout which can be cleaned up at the end.
+	id := uuid.NewV4().String()
+	build.RecorderFrom(ctx).BuildID(id)
+	workDir := build.WorkDir(id)
+	err := os.MkdirAll(workDir, 0750)
+	if err != nil {
+		d.addErrors(pending, build.StageMkdir)
+		return build.StageFailed(build.StageMkdir, errors.WithStack(err))
+	}
+	defer d.cleanup(ctx, workDir)
+
+	// if we receive a signal that this goroutine should stop, do that
+	// since cleanup is deferred it will still execute after the return statement
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	finish := build.StartStage(ctx, build.StageClone)
+	cloneCtx, cancel := build.WithTimeout(ctx, build.StageClone, d.cloneTimeout)
+	dir, err := d.cloneCode(cloneCtx, workDir, payload)
+	cancel()
+	finish(err)
+	if err != nil {
+		d.addErrors(pending, build.ErrorType(build.StageClone, err))
+		return build.StageFailed(build.StageClone, errors.WithStack(err))
+	}
+
+	// the clone can take a while, so check again before handing it on
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	src := build.Source{
+		Payload: payload,
+		Dir:     dir,
+	}
+
+	// the schema is compared once for every language, which all version
+	// the commit from the same report
+	report, err := d.schemas.Compare(ctx, src)
+	if err != nil {
+		d.addErrors(pending, build.StageSchema)
+		return build.StageFailed(build.StageSchema, err)
+	}
+	if report != nil {
+		ctx = schema.WithReport(ctx, report)
+	}
+
+	// nothing is published if the gate refuses the release
+	gated, err := d.schemas.Gate(ctx, src)
+	if gated {
+		d.setGateStatus(ctx, payload, report, err)
+	}
+	if err != nil {
+		d.addErrors(pending, build.StageGate)
+		return build.StageFailed(build.StageGate, err)
+	}
+
+	out := &syncWriter{w: build.OutputFrom(ctx)}
+	errs := make([]error, len(pending))
+	var wg sync.WaitGroup
+	for i, l := range pending {
+		wg.Add(1)
+		go func(i int, l language) {
+			defer wg.Done()
+			errs[i] = d.run(ctx, tracker, l, src, out)
+		}(i, l)
+	}
+	wg.Wait()
+
+	var failed []string
+	var first error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		// a newer push will publish every language, so the rest of
+		// this push's failures do not matter
+		if build.IsSuperseded(err) {
+			return build.ErrSuperseded
+		}
+		if first == nil {
+			first = err
+		}
+		failed = append(failed, pending[i].name)
+	}
+	if first == nil {
+		// later pushes are compared with this one if it was a release,
+		// but the artifacts are out so this failing does not fail the job
+		if err := d.schemas.Released(ctx, src); err != nil {
+			d.logger.Errorf("%+v\n", err)
+		}
+		return nil
+	}
+	// wrapping the first failure keeps its stage for the job, the rest
+	// are reported on each language
+	return errors.Wrap(first, fmt.Sprintf("%s failed", strings.Join(failed, ", ")))
+}
+
+// run packages a single language, reporting its progress and output
+// under its own name. A panic in the language is recovered and returned
+// as its error so it cannot take the other languages down with it.
+func (d *Dispatcher) run(ctx context.Context, tracker build.Tracker, l language, src build.Source, w io.Writer) (err error) {
+	out := newPrefixWriter(w, l.name)
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("%s packaging panicked: %v\n%s", l.name, r, debug.Stack())
+		}
+		out.Close()
+		if err != nil && !build.IsSuperseded(err) {
+			d.logger.WithField("language", l.name).Errorf("%+v\n", err)
+		}
+		tracker.Finished(l.name, err)
+	}()
+
+	rec := tracker.Started(l.name)
+
+	// wait for any other build of the branch to finish, the context
+	// returned is cancelled if a newer push to the branch comes in
+	langCtx, release, err := d.coordinator.Acquire(ctx, src.Payload, l.name)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = d.process(langCtx, rec, l, src, out)
+	if err != nil && ctx.Err() == nil && langCtx.Err() != nil {
+		return build.ErrSuperseded
+	}
+	return err
+}
+
+// process waits for a free worker of the language, if their number is
+// limited, then runs the language's service.
+func (d *Dispatcher) process(ctx context.Context, rec build.Recorder, l language, src build.Source, out io.Writer) error {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			fmt.Fprintf(out, "waiting for one of the %d %s workers to be free\n", cap(l.slots), l.name)
+			select {
+			case l.slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		defer func() {
+			<-l.slots
+		}()
+	}
+
+	labels := prometheus.Labels{"language": l.name}
+	d.gauges.AddActiveLanguageWorkers(labels, 1)
+	defer d.gauges.AddActiveLanguageWorkers(labels, -1)
+
+	ctx = build.WithRecorder(ctx, rec)
+	ctx = build.WithOutput(ctx, out)
+	return l.processor.Process(ctx, src)
+}
+
+func (d *Dispatcher) cloneCode(ctx context.Context, workDir string, payload event.Push) (string, error) {
+	// create tmp dir inside of the work directory so it gets cleaned up at the end
+	cloneDir, err := d.fs.CreateUniqueTmpDir(workDir)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create tmp directory for cloning")
+	}
+	// git clone the project
+	err = d.repo.CloneWithCheckout(ctx, cloneDir, payload)
+	if err != nil {
+		return "", errors.Wrap(err, "could not clone directory and checkout branch")
+	}
+
+	return cloneDir, nil
+}
+
+// setGateStatus reports the result of the breaking change gate as a
+// commit status on the pushed commit. Failing to set it is logged, as
+// it does not change the result of the build.
+func (d *Dispatcher) setGateStatus(ctx context.Context, payload event.Push, report *schema.Report, gateErr error) {
+	state := "success"
+	var description string
+	switch {
+	case gateErr != nil:
+		state = "failure"
+		breaking := 0
+		for _, c := range report.Changes {
+			if c.Level == schema.Breaking {
+				breaking++
+			}
+		}
+		description = fmt.Sprintf("%d breaking changes since %s, not released", breaking, report.BaseVersion)
+	case report.Base == "":
+		description = "first release, nothing to compare with"
+	case report.Level() == schema.Breaking:
+		description = fmt.Sprintf("breaking changes since %s allowed", report.BaseVersion)
+	default:
+		description = fmt.Sprintf("no breaking changes since %s", report.BaseVersion)
+	}
+
+	repo := payload.Repository
+	err := d.repo.CreateStatus(ctx, repo.Owner.Login, repo.Name, payload.After, state, gateStatus, description, "")
+	if err != nil {
+		d.logger.Errorf("%+v\n", err)
+	}
+}
+
+// addErrors counts a failure of a shared stage against every language
+// it stopped from running.
+func (d *Dispatcher) addErrors(languages []language, errorType string) {
+	for _, l := range languages {
+		d.metrics.AddPackagingErrors(prometheus.Labels{"language": l.name, "type": errorType}, 1)
+	}
+}
+
+// cleanup runs a fs.DeleteDir on the work directory holding the shared checkout.
+func (d *Dispatcher) cleanup(ctx context.Context, workDir string) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "cleanup")
+	defer span.Finish()
+
+	err := d.fs.DeleteDir(workDir)
+	if err != nil {
+		d.logger.Errorf("%+v\n", err)
+	}
+}
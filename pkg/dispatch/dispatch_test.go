@@ -0,0 +1,380 @@
+package dispatch
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/filesys"
+	"github.com/gospotcheck/protofact/pkg/schema"
+)
+
+type fakeRepo struct {
+	mu     sync.Mutex
+	clones int
+	err    error
+	// hang makes the clone wait until its context is done
+	hang bool
+	// statuses are the commit statuses set, as state: description
+	statuses []string
+}
+
+func (f *fakeRepo) CloneWithCheckout(ctx context.Context, tmpDir string, payload event.Push) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.clones++
+	if f.err != nil {
+		return f.err
+	}
+	if f.hang {
+		<-ctx.Done()
+		return build.TimedOut(ctx, ctx.Err())
+	}
+	return ioutil.WriteFile(filepath.Join(tmpDir, "README.md"), []byte("protos"), 0640)
+}
+
+func (f *fakeRepo) CreateStatus(ctx context.Context, owner, repo, sha, state, statusContext, description, targetURL string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses = append(f.statuses, state+": "+description)
+	return nil
+}
+
+type nopCounters struct{}
+
+func (nopCounters) AddPackagingErrors(prometheus.Labels, float64) {}
+
+type nopGauges struct{}
+
+func (nopGauges) AddActiveLanguageWorkers(prometheus.Labels, float64) {}
+
+type fakeProcessor struct {
+	name  string
+	err   error
+	panic bool
+	mu    sync.Mutex
+	calls int
+	read  string
+}
+
+func (f *fakeProcessor) Process(ctx context.Context, src build.Source) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+
+	content, err := ioutil.ReadFile(filepath.Join(src.Dir, "README.md"))
+	if err != nil {
+		return err
+	}
+	f.read = string(content)
+	build.OutputFrom(ctx).Write([]byte(f.name + " output\n"))
+
+	if f.panic {
+		panic("boom")
+	}
+	return f.err
+}
+
+type fakeTracker struct {
+	mu       sync.Mutex
+	done     map[string]bool
+	finished map[string]error
+}
+
+func newFakeTracker(done ...string) *fakeTracker {
+	t := &fakeTracker{done: map[string]bool{}, finished: map[string]error{}}
+	for _, d := range done {
+		t.done[d] = true
+	}
+	return t
+}
+
+func (f *fakeTracker) Done(language string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.done[language]
+}
+
+func (f *fakeTracker) Started(language string) build.Recorder {
+	return build.RecorderFrom(context.Background())
+}
+
+func (f *fakeTracker) Finished(language string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.finished[language] = err
+}
+
+// fakeSchemas counts its releases under mu, as every language worker
+// reports its release.
+type fakeSchemas struct {
+	mu       sync.Mutex
+	report   *schema.Report
+	err      error
+	gated    bool
+	gateErr  error
+	released int
+}
+
+func (f *fakeSchemas) Compare(ctx context.Context, src build.Source) (*schema.Report, error) {
+	return f.report, f.err
+}
+
+func (f *fakeSchemas) Gate(ctx context.Context, src build.Source) (bool, error) {
+	return f.gated, f.gateErr
+}
+
+func (f *fakeSchemas) Released(ctx context.Context, src build.Source) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.released++
+	return nil
+}
+
+func newTestDispatcher(repo *fakeRepo, processors ...*fakeProcessor) *Dispatcher {
+	d := New(&filesys.FS{}, repo, NewCoordinator(), &fakeSchemas{}, 0, log.WithField("test", "dispatch"), nopCounters{}, nopGauges{}, opentracing.NoopTracer{})
+	for _, p := range processors {
+		d.Register(p.name, p, 0)
+	}
+	return d
+}
+
+func Test_Process_SharesOneClone(t *testing.T) {
+	repo := &fakeRepo{}
+	npm := &fakeProcessor{name: "npm"}
+	ruby := &fakeProcessor{name: "ruby"}
+	d := newTestDispatcher(repo, npm, ruby)
+
+	var out bytes.Buffer
+	tracker := newFakeTracker()
+	ctx := build.WithOutput(build.WithTracker(context.Background(), tracker), &out)
+	err := d.Process(ctx, event.Push{})
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, repo.clones)
+	assert.Equal(t, "protos", npm.read)
+	assert.Equal(t, "protos", ruby.read)
+	assert.Contains(t, out.String(), "[npm] npm output\n")
+	assert.Contains(t, out.String(), "[ruby] ruby output\n")
+	assert.Equal(t, map[string]error{"npm": nil, "ruby": nil}, tracker.finished)
+}
+
+func Test_Process_IsolatesFailures(t *testing.T) {
+	npm := &fakeProcessor{name: "npm", err: build.StageFailed(build.StagePublish, errors.New("registry unavailable"))}
+	ruby := &fakeProcessor{name: "ruby"}
+	scala := &fakeProcessor{name: "scala", panic: true}
+	d := newTestDispatcher(&fakeRepo{}, npm, ruby, scala)
+
+	tracker := newFakeTracker()
+	err := d.Process(build.WithTracker(context.Background(), tracker), event.Push{})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "npm, scala failed")
+	assert.Equal(t, build.StagePublish, build.FailedStage(err))
+
+	assert.Equal(t, 1, ruby.calls)
+	assert.Nil(t, tracker.finished["ruby"])
+	assert.NotNil(t, tracker.finished["npm"])
+	assert.Contains(t, tracker.finished["scala"].Error(), "panicked: boom")
+}
+
+func Test_Process_SkipsDoneLanguages(t *testing.T) {
+	npm := &fakeProcessor{name: "npm"}
+	ruby := &fakeProcessor{name: "ruby"}
+	d := newTestDispatcher(&fakeRepo{}, npm, ruby)
+
+	err := d.Process(build.WithTracker(context.Background(), newFakeTracker("npm")), event.Push{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, npm.calls)
+	assert.Equal(t, 1, ruby.calls)
+
+	repo := &fakeRepo{}
+	d = newTestDispatcher(repo, npm)
+	err = d.Process(build.WithTracker(context.Background(), newFakeTracker("npm")), event.Push{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, repo.clones)
+}
+
+func Test_Process_OnlyWantedLanguages(t *testing.T) {
+	npm := &fakeProcessor{name: "npm"}
+	ruby := &fakeProcessor{name: "ruby"}
+	d := newTestDispatcher(&fakeRepo{}, npm, ruby)
+
+	ctx := build.WithLanguages(context.Background(), []string{"ruby"})
+	err := d.Process(ctx, event.Push{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, npm.calls)
+	assert.Equal(t, 1, ruby.calls)
+}
+
+func Test_Process_CloneFailure(t *testing.T) {
+	npm := &fakeProcessor{name: "npm"}
+	d := newTestDispatcher(&fakeRepo{err: errors.New("no such repo")}, npm)
+
+	err := d.Process(context.Background(), event.Push{})
+	assert.Equal(t, build.StageClone, build.FailedStage(err))
+	assert.Equal(t, 0, npm.calls)
+}
+
+func Test_Process_Schema(t *testing.T) {
+	var seen *schema.Report
+	report := &schema.Report{Base: "aaa", BaseVersion: "1.0.1"}
+	schemas := &fakeSchemas{report: report}
+	d := New(&filesys.FS{}, &fakeRepo{}, NewCoordinator(), schemas, 0, log.WithField("test", "dispatch"), nopCounters{}, nopGauges{}, opentracing.NoopTracer{})
+	d.Register("npm", processorFunc(func(ctx context.Context, src build.Source) error {
+		seen = schema.ReportFrom(ctx)
+		return nil
+	}), 0)
+
+	err := d.Process(context.Background(), event.Push{})
+	assert.Nil(t, err)
+	assert.Equal(t, report, seen)
+	assert.Equal(t, 1, schemas.released)
+
+	npm := &fakeProcessor{name: "npm", err: errors.New("publish failed")}
+	schemas = &fakeSchemas{}
+	d = New(&filesys.FS{}, &fakeRepo{}, NewCoordinator(), schemas, 0, log.WithField("test", "dispatch"), nopCounters{}, nopGauges{}, opentracing.NoopTracer{})
+	d.Register(npm.name, npm, 0)
+	assert.NotNil(t, d.Process(context.Background(), event.Push{}))
+	assert.Equal(t, 0, schemas.released)
+
+	npm = &fakeProcessor{name: "npm"}
+	schemas = &fakeSchemas{err: errors.New("bad proto")}
+	d = New(&filesys.FS{}, &fakeRepo{}, NewCoordinator(), schemas, 0, log.WithField("test", "dispatch"), nopCounters{}, nopGauges{}, opentracing.NoopTracer{})
+	d.Register(npm.name, npm, 0)
+	err = d.Process(context.Background(), event.Push{})
+	assert.Equal(t, build.StageSchema, build.FailedStage(err))
+	assert.Equal(t, 0, npm.calls)
+}
+
+func Test_Process_Gate(t *testing.T) {
+	report := &schema.Report{
+		Base:        "aaa",
+		BaseVersion: "1.0.1",
+		Changes:     []schema.Change{{Level: schema.Breaking, Description: "field demo.User.name (2) was removed"}},
+	}
+
+	repo := &fakeRepo{}
+	npm := &fakeProcessor{name: "npm"}
+	schemas := &fakeSchemas{report: report, gated: true, gateErr: build.Permanent(errors.New("breaking changes"))}
+	d := New(&filesys.FS{}, repo, NewCoordinator(), schemas, 0, log.WithField("test", "dispatch"), nopCounters{}, nopGauges{}, opentracing.NoopTracer{})
+	d.Register(npm.name, npm, 0)
+
+	err := d.Process(context.Background(), event.Push{})
+	assert.Equal(t, build.StageGate, build.FailedStage(err))
+	assert.True(t, build.IsPermanent(err))
+	assert.Equal(t, 0, npm.calls)
+	assert.Equal(t, []string{"failure: 1 breaking changes since 1.0.1, not released"}, repo.statuses)
+
+	repo = &fakeRepo{}
+	schemas = &fakeSchemas{report: report, gated: true}
+	d = New(&filesys.FS{}, repo, NewCoordinator(), schemas, 0, log.WithField("test", "dispatch"), nopCounters{}, nopGauges{}, opentracing.NoopTracer{})
+	d.Register(npm.name, npm, 0)
+
+	assert.Nil(t, d.Process(context.Background(), event.Push{}))
+	assert.Equal(t, 1, npm.calls)
+	assert.Equal(t, []string{"success: breaking changes since 1.0.1 allowed"}, repo.statuses)
+}
+
+type processorFunc func(ctx context.Context, src build.Source) error
+
+func (f processorFunc) Process(ctx context.Context, src build.Source) error {
+	return f(ctx, src)
+}
+
+func Test_Process_CloneTimeout(t *testing.T) {
+	npm := &fakeProcessor{name: "npm"}
+	d := New(&filesys.FS{}, &fakeRepo{hang: true}, NewCoordinator(), &fakeSchemas{}, 10*time.Millisecond, log.WithField("test", "dispatch"), nopCounters{}, nopGauges{}, opentracing.NoopTracer{})
+	d.Register(npm.name, npm, 0)
+
+	err := d.Process(context.Background(), event.Push{})
+	assert.Equal(t, build.StageClone, build.FailedStage(err))
+	assert.True(t, build.IsTimeout(err))
+	assert.Equal(t, 0, npm.calls)
+}
+
+func Test_Process_Superseded(t *testing.T) {
+	repo := &fakeRepo{}
+	npm := &fakeProcessor{name: "npm"}
+	coordinator := NewCoordinator()
+	d := New(&filesys.FS{}, repo, coordinator, &fakeSchemas{}, 0, log.WithField("test", "dispatch"), nopCounters{}, nopGauges{}, opentracing.NoopTracer{})
+	d.Register(npm.name, npm, 0)
+
+	older := event.Push{}
+	older.Ref = "refs/heads/master"
+	older.Repository.PushedAt = 1
+	newer := older
+	newer.Repository.PushedAt = 2
+	coordinator.Observe(newer)
+
+	err := d.Process(context.Background(), older)
+	assert.True(t, build.IsSuperseded(err))
+	assert.Equal(t, 0, repo.clones)
+	assert.Equal(t, 0, npm.calls)
+}
+
+// concurrentProcessor records the most builds it has had running at once.
+type concurrentProcessor struct {
+	mu      sync.Mutex
+	running int
+	most    int
+}
+
+func (c *concurrentProcessor) Process(ctx context.Context, src build.Source) error {
+	c.mu.Lock()
+	c.running++
+	if c.running > c.most {
+		c.most = c.running
+	}
+	c.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	c.mu.Lock()
+	c.running--
+	c.mu.Unlock()
+	return nil
+}
+
+func Test_Process_LimitsLanguageWorkers(t *testing.T) {
+	scala := &concurrentProcessor{}
+	d := New(&filesys.FS{}, &fakeRepo{}, NewCoordinator(), &fakeSchemas{}, 0, log.WithField("test", "dispatch"), nopCounters{}, nopGauges{}, opentracing.NoopTracer{})
+	d.Register("scala", scala, 1)
+
+	// pushes to different branches would otherwise build side by side
+	var wg sync.WaitGroup
+	for _, ref := range []string{"refs/heads/a", "refs/heads/b", "refs/heads/c"} {
+		payload := event.Push{Ref: ref}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, d.Process(context.Background(), payload))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, scala.most)
+}
+
+func Test_PrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := newPrefixWriter(&out, "npm")
+
+	w.Write([]byte("first li"))
+	assert.Equal(t, "", out.String())
+	w.Write([]byte("ne\nsecond line\nlast"))
+	assert.Equal(t, "[npm] first line\n[npm] second line\n", out.String())
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "[npm] first line\n[npm] second line\n[npm] last\n", out.String())
+}
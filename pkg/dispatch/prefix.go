@@ -0,0 +1,70 @@
+package dispatch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// prefixWriter starts every line written to it with the name of a
+// language, so the output of languages running at the same time can be
+// told apart in the job's log. Lines are held until they are complete
+// so they are not interleaved mid-line with another language.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    bytes.Buffer
+}
+
+func newPrefixWriter(w io.Writer, name string) *prefixWriter {
+	return &prefixWriter{
+		w:      w,
+		prefix: []byte(fmt.Sprintf("[%s] ", name)),
+	}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf.Write(b)
+	for {
+		i := bytes.IndexByte(p.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		line := append(append([]byte{}, p.prefix...), p.buf.Next(i+1)...)
+		if _, err := p.w.Write(line); err != nil {
+			return len(b), err
+		}
+	}
+}
+
+// Close writes out any final line that did not end in a newline.
+func (p *prefixWriter) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.buf.Len() == 0 {
+		return nil
+	}
+	line := append(append([]byte{}, p.prefix...), p.buf.Bytes()...)
+	p.buf.Reset()
+	_, err := p.w.Write(append(line, '\n'))
+	return err
+}
+
+// syncWriter serializes writes to a writer shared by the prefixWriters
+// of languages running at the same time.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(b)
+}
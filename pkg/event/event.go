@@ -0,0 +1,96 @@
+// Package event holds the push event every packager consumes, whichever
+// git host the push was made to. The webhook of each host is mapped
+// onto it, so a push to any of them produces the same artifacts.
+package event
+
+import (
+	"fmt"
+	"time"
+)
+
+// The git hosts a push can come from.
+const (
+	Github          = "github"
+	Gitlab          = "gitlab"
+	Bitbucket       = "bitbucket"
+	BitbucketServer = "bitbucket-server"
+	Gitea           = "gitea"
+)
+
+// Push is a push of a commit to a ref of a repository. Its fields, and
+// their JSON, follow the push event Github sends, which jobs persisted
+// before other hosts were supported still hold.
+type Push struct {
+	// Provider is the git host the push was made to. It is Github when
+	// empty.
+	Provider string `json:"provider,omitempty"`
+	// Ref is the pushed ref, such as refs/heads/master.
+	Ref string `json:"ref"`
+	// Before is the commit the ref pointed to before the push.
+	Before string `json:"before,omitempty"`
+	// After is the pushed commit, which is packaged.
+	After string `json:"after"`
+	// Deleted is set when the push deleted the ref.
+	Deleted    bool       `json:"deleted,omitempty"`
+	HeadCommit Commit     `json:"head_commit"`
+	Pusher     Pusher     `json:"pusher"`
+	Repository Repository `json:"repository"`
+}
+
+// Commit is the pushed commit.
+type Commit struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+// Pusher is who made the push.
+type Pusher struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Repository is the repository pushed to.
+type Repository struct {
+	// Name is the name of the repository, such as protos.
+	Name string `json:"name"`
+	// FullName is the path of the repository on its host, such as
+	// org/protos, group/subgroup/protos on Gitlab or PROJECT/protos on
+	// Bitbucket Server.
+	FullName string `json:"full_name"`
+	// Owner is the account or group the repository belongs to.
+	Owner         Owner  `json:"owner"`
+	HTMLURL       string `json:"html_url"`
+	CloneURL      string `json:"clone_url"`
+	DefaultBranch string `json:"default_branch,omitempty"`
+	// PushedAt is the time of the push in seconds since the epoch.
+	PushedAt int64 `json:"pushed_at"`
+}
+
+// Owner is the account or group a repository belongs to.
+type Owner struct {
+	Login string `json:"login"`
+}
+
+// Github reports whether the push was made to Github, which reporting
+// back on it and releasing it through the Github API need.
+func (p Push) Github() bool {
+	return p.Provider == "" || p.Provider == Github
+}
+
+// GithubPush returns the push event a push of sha to ref of a Github
+// repository would have sent, holding everything packaging reads from
+// one. It is pushed at the passed time, which its versions are made
+// from.
+func GithubPush(owner, name, ref, sha string, pushedAt time.Time) Push {
+	var payload Push
+	payload.Ref = ref
+	payload.After = sha
+	payload.HeadCommit.ID = sha
+	payload.Repository.Name = name
+	payload.Repository.FullName = fmt.Sprintf("%s/%s", owner, name)
+	payload.Repository.Owner.Login = owner
+	payload.Repository.HTMLURL = fmt.Sprintf("https://github.com/%s/%s", owner, name)
+	payload.Repository.CloneURL = fmt.Sprintf("https://github.com/%s/%s.git", owner, name)
+	payload.Repository.PushedAt = pushedAt.Unix()
+	return payload
+}
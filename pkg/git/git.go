@@ -7,30 +7,60 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	g "github.com/gogits/git-module"
 	"github.com/google/go-github/v32/github"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
-	hooks "gopkg.in/go-playground/webhooks.v5/github"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/event"
 )
 
+// TagMessage is the message of every tag Protofact creates, which tells
+// them apart from the tags people push.
+const TagMessage = "Automated tag by Protofact."
+
+// committer is the name Protofact commits and tags as.
+const committer = "protofact"
+
 // Config represents the inputs needed to set up a Repo.
 type Config struct {
 	Username string
 	Token    string
 	Email    string
+	// APIURL is the base URL of the Github API, for Github Enterprise or
+	// a fake API in tests. It is https://api.github.com/ by default.
+	APIURL string
+	// GitlabToken is an access token with read_repository and
+	// write_repository scopes, used to clone and push to Gitlab repositories.
+	GitlabToken string
+	// Bitbucket, BitbucketServer and Gitea are the credentials repositories
+	// on each of them are cloned with.
+	Bitbucket       Credentials
+	BitbucketServer Credentials
+	Gitea           Credentials
+}
+
+// Credentials are a username and a token, or app password, used in place
+// of its password over https.
+type Credentials struct {
+	Username string
+	Token    string
 }
 
 // Repo represents a git repository, which receives convenience methods
 // for retrieving code.
 type Repo struct {
-	username string
-	token    string
-	email    string
-	logger   *log.Entry
-	client   *github.Client
+	username    string
+	token       string
+	gitlabToken string
+	credentials map[string]Credentials
+	email       string
+	logger      *log.Entry
+	client      *github.Client
 }
 
 // New creates a Repo struct using a Config struct.
@@ -40,13 +70,28 @@ func New(ctx context.Context, c Config, logger *log.Entry) *Repo {
 	)
 	tc := oauth2.NewClient(ctx, ts)
 	client := github.NewClient(tc)
+	if c.APIURL != "" {
+		// the client resolves paths against the base URL, which needs a trailing slash
+		baseURL, err := url.Parse(strings.TrimSuffix(c.APIURL, "/") + "/")
+		if err != nil {
+			logger.Errorf("%+v\n", errors.Wrap(err, fmt.Sprintf("could not parse Github API url %s, using the default", c.APIURL)))
+		} else {
+			client.BaseURL = baseURL
+		}
+	}
 
 	return &Repo{
-		username: c.Username,
-		token:    c.Token,
-		logger:   logger,
-		client:   client,
-		email:    c.Email,
+		username:    c.Username,
+		token:       c.Token,
+		gitlabToken: c.GitlabToken,
+		logger:      logger,
+		client:      client,
+		email:       c.Email,
+		credentials: map[string]Credentials{
+			event.Bitbucket:       c.Bitbucket,
+			event.BitbucketServer: c.BitbucketServer,
+			event.Gitea:           c.Gitea,
+		},
 	}
 }
 
@@ -60,7 +105,7 @@ func (r *Repo) SetGitConfig() error {
 		return errors.Wrap(err, errMessage)
 	}
 
-	nameCmd := exec.Command("git", "config", "--global", "user.name", "protofact")
+	nameCmd := exec.Command("git", "config", "--global", "user.name", committer)
 	out, err = nameCmd.CombinedOutput()
 	r.logger.Debug(fmt.Sprintf("%s", out))
 	if err != nil {
@@ -71,30 +116,99 @@ func (r *Repo) SetGitConfig() error {
 	return nil
 }
 
-// CloneWithCheckout uses a github Push Event payload to clone down a repository
-// and immediately checkout HEAD on the branch that caused that Push Event.
-func (r *Repo) CloneWithCheckout(tmpDir string, payload hooks.PushPayload) error {
+// CloneWithCheckout uses a Push Event payload to clone down a repository
+// and checkout the exact commit that caused that Push Event. The branch may
+// have moved on since the push, so its HEAD is not used. The git commands are
+// killed if ctx is done before they finish.
+func (r *Repo) CloneWithCheckout(ctx context.Context, tmpDir string, payload event.Push) error {
+	if payload.After == "" {
+		return errors.New("push event has no commit sha to checkout")
+	}
 	branch := g.RefEndName(payload.Ref)
-	url, err := r.CreateAuthenticatedURL(payload.Repository.CloneURL)
+	url, err := r.cloneURL(payload)
 	if err != nil {
 		return errors.Wrap(err, "could not create authenticated url")
 	}
-	err = g.Clone(url, tmpDir, g.CloneRepoOptions{Branch: branch})
+	// a build of a commit on request may not name a branch, in which case
+	// the default branch is cloned and the commit fetched if need be
+	args := []string{"clone"}
+	if strings.HasPrefix(payload.Ref, "refs/heads/") {
+		args = append(args, "--branch", branch)
+	}
+	cloneCmd := exec.CommandContext(ctx, "git", append(args, url, tmpDir)...)
+	out, err := build.CombinedOutput(ctx, cloneCmd)
+	r.logger.Debug(fmt.Sprintf("%s", out))
 	if err != nil {
 		errMsg := fmt.Sprintf("could not clone repo %s on branch %s to temp dir %s", payload.Repository.CloneURL, payload.Ref, tmpDir)
 		return errors.Wrap(err, errMsg)
 	}
-	r.logger.Debug(fmt.Sprintf("successfully cloned %s to temp dir %s", url, tmpDir))
+
+	err = r.checkout(ctx, tmpDir, payload.After)
+	if err != nil {
+		// the commit is no longer in the branch's history, such as after
+		// a force push, so fetch it on its own before trying again. The
+		// head of a pull request is not on any branch, and is fetched
+		// from its ref.
+		target := payload.After
+		if strings.HasPrefix(payload.Ref, "refs/pull/") {
+			target = payload.Ref
+		}
+		fetchCmd := exec.CommandContext(ctx, "git", "fetch", "origin", target)
+		fetchCmd.Dir = tmpDir
+		out, fetchErr := build.CombinedOutput(ctx, fetchCmd)
+		r.logger.Debug(fmt.Sprintf("%s", out))
+		if fetchErr != nil {
+			errMsg := fmt.Sprintf("could not checkout or fetch commit %s: %s", payload.After, out)
+			return errors.Wrap(fetchErr, errMsg)
+		}
+		err = r.checkout(ctx, tmpDir, payload.After)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("could not checkout commit %s", payload.After))
+		}
+	}
+	r.logger.Debug(fmt.Sprintf("successfully cloned %s at %s to temp dir %s", payload.Repository.CloneURL, payload.After, tmpDir))
+	return nil
+}
+
+func (r *Repo) checkout(ctx context.Context, dir, sha string) error {
+	checkoutCmd := exec.CommandContext(ctx, "git", "checkout", "-q", sha)
+	checkoutCmd.Dir = dir
+	out, err := build.CombinedOutput(ctx, checkoutCmd)
+	r.logger.Debug(fmt.Sprintf("%s", out))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error checking out %s: %s\n", sha, out))
+	}
 	return nil
 }
 
+// cloneURL returns the clone url of the pushed repository with the
+// credentials of its provider.
+func (r *Repo) cloneURL(payload event.Push) (string, error) {
+	switch payload.Provider {
+	case event.Gitlab:
+		// Gitlab takes any username along with an access token
+		return authenticatedURL(payload.Repository.CloneURL, "oauth2", r.gitlabToken)
+	case event.Bitbucket, event.BitbucketServer, event.Gitea:
+		c := r.credentials[payload.Provider]
+		return authenticatedURL(payload.Repository.CloneURL, c.Username, c.Token)
+	}
+	return r.CreateAuthenticatedURL(payload.Repository.CloneURL)
+}
+
 // CreateAuthenticatedURL adds the username and password from the instantiation of
 // the Repo to use https authentication on all calls to the origin.
 func (r *Repo) CreateAuthenticatedURL(cloneURL string) (string, error) {
+	return authenticatedURL(cloneURL, r.username, r.token)
+}
+
+func authenticatedURL(cloneURL, username, token string) (string, error) {
 	splitURL := strings.Split(cloneURL, "://")
+	if len(splitURL) != 2 {
+		return "", errors.Errorf("clone url %s has no scheme", cloneURL)
+	}
 	// passwords often have characters that need escaping in them
-	p := url.QueryEscape(r.token)
-	authURL := fmt.Sprintf("%s://%s:%s@%s", splitURL[0], r.username, p, splitURL[1])
+	p := url.QueryEscape(token)
+	authURL := fmt.Sprintf("%s://%s:%s@%s", splitURL[0], username, p, splitURL[1])
 	parsedURL, err := url.Parse(authURL)
 	if err != nil {
 		return "", errors.Wrap(err, "clone url was not valid")
@@ -113,11 +227,174 @@ func (r *Repo) CreateRelease(ctx context.Context, owner, repo string, rel *githu
 	return rel, nil
 }
 
+// ResolveRef returns the SHA of the commit a ref, such as a branch,
+// points to in a Github repository.
+func (r *Repo) ResolveRef(ctx context.Context, owner, repo, ref string) (string, error) {
+	sha, _, err := r.client.Repositories.GetCommitSHA1(ctx, owner, repo, ref, "")
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("could not resolve %s in %s/%s", ref, owner, repo))
+	}
+	return sha, nil
+}
+
+// CreateStatus sets a commit status, named by statusContext, on a commit
+// of a Github repository. State is one of pending, success, failure or
+// error, and targetURL, if not empty, is linked from the status.
+func (r *Repo) CreateStatus(ctx context.Context, owner, repo, sha, state, statusContext, description, targetURL string) error {
+	status := &github.RepoStatus{
+		State:       &state,
+		Context:     &statusContext,
+		Description: &description,
+	}
+	if targetURL != "" {
+		status.TargetURL = &targetURL
+	}
+	_, _, err := r.client.Repositories.CreateStatus(ctx, owner, repo, sha, status)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not set status %s on %s in %s/%s", statusContext, sha, owner, repo))
+	}
+	return nil
+}
+
+// CreateCheckRun creates a check run on a commit of a Github repository
+// and returns its id.
+func (r *Repo) CreateCheckRun(ctx context.Context, owner, repo string, opts github.CreateCheckRunOptions) (int64, error) {
+	run, _, err := r.client.Checks.CreateCheckRun(ctx, owner, repo, opts)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("could not create check run %s on %s in %s/%s", opts.Name, opts.HeadSHA, owner, repo))
+	}
+	return run.GetID(), nil
+}
+
+// UpdateCheckRun updates a check run of a Github repository.
+func (r *Repo) UpdateCheckRun(ctx context.Context, owner, repo string, id int64, opts github.UpdateCheckRunOptions) error {
+	_, _, err := r.client.Checks.UpdateCheckRun(ctx, owner, repo, id, opts)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not update check run %d in %s/%s", id, owner, repo))
+	}
+	return nil
+}
+
+// ListCommits returns the commits of a branch of a Github repository
+// made since a time, newest first.
+func (r *Repo) ListCommits(ctx context.Context, owner, repo, branch string, since time.Time) ([]*github.RepositoryCommit, error) {
+	var commits []*github.RepositoryCommit
+	opts := &github.CommitsListOptions{SHA: branch, Since: since, ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := r.client.Repositories.ListCommits(ctx, owner, repo, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("could not list the commits of %s in %s/%s", branch, owner, repo))
+		}
+		commits = append(commits, page...)
+		if resp.NextPage == 0 {
+			return commits, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// ListStatuses returns the latest commit status of each context on a
+// commit of a Github repository.
+func (r *Repo) ListStatuses(ctx context.Context, owner, repo, sha string) ([]*github.RepoStatus, error) {
+	var statuses []*github.RepoStatus
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		combined, resp, err := r.client.Repositories.GetCombinedStatus(ctx, owner, repo, sha, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("could not get the statuses of %s in %s/%s", sha, owner, repo))
+		}
+		statuses = append(statuses, combined.Statuses...)
+		if resp.NextPage == 0 {
+			return statuses, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// ListCheckRuns returns the latest check run of each name on a commit
+// of a Github repository.
+func (r *Repo) ListCheckRuns(ctx context.Context, owner, repo, sha string) ([]*github.CheckRun, error) {
+	var runs []*github.CheckRun
+	latest := "latest"
+	opts := &github.ListCheckRunsOptions{Filter: &latest, ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := r.client.Checks.ListCheckRunsForRef(ctx, owner, repo, sha, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("could not list the check runs of %s in %s/%s", sha, owner, repo))
+		}
+		runs = append(runs, page.CheckRuns...)
+		if resp.NextPage == 0 {
+			return runs, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// ListIssueComments returns every comment on an issue or pull request
+// of a Github repository.
+func (r *Repo) ListIssueComments(ctx context.Context, owner, repo string, number int) ([]*github.IssueComment, error) {
+	var comments []*github.IssueComment
+	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := r.client.Issues.ListComments(ctx, owner, repo, number, opts)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("could not list comments on #%d in %s/%s", number, owner, repo))
+		}
+		comments = append(comments, page...)
+		if resp.NextPage == 0 {
+			return comments, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// CreateIssueComment comments on an issue or pull request of a Github
+// repository.
+func (r *Repo) CreateIssueComment(ctx context.Context, owner, repo string, number int, body string) error {
+	_, _, err := r.client.Issues.CreateComment(ctx, owner, repo, number, &github.IssueComment{Body: &body})
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not comment on #%d in %s/%s", number, owner, repo))
+	}
+	return nil
+}
+
+// EditIssueComment replaces the body of a comment on an issue or pull
+// request of a Github repository.
+func (r *Repo) EditIssueComment(ctx context.Context, owner, repo string, id int64, body string) error {
+	_, _, err := r.client.Issues.EditComment(ctx, owner, repo, id, &github.IssueComment{Body: &body})
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not edit comment %d in %s/%s", id, owner, repo))
+	}
+	return nil
+}
+
+// CreatedTag reports whether a tag of a Github repository was created
+// by Protofact, going by the tagger and message of the tag. A
+// lightweight tag has neither, and so was always pushed by someone else.
+func (r *Repo) CreatedTag(ctx context.Context, owner, repo, tag string) (bool, error) {
+	ref, _, err := r.client.Git.GetRef(ctx, owner, repo, fmt.Sprintf("tags/%s", tag))
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("could not find tag %s in %s/%s", tag, owner, repo))
+	}
+	if ref.GetObject().GetType() != "tag" {
+		return false, nil
+	}
+	annotated, _, err := r.client.Git.GetTag(ctx, owner, repo, ref.GetObject().GetSHA())
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("could not read tag %s in %s/%s", tag, owner, repo))
+	}
+	tagger := annotated.GetTagger()
+	if tagger.GetName() == committer && tagger.GetEmail() == r.email {
+		return true, nil
+	}
+	return strings.TrimSpace(annotated.GetMessage()) == TagMessage, nil
+}
+
 // CreateTag makes an annotated git tag on a repo.
-func (r Repo) CreateTag(dir, version, msg string) error {
-	tagCmd := exec.Command("git", "tag", "-a", version, "-m", msg)
+func (r Repo) CreateTag(ctx context.Context, dir, version, msg string) error {
+	tagCmd := exec.CommandContext(ctx, "git", "tag", "-a", version, "-m", msg)
 	tagCmd.Dir = dir
-	out, err := tagCmd.CombinedOutput()
+	out, err := build.CombinedOutput(ctx, tagCmd)
 	r.logger.Debug(fmt.Sprintf("%s", out))
 	if err != nil {
 		errMessage := fmt.Sprintf("error tagging git repo: %s\n", out)
@@ -127,14 +404,34 @@ func (r Repo) CreateTag(dir, version, msg string) error {
 	return nil
 }
 
-// PushTags pushes a repo with no other changes but tags up to the origin.
-func (r Repo) PushTags(dir string) error {
-	pushCmd := exec.Command("git", "push", "--follow-tags")
+// TagCommit returns the commit a tag of a repo points to, and false if
+// the repo has no such tag. A clone has the tags of its origin, so a tag
+// pushed by an earlier attempt is found in the clone of a retry.
+func (r Repo) TagCommit(ctx context.Context, dir, tag string) (string, bool, error) {
+	revParseCmd := exec.CommandContext(ctx, "git", "rev-parse", "-q", "--verify", fmt.Sprintf("refs/tags/%s^{commit}", tag))
+	revParseCmd.Dir = dir
+	out, err := build.CombinedOutput(ctx, revParseCmd)
+	r.logger.Debug(fmt.Sprintf("%s", out))
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 && strings.TrimSpace(string(out)) == "" {
+		// --verify -q exits quietly with 1 for a ref that does not exist
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, errors.Wrap(err, fmt.Sprintf("error looking up git tag %s: %s\n", tag, out))
+	}
+	return strings.TrimSpace(string(out)), true, nil
+}
+
+// PushTag pushes a tag of a repo up to the origin. The tag is pushed by
+// its ref, as the clone has the pushed commit checked out rather than a
+// branch git could follow tags from.
+func (r Repo) PushTag(ctx context.Context, dir, tag string) error {
+	pushCmd := exec.CommandContext(ctx, "git", "push", "origin", fmt.Sprintf("refs/tags/%s", tag))
 	pushCmd.Dir = dir
-	out, err := pushCmd.CombinedOutput()
+	out, err := build.CombinedOutput(ctx, pushCmd)
 	r.logger.Debug(fmt.Sprintf("%s", out))
 	if err != nil {
-		errMessage := fmt.Sprintf("error pushing git tags: %s\n", out)
+		errMessage := fmt.Sprintf("error pushing git tag %s: %s\n", tag, out)
 		return errors.Wrap(err, errMessage)
 	}
 
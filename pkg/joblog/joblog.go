@@ -0,0 +1,161 @@
+// Package joblog writes and serves the build log kept for each job.
+// A job's log holds Protofact's own stage messages interleaved with
+// the combined output of every subprocess the job runs.
+package joblog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// pruneInterval is how often old logs are looked for and removed.
+const pruneInterval = time.Hour
+
+// Config represents config values for job logs.
+type Config struct {
+	// Dir is the directory log files are written to.
+	Dir string
+	// Retention is how long a log is kept after it was last written to.
+	Retention time.Duration
+}
+
+// Dir is a directory of job logs, one file per job id.
+type Dir struct {
+	path      string
+	retention time.Duration
+	logger    log.FieldLogger
+}
+
+// New returns a pointer to a Dir, creating the configured directory if needed.
+func New(config Config, logger log.FieldLogger) (*Dir, error) {
+	if config.Dir == "" {
+		config.Dir = "/var/lib/protofact/logs"
+	}
+	if config.Retention <= 0 {
+		config.Retention = 7 * 24 * time.Hour
+	}
+
+	err := os.MkdirAll(config.Dir, 0750)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not create job log directory %s", config.Dir))
+	}
+
+	return &Dir{
+		path:      config.Dir,
+		retention: config.Retention,
+		logger:    logger,
+	}, nil
+}
+
+// Create opens the log for a job for appending, creating it if needed.
+// Every attempt of a job appends to the same log.
+func (d *Dir) Create(id string) (*Log, error) {
+	f, err := os.OpenFile(d.file(id), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not open log for job %s", id))
+	}
+	return &Log{w: f}, nil
+}
+
+// Open opens the log for a job for reading.
+func (d *Dir) Open(id string) (*os.File, error) {
+	return os.Open(d.file(id))
+}
+
+// Prune removes every log that has not been written to within the
+// retention period, returning the number removed.
+func (d *Dir) Prune(now time.Time) (int, error) {
+	infos, err := ioutil.ReadDir(d.path)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("could not read job log directory %s", d.path))
+	}
+
+	var count int
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".log") {
+			continue
+		}
+		if now.Sub(info.ModTime()) < d.retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(d.path, info.Name())); err != nil {
+			return count, errors.Wrap(err, fmt.Sprintf("could not remove job log %s", info.Name()))
+		}
+		count++
+	}
+	return count, nil
+}
+
+// RunPruner prunes old logs once immediately and then periodically
+// until ctx is cancelled.
+func (d *Dir) RunPruner(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := d.Prune(time.Now()); err != nil {
+			d.logger.Errorf("%+v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// file returns the path of the log for a job id. The id is reduced to
+// its base name so it cannot be used to reach outside the directory.
+func (d *Dir) file(id string) string {
+	return filepath.Join(d.path, fmt.Sprintf("%s.log", filepath.Base(id)))
+}
+
+// Log is an open job log. It is safe to write to from several goroutines.
+type Log struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// Discard returns a Log that throws away everything written to it.
+func Discard() *Log {
+	return &Log{w: nopCloser{ioutil.Discard}}
+}
+
+// Write appends raw output, such as from a subprocess, to the log.
+func (l *Log) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// Printf appends a timestamped Protofact message to the log.
+func (l *Log) Printf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "[protofact %s] %s\n", time.Now().UTC().Format(time.RFC3339), strings.TrimRight(msg, "\n"))
+}
+
+// Close closes the underlying file.
+func (l *Log) Close() error {
+	return l.w.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
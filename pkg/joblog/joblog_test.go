@@ -0,0 +1,74 @@
+package joblog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDir(t *testing.T) *Dir {
+	path, err := ioutil.TempDir("", "protofact-joblog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(path)
+	})
+	d, err := New(Config{Dir: path, Retention: time.Hour}, log.WithField("test", t.Name()))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return d
+}
+
+func Test_CreateAppendsAcrossAttempts(t *testing.T) {
+	d := newTestDir(t)
+
+	for _, line := range []string{"first attempt\n", "second attempt\n"} {
+		l, err := d.Create("job")
+		assert.Nil(t, err)
+		_, err = l.Write([]byte(line))
+		assert.Nil(t, err)
+		assert.Nil(t, l.Close())
+	}
+
+	f, err := d.Open("job")
+	assert.Nil(t, err)
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, "first attempt\nsecond attempt\n", string(content))
+}
+
+func Test_OpenStaysInsideDir(t *testing.T) {
+	d := newTestDir(t)
+	assert.Equal(t, filepath.Join(d.path, "passwd.log"), d.file("../../etc/passwd"))
+}
+
+func Test_Prune(t *testing.T) {
+	d := newTestDir(t)
+
+	for _, id := range []string{"old", "new"} {
+		l, err := d.Create(id)
+		assert.Nil(t, err)
+		l.Printf("a message")
+		assert.Nil(t, l.Close())
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(d.file("old"), old, old))
+
+	count, err := d.Prune(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	_, err = d.Open("old")
+	assert.True(t, os.IsNotExist(err))
+	f, err := d.Open("new")
+	assert.Nil(t, err)
+	f.Close()
+}
@@ -18,3 +18,23 @@ func (c Counters) AddPackagingErrors(labels prometheus.Labels, count float64) {
 func (c Counters) AddPackagingProcessDuration(labels prometheus.Labels, count float64) {
 	c.PackagingProcessDuration.With(labels).Add(count)
 }
+
+// Gauges holds the prometheus gauges reporting how busy the
+// application is.
+type Gauges struct {
+	QueueDepth            *prometheus.GaugeVec
+	ActiveWorkers         *prometheus.GaugeVec
+	ActiveLanguageWorkers *prometheus.GaugeVec
+}
+
+func (g Gauges) SetQueueDepth(count float64) {
+	g.QueueDepth.With(prometheus.Labels{}).Set(count)
+}
+
+func (g Gauges) AddActiveWorkers(count float64) {
+	g.ActiveWorkers.With(prometheus.Labels{}).Add(count)
+}
+
+func (g Gauges) AddActiveLanguageWorkers(labels prometheus.Labels, count float64) {
+	g.ActiveLanguageWorkers.With(labels).Add(count)
+}
@@ -0,0 +1,60 @@
+package queue
+
+import "time"
+
+// Config represents config values for the job store and worker pool.
+type Config struct {
+	// DataDir is the directory the job database is written to.
+	DataDir string
+	// Workers is the number of jobs processed at the same time.
+	Workers int
+	// LanguageWorkers caps the number of builds of a language that run
+	// at the same time, across all workers. A language that is not
+	// listed is only capped by Workers.
+	LanguageWorkers map[string]int
+	// MaxQueued is the number of jobs that can be waiting to run,
+	// including those waiting to be retried. Once it is reached new
+	// pushes are turned away until the queue drains.
+	MaxQueued int
+	// RetryAfter is how long a push turned away by a full queue is
+	// told to wait before it is delivered again. It is sent in the
+	// Retry-After header of the webhook response.
+	RetryAfter time.Duration
+	// MaxAttempts is the number of times a job is run before it is
+	// moved to the dead-letter list.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. Every retry after
+	// that doubles it, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retention is how long a finished job, dead-lettered ones included,
+	// is kept after it was last updated. Jobs waiting or running are kept
+	// however old they are.
+	Retention time.Duration
+}
+
+// withDefaults fills in any zero values with sensible defaults.
+func (c Config) withDefaults() Config {
+	if c.DataDir == "" {
+		c.DataDir = "/var/lib/protofact"
+	}
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	if c.MaxQueued <= 0 {
+		c.MaxQueued = 100
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 5
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = 30 * time.Second
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 30 * time.Minute
+	}
+	if c.Retention <= 0 {
+		c.Retention = 7 * 24 * time.Hour
+	}
+	return c
+}
@@ -0,0 +1,155 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/schema"
+)
+
+// State is the lifecycle state of a Job.
+type State string
+
+// The states a Job moves through. A job that fails is retried until it
+// runs out of attempts, at which point it is Failed and dead-lettered.
+// A job is Superseded, and not retried, when a newer push to its branch
+// came in before it could finish. A job is WaitingForCI between checks
+// of its commit's CI, before its first attempt.
+const (
+	Queued       State = "queued"
+	WaitingForCI State = "waiting_for_ci"
+	Running      State = "running"
+	Succeeded    State = "succeeded"
+	Failed       State = "failed"
+	Superseded   State = "superseded"
+)
+
+// Job is a single accepted push event waiting to be, or having been,
+// packaged. Jobs are persisted as JSON so they survive restarts.
+type Job struct {
+	// ID identifies the job, and is the key it is stored under.
+	ID string `json:"id"`
+	// Payload is the push the job packages.
+	Payload event.Push `json:"payload"`
+	// State is where the job is in its lifecycle.
+	State State `json:"state"`
+	// Attempts counts the attempts started so far, including one that
+	// is running.
+	Attempts int `json:"attempts"`
+	// NextAttempt is when the job is next due to run while it is queued.
+	NextAttempt time.Time `json:"next_attempt"`
+	// LastError is the error the most recent attempt failed with.
+	LastError string `json:"last_error,omitempty"`
+	// FailedStage is the stage the most recent attempt failed in.
+	FailedStage string `json:"failed_stage,omitempty"`
+	// TimedOut is set when the most recent attempt failed by running out
+	// of time.
+	TimedOut bool `json:"timed_out,omitempty"`
+	// BuildID is the build directory of the most recent attempt.
+	BuildID string `json:"build_id,omitempty"`
+	// Version is the version the most recent attempt packaged.
+	Version string `json:"version,omitempty"`
+	// Schema describes the changes to the schema since the last release.
+	Schema *schema.Report `json:"schema,omitempty"`
+	// Stages are the stages of the most recent attempt, in the order
+	// they started.
+	Stages []Stage `json:"stages,omitempty"`
+	// Languages holds the result of each language packaged for the push.
+	// A language that succeeded is kept as it is on later attempts, as it
+	// is not run again.
+	Languages []Language `json:"languages,omitempty"`
+	// Only limits a job started on request to some of the languages of
+	// the process. It is empty for pushes, which package every language.
+	Only []string `json:"only,omitempty"`
+	// AllowBreaking lets a job started on request publish a stable
+	// release with breaking schema changes.
+	AllowBreaking bool `json:"allow_breaking,omitempty"`
+	// Force lets a job started on request package languages that were
+	// already published from its commit.
+	Force bool `json:"force,omitempty"`
+	// Requested is set for a job started on request, which is not seen
+	// as a push to its branch.
+	Requested bool `json:"requested,omitempty"`
+	// CheckRunID is the Github check run the job is reported on, if any.
+	CheckRunID int64 `json:"check_run_id,omitempty"`
+	// CI describes the last check of the CI of the commit.
+	CI string `json:"ci,omitempty"`
+	// WaitingSince is when the job started waiting for the CI of the
+	// commit.
+	WaitingSince *time.Time `json:"waiting_since,omitempty"`
+	// CIPassed is set once the CI of the commit has passed, so it is not
+	// checked again.
+	CIPassed bool `json:"ci_passed,omitempty"`
+	// CreatedAt is when the job was queued.
+	CreatedAt time.Time `json:"created_at"`
+	// StartedAt is when the most recent attempt started.
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// FinishedAt is when the most recent attempt finished.
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// UpdatedAt is when the job was last saved.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Stage is the timing and result of one stage of a job attempt.
+type Stage struct {
+	// Name is the name of the stage, such as clone.
+	Name string `json:"name"`
+	// StartedAt is when the stage started.
+	StartedAt time.Time `json:"started_at"`
+	// FinishedAt is when the stage finished, and nil while it runs.
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Error is the error the stage failed with, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// Language is the progress and result of one language of a job.
+type Language struct {
+	// Name is the name of the language, such as npm.
+	Name string `json:"name"`
+	// State is Running until the language finishes, and then its result.
+	State State `json:"state"`
+	// BuildID is the build directory of the language.
+	BuildID string `json:"build_id,omitempty"`
+	// Version is the version the language was packaged as.
+	Version string `json:"version,omitempty"`
+	// Stages are the stages of the language, in the order they started.
+	Stages []Stage `json:"stages,omitempty"`
+	// Error is the error the language failed with.
+	Error string `json:"error,omitempty"`
+	// FailedStage is the stage the language failed in.
+	FailedStage string `json:"failed_stage,omitempty"`
+	// TimedOut is set when the language failed by running out of time.
+	TimedOut bool `json:"timed_out,omitempty"`
+	// StartedAt is when the language started.
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// FinishedAt is when the language finished.
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// PublishedBy is set when the language was not run because the job
+	// with that id had already published it from the same commit and
+	// ref.
+	PublishedBy string `json:"published_by,omitempty"`
+}
+
+// language returns the entry for the named language, or nil if it has
+// not been run yet.
+func (j *Job) language(name string) *Language {
+	for i := range j.Languages {
+		if j.Languages[i].Name == name {
+			return &j.Languages[i]
+		}
+	}
+	return nil
+}
+
+// NewJob returns a queued Job for the passed push event.
+func NewJob(id string, payload event.Push) *Job {
+	now := time.Now().UTC()
+	return &Job{
+		ID:          id,
+		Payload:     payload,
+		State:       Queued,
+		NextAttempt: now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+}
@@ -0,0 +1,404 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/ci"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/joblog"
+)
+
+// pollInterval is how often an idle worker checks the store for jobs
+// whose retry delay has passed.
+const pollInterval = time.Second
+
+type processor interface {
+	Process(ctx context.Context, payload event.Push) error
+}
+
+// reporter is told of every attempt of a job as it starts and once it
+// has finished, before the job is saved, so it can keep state on it.
+type reporter interface {
+	Started(ctx context.Context, job *Job)
+	Finished(ctx context.Context, job *Job)
+}
+
+// waiter checks the CI of a job's commit, which has to pass before the
+// job is run.
+type waiter interface {
+	Check(ctx context.Context, payload event.Push) (ci.Result, error)
+	Interval() time.Duration
+	Timeout() time.Duration
+}
+
+type logs interface {
+	Create(id string) (*joblog.Log, error)
+}
+
+type gauges interface {
+	SetQueueDepth(count float64)
+	AddActiveWorkers(count float64)
+}
+
+// Pool runs a fixed number of workers that pull jobs from a Store and
+// hand them to a processor. Failed jobs are retried with exponential
+// backoff until they run out of attempts, then they are dead-lettered.
+type Pool struct {
+	store     *Store
+	processor processor
+	reporter  reporter
+	ci        waiter
+	logs      logs
+	gauges    gauges
+	logger    log.FieldLogger
+	tracer    opentracing.Tracer
+	config    Config
+	wake      chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+// NewPool returns a pointer to a Pool configured with the parameters passed in.
+func NewPool(config Config, store *Store, processor processor, reporter reporter, ci waiter, logs logs, gauges gauges, logger log.FieldLogger, tracer opentracing.Tracer) *Pool {
+	return &Pool{
+		store:     store,
+		processor: processor,
+		reporter:  reporter,
+		ci:        ci,
+		logs:      logs,
+		gauges:    gauges,
+		logger:    logger,
+		tracer:    tracer,
+		config:    config.withDefaults(),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Notify wakes an idle worker so a newly enqueued job is picked up
+// without waiting for the next poll.
+func (p *Pool) Notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the workers and blocks until every worker has returned.
+// Workers return once Shutdown is called and their running job is done,
+// or when ctx is cancelled, which also cancels their running jobs.
+func (p *Pool) Run(ctx context.Context) {
+	defer close(p.done)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.report(ctx)
+	}()
+	for i := 0; i < p.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// Shutdown stops the workers from starting any more jobs and waits for
+// the jobs they are running to finish and Run to return. If ctx is done
+// first it returns ctx's error, and the caller should cancel the context
+// passed to Run so the running jobs are put back to be run again.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// report keeps the queue depth gauge up to date until the pool stops.
+func (p *Pool) report(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		depth, err := p.store.Depth()
+		if err != nil {
+			p.logger.Errorf("%+v\n", err)
+		} else {
+			p.gauges.SetQueueDepth(float64(depth))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) stopping() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Pool) work(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		// run every job that is due before going back to waiting
+		for ctx.Err() == nil && !p.stopping() {
+			job, err := p.store.Next(time.Now().UTC())
+			if err != nil {
+				p.logger.Errorf("%+v\n", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			p.run(ctx, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.stop:
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) run(ctx context.Context, job *Job) {
+	p.gauges.AddActiveWorkers(1)
+	defer p.gauges.AddActiveWorkers(-1)
+
+	logger := p.logger.WithField("job_id", job.ID)
+
+	// nothing is published for a commit until its CI has passed
+	if !job.CIPassed && !p.awaitCI(ctx, job, logger) {
+		return
+	}
+
+	span := p.tracer.StartSpan("process_job")
+	span.SetTag("job_id", job.ID)
+	span.SetTag("attempt", job.Attempts)
+	defer span.Finish()
+
+	// progress is reported per attempt, so clear out the previous one.
+	// Languages are left alone, each is cleared as it starts again.
+	now := time.Now().UTC()
+	job.BuildID = ""
+	job.Version = ""
+	job.Schema = nil
+	job.Stages = nil
+	job.StartedAt = &now
+	job.FinishedAt = nil
+	p.reporter.Started(ctx, job)
+	if err := p.store.Save(job); err != nil {
+		logger.Errorf("%+v\n", err)
+	}
+
+	out, err := p.logs.Create(job.ID)
+	if err != nil {
+		// a job should not fail for want of a log, so carry on without one
+		logger.Errorf("%+v\n", err)
+		out = joblog.Discard()
+	}
+	defer out.Close()
+	out.Printf("attempt %d of %d for %s at %s", job.Attempts, p.config.MaxAttempts, job.Payload.Ref, job.Payload.After)
+
+	rec := newRecorder(job, p.store, out, logger)
+	jobCtx := build.WithRecorder(opentracing.ContextWithSpan(ctx, span), rec)
+	jobCtx = build.WithTracker(jobCtx, rec)
+	jobCtx = build.WithOutput(jobCtx, out)
+	if len(job.Only) > 0 {
+		jobCtx = build.WithLanguages(jobCtx, job.Only)
+	}
+	if job.AllowBreaking {
+		jobCtx = build.WithBreakingAllowed(jobCtx)
+	}
+	if job.Requested {
+		jobCtx = build.WithRequested(jobCtx)
+	}
+	err = p.processor.Process(jobCtx, job.Payload)
+
+	finished := time.Now().UTC()
+	job.FinishedAt = &finished
+	if err == nil {
+		out.Printf("attempt %d succeeded", job.Attempts)
+		job.State = Succeeded
+		job.LastError = ""
+		job.FailedStage = ""
+		job.TimedOut = false
+		p.reporter.Finished(ctx, job)
+		if err = p.store.Save(job); err != nil {
+			logger.Errorf("%+v\n", err)
+		}
+		return
+	}
+
+	// a newer push to the branch will be packaged instead
+	if build.IsSuperseded(err) {
+		out.Printf("superseded by a newer push to %s, it will not be retried", job.Payload.Ref)
+		job.State = Superseded
+		job.LastError = ""
+		job.FailedStage = ""
+		job.TimedOut = false
+		p.reporter.Finished(ctx, job)
+		if err = p.store.Save(job); err != nil {
+			logger.Errorf("%+v\n", err)
+		}
+		return
+	}
+
+	// if we are shutting down the failure is ours, not the job's,
+	// so put it back without counting the attempt and it is picked
+	// up again once we restart
+	if ctx.Err() != nil {
+		out.Printf("attempt %d interrupted by shutdown, it will be run again after a restart", job.Attempts)
+		job.Attempts--
+		if err = p.store.Retry(job, time.Now().UTC()); err != nil {
+			logger.Errorf("%+v\n", err)
+		}
+		return
+	}
+
+	job.LastError = err.Error()
+	job.FailedStage = build.FailedStage(err)
+	job.TimedOut = build.IsTimeout(err)
+	logger.Errorf("attempt %d of %d failed: %+v\n", job.Attempts, p.config.MaxAttempts, err)
+	out.Printf("attempt %d failed: %v", job.Attempts, err)
+	p.reporter.Finished(ctx, job)
+
+	// trying again would fail the same way
+	if build.IsPermanent(err) {
+		out.Printf("the failure is permanent, moving job to the dead-letter list without retrying")
+		if err = p.store.Bury(job); err != nil {
+			logger.Errorf("%+v\n", err)
+		}
+		return
+	}
+
+	if job.Attempts >= p.config.MaxAttempts {
+		out.Printf("no attempts left, moving job to the dead-letter list")
+		if err = p.store.Bury(job); err != nil {
+			logger.Errorf("%+v\n", err)
+		}
+		return
+	}
+
+	delay := p.backoff(job.Attempts)
+	out.Printf("retrying in %s", delay)
+	if err = p.store.Retry(job, time.Now().UTC().Add(delay)); err != nil {
+		logger.Errorf("%+v\n", err)
+	}
+}
+
+// awaitCI checks the CI of the job's commit, and reports whether it has
+// passed so the job can run. Until then the job goes back on the queue
+// to be checked again, without holding a worker or counting as an
+// attempt. It is abandoned if its CI fails or does not finish in time.
+func (p *Pool) awaitCI(ctx context.Context, job *Job, logger log.FieldLogger) bool {
+	now := time.Now().UTC()
+	first := job.WaitingSince == nil
+	if first {
+		job.WaitingSince = &now
+	}
+
+	result, err := p.ci.Check(ctx, job.Payload)
+	if err != nil && ctx.Err() != nil {
+		// a check cut short by shutdown is done again after a restart
+		job.Attempts--
+		if err = p.store.Wait(job, now); err != nil {
+			logger.Errorf("%+v\n", err)
+		}
+		return false
+	}
+	if err != nil {
+		// the check is tried again, as long as there is time left
+		logger.Errorf("%+v\n", err)
+		result = ci.Result{State: ci.Pending, Description: "could not check CI, trying again"}
+	}
+	job.CI = result.Description
+
+	out, err := p.logs.Create(job.ID)
+	if err != nil {
+		logger.Errorf("%+v\n", err)
+		out = joblog.Discard()
+	}
+	defer out.Close()
+
+	if result.State == ci.Passed {
+		if !first {
+			out.Printf("CI passed: %s", result.Description)
+		}
+		job.CIPassed = true
+		return true
+	}
+
+	// checking CI is not an attempt
+	job.Attempts--
+	switch {
+	case result.State == ci.Pending && now.Sub(*job.WaitingSince) < p.ci.Timeout():
+		if first {
+			out.Printf("waiting for CI: %s", result.Description)
+		}
+		if err = p.store.Wait(job, now.Add(p.ci.Interval())); err != nil {
+			logger.Errorf("%+v\n", err)
+		}
+		return false
+	case result.State == ci.Pending:
+		job.LastError = fmt.Sprintf("CI did not finish within %s: %s", p.ci.Timeout(), result.Description)
+		job.TimedOut = true
+	default:
+		job.LastError = fmt.Sprintf("CI failed: %s", result.Description)
+		job.TimedOut = false
+	}
+
+	job.FailedStage = build.StageCI
+	job.FinishedAt = &now
+	out.Printf("%s, abandoning the job", job.LastError)
+	p.reporter.Finished(ctx, job)
+	if err = p.store.Bury(job); err != nil {
+		logger.Errorf("%+v\n", err)
+	}
+	return false
+}
+
+// backoff returns the delay before the next attempt, doubling the
+// configured base delay for each attempt already made.
+func (p *Pool) backoff(attempts int) time.Duration {
+	delay := p.config.Backoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= p.config.MaxBackoff {
+			return p.config.MaxBackoff
+		}
+	}
+	return delay
+}
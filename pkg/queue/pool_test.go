@@ -0,0 +1,549 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/ci"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/joblog"
+)
+
+type fakeProcessor struct {
+	mu       sync.Mutex
+	calls    int
+	failures int
+}
+
+func (f *fakeProcessor) Process(ctx context.Context, payload event.Push) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+
+	build.RecorderFrom(ctx).Version("1.0.1530281075")
+	finish := build.StartStage(ctx, build.StagePublish)
+	if f.calls <= f.failures {
+		err := errors.New("registry unavailable")
+		finish(err)
+		return build.StageFailed(build.StagePublish, err)
+	}
+	finish(nil)
+	return nil
+}
+
+// languagesProcessor packages each of its languages that the tracker
+// does not already have as done, failing a language for as many runs
+// as it is listed in failures. The languages in unpublished succeed
+// without publishing, as when their config has Publish off.
+type languagesProcessor struct {
+	mu          sync.Mutex
+	runs        map[string]int
+	failures    map[string]int
+	unpublished map[string]bool
+}
+
+func (f *languagesProcessor) Process(ctx context.Context, payload event.Push) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tracker := build.TrackerFrom(ctx)
+	var failed error
+	for _, lang := range []string{"npm", "ruby"} {
+		if tracker.Done(lang) {
+			continue
+		}
+		f.runs[lang]++
+		rec := tracker.Started(lang)
+		rec.Version("1.0.1530281075")
+		if f.unpublished[lang] {
+			tracker.Finished(lang, nil)
+			continue
+		}
+		finish := build.StartStage(build.WithRecorder(ctx, rec), build.StagePublish)
+		var err error
+		if f.runs[lang] <= f.failures[lang] {
+			err = build.StageFailed(build.StagePublish, errors.New("registry unavailable"))
+			failed = err
+		}
+		finish(err)
+		tracker.Finished(lang, err)
+	}
+	return failed
+}
+
+type nopReporter struct{}
+
+func (nopReporter) Started(ctx context.Context, job *Job)  {}
+func (nopReporter) Finished(ctx context.Context, job *Job) {}
+
+// noCI requires no CI, so every job runs straight away.
+var noCI = ci.New(ci.Config{}, nil)
+
+// fakeWaiter returns its results in turn, and the last one from then on.
+type fakeWaiter struct {
+	mu      sync.Mutex
+	checks  int
+	results []ci.Result
+	timeout time.Duration
+}
+
+func (f *fakeWaiter) Check(ctx context.Context, payload event.Push) (ci.Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checks++
+	if f.checks > len(f.results) {
+		return f.results[len(f.results)-1], nil
+	}
+	return f.results[f.checks-1], nil
+}
+
+func (f *fakeWaiter) Interval() time.Duration {
+	return time.Nanosecond
+}
+
+func (f *fakeWaiter) Timeout() time.Duration {
+	return f.timeout
+}
+
+type nopGauges struct{}
+
+func (nopGauges) SetQueueDepth(count float64)    {}
+func (nopGauges) AddActiveWorkers(count float64) {}
+
+func newTestLogs(t *testing.T) *joblog.Dir {
+	dir, err := ioutil.TempDir("", "protofact-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	logs, err := joblog.New(joblog.Config{Dir: dir}, log.WithField("test", t.Name()))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return logs
+}
+
+func runUntil(t *testing.T, pool *Pool, store *Store, id string, state State) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := store.Get(id)
+		assert.Nil(t, err)
+		if job.State == state {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s never reached state %s", id, state)
+	return nil
+}
+
+func Test_Pool_RetriesUntilSuccess(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	proc := &fakeProcessor{failures: 2}
+	config := Config{MaxAttempts: 3, Backoff: time.Nanosecond}
+	pool := NewPool(config, store, proc, nopReporter{}, noCI, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	job := runUntil(t, pool, store, "a", Succeeded)
+	assert.Equal(t, 3, job.Attempts)
+	assert.Equal(t, "", job.LastError)
+	assert.Equal(t, "1.0.1530281075", job.Version)
+	assert.NotNil(t, job.FinishedAt)
+	// only the stages of the last attempt are kept
+	assert.Len(t, job.Stages, 1)
+	assert.Equal(t, build.StagePublish, job.Stages[0].Name)
+	assert.NotNil(t, job.Stages[0].FinishedAt)
+	assert.Equal(t, "", job.Stages[0].Error)
+}
+
+func Test_Pool_DeadLettersAfterMaxAttempts(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	proc := &fakeProcessor{failures: 10}
+	config := Config{MaxAttempts: 2, Backoff: time.Nanosecond}
+	pool := NewPool(config, store, proc, nopReporter{}, noCI, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	job := runUntil(t, pool, store, "a", Failed)
+	assert.Equal(t, 2, job.Attempts)
+	assert.Equal(t, build.StagePublish, job.FailedStage)
+	assert.Equal(t, "registry unavailable", job.Stages[0].Error)
+
+	f, err := pool.logs.(*joblog.Dir).Open("a")
+	assert.Nil(t, err)
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "attempt 1 of 2")
+	assert.Contains(t, string(content), "publish failed after")
+	assert.Contains(t, string(content), "moving job to the dead-letter list")
+
+	dead, err := store.Dead()
+	assert.Nil(t, err)
+	assert.Len(t, dead, 1)
+}
+
+func Test_Pool_RetriesOnlyFailedLanguages(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	proc := &languagesProcessor{runs: map[string]int{}, failures: map[string]int{"ruby": 1}}
+	config := Config{MaxAttempts: 3, Backoff: time.Nanosecond}
+	pool := NewPool(config, store, proc, nopReporter{}, noCI, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	job := runUntil(t, pool, store, "a", Succeeded)
+	assert.Equal(t, 2, job.Attempts)
+	assert.Equal(t, map[string]int{"npm": 1, "ruby": 2}, proc.runs)
+
+	assert.Len(t, job.Languages, 2)
+	for _, lang := range job.Languages {
+		assert.Equal(t, Succeeded, lang.State)
+		assert.Equal(t, "1.0.1530281075", lang.Version)
+		assert.Equal(t, "", lang.Error)
+		assert.Len(t, lang.Stages, 1)
+	}
+}
+
+func Test_Pool_SkipsPublishedLanguages(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	proc := &languagesProcessor{runs: map[string]int{}}
+	config := Config{MaxAttempts: 3, Backoff: time.Nanosecond}
+	logs := newTestLogs(t)
+	// a pool runs once, so every job is run by a pool of its own
+	run := func(job *Job) *Job {
+		assert.Nil(t, store.Enqueue(job))
+		pool := NewPool(config, store, proc, nopReporter{}, noCI, logs, nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+		return runUntil(t, pool, store, job.ID, Succeeded)
+	}
+
+	var payload event.Push
+	payload.Ref = "refs/heads/master"
+	payload.After = "aaa"
+	payload.Repository.FullName = "org/protos"
+	run(NewJob("a", payload))
+
+	// a redelivery of the push is acknowledged without building again
+	job := run(NewJob("b", payload))
+	assert.Equal(t, map[string]int{"npm": 1, "ruby": 1}, proc.runs)
+	assert.Len(t, job.Languages, 2)
+	for _, lang := range job.Languages {
+		assert.Equal(t, Succeeded, lang.State)
+		assert.Equal(t, "1.0.1530281075", lang.Version)
+		assert.Equal(t, "a", lang.PublishedBy)
+	}
+
+	// the same commit pushed to another ref is built for it
+	other := payload
+	other.Ref = "refs/heads/release"
+	run(NewJob("c", other))
+	assert.Equal(t, map[string]int{"npm": 2, "ruby": 2}, proc.runs)
+
+	// and a forced job builds it again
+	forced := NewJob("d", payload)
+	forced.Force = true
+	job = run(forced)
+	assert.Equal(t, map[string]int{"npm": 3, "ruby": 3}, proc.runs)
+	for _, lang := range job.Languages {
+		assert.Equal(t, "", lang.PublishedBy)
+	}
+
+	publication, found, err := store.Published("org/protos", "aaa", "ruby")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "d", publication.JobID)
+}
+
+func Test_Pool_RecordsOnlyPublishedLanguages(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	proc := &languagesProcessor{runs: map[string]int{}, unpublished: map[string]bool{"ruby": true}}
+	config := Config{MaxAttempts: 3, Backoff: time.Nanosecond}
+	pool := NewPool(config, store, proc, nopReporter{}, noCI, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+
+	var payload event.Push
+	payload.Ref = "refs/heads/master"
+	payload.After = "aaa"
+	payload.Repository.FullName = "org/protos"
+	assert.Nil(t, store.Enqueue(NewJob("a", payload)))
+	job := runUntil(t, pool, store, "a", Succeeded)
+	for _, lang := range job.Languages {
+		assert.Equal(t, Succeeded, lang.State)
+	}
+
+	_, found, err := store.Published("org/protos", "aaa", "npm")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	// ruby succeeded without publishing, so it is left for a later job
+	_, found, err = store.Published("org/protos", "aaa", "ruby")
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+type supersededProcessor struct{}
+
+func (supersededProcessor) Process(ctx context.Context, payload event.Push) error {
+	return build.ErrSuperseded
+}
+
+func Test_Pool_SupersededIsNotRetried(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	config := Config{MaxAttempts: 3, Backoff: time.Nanosecond}
+	pool := NewPool(config, store, supersededProcessor{}, nopReporter{}, noCI, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	job := runUntil(t, pool, store, "a", Superseded)
+	assert.Equal(t, 1, job.Attempts)
+	assert.Equal(t, "", job.LastError)
+
+	dead, err := store.Dead()
+	assert.Nil(t, err)
+	assert.Len(t, dead, 0)
+}
+
+// recordingReporter records the state of each job it is told of, and
+// keeps a check run id on it like a real reporter.
+type recordingReporter struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingReporter) Started(ctx context.Context, job *Job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, "started")
+	job.CheckRunID = 42
+}
+
+func (r *recordingReporter) Finished(ctx context.Context, job *Job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf("finished %s %s", job.State, job.LastError))
+}
+
+func Test_Pool_Reports(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	reporter := &recordingReporter{}
+	config := Config{MaxAttempts: 3, Backoff: time.Nanosecond}
+	pool := NewPool(config, store, &fakeProcessor{failures: 1}, reporter, noCI, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	job := runUntil(t, pool, store, "a", Succeeded)
+	assert.Equal(t, int64(42), job.CheckRunID)
+
+	reporter.mu.Lock()
+	defer reporter.mu.Unlock()
+	assert.Equal(t, []string{
+		"started",
+		"finished running publish stage failed: registry unavailable",
+		"started",
+		"finished succeeded ",
+	}, reporter.events)
+}
+
+func Test_Pool_WaitsForCI(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	waiter := &fakeWaiter{
+		results: []ci.Result{
+			{State: ci.Pending, Description: "waiting for lint"},
+			{State: ci.Pending, Description: "waiting for lint"},
+			{State: ci.Passed, Description: "lint succeeded"},
+		},
+		timeout: time.Hour,
+	}
+	proc := &fakeProcessor{}
+	config := Config{MaxAttempts: 3, Backoff: time.Nanosecond}
+	pool := NewPool(config, store, proc, nopReporter{}, waiter, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	job := runUntil(t, pool, store, "a", Succeeded)
+	// checking CI is not an attempt
+	assert.Equal(t, 1, job.Attempts)
+	assert.True(t, job.CIPassed)
+	assert.Equal(t, "lint succeeded", job.CI)
+	assert.NotNil(t, job.WaitingSince)
+	assert.Equal(t, 3, waiter.checks)
+	assert.Equal(t, 1, proc.calls)
+}
+
+func Test_Pool_AbandonsWithoutCI(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	// CI that failed abandons the job without running it
+	waiter := &fakeWaiter{results: []ci.Result{{State: ci.Failed, Description: "lint did not succeed"}}, timeout: time.Hour}
+	proc := &fakeProcessor{}
+	reporter := &recordingReporter{}
+	config := Config{MaxAttempts: 3, Backoff: time.Nanosecond}
+	pool := NewPool(config, store, proc, reporter, waiter, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	job := runUntil(t, pool, store, "a", Failed)
+	assert.Equal(t, 0, job.Attempts)
+	assert.Equal(t, build.StageCI, job.FailedStage)
+	assert.Equal(t, "CI failed: lint did not succeed", job.LastError)
+	assert.False(t, job.TimedOut)
+	assert.Equal(t, 0, proc.calls)
+	reporter.mu.Lock()
+	assert.Equal(t, []string{"finished running CI failed: lint did not succeed"}, reporter.events)
+	reporter.mu.Unlock()
+
+	// as does CI that does not finish in time
+	waiter = &fakeWaiter{results: []ci.Result{{State: ci.Pending, Description: "waiting for lint"}}}
+	pool = NewPool(config, store, proc, nopReporter{}, waiter, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+	assert.Nil(t, store.Enqueue(NewJob("b", event.Push{})))
+	job = runUntil(t, pool, store, "b", Failed)
+	assert.True(t, job.TimedOut)
+	assert.Equal(t, "CI did not finish within 0s: waiting for lint", job.LastError)
+	assert.Equal(t, 0, proc.calls)
+}
+
+// gateProcessor refuses every build unless breaking changes are allowed.
+type gateProcessor struct{}
+
+func (gateProcessor) Process(ctx context.Context, payload event.Push) error {
+	if build.BreakingAllowed(ctx) {
+		return nil
+	}
+	return build.StageFailed(build.StageGate, build.Permanent(errors.New("breaking schema changes")))
+}
+
+func Test_Pool_PermanentIsNotRetried(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	config := Config{MaxAttempts: 3, Backoff: time.Nanosecond}
+	pool := NewPool(config, store, gateProcessor{}, nopReporter{}, noCI, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	job := runUntil(t, pool, store, "a", Failed)
+	assert.Equal(t, 1, job.Attempts)
+	assert.Equal(t, build.StageGate, job.FailedStage)
+
+	dead, err := store.Dead()
+	assert.Nil(t, err)
+	assert.Len(t, dead, 1)
+
+	allowed := NewJob("b", event.Push{})
+	allowed.AllowBreaking = true
+	assert.Nil(t, store.Enqueue(allowed))
+	pool = NewPool(config, store, gateProcessor{}, nopReporter{}, noCI, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+	runUntil(t, pool, store, "b", Succeeded)
+}
+
+// blockingProcessor signals started once it is running a job, then
+// blocks until release is closed or its context is cancelled.
+type blockingProcessor struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingProcessor) Process(ctx context.Context, payload event.Push) error {
+	close(b.started)
+	select {
+	case <-b.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func Test_Pool_ShutdownDrainsRunningJob(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	proc := &blockingProcessor{started: make(chan struct{}), release: make(chan struct{})}
+	config := Config{MaxAttempts: 3, Backoff: time.Nanosecond}
+	pool := NewPool(config, store, proc, nopReporter{}, noCI, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	go pool.Run(context.Background())
+	<-proc.started
+
+	time.AfterFunc(50*time.Millisecond, func() {
+		close(proc.release)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, pool.Shutdown(ctx))
+
+	job, err := store.Get("a")
+	assert.Nil(t, err)
+	assert.Equal(t, Succeeded, job.State)
+}
+
+func Test_Pool_ShutdownHandsBackUnfinishedJob(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	proc := &blockingProcessor{started: make(chan struct{}), release: make(chan struct{})}
+	config := Config{MaxAttempts: 3, Backoff: time.Nanosecond}
+	pool := NewPool(config, store, proc, nopReporter{}, noCI, newTestLogs(t), nopGauges{}, log.WithField("test", t.Name()), opentracing.NoopTracer{})
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pool.Run(runCtx)
+		close(done)
+	}()
+	<-proc.started
+
+	// the grace period runs out with the job still going
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, pool.Shutdown(ctx))
+	cancelRun()
+	<-done
+
+	job, err := store.Get("a")
+	assert.Nil(t, err)
+	assert.Equal(t, Queued, job.State)
+	assert.Equal(t, 0, job.Attempts)
+}
+
+func Test_Pool_Backoff(t *testing.T) {
+	config := Config{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	pool := NewPool(config, nil, nil, nil, nil, nil, nil, nil, nil)
+
+	assert.Equal(t, time.Second, pool.backoff(1))
+	assert.Equal(t, 2*time.Second, pool.backoff(2))
+	assert.Equal(t, 4*time.Second, pool.backoff(3))
+	assert.Equal(t, 5*time.Second, pool.backoff(4))
+}
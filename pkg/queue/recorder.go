@@ -0,0 +1,280 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/joblog"
+	"github.com/gospotcheck/protofact/pkg/schema"
+)
+
+// recorder implements build.Recorder, writing progress onto a running
+// job and saving it so the job status is current while it runs.
+// Progress is also written to the job's log.
+//
+// It also implements build.Tracker. The recorder it returns for a
+// language writes that language's progress to its entry in the job's
+// Languages, sharing the lock of the job's recorder as languages run
+// at the same time.
+type recorder struct {
+	mu       *sync.Mutex
+	job      *Job
+	language string
+	store    *Store
+	log      *joblog.Log
+	logger   log.FieldLogger
+}
+
+func newRecorder(job *Job, store *Store, out *joblog.Log, logger log.FieldLogger) *recorder {
+	return &recorder{
+		mu:     &sync.Mutex{},
+		job:    job,
+		store:  store,
+		log:    out,
+		logger: logger,
+	}
+}
+
+func (r *recorder) BuildID(id string) {
+	r.printf("build directory id %s", id)
+	r.update(func(job *Job) {
+		if lang := job.language(r.language); lang != nil {
+			lang.BuildID = id
+			return
+		}
+		job.BuildID = id
+	})
+}
+
+func (r *recorder) Version(version string) {
+	r.printf("version %s", version)
+	r.update(func(job *Job) {
+		if lang := job.language(r.language); lang != nil {
+			lang.Version = version
+			return
+		}
+		job.Version = version
+	})
+}
+
+func (r *recorder) Schema(report schema.Report) {
+	r.printf("schema changes since the last release: %s", report.Level())
+	r.update(func(job *Job) {
+		job.Schema = &report
+	})
+}
+
+func (r *recorder) StageStarted(stage string) {
+	r.printf("%s started", stage)
+	r.update(func(job *Job) {
+		stages := r.stages(job)
+		*stages = append(*stages, Stage{
+			Name:      stage,
+			StartedAt: time.Now().UTC(),
+		})
+	})
+}
+
+func (r *recorder) StageFinished(stage string, err error) {
+	r.update(func(job *Job) {
+		stages := *r.stages(job)
+		// the most recent stage with the name is the one finishing
+		for i := len(stages) - 1; i >= 0; i-- {
+			if stages[i].Name != stage || stages[i].FinishedAt != nil {
+				continue
+			}
+			now := time.Now().UTC()
+			stages[i].FinishedAt = &now
+			took := now.Sub(stages[i].StartedAt)
+			if err != nil {
+				stages[i].Error = err.Error()
+				r.printf("%s failed after %s: %v", stage, took, err)
+				return
+			}
+			r.printf("%s finished in %s", stage, took)
+			return
+		}
+	})
+}
+
+// Done reports whether the language succeeded on an earlier attempt,
+// or was already published from the job's commit and ref by another
+// job, as when a webhook is redelivered. A published language is
+// recorded as succeeded without running, unless the job is forced.
+func (r *recorder) Done(language string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lang := r.job.language(language)
+	if lang != nil && lang.State == Succeeded {
+		return true
+	}
+	payload := r.job.Payload
+	if r.job.Force || !published(payload) {
+		return false
+	}
+	publication, found, err := r.store.Published(payload.Repository.FullName, payload.After, language)
+	if err != nil {
+		r.logger.Errorf("%+v\n", err)
+		return false
+	}
+	if !found || publication.Ref != payload.Ref {
+		return false
+	}
+
+	r.forLanguage(language).printf("already published as %s by job %s", publication.Version, publication.JobID)
+	now := time.Now().UTC()
+	entry := Language{
+		Name:        language,
+		State:       Succeeded,
+		Version:     publication.Version,
+		FinishedAt:  &now,
+		PublishedBy: publication.JobID,
+	}
+	if lang != nil {
+		*lang = entry
+	} else {
+		r.job.Languages = append(r.job.Languages, entry)
+	}
+	if err := r.store.Save(r.job); err != nil {
+		r.logger.Errorf("%+v\n", err)
+	}
+	return true
+}
+
+// Started marks the language as running, clearing out the progress of
+// any earlier attempt, and returns a recorder for it.
+func (r *recorder) Started(language string) build.Recorder {
+	lr := r.forLanguage(language)
+	lr.printf("started")
+	lr.update(func(job *Job) {
+		now := time.Now().UTC()
+		entry := Language{
+			Name:      language,
+			State:     Running,
+			StartedAt: &now,
+		}
+		if lang := job.language(language); lang != nil {
+			*lang = entry
+			return
+		}
+		job.Languages = append(job.Languages, entry)
+	})
+	return lr
+}
+
+// Finished records the result of the language, and the publication
+// of the language from the job's commit if it succeeded and published.
+// A language configured not to publish succeeds without publishing, so
+// a later job still packages it.
+func (r *recorder) Finished(language string, err error) {
+	lr := r.forLanguage(language)
+	switch {
+	case build.IsSuperseded(err):
+		lr.printf("superseded by a newer push")
+	case err != nil:
+		lr.printf("failed: %v", err)
+	default:
+		lr.printf("succeeded")
+	}
+	lr.update(func(job *Job) {
+		lang := job.language(language)
+		if lang == nil {
+			return
+		}
+		now := time.Now().UTC()
+		lang.FinishedAt = &now
+		if build.IsSuperseded(err) {
+			lang.State = Superseded
+			return
+		}
+		if err != nil {
+			lang.State = Failed
+			lang.Error = err.Error()
+			lang.FailedStage = build.FailedStage(err)
+			lang.TimedOut = build.IsTimeout(err)
+			return
+		}
+		lang.State = Succeeded
+
+		payload := job.Payload
+		if !published(payload) || !publishedStage(lang.Stages) {
+			return
+		}
+		publication := Publication{
+			Ref:     payload.Ref,
+			Version: lang.Version,
+			JobID:   job.ID,
+			At:      now,
+		}
+		if err := r.store.SetPublished(payload.Repository.FullName, payload.After, language, publication); err != nil {
+			r.logger.Errorf("%+v\n", err)
+		}
+	})
+}
+
+// published reports whether the publications of a push are recorded,
+// which needs the repository and commit it was pushed to.
+func published(payload event.Push) bool {
+	return payload.Repository.FullName != "" && payload.After != ""
+}
+
+// publishedStage reports whether the stages of a language include a
+// publish, or the release of the Go module, that finished without error.
+func publishedStage(stages []Stage) bool {
+	for _, stage := range stages {
+		if stage.Name != build.StagePublish && stage.Name != build.StageRelease {
+			continue
+		}
+		if stage.FinishedAt != nil && stage.Error == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// forLanguage returns a recorder for the named language of the same job.
+func (r *recorder) forLanguage(language string) *recorder {
+	return &recorder{
+		mu:       r.mu,
+		job:      r.job,
+		language: language,
+		store:    r.store,
+		log:      r.log,
+		logger:   r.logger.WithField("language", language),
+	}
+}
+
+// stages returns the stages progress is being recorded to, which are
+// those of the language if the recorder has one.
+func (r *recorder) stages(job *Job) *[]Stage {
+	if lang := job.language(r.language); lang != nil {
+		return &lang.Stages
+	}
+	return &job.Stages
+}
+
+// printf writes a message to the job's log, naming the language if
+// the recorder has one.
+func (r *recorder) printf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if r.language != "" {
+		msg = fmt.Sprintf("%s: %s", r.language, msg)
+	}
+	r.log.Printf("%s", msg)
+}
+
+func (r *recorder) update(fn func(job *Job)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fn(r.job)
+	if err := r.store.Save(r.job); err != nil {
+		r.logger.Errorf("%+v\n", err)
+	}
+}
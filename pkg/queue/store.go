@@ -0,0 +1,677 @@
+// Package queue provides a durable, on-disk job queue for push events
+// and a pool of workers that process them with retries.
+package queue
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	jobsBucket      = []byte("jobs")
+	pendingBucket   = []byte("pending")
+	deadBucket      = []byte("dead")
+	buildsBucket    = []byte("builds")
+	releaseBucket   = []byte("releases")
+	publishedBucket = []byte("published")
+	deliveryBucket  = []byte("deliveries")
+)
+
+// deliveryRetention is how long webhook deliveries are remembered, which
+// covers the three days Github lets a delivery be redelivered for.
+const deliveryRetention = 7 * 24 * time.Hour
+
+// pruneInterval is how often finished jobs are looked for and removed.
+const pruneInterval = time.Hour
+
+// ErrNotFound is returned when a job id does not exist in the store.
+var ErrNotFound = errors.New("job not found")
+
+// ErrQueueFull is returned by Enqueue when the configured number of
+// jobs are already waiting to run.
+var ErrQueueFull = errors.New("job queue is full")
+
+// Store is a job store backed by an embedded bolt database. Jobs are kept
+// by id, and the ids of jobs waiting to run are kept in insertion order
+// so they are picked up first in, first out.
+type Store struct {
+	db        *bolt.DB
+	maxQueued int
+	retention time.Duration
+}
+
+// Open opens, creating if necessary, the job database in the configured data directory.
+func Open(config Config) (*Store, error) {
+	config = config.withDefaults()
+	dir := config.DataDir
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not create data directory %s", dir))
+	}
+
+	path := filepath.Join(dir, "protofact.db")
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not open job database at %s", path))
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{jobsBucket, pendingBucket, deadBucket, buildsBucket, releaseBucket, publishedBucket, deliveryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("could not create bucket %s", name))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db, maxQueued: config.MaxQueued, retention: config.Retention}, nil
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Enqueue saves a job and adds it to the end of the pending list.
+// If the pending list is already full it returns ErrQueueFull and the
+// job is not saved.
+func (s *Store) Enqueue(job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(pendingBucket).Stats().KeyN >= s.maxQueued {
+			return ErrQueueFull
+		}
+		job.State = Queued
+		if err := putJob(tx, job); err != nil {
+			return err
+		}
+		return pushPending(tx, job.ID)
+	})
+}
+
+// Next removes the first pending job that is due to run at or before now,
+// marks it as running and counts the attempt. If no job is due it returns nil.
+func (s *Store) Next(now time.Time) (*Job, error) {
+	var next *Job
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(pendingBucket)
+
+		// keys are collected and deleted after iterating, since deleting
+		// under a bolt cursor can skip the following key
+		var remove [][]byte
+		c := pending.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			job, err := getJob(tx, string(v))
+			if err == ErrNotFound {
+				// the job was removed out from under the pending list
+				remove = append(remove, k)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if job.NextAttempt.After(now) {
+				continue
+			}
+
+			remove = append(remove, k)
+			next = job
+			break
+		}
+
+		for _, k := range remove {
+			if err := pending.Delete(k); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if next == nil {
+			return nil
+		}
+
+		next.State = Running
+		next.Attempts++
+		return putJob(tx, next)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get next pending job")
+	}
+	return next, nil
+}
+
+// Depth returns the number of jobs on the pending list, those waiting
+// for a worker, to be retried or for CI.
+func (s *Store) Depth() (int, error) {
+	var depth int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		depth = tx.Bucket(pendingBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count pending jobs")
+	}
+	return depth, nil
+}
+
+// Save writes the current state of a job without changing its place in the queue.
+func (s *Store) Save(job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putJob(tx, job)
+	})
+}
+
+// BuildNumber returns the build number of a commit of a repository.
+// The first call for a commit gives it the next number of its
+// repository, counting from 1, and every later call returns the same
+// number, so each language and retry of a commit sees the same one.
+func (s *Store) BuildNumber(repository, sha string) (int64, error) {
+	var number int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		builds, err := tx.Bucket(buildsBucket).CreateBucketIfNotExists([]byte(repository))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if existing := builds.Get([]byte(sha)); existing != nil {
+			number = int64(binary.BigEndian.Uint64(existing))
+			return nil
+		}
+		seq, err := builds.NextSequence()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, seq)
+		number = int64(seq)
+		return errors.WithStack(builds.Put([]byte(sha), value))
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("could not get build number of %s in %s", sha, repository))
+	}
+	return number, nil
+}
+
+// Release is the last stable release of a repository.
+type Release struct {
+	SHA     string `json:"sha"`
+	Version string `json:"version"`
+}
+
+// LastRelease returns the last stable release recorded for a
+// repository, and false if none has been.
+func (s *Store) LastRelease(repository string) (Release, bool, error) {
+	var release Release
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(releaseBucket).Get([]byte(repository))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return errors.WithStack(json.Unmarshal(value, &release))
+	})
+	if err != nil {
+		return Release{}, false, errors.Wrap(err, fmt.Sprintf("could not get last release of %s", repository))
+	}
+	return release, found, nil
+}
+
+// SetRelease records the last stable release of a repository.
+func (s *Store) SetRelease(repository string, release Release) error {
+	value, err := json.Marshal(release)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return errors.WithStack(tx.Bucket(releaseBucket).Put([]byte(repository), value))
+	})
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not record release of %s", repository))
+	}
+	return nil
+}
+
+// Publication is a language published from a commit of a repository.
+type Publication struct {
+	// Ref is the ref the commit was published from, as a commit pushed
+	// to another ref is released differently.
+	Ref     string    `json:"ref"`
+	Version string    `json:"version,omitempty"`
+	JobID   string    `json:"job_id"`
+	At      time.Time `json:"at"`
+}
+
+// Published returns the publication of a language from a commit of a
+// repository, and false if the language has not been published from it.
+func (s *Store) Published(repository, sha, language string) (Publication, bool, error) {
+	var publication Publication
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		published := tx.Bucket(publishedBucket).Bucket([]byte(repository))
+		if published == nil {
+			return nil
+		}
+		value := published.Get(publicationKey(sha, language))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return errors.WithStack(json.Unmarshal(value, &publication))
+	})
+	if err != nil {
+		return Publication{}, false, errors.Wrap(err, fmt.Sprintf("could not get publication of %s from %s in %s", language, sha, repository))
+	}
+	return publication, found, nil
+}
+
+// SetPublished records the publication of a language from a commit of a
+// repository, replacing any earlier one.
+func (s *Store) SetPublished(repository, sha, language string, publication Publication) error {
+	value, err := json.Marshal(publication)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		published, err := tx.Bucket(publishedBucket).CreateBucketIfNotExists([]byte(repository))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(published.Put(publicationKey(sha, language), value))
+	})
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not record publication of %s from %s in %s", language, sha, repository))
+	}
+	return nil
+}
+
+func publicationKey(sha, language string) []byte {
+	return []byte(sha + "/" + language)
+}
+
+// delivery is a webhook delivery that has been accepted.
+type delivery struct {
+	JobIDs []string  `json:"job_ids"`
+	At     time.Time `json:"at"`
+}
+
+// Delivery returns the ids of the jobs a webhook delivery was accepted
+// as, and false if the delivery has not been accepted before.
+func (s *Store) Delivery(id string) ([]string, bool, error) {
+	var d delivery
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(deliveryBucket).Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return errors.WithStack(json.Unmarshal(value, &d))
+	})
+	if err != nil {
+		return nil, false, errors.Wrap(err, fmt.Sprintf("could not get delivery %s", id))
+	}
+	return d.JobIDs, found, nil
+}
+
+// EnqueueDelivery saves the jobs a webhook delivery is accepted as and
+// adds them to the end of the pending list, recording the delivery at
+// a time in the same transaction, so two deliveries with the same id
+// cannot both be queued. A delivery recorded before is not queued
+// again, and the ids of the jobs it was accepted as are returned with
+// true. If the pending list has no room for every job it returns
+// ErrQueueFull and nothing is saved, so the delivery is queued when it
+// is redelivered. A delivery without an id, which its provider does not
+// send, is queued without being recorded. Deliveries recorded longer
+// than deliveryRetention before it are forgotten.
+func (s *Store) EnqueueDelivery(id string, jobs []*Job, at time.Time) ([]string, bool, error) {
+	var ids []string
+	var seen bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket(deliveryBucket)
+		if value := deliveries.Get([]byte(id)); id != "" && value != nil {
+			var d delivery
+			if err := json.Unmarshal(value, &d); err != nil {
+				return errors.WithStack(err)
+			}
+			ids, seen = d.JobIDs, true
+			return nil
+		}
+
+		if tx.Bucket(pendingBucket).Stats().KeyN+len(jobs) > s.maxQueued {
+			return ErrQueueFull
+		}
+		for _, job := range jobs {
+			job.State = Queued
+			if err := putJob(tx, job); err != nil {
+				return err
+			}
+			if err := pushPending(tx, job.ID); err != nil {
+				return err
+			}
+			ids = append(ids, job.ID)
+		}
+
+		if id == "" {
+			return nil
+		}
+		if err := pruneDeliveries(deliveries, at); err != nil {
+			return err
+		}
+		value, err := json.Marshal(delivery{JobIDs: ids, At: at})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(deliveries.Put([]byte(id), value))
+	})
+	if err == ErrQueueFull {
+		return nil, false, err
+	}
+	if err != nil {
+		return nil, false, errors.Wrap(err, fmt.Sprintf("could not enqueue delivery %s", id))
+	}
+	return ids, seen, nil
+}
+
+// pruneDeliveries forgets the deliveries recorded longer than
+// deliveryRetention before at.
+func pruneDeliveries(deliveries *bolt.Bucket, at time.Time) error {
+	// keys are collected and deleted after iterating, since deleting
+	// under a bolt cursor can skip the following key
+	var expired [][]byte
+	err := deliveries.ForEach(func(k, v []byte) error {
+		var d delivery
+		if err := json.Unmarshal(v, &d); err != nil {
+			return errors.WithStack(err)
+		}
+		if at.Sub(d.At) > deliveryRetention {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := deliveries.Delete(k); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// Retry puts a job back on the pending list to be run again no earlier than at.
+func (s *Store) Retry(job *Job, at time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		job.State = Queued
+		job.NextAttempt = at
+		if err := putJob(tx, job); err != nil {
+			return err
+		}
+		return pushPending(tx, job.ID)
+	})
+}
+
+// Wait puts a job back on the pending list to wait for the CI of its
+// commit, to be checked again no earlier than at.
+func (s *Store) Wait(job *Job, at time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		job.State = WaitingForCI
+		job.NextAttempt = at
+		if err := putJob(tx, job); err != nil {
+			return err
+		}
+		return pushPending(tx, job.ID)
+	})
+}
+
+// Bury marks a job as failed and moves it to the dead-letter list.
+func (s *Store) Bury(job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		job.State = Failed
+		if err := putJob(tx, job); err != nil {
+			return err
+		}
+		at, err := job.UpdatedAt.MarshalText()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(tx.Bucket(deadBucket).Put([]byte(job.ID), at))
+	})
+}
+
+// Dead returns all jobs on the dead-letter list.
+func (s *Store) Dead() ([]*Job, error) {
+	jobs := []*Job{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadBucket).ForEach(func(k, _ []byte) error {
+			job, err := getJob(tx, string(k))
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list dead-letter jobs")
+	}
+	return jobs, nil
+}
+
+// Requeue takes a job off the dead-letter list, resets its attempts
+// and puts it on the end of the pending list.
+func (s *Store) Requeue(id string) (*Job, error) {
+	var job *Job
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket(deadBucket)
+		if dead.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		if err := dead.Delete([]byte(id)); err != nil {
+			return errors.WithStack(err)
+		}
+
+		var err error
+		job, err = getJob(tx, id)
+		if err != nil {
+			return err
+		}
+		job.State = Queued
+		job.Attempts = 0
+		job.NextAttempt = time.Now().UTC()
+		// a job abandoned waiting for CI gets to wait for it again
+		job.WaitingSince = nil
+		if err := putJob(tx, job); err != nil {
+			return err
+		}
+		return pushPending(tx, job.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Get returns a single job by id.
+func (s *Store) Get(id string) (*Job, error) {
+	var job *Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		job, err = getJob(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Prune removes every finished job, dead-lettered ones included, that
+// has not been updated within the retention period, returning the
+// number removed. Jobs waiting or running are kept however old they are.
+func (s *Store) Prune(now time.Time) (int, error) {
+	var count int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(jobsBucket)
+
+		// keys are collected and deleted after iterating, since deleting
+		// under a bolt cursor can skip the following key
+		var expired [][]byte
+		err := jobs.ForEach(func(k, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return errors.WithStack(err)
+			}
+			if !finished(job.State) || now.Sub(job.UpdatedAt) < s.retention {
+				return nil
+			}
+			expired = append(expired, k)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := jobs.Delete(k); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := tx.Bucket(deadBucket).Delete(k); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "could not prune finished jobs")
+	}
+	return count, nil
+}
+
+// RunPruner prunes finished jobs once immediately and then periodically
+// until ctx is cancelled.
+func (s *Store) RunPruner(ctx context.Context, logger log.FieldLogger) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Prune(time.Now().UTC()); err != nil {
+			logger.Errorf("%+v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// finished reports whether a job in state is done with, so it is never
+// run again unless it is requeued from the dead-letter list.
+func finished(state State) bool {
+	return state == Succeeded || state == Failed || state == Superseded
+}
+
+// List returns every job in the store, in no particular order.
+func (s *Store) List() ([]*Job, error) {
+	jobs := []*Job{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(_, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return errors.WithStack(err)
+			}
+			jobs = append(jobs, &job)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list jobs")
+	}
+	return jobs, nil
+}
+
+// Recover puts any job left running by a previous process back on the
+// pending list. It should be called once at startup, before any workers run.
+// The attempt that was interrupted is not counted.
+func (s *Store) Recover() (int, error) {
+	var count int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var running []*Job
+		err := tx.Bucket(jobsBucket).ForEach(func(_, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return errors.WithStack(err)
+			}
+			if job.State == Running {
+				running = append(running, &job)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, job := range running {
+			job.State = Queued
+			if job.Attempts > 0 {
+				job.Attempts--
+			}
+			if err := putJob(tx, job); err != nil {
+				return err
+			}
+			if err := pushPending(tx, job.ID); err != nil {
+				return err
+			}
+		}
+		count = len(running)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "could not recover running jobs")
+	}
+	return count, nil
+}
+
+func putJob(tx *bolt.Tx, job *Job) error {
+	job.UpdatedAt = time.Now().UTC()
+	content, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal job")
+	}
+	return errors.WithStack(tx.Bucket(jobsBucket).Put([]byte(job.ID), content))
+}
+
+func getJob(tx *bolt.Tx, id string) (*Job, error) {
+	content := tx.Bucket(jobsBucket).Get([]byte(id))
+	if content == nil {
+		return nil, ErrNotFound
+	}
+	var job Job
+	if err := json.Unmarshal(content, &job); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not unmarshal job %s", id))
+	}
+	return &job, nil
+}
+
+func pushPending(tx *bolt.Tx, id string) error {
+	pending := tx.Bucket(pendingBucket)
+	seq, err := pending.NextSequence()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return errors.WithStack(pending.Put(key, []byte(id)))
+}
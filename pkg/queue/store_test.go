@@ -0,0 +1,371 @@
+package queue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/event"
+)
+
+func openTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "protofact-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := Open(Config{DataDir: dir})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_Store_NextIsFirstInFirstOut(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	assert.Nil(t, store.Enqueue(NewJob("first", event.Push{})))
+	assert.Nil(t, store.Enqueue(NewJob("second", event.Push{})))
+
+	job, err := store.Next(time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Equal(t, "first", job.ID)
+	assert.Equal(t, Running, job.State)
+	assert.Equal(t, 1, job.Attempts)
+
+	job, err = store.Next(time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Equal(t, "second", job.ID)
+
+	job, err = store.Next(time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Nil(t, job)
+}
+
+func Test_Store_NextSkipsJobsNotYetDue(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	later := NewJob("later", event.Push{})
+	assert.Nil(t, store.Retry(later, time.Now().UTC().Add(time.Hour)))
+	assert.Nil(t, store.Enqueue(NewJob("now", event.Push{})))
+
+	job, err := store.Next(time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Equal(t, "now", job.ID)
+
+	job, err = store.Next(time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Nil(t, job)
+
+	job, err = store.Next(time.Now().UTC().Add(2 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, "later", job.ID)
+}
+
+func Test_Store_BuryAndRequeue(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{Ref: "refs/heads/master"})))
+	job, err := store.Next(time.Now().UTC())
+	assert.Nil(t, err)
+	waiting := time.Now().UTC()
+	job.WaitingSince = &waiting
+	assert.Nil(t, store.Bury(job))
+
+	dead, err := store.Dead()
+	assert.Nil(t, err)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, Failed, dead[0].State)
+	assert.Equal(t, "refs/heads/master", dead[0].Payload.Ref)
+
+	job, err = store.Requeue("a")
+	assert.Nil(t, err)
+	assert.Equal(t, Queued, job.State)
+	assert.Equal(t, 0, job.Attempts)
+	assert.Nil(t, job.WaitingSince)
+
+	dead, err = store.Dead()
+	assert.Nil(t, err)
+	assert.Len(t, dead, 0)
+
+	_, err = store.Requeue("a")
+	assert.Equal(t, ErrNotFound, err)
+
+	job, err = store.Next(time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Equal(t, "a", job.ID)
+}
+
+func Test_Store_RecoverRequeuesRunningJobs(t *testing.T) {
+	store, cleanup := openTestStore(t)
+	defer cleanup()
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	_, err := store.Next(time.Now().UTC())
+	assert.Nil(t, err)
+
+	count, err := store.Recover()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	job, err := store.Next(time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Equal(t, "a", job.ID)
+	assert.Equal(t, 1, job.Attempts)
+}
+
+func Test_Store_EnqueueWhenFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protofact-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := Open(Config{DataDir: dir, MaxQueued: 2})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer store.Close()
+
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+	assert.Nil(t, store.Enqueue(NewJob("b", event.Push{})))
+	assert.Equal(t, ErrQueueFull, store.Enqueue(NewJob("c", event.Push{})))
+	_, err = store.Get("c")
+	assert.Equal(t, ErrNotFound, err)
+
+	depth, err := store.Depth()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, depth)
+
+	// taking a job off the queue makes room for another
+	_, err = store.Next(time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Nil(t, store.Enqueue(NewJob("c", event.Push{})))
+}
+
+func Test_Store_BuildNumber(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	first, err := store.BuildNumber("org/protos", "aaa")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), first)
+
+	second, err := store.BuildNumber("org/protos", "bbb")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), second)
+
+	again, err := store.BuildNumber("org/protos", "aaa")
+	assert.Nil(t, err)
+	assert.Equal(t, first, again)
+
+	other, err := store.BuildNumber("org/other", "ccc")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), other)
+}
+
+func Test_Store_Release(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	_, found, err := store.LastRelease("org/protos")
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	assert.Nil(t, store.SetRelease("org/protos", Release{SHA: "aaa", Version: "1.0.5"}))
+	assert.Nil(t, store.SetRelease("org/protos", Release{SHA: "bbb", Version: "1.1.7"}))
+
+	release, found, err := store.LastRelease("org/protos")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, Release{SHA: "bbb", Version: "1.1.7"}, release)
+
+	_, found, err = store.LastRelease("org/other")
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+func Test_Store_Published(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	_, found, err := store.Published("org/protos", "aaa", "ruby")
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	at := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	publication := Publication{Ref: "refs/heads/master", Version: "1.0.5", JobID: "a", At: at}
+	assert.Nil(t, store.SetPublished("org/protos", "aaa", "ruby", publication))
+
+	got, found, err := store.Published("org/protos", "aaa", "ruby")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, publication, got)
+
+	// publications are kept per language and repository
+	_, found, err = store.Published("org/protos", "aaa", "npm")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	_, found, err = store.Published("org/other", "aaa", "ruby")
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+func Test_Store_Delivery(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	_, seen, err := store.Delivery("github/1")
+	assert.Nil(t, err)
+	assert.False(t, seen)
+
+	at := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	ids, seen, err := store.EnqueueDelivery("github/1", []*Job{NewJob("a", event.Push{}), NewJob("b", event.Push{})}, at)
+	assert.Nil(t, err)
+	assert.False(t, seen)
+	assert.Equal(t, []string{"a", "b"}, ids)
+	// a delivery that queued nothing is still remembered
+	_, _, err = store.EnqueueDelivery("github/2", nil, at.Add(time.Hour))
+	assert.Nil(t, err)
+
+	// a redelivery is answered with the jobs of the first delivery, and
+	// its own are not queued
+	ids, seen, err = store.EnqueueDelivery("github/1", []*Job{NewJob("c", event.Push{})}, at.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.True(t, seen)
+	assert.Equal(t, []string{"a", "b"}, ids)
+	_, err = store.Get("c")
+	assert.Equal(t, ErrNotFound, err)
+	depth, err := store.Depth()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, depth)
+
+	ids, seen, err = store.Delivery("github/1")
+	assert.Nil(t, err)
+	assert.True(t, seen)
+	assert.Equal(t, []string{"a", "b"}, ids)
+	_, seen, err = store.Delivery("github/2")
+	assert.Nil(t, err)
+	assert.True(t, seen)
+
+	// a delivery without an id is queued but not remembered
+	ids, seen, err = store.EnqueueDelivery("", []*Job{NewJob("d", event.Push{})}, at)
+	assert.Nil(t, err)
+	assert.False(t, seen)
+	assert.Equal(t, []string{"d"}, ids)
+	_, seen, err = store.Delivery("")
+	assert.Nil(t, err)
+	assert.False(t, seen)
+
+	// deliveries are forgotten once they can no longer be redelivered
+	_, _, err = store.EnqueueDelivery("github/3", nil, at.Add(deliveryRetention+time.Minute))
+	assert.Nil(t, err)
+	_, seen, err = store.Delivery("github/1")
+	assert.Nil(t, err)
+	assert.False(t, seen)
+	_, seen, err = store.Delivery("github/2")
+	assert.Nil(t, err)
+	assert.True(t, seen)
+}
+
+func Test_Store_EnqueueDeliveryWhenFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protofact-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := Open(Config{DataDir: dir, MaxQueued: 2})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer store.Close()
+
+	at := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, store.Enqueue(NewJob("a", event.Push{})))
+
+	// a delivery is queued whole or not at all, and is not remembered
+	// when it is turned away so its redelivery is queued
+	jobs := []*Job{NewJob("b", event.Push{}), NewJob("c", event.Push{})}
+	_, _, err = store.EnqueueDelivery("github/1", jobs, at)
+	assert.Equal(t, ErrQueueFull, err)
+	_, err = store.Get("b")
+	assert.Equal(t, ErrNotFound, err)
+	_, seen, err := store.Delivery("github/1")
+	assert.Nil(t, err)
+	assert.False(t, seen)
+
+	ids, seen, err := store.EnqueueDelivery("github/1", jobs[:1], at)
+	assert.Nil(t, err)
+	assert.False(t, seen)
+	assert.Equal(t, []string{"b"}, ids)
+}
+
+func Test_Store_EnqueueDeliveryConcurrently(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	// of the same delivery arriving at once, only one is queued
+	at := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, err := store.EnqueueDelivery("github/1", []*Job{NewJob(fmt.Sprintf("job-%d", i), event.Push{})}, at)
+			assert.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	depth, err := store.Depth()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, depth)
+}
+
+func Test_Store_Prune(t *testing.T) {
+	store, done := openTestStore(t)
+	defer done()
+
+	for _, state := range []State{Succeeded, Superseded} {
+		job := NewJob(string(state), event.Push{})
+		job.State = state
+		assert.Nil(t, store.Save(job))
+	}
+	assert.Nil(t, store.Bury(NewJob("dead", event.Push{})))
+	assert.Nil(t, store.Enqueue(NewJob("queued", event.Push{})))
+	assert.Nil(t, store.Enqueue(NewJob("running", event.Push{})))
+	running, err := store.Next(time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Equal(t, "queued", running.ID)
+
+	// nothing is removed within the retention period
+	now := time.Now().UTC()
+	count, err := store.Prune(now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// after it finished jobs are, dead-lettered ones included, but jobs
+	// waiting or running are kept however old they are
+	count, err = store.Prune(now.Add(8 * 24 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+	for _, id := range []string{string(Succeeded), string(Superseded), "dead"} {
+		_, err := store.Get(id)
+		assert.Equal(t, ErrNotFound, err)
+	}
+	dead, err := store.Dead()
+	assert.Nil(t, err)
+	assert.Empty(t, dead)
+	jobs, err := store.List()
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 2)
+}
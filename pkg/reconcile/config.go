@@ -0,0 +1,22 @@
+package reconcile
+
+import "time"
+
+// Config represents config values for reconciling the pushes missed
+// while Protofact was down.
+type Config struct {
+	// Repositories are the full names of the Github repositories whose
+	// branches are reconciled, such as org/protos. Nothing is reconciled
+	// while it is empty.
+	Repositories []string
+	// Branches are the branches reconciled in every repository. It is the
+	// default branch of the branch policy by default.
+	Branches []string
+	// Lookback is how far back the commits of a branch are looked at,
+	// so a branch that was not pushed to within it is left alone. It is
+	// a day by default.
+	Lookback time.Duration
+	// Interval is how often reconciliation runs after the run at
+	// startup. It is an hour by default.
+	Interval time.Duration
+}
@@ -0,0 +1,241 @@
+// Package reconcile packages the commits whose push Protofact missed,
+// such as while it was down, by comparing the branches of the tracked
+// Github repositories with the record of what has been published.
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+type repo interface {
+	ListCommits(ctx context.Context, owner, repo, branch string, since time.Time) ([]*github.RepositoryCommit, error)
+}
+
+type store interface {
+	List() ([]*queue.Job, error)
+	Published(repository, sha, language string) (queue.Publication, bool, error)
+	Enqueue(job *queue.Job) error
+}
+
+type notifier interface {
+	Notify()
+}
+
+type observer interface {
+	Observe(payload event.Push)
+}
+
+type policy interface {
+	Decide(ref string) branch.Decision
+	Default() string
+}
+
+// Reconciler queues a job for every recent commit of the tracked
+// branches that has not been packaged in each of the languages of the
+// process.
+type Reconciler struct {
+	config    Config
+	repo      repo
+	store     store
+	pool      notifier
+	observer  observer
+	branches  policy
+	languages []string
+	logger    log.FieldLogger
+}
+
+// New returns a pointer to a Reconciler configured with the parameters
+// passed in. Languages are those the process packages.
+func New(config Config, repo repo, store store, pool notifier, observer observer, branches policy, languages []string, logger log.FieldLogger) *Reconciler {
+	if config.Lookback <= 0 {
+		config.Lookback = 24 * time.Hour
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Hour
+	}
+	if len(config.Branches) == 0 {
+		config.Branches = []string{branches.Default()}
+	}
+	return &Reconciler{
+		config:    config,
+		repo:      repo,
+		store:     store,
+		pool:      pool,
+		observer:  observer,
+		branches:  branches,
+		languages: languages,
+		logger:    logger,
+	}
+}
+
+// Run reconciles once immediately and then periodically until ctx is
+// cancelled. It returns straight away if no repository is tracked.
+func (r *Reconciler) Run(ctx context.Context) {
+	if len(r.config.Repositories) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		queued, err := r.Reconcile(ctx, time.Now())
+		if err != nil {
+			r.logger.Errorf("%+v\n", err)
+		}
+		if queued > 0 {
+			r.logger.Warnf("queued %d missed pushes", queued)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile queues a job for every commit of the tracked branches made
+// within the lookback window before now that is missing a language, and
+// returns how many it queued. The commits of a branch are queued oldest
+// first, each as if it was pushed when it was committed, so the builds
+// of the older ones are superseded by the newer ones as for any push. A
+// branch that cannot be listed is logged and skipped, so one repository
+// cannot hold up the others.
+func (r *Reconciler) Reconcile(ctx context.Context, now time.Time) (int, error) {
+	jobs, err := r.store.List()
+	if err != nil {
+		return 0, err
+	}
+	// a commit with a job of its own was not missed, even if the job has
+	// not published it yet or failed to
+	seen := map[string]bool{}
+	for _, job := range jobs {
+		seen[key(job.Payload.Repository.FullName, job.Payload.Ref, job.Payload.After)] = true
+	}
+
+	var queued int
+	for _, repository := range r.config.Repositories {
+		parts := strings.Split(repository, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			r.logger.Errorf("cannot reconcile %q, it is not the full name of a repository such as org/protos", repository)
+			continue
+		}
+		owner, name := parts[0], parts[1]
+
+		for _, b := range r.config.Branches {
+			ref := fmt.Sprintf("refs/heads/%s", b)
+			if r.branches.Decide(ref).Skipped() {
+				continue
+			}
+
+			commits, err := r.repo.ListCommits(ctx, owner, name, b, now.Add(-r.config.Lookback))
+			if err != nil {
+				r.logger.Errorf("%+v\n", err)
+				continue
+			}
+			missed, err := r.missed(seen, repository, ref, commits)
+			if err != nil {
+				return queued, err
+			}
+			for _, m := range missed {
+				commit, sha, missing := m.commit, m.commit.GetSHA(), m.languages
+
+				// the commit is versioned as if it was pushed when it was
+				// committed, so it does not supersede a newer push
+				pushedAt := now
+				if date := commit.GetCommit().GetCommitter().Date; date != nil {
+					pushedAt = *date
+				}
+				payload := event.GithubPush(owner, name, ref, sha, pushedAt)
+				payload.HeadCommit.Message = commit.GetCommit().GetMessage()
+
+				job := queue.NewJob(uuid.NewV4().String(), payload)
+				if len(missing) < len(r.languages) {
+					job.Only = missing
+				}
+				err = r.store.Enqueue(job)
+				if err == queue.ErrQueueFull {
+					// what is left is picked up by the next run
+					r.logger.Warnf("job queue is full, stopped reconciling at %s of %s", b, repository)
+					return queued, nil
+				}
+				if err != nil {
+					return queued, err
+				}
+				r.logger.Infof("queued job %s for %s of %s at %s, which is missing %s", job.ID, b, repository, sha, strings.Join(missing, ", "))
+				r.observer.Observe(payload)
+				r.pool.Notify()
+				seen[key(repository, ref, sha)] = true
+				queued++
+			}
+		}
+	}
+	return queued, nil
+}
+
+// missedCommit is a commit of a branch and the languages it is missing.
+type missedCommit struct {
+	commit    *github.RepositoryCommit
+	languages []string
+}
+
+// missed returns the commits of a branch made after the newest commit
+// it was packaged at, oldest first, from its commits listed newest first.
+// A commit with a job of its own, which seen holds, or published in any
+// language was packaged, and the commits before it were superseded by it
+// or pushed along with it. Such a commit is only missed if it is missing
+// a language.
+func (r *Reconciler) missed(seen map[string]bool, repository, ref string, commits []*github.RepositoryCommit) ([]missedCommit, error) {
+	var missed []missedCommit
+	for _, commit := range commits {
+		if seen[key(repository, ref, commit.GetSHA())] {
+			break
+		}
+		missing, err := r.missing(repository, ref, commit.GetSHA())
+		if err != nil {
+			return nil, err
+		}
+		if len(missing) > 0 {
+			missed = append(missed, missedCommit{commit: commit, languages: missing})
+		}
+		if len(missing) < len(r.languages) {
+			break
+		}
+	}
+	for i, j := 0, len(missed)-1; i < j; i, j = i+1, j-1 {
+		missed[i], missed[j] = missed[j], missed[i]
+	}
+	return missed, nil
+}
+
+// missing returns the languages that have not been published from a
+// commit pushed to ref.
+func (r *Reconciler) missing(repository, ref, sha string) ([]string, error) {
+	var missing []string
+	for _, language := range r.languages {
+		publication, found, err := r.store.Published(repository, sha, language)
+		if err != nil {
+			return nil, err
+		}
+		if !found || publication.Ref != ref {
+			missing = append(missing, language)
+		}
+	}
+	return missing, nil
+}
+
+func key(repository, ref, sha string) string {
+	return repository + " " + ref + " " + sha
+}
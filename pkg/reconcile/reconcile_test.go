@@ -0,0 +1,237 @@
+package reconcile
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+// fakeCommit is a commit of a branch of a fakeRepo.
+type fakeCommit struct {
+	sha  string
+	date time.Time
+}
+
+// fakeRepo holds the commits of each branch of each repository, newest
+// first, keyed by full name and branch.
+type fakeRepo struct {
+	commits map[string][]fakeCommit
+	since   []time.Time
+}
+
+func (f *fakeRepo) ListCommits(ctx context.Context, owner, repo, branch string, since time.Time) ([]*github.RepositoryCommit, error) {
+	f.since = append(f.since, since)
+	key := owner + "/" + repo + "@" + branch
+	commits, ok := f.commits[key]
+	if !ok {
+		return nil, errors.Errorf("no branch %s", key)
+	}
+	var listed []*github.RepositoryCommit
+	for _, c := range commits {
+		if c.date.Before(since) {
+			continue
+		}
+		sha, date := c.sha, c.date
+		message := "Update protos"
+		listed = append(listed, &github.RepositoryCommit{
+			SHA: &sha,
+			Commit: &github.Commit{
+				Message:   &message,
+				Committer: &github.CommitAuthor{Date: &date},
+			},
+		})
+	}
+	return listed, nil
+}
+
+type fakeNotifier struct {
+	notified int
+}
+
+func (f *fakeNotifier) Notify() {
+	f.notified++
+}
+
+type fakeObserver struct {
+	observed []event.Push
+}
+
+func (f *fakeObserver) Observe(payload event.Push) {
+	f.observed = append(f.observed, payload)
+}
+
+func openTestStore(t *testing.T) *queue.Store {
+	dir, err := ioutil.TempDir("", "protofact-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := queue.Open(queue.Config{DataDir: dir})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll(dir)
+	})
+	return store
+}
+
+func newTestPolicy(t *testing.T) *branch.Policy {
+	policy, err := branch.New(branch.Config{
+		Rules: []branch.Rule{{Glob: "wip/*", Channel: "skip"}},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return policy
+}
+
+func Test_Reconcile(t *testing.T) {
+	now := time.Date(2020, 6, 2, 12, 0, 0, 0, time.UTC)
+	repo := &fakeRepo{
+		commits: map[string][]fakeCommit{
+			"org/protos@master":  {{"aaa", now.Add(-time.Hour)}},
+			"org/protos@develop": {{"bbb", now.Add(-2 * time.Hour)}},
+			"org/protos@wip/x":   {{"ccc", now.Add(-time.Hour)}},
+			"org/other@master":   {{"ddd", now.Add(-time.Hour)}},
+			"org/stale@master":   {{"eee", now.Add(-48 * time.Hour)}},
+		},
+	}
+	store := openTestStore(t)
+	pool := &fakeNotifier{}
+	observer := &fakeObserver{}
+	config := Config{
+		Repositories: []string{"org/protos", "org/other", "org/stale", "org/missing", "protos"},
+		Branches:     []string{"master", "develop", "wip/x"},
+	}
+	r := New(config, repo, store, pool, observer, newTestPolicy(t), []string{"npm", "ruby"}, log.WithField("test", t.Name()))
+
+	// master of org/protos was published in ruby only, and develop was
+	// pushed but has not been packaged yet
+	assert.Nil(t, store.SetPublished("org/protos", "aaa", "ruby", queue.Publication{Ref: "refs/heads/master", JobID: "a"}))
+	pushed := queue.NewJob("b", event.GithubPush("org", "protos", "refs/heads/develop", "bbb", now))
+	assert.Nil(t, store.Enqueue(pushed))
+	// master of org/other was published, but from another ref
+	assert.Nil(t, store.SetPublished("org/other", "ddd", "npm", queue.Publication{Ref: "refs/heads/release", JobID: "d"}))
+	assert.Nil(t, store.SetPublished("org/other", "ddd", "ruby", queue.Publication{Ref: "refs/heads/release", JobID: "d"}))
+
+	queued, err := r.Reconcile(context.Background(), now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, queued)
+	assert.Equal(t, 2, pool.notified)
+	assert.Len(t, observer.observed, 2)
+	for _, since := range repo.since {
+		assert.Equal(t, now.Add(-24*time.Hour), since)
+	}
+
+	jobs, err := store.List()
+	assert.Nil(t, err)
+	byCommit := map[string]*queue.Job{}
+	for _, job := range jobs {
+		byCommit[job.Payload.After] = job
+	}
+	assert.Len(t, byCommit, 3)
+
+	// only the languages missing from a commit are packaged
+	master := byCommit["aaa"]
+	assert.Equal(t, []string{"npm"}, master.Only)
+	assert.Equal(t, "refs/heads/master", master.Payload.Ref)
+	assert.Equal(t, "org/protos", master.Payload.Repository.FullName)
+	assert.Equal(t, "Update protos", master.Payload.HeadCommit.Message)
+	assert.Equal(t, now.Add(-time.Hour).Unix(), master.Payload.Repository.PushedAt)
+
+	other := byCommit["ddd"]
+	assert.Empty(t, other.Only)
+	assert.Equal(t, "refs/heads/master", other.Payload.Ref)
+
+	// a commit with a job is left to it, and a commit that was queued is
+	// not queued again
+	queued, err = r.Reconcile(context.Background(), now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, queued)
+}
+
+func Test_Reconcile_MissedCommits(t *testing.T) {
+	now := time.Date(2020, 6, 2, 12, 0, 0, 0, time.UTC)
+	repo := &fakeRepo{
+		commits: map[string][]fakeCommit{
+			// two pushes were missed after the last one was published
+			"org/protos@master": {
+				{"ccc", now.Add(-time.Hour)},
+				{"bbb", now.Add(-2 * time.Hour)},
+				{"aaa", now.Add(-3 * time.Hour)},
+			},
+			// and one after a commit that has a job, whose older commits
+			// were pushed along with it
+			"org/protos@develop": {
+				{"fff", now.Add(-time.Hour)},
+				{"eee", now.Add(-2 * time.Hour)},
+				{"ddd", now.Add(-3 * time.Hour)},
+			},
+		},
+	}
+	store := openTestStore(t)
+	observer := &fakeObserver{}
+	config := Config{
+		Repositories: []string{"org/protos"},
+		Branches:     []string{"master", "develop"},
+	}
+	r := New(config, repo, store, &fakeNotifier{}, observer, newTestPolicy(t), []string{"npm", "ruby"}, log.WithField("test", t.Name()))
+
+	assert.Nil(t, store.SetPublished("org/protos", "aaa", "npm", queue.Publication{Ref: "refs/heads/master", JobID: "a"}))
+	assert.Nil(t, store.SetPublished("org/protos", "aaa", "ruby", queue.Publication{Ref: "refs/heads/master", JobID: "a"}))
+	assert.Nil(t, store.Enqueue(queue.NewJob("e", event.GithubPush("org", "protos", "refs/heads/develop", "eee", now))))
+
+	queued, err := r.Reconcile(context.Background(), now)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, queued)
+
+	// the missed commits of a branch are seen oldest first, each as if it
+	// was pushed when it was committed, so the newest supersedes the
+	// builds of the others
+	var observed []string
+	for _, payload := range observer.observed {
+		observed = append(observed, payload.After)
+	}
+	assert.Equal(t, []string{"bbb", "ccc", "fff"}, observed)
+	assert.Equal(t, now.Add(-2*time.Hour).Unix(), observer.observed[0].Repository.PushedAt)
+	assert.Equal(t, now.Add(-time.Hour).Unix(), observer.observed[1].Repository.PushedAt)
+
+	// and are not queued again
+	queued, err = r.Reconcile(context.Background(), now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, queued)
+}
+
+func Test_Reconcile_Defaults(t *testing.T) {
+	policy, err := branch.New(branch.Config{Default: "main"})
+	assert.Nil(t, err)
+	r := New(Config{}, &fakeRepo{}, openTestStore(t), &fakeNotifier{}, &fakeObserver{}, policy, []string{"npm"}, log.WithField("test", t.Name()))
+
+	assert.Equal(t, []string{"main"}, r.config.Branches)
+	assert.Equal(t, 24*time.Hour, r.config.Lookback)
+	assert.Equal(t, time.Hour, r.config.Interval)
+
+	// without repositories there is nothing to reconcile
+	done := make(chan struct{})
+	go func() {
+		r.Run(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return without repositories")
+	}
+}
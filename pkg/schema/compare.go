@@ -0,0 +1,262 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The levels of a change, by what they mean for the version of the
+// code generated from the schema.
+const (
+	// Breaking changes can break code or clients built against the old
+	// schema, and need a new major version.
+	Breaking = "breaking"
+	// Minor changes add to the schema, and need a new minor version.
+	Minor = "minor"
+	// Patch means nothing in the schema changed.
+	Patch = "patch"
+)
+
+// Change is a single difference between two schemas.
+type Change struct {
+	Level       string `json:"level"`
+	Description string `json:"description"`
+}
+
+// Report is the result of comparing the schema of a commit with that of
+// the last stable release.
+type Report struct {
+	// Base is the commit of the last stable release the schema was
+	// compared with, and BaseVersion the version it was released as.
+	// Both are empty if there was no release to compare with.
+	Base        string   `json:"base,omitempty"`
+	BaseVersion string   `json:"base_version,omitempty"`
+	Changes     []Change `json:"changes,omitempty"`
+}
+
+// Level returns the highest level of the changes in the report, or
+// Patch if there are none.
+func (r Report) Level() string {
+	level := Patch
+	for _, c := range r.Changes {
+		if c.Level == Breaking {
+			return Breaking
+		}
+		level = Minor
+	}
+	return level
+}
+
+// Markdown returns the report as a markdown section, such as for the
+// body of a release.
+func (r Report) Markdown() string {
+	var b strings.Builder
+	b.WriteString("### Schema changes\n\n")
+	if r.Base == "" {
+		b.WriteString("First release, there was no earlier release to compare with.\n")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Compared with %s (%s): %s.\n", r.BaseVersion, r.Base, r.Level())
+	if len(r.Changes) > 0 {
+		b.WriteString("\n")
+	}
+	for _, c := range r.Changes {
+		fmt.Fprintf(&b, "- **%s** %s\n", c.Level, c.Description)
+	}
+	return b.String()
+}
+
+// Compare returns the changes from the old schema to the new one, the
+// breaking changes first. Removing or renaming a message, enum,
+// service, field, enum value or RPC, or changing the type, number or
+// label of a field or the types of an RPC, is breaking. Adding any of
+// them is minor.
+func Compare(old, new *Schema) []Change {
+	var breaking, minor []string
+
+	for _, name := range sortedKeys(old.Messages) {
+		o := old.Messages[name]
+		n, ok := new.Messages[name]
+		if !ok {
+			breaking = append(breaking, fmt.Sprintf("message %s was removed", name))
+			continue
+		}
+		for _, number := range sortedInts(o.Fields) {
+			of := o.Fields[number]
+			nf, ok := n.Fields[number]
+			switch {
+			case !ok:
+				breaking = append(breaking, fmt.Sprintf("field %s.%s (%d) was removed", name, of.Name, number))
+			case nf.Name != of.Name:
+				breaking = append(breaking, fmt.Sprintf("field %s.%s (%d) was renamed to %s", name, of.Name, number, nf.Name))
+			}
+			if !ok {
+				continue
+			}
+			if nf.Type != of.Type {
+				breaking = append(breaking, fmt.Sprintf("field %s.%s (%d) changed type from %s to %s", name, nf.Name, number, of.Type, nf.Type))
+			}
+			if label(nf) != label(of) {
+				breaking = append(breaking, fmt.Sprintf("field %s.%s (%d) changed from %s to %s", name, nf.Name, number, label(of), label(nf)))
+			}
+			if nf.Oneof != of.Oneof {
+				breaking = append(breaking, fmt.Sprintf("field %s.%s (%d) moved from oneof %q to %q", name, nf.Name, number, of.Oneof, nf.Oneof))
+			}
+		}
+		for _, number := range sortedInts(n.Fields) {
+			if _, ok := o.Fields[number]; !ok {
+				minor = append(minor, fmt.Sprintf("field %s.%s (%d) was added", name, n.Fields[number].Name, number))
+			}
+		}
+	}
+	for _, name := range sortedKeys(new.Messages) {
+		if _, ok := old.Messages[name]; !ok {
+			minor = append(minor, fmt.Sprintf("message %s was added", name))
+		}
+	}
+
+	for _, name := range sortedKeys(old.Enums) {
+		o := old.Enums[name]
+		n, ok := new.Enums[name]
+		if !ok {
+			breaking = append(breaking, fmt.Sprintf("enum %s was removed", name))
+			continue
+		}
+		for _, number := range sortedInts(o.Values) {
+			nv, ok := n.Values[number]
+			switch {
+			case !ok:
+				breaking = append(breaking, fmt.Sprintf("enum value %s.%s (%d) was removed", name, o.Values[number], number))
+			case nv != o.Values[number]:
+				breaking = append(breaking, fmt.Sprintf("enum value %s.%s (%d) was renamed to %s", name, o.Values[number], number, nv))
+			}
+		}
+		for _, number := range sortedInts(n.Values) {
+			if _, ok := o.Values[number]; !ok {
+				minor = append(minor, fmt.Sprintf("enum value %s.%s (%d) was added", name, n.Values[number], number))
+			}
+		}
+	}
+	for _, name := range sortedKeys(new.Enums) {
+		if _, ok := old.Enums[name]; !ok {
+			minor = append(minor, fmt.Sprintf("enum %s was added", name))
+		}
+	}
+
+	for _, name := range sortedKeys(old.Services) {
+		o := old.Services[name]
+		n, ok := new.Services[name]
+		if !ok {
+			breaking = append(breaking, fmt.Sprintf("service %s was removed", name))
+			continue
+		}
+		for _, method := range sortedKeys(o.Methods) {
+			om := o.Methods[method]
+			nm, ok := n.Methods[method]
+			if !ok {
+				// a renamed RPC shows up as removed under its old name
+				breaking = append(breaking, fmt.Sprintf("rpc %s.%s was removed or renamed", name, method))
+				continue
+			}
+			if signature(nm) != signature(om) {
+				breaking = append(breaking, fmt.Sprintf("rpc %s.%s changed from %s to %s", name, method, signature(om), signature(nm)))
+			}
+		}
+		for _, method := range sortedKeys(n.Methods) {
+			if _, ok := o.Methods[method]; !ok {
+				minor = append(minor, fmt.Sprintf("rpc %s.%s was added", name, method))
+			}
+		}
+	}
+	for _, name := range sortedKeys(new.Services) {
+		if _, ok := old.Services[name]; !ok {
+			minor = append(minor, fmt.Sprintf("service %s was added", name))
+		}
+	}
+
+	var changes []Change
+	for _, d := range breaking {
+		changes = append(changes, Change{Level: Breaking, Description: d})
+	}
+	for _, d := range minor {
+		changes = append(changes, Change{Level: Minor, Description: d})
+	}
+	return changes
+}
+
+// label returns how a field is repeated, treating an optional label as
+// the same as none as both are singular on the wire.
+func label(f *Field) string {
+	if f.Label == "repeated" || f.Label == "required" {
+		return f.Label
+	}
+	return "singular"
+}
+
+func signature(m *Method) string {
+	in, out := m.Input, m.Output
+	if m.ClientStreaming {
+		in = "stream " + in
+	}
+	if m.ServerStreaming {
+		out = "stream " + out
+	}
+	return fmt.Sprintf("(%s) returns (%s)", in, out)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*Message:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*Enum:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*Service:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*Method:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedInts(m interface{}) []int {
+	var keys []int
+	switch m := m.(type) {
+	case map[int]*Field:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[int]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+type reportKey struct{}
+
+// WithReport returns a copy of ctx carrying the schema report of the
+// commit being built.
+func WithReport(ctx context.Context, r *Report) context.Context {
+	return context.WithValue(ctx, reportKey{}, r)
+}
+
+// ReportFrom returns the schema report carried by ctx, or nil if the
+// schema was not compared.
+func ReportFrom(ctx context.Context) *Report {
+	r, _ := ctx.Value(reportKey{}).(*Report)
+	return r
+}
@@ -0,0 +1,467 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// scalars are the types built into protobuf, which need no resolving.
+var scalars = map[string]bool{
+	"double": true, "float": true, "int32": true, "int64": true, "uint32": true, "uint64": true,
+	"sint32": true, "sint64": true, "fixed32": true, "fixed64": true, "sfixed32": true, "sfixed64": true,
+	"bool": true, "string": true, "bytes": true,
+}
+
+// parser reads the declarations of one .proto file into a Schema. It
+// only understands as much of the language as comparing schemas needs,
+// and skips options, reserved ranges, extensions and imports.
+type parser struct {
+	file   string
+	tokens []token
+	pos    int
+	pkg    string
+	schema *Schema
+}
+
+type token struct {
+	text string
+	line int
+}
+
+// parse adds the declarations of a .proto file to s.
+func parse(file, content string, s *Schema) error {
+	tokens, err := tokenize(content)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not read %s", file))
+	}
+	p := &parser{file: file, tokens: tokens, schema: s}
+	if err := p.parseFile(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not parse %s", file))
+	}
+	return nil
+}
+
+func tokenize(content string) ([]token, error) {
+	var tokens []token
+	line := 1
+	runes := []rune(content)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == '\n':
+			line++
+			i++
+		case unicode.IsSpace(r):
+			i++
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '/':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			i += 2
+			for i < len(runes) && !(runes[i] == '*' && i+1 < len(runes) && runes[i+1] == '/') {
+				if runes[i] == '\n' {
+					line++
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, errors.Errorf("line %d: comment is not closed", line)
+			}
+			i += 2
+		case r == '"' || r == '\'':
+			start := i
+			i++
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' {
+					i++
+				}
+				if i < len(runes) && runes[i] == '\n' {
+					return nil, errors.Errorf("line %d: string is not closed", line)
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, errors.Errorf("line %d: string is not closed", line)
+			}
+			i++
+			tokens = append(tokens, token{text: string(runes[start:i]), line: line})
+		case isWord(r):
+			start := i
+			for i < len(runes) && isWord(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{text: string(runes[start:i]), line: line})
+		default:
+			tokens = append(tokens, token{text: string(r), line: line})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-' || r == '+'
+}
+
+func (p *parser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos].text
+}
+
+func (p *parser) next() string {
+	text := p.peek()
+	p.pos++
+	return text
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	line := 0
+	if p.pos < len(p.tokens) {
+		line = p.tokens[p.pos].line
+	} else if len(p.tokens) > 0 {
+		line = p.tokens[len(p.tokens)-1].line
+	}
+	return errors.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) expect(text string) error {
+	if got := p.next(); got != text {
+		p.pos--
+		return p.errorf("expected %q, found %q", text, got)
+	}
+	return nil
+}
+
+func (p *parser) parseFile() error {
+	for p.pos < len(p.tokens) {
+		switch p.peek() {
+		case "package":
+			p.next()
+			p.pkg = p.next()
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case "message":
+			p.next()
+			if err := p.parseMessage(p.pkg); err != nil {
+				return err
+			}
+		case "enum":
+			p.next()
+			if err := p.parseEnum(p.pkg); err != nil {
+				return err
+			}
+		case "service":
+			p.next()
+			if err := p.parseService(); err != nil {
+				return err
+			}
+		case "extend":
+			if err := p.skipBlock(); err != nil {
+				return err
+			}
+		case ";":
+			p.next()
+		default:
+			// syntax, edition, import and option statements
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseMessage(scope string) error {
+	name := p.next()
+	full := join(scope, name)
+	msg := &Message{Name: full, Fields: map[int]*Field{}}
+	p.schema.Messages[full] = msg
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	return p.parseMessageBody(msg, "")
+}
+
+// parseMessageBody reads fields and nested declarations up to the
+// closing brace of a message, or of a oneof in it.
+func (p *parser) parseMessageBody(msg *Message, oneof string) error {
+	for {
+		switch p.peek() {
+		case "":
+			return p.errorf("message %s is not closed", msg.Name)
+		case "}":
+			p.next()
+			return nil
+		case ";":
+			p.next()
+		case "message":
+			p.next()
+			if err := p.parseMessage(msg.Name); err != nil {
+				return err
+			}
+		case "enum":
+			p.next()
+			if err := p.parseEnum(msg.Name); err != nil {
+				return err
+			}
+		case "extend":
+			if err := p.skipBlock(); err != nil {
+				return err
+			}
+		case "option", "reserved", "extensions":
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		case "oneof":
+			p.next()
+			name := p.next()
+			if err := p.expect("{"); err != nil {
+				return err
+			}
+			if err := p.parseMessageBody(msg, name); err != nil {
+				return err
+			}
+		default:
+			if err := p.parseField(msg, oneof); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *parser) parseField(msg *Message, oneof string) error {
+	field := &Field{Oneof: oneof}
+	switch p.peek() {
+	case "repeated", "optional", "required":
+		field.Label = p.next()
+	}
+
+	if p.peek() == "map" && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].text == "<" {
+		p.next()
+		p.next()
+		key := p.next()
+		if err := p.expect(","); err != nil {
+			return err
+		}
+		value := p.next()
+		if err := p.expect(">"); err != nil {
+			return err
+		}
+		field.Type = fmt.Sprintf("map<%s, %s>", key, value)
+		field.mapKey, field.mapValue = key, value
+	} else {
+		field.Type = p.next()
+	}
+
+	// a proto2 group declares a message and a field of it at once
+	group := field.Type == "group"
+	if group {
+		groupName := p.next()
+		field.Name = strings.ToLower(groupName)
+		field.Type = groupName
+	} else {
+		field.Name = p.next()
+	}
+
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	number, err := p.number()
+	if err != nil {
+		return err
+	}
+	field.Number = number
+	if p.peek() == "[" {
+		if err := p.skipBalanced("[", "]"); err != nil {
+			return err
+		}
+	}
+
+	field.scope = msg.Name
+	msg.Fields[number] = field
+	if group {
+		nested := &Message{Name: join(msg.Name, field.Type), Fields: map[int]*Field{}}
+		p.schema.Messages[nested.Name] = nested
+		if err := p.expect("{"); err != nil {
+			return err
+		}
+		return p.parseMessageBody(nested, "")
+	}
+	return p.expect(";")
+}
+
+func (p *parser) parseEnum(scope string) error {
+	name := p.next()
+	enum := &Enum{Name: join(scope, name), Values: map[int]string{}}
+	p.schema.Enums[enum.Name] = enum
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	for {
+		switch p.peek() {
+		case "":
+			return p.errorf("enum %s is not closed", enum.Name)
+		case "}":
+			p.next()
+			return nil
+		case ";":
+			p.next()
+		case "option", "reserved":
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		default:
+			value := p.next()
+			if err := p.expect("="); err != nil {
+				return err
+			}
+			number, err := p.number()
+			if err != nil {
+				return err
+			}
+			if p.peek() == "[" {
+				if err := p.skipBalanced("[", "]"); err != nil {
+					return err
+				}
+			}
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+			// the first name of an aliased number is the one kept
+			if _, ok := enum.Values[number]; !ok {
+				enum.Values[number] = value
+			}
+		}
+	}
+}
+
+func (p *parser) parseService() error {
+	name := p.next()
+	svc := &Service{Name: join(p.pkg, name), Methods: map[string]*Method{}}
+	p.schema.Services[svc.Name] = svc
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	for {
+		switch p.peek() {
+		case "":
+			return p.errorf("service %s is not closed", svc.Name)
+		case "}":
+			p.next()
+			return nil
+		case ";":
+			p.next()
+		case "rpc":
+			p.next()
+			method := &Method{Name: p.next(), scope: p.pkg}
+			var err error
+			if method.ClientStreaming, method.Input, err = p.rpcType(); err != nil {
+				return err
+			}
+			if err := p.expect("returns"); err != nil {
+				return err
+			}
+			if method.ServerStreaming, method.Output, err = p.rpcType(); err != nil {
+				return err
+			}
+			if p.peek() == "{" {
+				if err := p.skipBalanced("{", "}"); err != nil {
+					return err
+				}
+			} else if err := p.expect(";"); err != nil {
+				return err
+			}
+			svc.Methods[method.Name] = method
+		default:
+			// options
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *parser) rpcType() (bool, string, error) {
+	if err := p.expect("("); err != nil {
+		return false, "", err
+	}
+	stream := false
+	if p.peek() == "stream" && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].text != ")" {
+		p.next()
+		stream = true
+	}
+	typ := p.next()
+	return stream, typ, p.expect(")")
+}
+
+func (p *parser) number() (int, error) {
+	text := p.next()
+	var n int
+	if _, err := fmt.Sscan(text, &n); err != nil {
+		p.pos--
+		return 0, p.errorf("expected a number, found %q", text)
+	}
+	return n, nil
+}
+
+// skipStatement skips to the end of a statement, past any braces or
+// brackets in it, such as those of an aggregate option value.
+func (p *parser) skipStatement() error {
+	depth := 0
+	for {
+		switch p.next() {
+		case "":
+			return p.errorf("statement is not closed")
+		case "{", "[", "(":
+			depth++
+		case "}", "]", ")":
+			depth--
+		case ";":
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+// skipBlock skips a declaration up to the end of its braces.
+func (p *parser) skipBlock() error {
+	for p.peek() != "{" {
+		if p.next() == "" {
+			return p.errorf("block is not opened")
+		}
+	}
+	return p.skipBalanced("{", "}")
+}
+
+func (p *parser) skipBalanced(open, close string) error {
+	if err := p.expect(open); err != nil {
+		return err
+	}
+	depth := 1
+	for depth > 0 {
+		switch p.next() {
+		case "":
+			return p.errorf("%q is not closed", open)
+		case open:
+			depth++
+		case close:
+			depth--
+		}
+	}
+	return nil
+}
+
+func join(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
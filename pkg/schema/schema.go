@@ -0,0 +1,221 @@
+// Package schema reads the protobuf schema of a repository from its
+// .proto files and compares two schemas, classifying the changes
+// between them by how they affect the code generated from them.
+package schema
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Schema holds the messages, enums and services declared in a set of
+// .proto files, each by its fully qualified name.
+type Schema struct {
+	Messages map[string]*Message
+	Enums    map[string]*Enum
+	Services map[string]*Service
+}
+
+// Message is a message and its fields, by field number.
+type Message struct {
+	Name   string
+	Fields map[int]*Field
+}
+
+// Field is a field of a message. Type is the fully qualified name of a
+// message or enum type, as far as it can be resolved, or a scalar type.
+type Field struct {
+	Name   string
+	Number int
+	Type   string
+	// Label is repeated, optional or required, or empty if the field
+	// was declared without one.
+	Label string
+	// Oneof is the name of the oneof the field is part of, if any.
+	Oneof string
+
+	scope    string
+	mapKey   string
+	mapValue string
+}
+
+// Enum is an enum and the names of its values, by number.
+type Enum struct {
+	Name   string
+	Values map[int]string
+}
+
+// Service is a service and its RPCs, by name.
+type Service struct {
+	Name    string
+	Methods map[string]*Method
+}
+
+// Method is an RPC of a service.
+type Method struct {
+	Name            string
+	Input           string
+	Output          string
+	ClientStreaming bool
+	ServerStreaming bool
+
+	scope string
+}
+
+func newSchema() *Schema {
+	return &Schema{
+		Messages: map[string]*Message{},
+		Enums:    map[string]*Enum{},
+		Services: map[string]*Service{},
+	}
+}
+
+// Parse reads the schema declared by a set of .proto files, given
+// their content by file name.
+func Parse(files map[string]string) (*Schema, error) {
+	s := newSchema()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := parse(name, files[name], s); err != nil {
+			return nil, err
+		}
+	}
+	s.resolve()
+	return s, nil
+}
+
+// Load reads the schema declared by every .proto file under dir.
+func Load(dir string) (*Schema, error) {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".proto" {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[path] = string(content)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not read .proto files under %s", dir))
+	}
+	return Parse(files)
+}
+
+// LoadCommit reads the schema declared by every .proto file under the
+// path dir, relative to the root of the repository, as it was at the
+// commit sha of the git repository checked out in repoDir.
+func LoadCommit(ctx context.Context, repoDir, sha, dir string) (*Schema, error) {
+	args := []string{"ls-tree", "-r", "--name-only", sha}
+	if dir != "" && dir != "." {
+		args = append(args, "--", dir)
+	}
+	out, err := git(ctx, repoDir, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]string{}
+	for _, path := range strings.Split(out, "\n") {
+		if filepath.Ext(path) != ".proto" {
+			continue
+		}
+		content, err := git(ctx, repoDir, "show", fmt.Sprintf("%s:%s", sha, path))
+		if err != nil {
+			return nil, err
+		}
+		files[path] = content
+	}
+	return Parse(files)
+}
+
+// resolve replaces the type names of fields and RPCs with the fully
+// qualified names they refer to, following protobuf's scoping rules,
+// so a type is compared the same however it was written. A name that
+// is not declared in the schema, such as one imported from elsewhere,
+// is left as written.
+func (s *Schema) resolve() {
+	for _, msg := range s.Messages {
+		for _, field := range msg.Fields {
+			if field.mapKey != "" {
+				field.Type = fmt.Sprintf("map<%s, %s>", field.mapKey, s.lookup(field.scope, field.mapValue))
+				continue
+			}
+			field.Type = s.lookup(field.scope, field.Type)
+		}
+	}
+	for _, svc := range s.Services {
+		for _, method := range svc.Methods {
+			method.Input = s.lookup(method.scope, method.Input)
+			method.Output = s.lookup(method.scope, method.Output)
+		}
+	}
+}
+
+func (s *Schema) lookup(scope, name string) string {
+	if scalars[name] {
+		return name
+	}
+	if strings.HasPrefix(name, ".") {
+		return strings.TrimPrefix(name, ".")
+	}
+	for {
+		full := join(scope, name)
+		if s.declared(full) {
+			return full
+		}
+		if scope == "" {
+			return name
+		}
+		if i := strings.LastIndex(scope, "."); i >= 0 {
+			scope = scope[:i]
+		} else {
+			scope = ""
+		}
+	}
+}
+
+func (s *Schema) declared(name string) bool {
+	if _, ok := s.Messages[name]; ok {
+		return true
+	}
+	_, ok := s.Enums[name]
+	return ok
+}
+
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		msg := fmt.Sprintf("error running git %s", strings.Join(args, " "))
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			msg = fmt.Sprintf("%s: %s", msg, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", errors.Wrap(err, msg)
+	}
+	return string(out), nil
+}
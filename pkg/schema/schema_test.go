@@ -0,0 +1,242 @@
+package schema
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const userProto = `
+syntax = "proto3";
+
+package demo.users; // the users service
+
+import "google/protobuf/timestamp.proto";
+
+option java_package = "com.demo.users";
+option (custom) = { a: 1, b: "}" };
+
+/* a user of the
+   application */
+message User {
+  string id = 1;
+  string name = 2 [deprecated = true];
+  repeated Role roles = 3;
+  google.protobuf.Timestamp created_at = 4;
+  map<string, Address> addresses = 5;
+  oneof contact {
+    string email = 6;
+    string phone = 7;
+  }
+  reserved 8, 9 to 11;
+  reserved "legacy";
+
+  message Address {
+    string street = 1;
+  }
+}
+
+enum Role {
+  option allow_alias = true;
+  ROLE_UNKNOWN = 0;
+  ROLE_ADMIN = 1;
+  ROLE_ROOT = 1;
+}
+
+service Users {
+  option deprecated = false;
+  rpc GetUser(GetUserRequest) returns (User);
+  rpc WatchUsers(stream .demo.users.GetUserRequest) returns (stream User) {
+    option idempotency_level = NO_SIDE_EFFECTS;
+  }
+}
+
+message GetUserRequest {
+  string id = 1;
+}
+`
+
+func Test_Parse(t *testing.T) {
+	s, err := Parse(map[string]string{"users.proto": userProto})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Len(t, s.Messages, 3)
+	user := s.Messages["demo.users.User"]
+	if assert.NotNil(t, user) {
+		assert.Len(t, user.Fields, 7)
+		assert.Equal(t, "demo.users.Role", user.Fields[3].Type)
+		assert.Equal(t, "repeated", user.Fields[3].Label)
+		assert.Equal(t, "google.protobuf.Timestamp", user.Fields[4].Type)
+		assert.Equal(t, "map<string, demo.users.User.Address>", user.Fields[5].Type)
+		assert.Equal(t, "contact", user.Fields[7].Oneof)
+	}
+	assert.Contains(t, s.Messages, "demo.users.User.Address")
+
+	role := s.Enums["demo.users.Role"]
+	if assert.NotNil(t, role) {
+		assert.Equal(t, map[int]string{0: "ROLE_UNKNOWN", 1: "ROLE_ADMIN"}, role.Values)
+	}
+
+	users := s.Services["demo.users.Users"]
+	if assert.NotNil(t, users) {
+		assert.Equal(t, &Method{Name: "GetUser", Input: "demo.users.GetUserRequest", Output: "demo.users.User", scope: "demo.users"}, users.Methods["GetUser"])
+		watch := users.Methods["WatchUsers"]
+		assert.True(t, watch.ClientStreaming)
+		assert.True(t, watch.ServerStreaming)
+		assert.Equal(t, "demo.users.GetUserRequest", watch.Input)
+	}
+}
+
+func Test_Parse_Invalid(t *testing.T) {
+	_, err := Parse(map[string]string{"bad.proto": "message User { string id = ; }"})
+	assert.NotNil(t, err)
+
+	_, err = Parse(map[string]string{"bad.proto": "message User { string id = 1;"})
+	assert.NotNil(t, err)
+}
+
+func Test_Compare(t *testing.T) {
+	base := `
+package demo;
+message User {
+  string id = 1;
+  string name = 2;
+}
+enum Role {
+  ROLE_UNKNOWN = 0;
+}
+service Users {
+  rpc GetUser(User) returns (User);
+}
+`
+	tests := []struct {
+		name    string
+		proto   string
+		level   string
+		changes []Change
+	}{
+		{
+			name:  "unchanged apart from comments and layout",
+			proto: "package demo; // users\nmessage User { string id = 1; string name = 2; }\nenum Role { ROLE_UNKNOWN = 0; }\nservice Users { rpc GetUser(.demo.User) returns (User); }",
+			level: Patch,
+		},
+		{
+			name:  "added field, message and rpc",
+			proto: "package demo;\nmessage User { string id = 1; string name = 2; string email = 3; }\nmessage Team {}\nenum Role { ROLE_UNKNOWN = 0; }\nservice Users { rpc GetUser(User) returns (User); rpc GetTeam(Team) returns (Team); }",
+			level: Minor,
+			changes: []Change{
+				{Level: Minor, Description: "field demo.User.email (3) was added"},
+				{Level: Minor, Description: "message demo.Team was added"},
+				{Level: Minor, Description: "rpc demo.Users.GetTeam was added"},
+			},
+		},
+		{
+			name:  "removed field",
+			proto: "package demo;\nmessage User { string id = 1; }\nenum Role { ROLE_UNKNOWN = 0; }\nservice Users { rpc GetUser(User) returns (User); }",
+			level: Breaking,
+			changes: []Change{
+				{Level: Breaking, Description: "field demo.User.name (2) was removed"},
+			},
+		},
+		{
+			name:  "changed type",
+			proto: "package demo;\nmessage User { string id = 1; int64 name = 2; }\nenum Role { ROLE_UNKNOWN = 0; }\nservice Users { rpc GetUser(User) returns (User); }",
+			level: Breaking,
+			changes: []Change{
+				{Level: Breaking, Description: "field demo.User.name (2) changed type from string to int64"},
+			},
+		},
+		{
+			name:  "renamed rpc",
+			proto: "package demo;\nmessage User { string id = 1; string name = 2; }\nenum Role { ROLE_UNKNOWN = 0; }\nservice Users { rpc FetchUser(User) returns (User); }",
+			level: Breaking,
+			changes: []Change{
+				{Level: Breaking, Description: "rpc demo.Users.GetUser was removed or renamed"},
+				{Level: Minor, Description: "rpc demo.Users.FetchUser was added"},
+			},
+		},
+		{
+			name:  "repeated field and streaming rpc",
+			proto: "package demo;\nmessage User { string id = 1; repeated string name = 2; }\nenum Role { ROLE_UNKNOWN = 0; }\nservice Users { rpc GetUser(User) returns (stream User); }",
+			level: Breaking,
+			changes: []Change{
+				{Level: Breaking, Description: "field demo.User.name (2) changed from singular to repeated"},
+				{Level: Breaking, Description: "rpc demo.Users.GetUser changed from (demo.User) returns (demo.User) to (demo.User) returns (stream demo.User)"},
+			},
+		},
+		{
+			name:  "removed enum value",
+			proto: "package demo;\nmessage User { string id = 1; string name = 2; }\nenum Role { ROLE_ADMIN = 1; }\nservice Users { rpc GetUser(User) returns (User); }",
+			level: Breaking,
+			changes: []Change{
+				{Level: Breaking, Description: "enum value demo.Role.ROLE_UNKNOWN (0) was removed"},
+				{Level: Minor, Description: "enum value demo.Role.ROLE_ADMIN (1) was added"},
+			},
+		},
+	}
+
+	old, err := Parse(map[string]string{"demo.proto": base})
+	if !assert.Nil(t, err) {
+		return
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			new, err := Parse(map[string]string{"demo.proto": tt.proto})
+			if !assert.Nil(t, err) {
+				return
+			}
+			changes := Compare(old, new)
+			assert.Equal(t, tt.changes, changes)
+			assert.Equal(t, tt.level, Report{Base: "abc", Changes: changes}.Level())
+		})
+	}
+}
+
+func Test_LoadCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "schema")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	run := func(args ...string) string {
+		out, err := git(context.Background(), dir, args...)
+		assert.Nil(t, err)
+		return out
+	}
+	write := func(content string) {
+		assert.Nil(t, os.MkdirAll(filepath.Join(dir, "proto"), 0750))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "proto", "demo.proto"), []byte(content), 0640))
+	}
+
+	run("init", "-q")
+	run("config", "user.email", "test@example.com")
+	run("config", "user.name", "test")
+	write("package demo; message User { string id = 1; }")
+	run("add", "-A")
+	run("commit", "-q", "-m", "first")
+	first := run("rev-parse", "HEAD")
+	write("package demo; message User { string id = 1; string name = 2; }")
+	run("add", "-A")
+	run("commit", "-q", "-m", "second")
+
+	old, err := LoadCommit(context.Background(), dir, first[:len(first)-1], "proto")
+	if !assert.Nil(t, err) {
+		return
+	}
+	new, err := Load(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []Change{{Level: Minor, Description: "field demo.User.name (2) was added"}}, Compare(old, new))
+}
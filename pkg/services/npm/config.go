@@ -1,5 +1,7 @@
 package npm
 
+import "github.com/gospotcheck/protofact/pkg/build"
+
 type Config struct {
 	Publish         bool
 	PackageName     string
@@ -8,4 +10,5 @@ type Config struct {
 	RegistryURL     string
 	ProtobufVersion string
 	Token           string
+	Timeouts        build.Timeouts
 }
@@ -7,22 +7,26 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"strconv"
-	"strings"
+	"path/filepath"
 	"text/template"
 	"time"
 
 	"github.com/gobuffalo/packr/v2"
-	g "github.com/gogits/git-module"
 	"github.com/opentracing/opentracing-go"
 	cp "github.com/otiai10/copy"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/go-playground/webhooks.v5/github"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/versioning"
 )
 
+// language is the name this service is configured and reported under.
+const language = "npm"
+
 type fs interface {
 	CreateUniqueTmpDir(parentPath string) (string, error)
 	DeleteDir(string) error
@@ -30,8 +34,8 @@ type fs interface {
 	CopyFile(src, dest string) error
 }
 
-type repo interface {
-	CloneWithCheckout(tmpDir string, payload github.PushPayload) error
+type versioner interface {
+	Version(ctx context.Context, src build.Source) (versioning.Version, error)
 }
 
 type counters interface {
@@ -42,15 +46,15 @@ type counters interface {
 // Service represents a npm packaging service. It has properties
 // that are the dependencies necessary for the service to function
 // and receives methods allowing it to build the code directory
-// necessary for publishing a gem. It fulfills the LanguageProcessor
-// interface in package main.
+// necessary for publishing a gem. It fulfills the processor
+// interface in package dispatch.
 type Service struct {
-	fs      fs
-	repo    repo
-	logger  log.FieldLogger
-	tracer  opentracing.Tracer
-	metrics counters
-	config  Config
+	fs       fs
+	versions versioner
+	logger   log.FieldLogger
+	tracer   opentracing.Tracer
+	metrics  counters
+	config   Config
 }
 
 type templateValues struct {
@@ -61,6 +65,7 @@ type templateValues struct {
 	ProtobufVersion string
 	Token           string
 	Email           string
+	SHA             string
 }
 
 type processorProps struct {
@@ -69,10 +74,10 @@ type processorProps struct {
 }
 
 // New returns a pointer to a npm Service configured with the parameters passed in.
-func New(config Config, fs fs, repo repo, logger log.FieldLogger, metrics counters, tracer opentracing.Tracer) *Service {
+func New(config Config, fs fs, versions versioner, logger log.FieldLogger, metrics counters, tracer opentracing.Tracer) *Service {
 	return &Service{
 		fs,
-		repo,
+		versions,
 		logger,
 		tracer,
 		metrics,
@@ -80,10 +85,16 @@ func New(config Config, fs fs, repo repo, logger log.FieldLogger, metrics counte
 	}
 }
 
+// Install returns the command that installs version of the package.
+func (s *Service) Install(repository, version string) string {
+	return fmt.Sprintf("npm install %s@%s", s.config.PackageName, version)
+}
+
 // Process is the main method for use by the main function of the application, and the only one required
-// by the interface in main.go. It takes a context, used for cancelling itself in the case of a sigterm or sigint,
-// and a Push Event payload. It executes all steps necessary for creating jars and publishing them via sbt.
-func (s *Service) Process(ctx context.Context, payload github.PushPayload) {
+// by the processor interface in package dispatch. It takes a context, used for cancelling itself in the case of a sigterm or sigint,
+// and the shared checkout of the pushed commit. It executes all steps necessary for creating jars and publishing them via sbt.
+// Any error is returned tagged with the stage that produced it so the job queue can retry it.
+func (s *Service) Process(ctx context.Context, src build.Source) error {
 	start := time.Now()
 	// this span is a child of the parent span in the http handler, but since this will finish after
 	// the http handler returns, it follows from that span so it will display correctly.
@@ -97,13 +108,12 @@ func (s *Service) Process(ctx context.Context, payload github.PushPayload) {
 
 	// create a new directory to do all the work of this Process call which can be cleaned up at the end.
 	id := uuid.NewV4().String()
-	buildDir := fmt.Sprintf("/tmp/%s", id)
-	err := os.Mkdir(buildDir, 0750)
+	build.RecorderFrom(ctx).BuildID(id)
+	buildDir := build.WorkDir(id)
+	err := os.MkdirAll(buildDir, 0750)
 	if err != nil {
-		s.metrics.AddPackagingErrors(prometheus.Labels{"type": "mkdir"}, 1)
-		err = errors.WithStack(err)
-		s.logger.Errorf("%+v", err)
-		return
+		s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": "mkdir"}, 1)
+		return build.StageFailed(build.StageMkdir, errors.WithStack(err))
 	}
 
 	// create a struct for passing to other functions referencing the location of the work
@@ -120,49 +130,80 @@ func (s *Service) Process(ctx context.Context, payload github.PushPayload) {
 	// since cleanup is deferred it will still execute after the return statement
 	select {
 	case <-ctx.Done():
-		return
+		return ctx.Err()
 	// otherwise, do our work
 	default:
-		// clone down the repository
-		path, err := s.cloneCode(ctx, payload, procProps)
-		if err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "clone"}, 1)
-			s.logger.Errorf("%+v\n", errors.WithStack(err))
-			return
-		}
+		payload := src.Payload
+		path := src.Dir
 
-		var version string
-		isMaster := !strings.Contains(payload.Ref, "master")
-		a := strconv.Itoa(int(payload.Repository.PushedAt))
-		if !isMaster {
-			version = fmt.Sprintf("1.0.%s", a)
-		} else {
-			branchName := g.RefEndName(payload.Ref)
-			// npm package version only allow dashes as delimiter
-			branchName = strings.Replace(branchName, "_", "-", -1)
-			branchName = strings.ToLower(branchName)
-			version = fmt.Sprintf("1.0.%s-%s", a, branchName)
+		v, err := s.versions.Version(ctx, src)
+		if err != nil {
+			s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.StageVersion}, 1)
+			return build.StageFailed(build.StageVersion, err)
 		}
+		version := v.NPM()
+		build.RecorderFrom(ctx).Version(version)
 
 		// get all relevant subdirectories (ts/*) and process them into their own directories to publish
-		err = createPackage(ctx, s.fs, s.config, s.logger, path, version, payload, procProps)
+		finish := build.StartStage(ctx, build.StageCreate)
+		stageCtx, cancel := build.WithTimeout(ctx, build.StageCreate, s.config.Timeouts.Template)
+		err = createPackage(stageCtx, s.fs, s.config, s.logger, path, version, payload, procProps)
+		err = build.TimedOut(stageCtx, err)
+		cancel()
+		finish(err)
 		if err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "create"}, 1)
-			s.logger.Errorf("%+v\n", errors.WithStack(err))
-			return
+			s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StageCreate, err)}, 1)
+			return build.StageFailed(build.StageCreate, errors.WithStack(err))
 		}
 
-		// publish the gem, either locally or to to a repo based on the config
-		err = publishPackage(ctx, s.config, s.logger, procProps.BuildDir, version)
+		// build the package, linking it locally
+		finish = build.StartStage(ctx, build.StageBuild)
+		stageCtx, cancel = build.WithTimeout(ctx, build.StageBuild, s.config.Timeouts.Build)
+		err = buildPackage(stageCtx, s.logger, procProps.BuildDir)
+		cancel()
+		finish(err)
 		if err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "publish"}, 1)
-			s.logger.Errorf("%+v\n", errors.WithStack(err))
+			s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StageBuild, err)}, 1)
+			return build.StageFailed(build.StageBuild, errors.WithStack(err))
+		}
+
+		// stop before publishing if the build was cancelled while building,
+		// by a newer push to the branch or by a shutdown
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// pack the package into the artifact directory, for a build of a
+		// local checkout
+		if out := build.ArtifactDir(ctx); out != "" {
+			finish = build.StartStage(ctx, build.StageCollect)
+			stageCtx, cancel = build.WithTimeout(ctx, build.StageCollect, s.config.Timeouts.Build)
+			err = packPackage(stageCtx, s.logger, procProps.BuildDir, out)
+			cancel()
+			finish(err)
+			if err != nil {
+				s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StageCollect, err)}, 1)
+				return build.StageFailed(build.StageCollect, errors.WithStack(err))
+			}
+		}
+
+		// publish the package to the registry, if the config says to
+		if s.config.Publish {
+			finish = build.StartStage(ctx, build.StagePublish)
+			stageCtx, cancel = build.WithTimeout(ctx, build.StagePublish, s.config.Timeouts.Publish)
+			err = publishPackage(stageCtx, s.logger, procProps.BuildDir)
+			cancel()
+			finish(err)
+			if err != nil {
+				s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StagePublish, err)}, 1)
+				return build.StageFailed(build.StagePublish, errors.WithStack(err))
+			}
 		}
 
 		duration := time.Since(start)
-		s.metrics.AddPackagingProcessDuration(prometheus.Labels{}, duration.Seconds())
+		s.metrics.AddPackagingProcessDuration(prometheus.Labels{"language": language}, duration.Seconds())
 
-		return
+		return nil
 	}
 }
 
@@ -177,25 +218,10 @@ func cleanup(ctx context.Context, fs fs, logger log.FieldLogger, props processor
 	}
 }
 
-func (s *Service) cloneCode(ctx context.Context, payload github.PushPayload, props processorProps) (string, error) {
-	// create tmp dir inside of the parent build directory so it gets cleaned up at the end
-	cloneDir, err := s.fs.CreateUniqueTmpDir(props.BuildDir)
-	if err != nil {
-		return "", errors.Wrap(err, "could not create tmp directory for cloning")
-	}
-	// git clone the project
-	err = s.repo.CloneWithCheckout(cloneDir, payload)
-	if err != nil {
-		return "", errors.Wrap(err, "could not clone directory and checkout branch")
-	}
-
-	return cloneDir, nil
-}
-
 // createPackage takes a path and finds all directories in the subpath of "npm" in that path. We package at that level.
 // For those directories it processes the templates in the npm package to create a directory mirroring the structure
 // of a publishable jar.
-func createPackage(ctx context.Context, fs fs, config Config, logger log.FieldLogger, codePath, version string, payload github.PushPayload, props processorProps) error {
+func createPackage(ctx context.Context, fs fs, config Config, logger log.FieldLogger, codePath, version string, payload event.Push, props processorProps) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "create_npm_package")
 	span.SetTag("directory", codePath)
 	// subdirectories of the language
@@ -209,6 +235,7 @@ func createPackage(ctx context.Context, fs fs, config Config, logger log.FieldLo
 		Token:           config.Token,
 		Version:         version,
 		Email:           config.Email,
+		SHA:             payload.After,
 	}
 
 	logger.Debug(fmt.Sprintf("%+v", values))
@@ -233,38 +260,61 @@ func createPackage(ctx context.Context, fs fs, config Config, logger log.FieldLo
 	return nil
 }
 
-// publishPackage publishes the gem to the repository defined on the machine.
-// If service.config.Publish is true, it will publish to a live online external repository.
-// If Publish is false it will just build the gem and not push it.
-func publishPackage(ctx context.Context, config Config, logger log.FieldLogger, path, version string) error {
+// buildPackage links the package in the build directory, which builds it
+// without publishing it anywhere.
+func buildPackage(ctx context.Context, logger log.FieldLogger, path string) error {
 	span, _ := opentracing.StartSpanFromContext(ctx, "build_npm_package")
 	span.SetTag("directory", path)
+	defer span.Finish()
 
-	buildCmd := exec.Command("npm", "link")
+	buildCmd := exec.CommandContext(ctx, "npm", "link")
 	buildCmd.Dir = path
-	out, err := buildCmd.CombinedOutput()
+	out, err := build.CombinedOutput(ctx, buildCmd)
 	logger.Debug(fmt.Sprintf("%s", out))
 	if err != nil {
 		errMessage := fmt.Sprintf("error running npm link: %s\n", out)
 		return errors.Wrap(err, errMessage)
 	}
 
-	span.Finish()
+	return nil
+}
 
-	if config.Publish {
-		span, _ := opentracing.StartSpanFromContext(ctx, "publish_npm_package")
-		span.SetTag("directory", path)
+// packPackage packs the package in the build directory into a tarball,
+// the same one npm publish would upload, and copies it to out.
+func packPackage(ctx context.Context, logger log.FieldLogger, path, out string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "pack_npm_package")
+	span.SetTag("directory", path)
+	defer span.Finish()
 
-		publishCmd := exec.Command("npm", "publish")
-		publishCmd.Dir = path
-		out, err := publishCmd.CombinedOutput()
-		logger.Debug(fmt.Sprintf("%s", out))
-		if err != nil {
-			errMessage := fmt.Sprintf("error running npm publish: %s\n", out)
-			return errors.Wrap(err, errMessage)
-		}
+	packCmd := exec.CommandContext(ctx, "npm", "pack")
+	packCmd.Dir = path
+	output, err := build.CombinedOutput(ctx, packCmd)
+	logger.Debug(fmt.Sprintf("%s", output))
+	if err != nil {
+		errMessage := fmt.Sprintf("error running npm pack: %s\n", output)
+		return errors.Wrap(err, errMessage)
+	}
+
+	_, err = build.CollectArtifacts(path, out, func(rel string) bool {
+		return filepath.Dir(rel) == "." && filepath.Ext(rel) == ".tgz"
+	})
+	return err
+}
 
-		span.Finish()
+// publishPackage publishes the package in the build directory to the
+// registry configured in its .npmrc.
+func publishPackage(ctx context.Context, logger log.FieldLogger, path string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "publish_npm_package")
+	span.SetTag("directory", path)
+	defer span.Finish()
+
+	publishCmd := exec.CommandContext(ctx, "npm", "publish")
+	publishCmd.Dir = path
+	out, err := build.CombinedOutput(ctx, publishCmd)
+	logger.Debug(fmt.Sprintf("%s", out))
+	if err != nil {
+		errMessage := fmt.Sprintf("error running npm publish: %s\n", out)
+		return errors.Wrap(err, errMessage)
 	}
 
 	return nil
@@ -97,6 +97,10 @@ func Test_CreatePackage(t *testing.T) {
 	assert.Contains(t, files, "package.json")
 	assert.Contains(t, files, ".npmrc")
 
+	packageJSON, err := ioutil.ReadFile(fmt.Sprintf("%s/package.json", procProps.BuildDir))
+	assert.Nil(t, err)
+	assert.Contains(t, string(packageJSON), fmt.Sprintf(`"gitHead": "%s"`, payload.After))
+
 	subDirs, err := fs.GetSubDirectories(procProps.BuildDir)
 	if err != nil {
 		t.Error(err)
@@ -117,8 +121,8 @@ func Test_CreatePackage(t *testing.T) {
 	assert.Contains(t, pkgFiles, "token_pb_service.d.ts")
 	assert.Contains(t, pkgFiles, "token_pb.d.ts")
 
-	err = publishPackage(ctx, config, logger, procProps.BuildDir, version)
+	err = buildPackage(ctx, logger, procProps.BuildDir)
 	if err != nil {
-		t.Errorf("npm publish failed at path %s: %s", procProps.BuildDir, err)
+		t.Errorf("npm link failed at path %s: %s", procProps.BuildDir, err)
 	}
 }
@@ -0,0 +1,7 @@
+package release
+
+import "github.com/gospotcheck/protofact/pkg/build"
+
+type Config struct {
+	Timeouts build.Timeouts
+}
@@ -3,30 +3,34 @@ package release
 import (
 	"context"
 	"fmt"
-	"os"
-	"strings"
 	"time"
 
-	g "github.com/gogits/git-module"
 	"github.com/google/go-github/v32/github"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
-	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
-	hooks "gopkg.in/go-playground/webhooks.v5/github"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/git"
+	"github.com/gospotcheck/protofact/pkg/schema"
+	"github.com/gospotcheck/protofact/pkg/versioning"
 )
 
-type fs interface {
-	CreateUniqueTmpDir(parentPath string) (string, error)
-	DeleteDir(string) error
-}
+// language is the name this service is configured and reported under.
+const language = "release"
 
 type repo interface {
 	CreateRelease(ctx context.Context, owner, repo string, rel *github.RepositoryRelease) (*github.RepositoryRelease, error)
-	CloneWithCheckout(tmpDir string, payload hooks.PushPayload) error
-	CreateTag(dir, version, msg string) error
-	PushTags(dir string) error
+	CreateTag(ctx context.Context, dir, version, msg string) error
+	PushTag(ctx context.Context, dir, tag string) error
+	TagCommit(ctx context.Context, dir, tag string) (string, bool, error)
+}
+
+type versioner interface {
+	Version(ctx context.Context, src build.Source) (versioning.Version, error)
 }
 
 type counters interface {
@@ -41,150 +45,146 @@ type counters interface {
 // the other packaged languages. This is most useful for go
 // as it uses git as its repository/package format.
 type Service struct {
-	fs      fs
-	repo    repo
-	logger  log.FieldLogger
-	tracer  opentracing.Tracer
-	metrics counters
-}
-
-type processorProps struct {
-	ID      string
-	WorkDir string
+	repo     repo
+	versions versioner
+	logger   log.FieldLogger
+	tracer   opentracing.Tracer
+	metrics  counters
+	config   Config
 }
 
 // New returns a pointer to a release Service configured with the parameters passed in.
-func New(fs fs, repo repo, logger log.FieldLogger, metrics counters, tracer opentracing.Tracer) *Service {
+func New(config Config, repo repo, versions versioner, logger log.FieldLogger, metrics counters, tracer opentracing.Tracer) *Service {
 	return &Service{
-		fs,
 		repo,
+		versions,
 		logger,
 		tracer,
 		metrics,
+		config,
 	}
 }
 
+// Install returns the command that fetches the Go module at the tag of
+// version.
+func (s *Service) Install(repository, version string) string {
+	return fmt.Sprintf("go get github.com/%s@%s", repository, version)
+}
+
 // Process is the main method for use by the main function of the application, and the only one required
-// by the interface in main.go. It takes a context, used for cancelling itself in the case of a sigterm or sigint,
-// and a Push Event payload. It executes all steps necessary for creating a release on the repo passed to the service.
-func (s *Service) Process(ctx context.Context, payload hooks.PushPayload) {
+// by the processor interface in package dispatch. It takes a context, used for cancelling itself in the case of a sigterm or sigint,
+// and the shared checkout of the pushed commit. It executes all steps necessary for creating a release on the repo passed to the service.
+// The tag is created in the shared checkout, which is safe as it does not change any files in it.
+// Any error is returned tagged with the stage that produced it so the job queue can retry it.
+func (s *Service) Process(ctx context.Context, src build.Source) error {
 	start := time.Now()
 	// this span is a child of the parent span in the http handler, but since this will finish after
 	// the http handler returns, it follows from that span so it will display correctly.
 	parentContext := opentracing.SpanFromContext(ctx).Context()
 	spanOption := opentracing.FollowsFrom(parentContext)
-	span := opentracing.StartSpan("process_scala", spanOption)
+	span := opentracing.StartSpan("process_release", spanOption)
 	defer span.Finish()
 
 	// creates a new copy of the context with the following span
 	ctx = opentracing.ContextWithSpan(ctx, span)
 
-	// create a new directory to do all the work of this Process call which can be cleaned up at the end.
-	id := uuid.NewV4().String()
-	workDir := fmt.Sprintf("/tmp/%s", id)
-	err := os.Mkdir(workDir, 0750)
-	if err != nil {
-		s.metrics.AddPackagingErrors(prometheus.Labels{"type": "mkdir"}, 1)
-		err = errors.WithStack(err)
-		s.logger.Errorf("%+v", err)
-		return
-	}
-
-	// create a struct for passing to other functions referencing the location of the work
-	// this specific Process call is executing.
-	procProps := processorProps{
-		ID:      id,
-		WorkDir: workDir,
-	}
-
-	// defer cleanup of this Process execution
-	defer cleanup(ctx, s.fs, s.logger, procProps)
-
 	// if we receive a signal that this goroutine should stop, do that
-	// since cleanup is deferred it will still execute after the return statement
 	select {
 	case <-ctx.Done():
-		return
+		return ctx.Err()
 	// otherwise, do our work
 	default:
-		// clone down the repository
-		path, err := s.cloneCode(ctx, payload, procProps)
-		if err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "clone"}, 1)
-			s.logger.Errorf("%+v\n", errors.WithStack(err))
-			return
-		}
-
-		// on master branch we want to cut a full release
-		// but on any other branch or commit we should be be making
-		// a prerelease
-		var version string
-		var prerelease bool
-		if strings.Contains(payload.Ref, "master") {
-			version = fmt.Sprintf("v1.0.%d", payload.Repository.PushedAt)
-			prerelease = false
-		} else {
-			branch := g.RefEndName(payload.Ref)
-			version = fmt.Sprintf("v1.0.%d-beta.%s", payload.Repository.PushedAt, branch)
-			prerelease = true
-		}
-
-		if err = s.repo.CreateTag(path, version, "Automated tag by Protofact."); err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "release"}, 1)
-			s.logger.Errorf("%+v\n", err)
-			return
+		payload := src.Payload
+		// releases are Github's, and go modules are only fetched from there
+		if !payload.Github() {
+			s.logger.Infof("skipping release of %s, which is not on Github", payload.Repository.FullName)
+			return nil
 		}
 
-		if err = s.repo.PushTags(path); err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "release"}, 1)
-			s.logger.Errorf("%+v\n", err)
-			return
+		// a stable branch cuts a full release, and any other branch
+		// or commit a prerelease
+		v, err := s.versions.Version(ctx, src)
+		if err != nil {
+			s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.StageVersion}, 1)
+			return build.StageFailed(build.StageVersion, err)
 		}
+		version := v.GoTag()
+		prerelease := !v.Stable()
 
-		bodyMsg := "Automated release by Protofact."
-		rel := github.RepositoryRelease{
-			TagName:    &version,
-			Name:       &version,
-			Body:       &bodyMsg,
-			Prerelease: &prerelease,
+		// a pushed tag is released as it is, otherwise tag the pushed
+		// commit and push the tag
+		if tag, ok := branch.Tag(payload.Ref); ok {
+			version = tag
+		} else {
+			finish := build.StartStage(ctx, build.StageTag)
+			stageCtx, cancel := build.WithTimeout(ctx, build.StageTag, s.config.Timeouts.Tag)
+			err = s.tagVersion(stageCtx, src.Dir, payload.After, version)
+			cancel()
+			finish(err)
+			if err != nil {
+				s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StageTag, err)}, 1)
+				return build.StageFailed(build.StageTag, err)
+			}
 		}
+		build.RecorderFrom(ctx).Version(version)
 
-		_, err = s.repo.CreateRelease(ctx, payload.Repository.Owner.Login, payload.Repository.Name, &rel)
+		finish := build.StartStage(ctx, build.StageRelease)
+		err = s.releaseVersion(ctx, payload, version, prerelease, releaseBody(schema.ReportFrom(ctx)))
+		finish(err)
 		if err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "release"}, 1)
-			s.logger.Errorf("%+v\n", err)
-			return
+			s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": "release"}, 1)
+			return build.StageFailed(build.StageRelease, err)
 		}
 
 		duration := time.Since(start)
-		s.metrics.AddPackagingProcessDuration(prometheus.Labels{}, duration.Seconds())
+		s.metrics.AddPackagingProcessDuration(prometheus.Labels{"language": language}, duration.Seconds())
 
-		return
+		return nil
 	}
 }
 
-// Cleanup runs a fs.DeleteDir on the build directory created when running Process.
-func cleanup(ctx context.Context, fs fs, logger log.FieldLogger, props processorProps) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "cleanup")
-	defer span.Finish()
-
-	err := fs.DeleteDir(props.WorkDir)
+// tagVersion tags the cloned repo with version and pushes the tag. A
+// tag of sha that an earlier attempt already pushed is left as it is,
+// so an attempt that failed to create the release after pushing the tag
+// can be retried.
+func (s *Service) tagVersion(ctx context.Context, path, sha, version string) error {
+	tagged, found, err := s.repo.TagCommit(ctx, path, version)
 	if err != nil {
-		logger.Errorf("%+v\n", err)
+		return err
+	}
+	if found {
+		if tagged != sha {
+			return build.Permanent(errors.Errorf("tag %s already exists at %s rather than %s", version, tagged, sha))
+		}
+		s.logger.Infof("tag %s of %s was already pushed", version, sha)
+		return nil
 	}
-}
 
-func (s *Service) cloneCode(ctx context.Context, payload hooks.PushPayload, props processorProps) (string, error) {
-	// create tmp dir inside of the parent build directory so it gets cleaned up at the end
-	cloneDir, err := s.fs.CreateUniqueTmpDir(props.WorkDir)
-	if err != nil {
-		return "", errors.Wrap(err, "could not create tmp directory for cloning")
+	if err := s.repo.CreateTag(ctx, path, version, git.TagMessage); err != nil {
+		return err
 	}
-	// git clone the project
-	err = s.repo.CloneWithCheckout(cloneDir, payload)
-	if err != nil {
-		return "", errors.Wrap(err, "could not clone directory and checkout branch")
+	return s.repo.PushTag(ctx, path, version)
+}
+
+// releaseVersion creates a Github release for the tag of version.
+func (s *Service) releaseVersion(ctx context.Context, payload event.Push, version string, prerelease bool, bodyMsg string) error {
+	rel := github.RepositoryRelease{
+		TagName:    &version,
+		Name:       &version,
+		Body:       &bodyMsg,
+		Prerelease: &prerelease,
 	}
 
-	return cloneDir, nil
+	_, err := s.repo.CreateRelease(ctx, payload.Repository.Owner.Login, payload.Repository.Name, &rel)
+	return err
+}
+
+// releaseBody returns the body of a release, listing the schema changes
+// since the last release if they were compared.
+func releaseBody(report *schema.Report) string {
+	body := "Automated release by Protofact."
+	if report == nil {
+		return body
+	}
+	return fmt.Sprintf("%s\n\n%s", body, report.Markdown())
 }
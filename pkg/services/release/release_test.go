@@ -1 +1,124 @@
 package release
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/schema"
+	"github.com/gospotcheck/protofact/pkg/versioning"
+)
+
+// fakeRepo keeps the tags pushed to the origin by the commit they tag,
+// which the clone of every attempt has, and fails to create a release
+// for as many calls as failures.
+type fakeRepo struct {
+	tags     map[string]string
+	created  map[string]string
+	failures int
+	releases []string
+}
+
+func (f *fakeRepo) CreateRelease(ctx context.Context, owner, repo string, rel *github.RepositoryRelease) (*github.RepositoryRelease, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("github unavailable")
+	}
+	f.releases = append(f.releases, rel.GetTagName())
+	return rel, nil
+}
+
+func (f *fakeRepo) CreateTag(ctx context.Context, dir, version, msg string) error {
+	if _, ok := f.tags[version]; ok {
+		return errors.Errorf("tag %s already exists", version)
+	}
+	f.created[version] = dir
+	return nil
+}
+
+func (f *fakeRepo) PushTag(ctx context.Context, dir, tag string) error {
+	f.tags[tag] = f.created[tag]
+	return nil
+}
+
+func (f *fakeRepo) TagCommit(ctx context.Context, dir, tag string) (string, bool, error) {
+	sha, ok := f.tags[tag]
+	return sha, ok, nil
+}
+
+type fakeVersioner struct{}
+
+func (fakeVersioner) Version(ctx context.Context, src build.Source) (versioning.Version, error) {
+	return versioning.Version{Major: 1, Minor: 0, Patch: 5}, nil
+}
+
+type nopCounters struct{}
+
+func (nopCounters) AddPackagingErrors(labels prometheus.Labels, count float64)          {}
+func (nopCounters) AddPackagingProcessDuration(labels prometheus.Labels, count float64) {}
+
+func Test_ProcessRetriesRelease(t *testing.T) {
+	// the directory of the checkout stands in for the commit it tags
+	repo := &fakeRepo{tags: map[string]string{}, created: map[string]string{}, failures: 1}
+	s := New(Config{}, repo, fakeVersioner{}, log.WithField("test", t.Name()), nopCounters{}, opentracing.NoopTracer{})
+	ctx := opentracing.ContextWithSpan(context.Background(), opentracing.StartSpan("test"))
+	src := build.Source{
+		Payload: event.GithubPush("org", "protos", "refs/heads/master", "aaa", time.Now()),
+		Dir:     "aaa",
+	}
+
+	// the tag is pushed before the release fails
+	err := s.Process(ctx, src)
+	assert.NotNil(t, err)
+	assert.Equal(t, build.StageRelease, build.FailedStage(err))
+	assert.Equal(t, map[string]string{"v1.0.5": "aaa"}, repo.tags)
+
+	// so the retry creates the release of the tag it finds
+	assert.Nil(t, s.Process(ctx, src))
+	assert.Equal(t, []string{"v1.0.5"}, repo.releases)
+
+	// a tag of the version at another commit is not released
+	src.Payload.After = "bbb"
+	err = s.Process(ctx, src)
+	assert.Equal(t, build.StageTag, build.FailedStage(err))
+	assert.True(t, build.IsPermanent(err))
+	assert.Equal(t, []string{"v1.0.5"}, repo.releases)
+}
+
+func Test_ReleaseBody(t *testing.T) {
+	assert.Equal(t, "Automated release by Protofact.", releaseBody(nil))
+
+	report := &schema.Report{
+		Base:        "da6b8c5",
+		BaseVersion: "1.2.1530281075",
+		Changes: []schema.Change{
+			{Level: schema.Breaking, Description: "field demo.User.name (2) was removed"},
+			{Level: schema.Minor, Description: "message demo.Team was added"},
+		},
+	}
+	assert.Equal(t, `Automated release by Protofact.
+
+### Schema changes
+
+Compared with 1.2.1530281075 (da6b8c5): breaking.
+
+- **breaking** field demo.User.name (2) was removed
+- **minor** message demo.Team was added
+`, releaseBody(report))
+
+	assert.Equal(t, `Automated release by Protofact.
+
+### Schema changes
+
+First release, there was no earlier release to compare with.
+`, releaseBody(&schema.Report{}))
+}
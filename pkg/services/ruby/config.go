@@ -1,5 +1,7 @@
 package ruby
 
+import "github.com/gospotcheck/protofact/pkg/build"
+
 type Config struct {
 	Authors     string
 	Email       string
@@ -10,4 +12,5 @@ type Config struct {
 	GRPCVersion string
 	Homepage    string
 	Publish     bool
+	Timeouts    build.Timeouts
 }
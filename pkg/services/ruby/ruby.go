@@ -8,22 +8,26 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"strconv"
-	"strings"
+	"path/filepath"
 	"text/template"
 	"time"
 
 	"github.com/gobuffalo/packr/v2"
-	g "github.com/gogits/git-module"
 	"github.com/opentracing/opentracing-go"
 	cp "github.com/otiai10/copy"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/go-playground/webhooks.v5/github"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/versioning"
 )
 
+// language is the name this service is configured and reported under.
+const language = "ruby"
+
 type fs interface {
 	CreateUniqueTmpDir(parentPath string) (string, error)
 	DeleteDir(string) error
@@ -31,8 +35,8 @@ type fs interface {
 	CopyFile(src, dest string) error
 }
 
-type repo interface {
-	CloneWithCheckout(tmpDir string, payload github.PushPayload) error
+type versioner interface {
+	Version(ctx context.Context, src build.Source) (versioning.Version, error)
 }
 
 type counters interface {
@@ -43,15 +47,15 @@ type counters interface {
 // Service represents a ruby packaging service. It has properties
 // that are the dependencies necessary for the service to function
 // and receives methods allowing it to build the code directory
-// necessary for publishing a gem. It fulfills the LanguageProcessor
-// interface in package main.
+// necessary for publishing a gem. It fulfills the processor
+// interface in package dispatch.
 type Service struct {
-	fs      fs
-	repo    repo
-	logger  log.FieldLogger
-	tracer  opentracing.Tracer
-	metrics counters
-	config  Config
+	fs       fs
+	versions versioner
+	logger   log.FieldLogger
+	tracer   opentracing.Tracer
+	metrics  counters
+	config   Config
 }
 
 type templateValues struct {
@@ -61,6 +65,7 @@ type templateValues struct {
 	GemRepoHost string
 	GRPCVersion string
 	Homepage    string
+	SHA         string
 	Version     string
 }
 
@@ -70,7 +75,7 @@ type processorProps struct {
 }
 
 // New returns a pointer to a ruby Service configured with the parameters passed in.
-func New(config Config, fs fs, repo repo, logger log.FieldLogger, metrics counters, tracer opentracing.Tracer) *Service {
+func New(config Config, fs fs, versions versioner, logger log.FieldLogger, metrics counters, tracer opentracing.Tracer) *Service {
 	// set up gem config file
 	if config.Publish {
 		if err := getGemCredentials(config.GemRepoUser, config.GemRepoPass, config.GemRepoHost); err != nil {
@@ -80,7 +85,7 @@ func New(config Config, fs fs, repo repo, logger log.FieldLogger, metrics counte
 	}
 	return &Service{
 		fs,
-		repo,
+		versions,
 		logger,
 		tracer,
 		metrics,
@@ -88,10 +93,16 @@ func New(config Config, fs fs, repo repo, logger log.FieldLogger, metrics counte
 	}
 }
 
+// Install returns the command that installs version of the gem.
+func (s *Service) Install(repository, version string) string {
+	return fmt.Sprintf("gem install %s -v %s", s.config.GemName, version)
+}
+
 // Process is the main method for use by the main function of the application, and the only one required
-// by the interface in main.go. It takes a context, used for cancelling itself in the case of a sigterm or sigint,
-// and a Push Event payload. It executes all steps necessary for creating jars and publishing them via sbt.
-func (s *Service) Process(ctx context.Context, payload github.PushPayload) {
+// by the processor interface in package dispatch. It takes a context, used for cancelling itself in the case of a sigterm or sigint,
+// and the shared checkout of the pushed commit. It executes all steps necessary for creating jars and publishing them via sbt.
+// Any error is returned tagged with the stage that produced it so the job queue can retry it.
+func (s *Service) Process(ctx context.Context, src build.Source) error {
 	start := time.Now()
 	// this span is a child of the parent span in the http handler, but since this will finish after
 	// the http handler returns, it follows from that span so it will display correctly.
@@ -105,13 +116,12 @@ func (s *Service) Process(ctx context.Context, payload github.PushPayload) {
 
 	// create a new directory to do all the work of this Process call which can be cleaned up at the end.
 	id := uuid.NewV4().String()
-	buildDir := fmt.Sprintf("/tmp/%s", id)
-	err := os.Mkdir(buildDir, 0750)
+	build.RecorderFrom(ctx).BuildID(id)
+	buildDir := build.WorkDir(id)
+	err := os.MkdirAll(buildDir, 0750)
 	if err != nil {
-		s.metrics.AddPackagingErrors(prometheus.Labels{"type": "mkdir"}, 1)
-		err = errors.WithStack(err)
-		s.logger.Errorf("%+v", err)
-		return
+		s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": "mkdir"}, 1)
+		return build.StageFailed(build.StageMkdir, errors.WithStack(err))
 	}
 
 	// create a struct for passing to other functions referencing the location of the work
@@ -128,50 +138,77 @@ func (s *Service) Process(ctx context.Context, payload github.PushPayload) {
 	// since cleanup is deferred it will still execute after the return statement
 	select {
 	case <-ctx.Done():
-		return
+		return ctx.Err()
 	// otherwise, do our work
 	default:
-		// clone down the repository
-		path, err := s.cloneCode(ctx, payload, procProps)
-		if err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "clone"}, 1)
-			s.logger.Errorf("%+v\n", errors.WithStack(err))
-			return
-		}
+		payload := src.Payload
+		path := src.Dir
 
-		var version string
-		isMaster := !strings.Contains(payload.Ref, "master")
-		a := strconv.Itoa(int(payload.Repository.PushedAt))
-		if !isMaster {
-			version = fmt.Sprintf("1.0.%s", a)
-		} else {
-			branchName := g.RefEndName(payload.Ref)
-			// ruby gem version only allow periods as delimiters
-			branchName = strings.Replace(branchName, "/", ".", -1)
-			branchName = strings.Replace(branchName, "-", ".", -1)
-			branchName = strings.Replace(branchName, "_", ".", -1)
-			version = fmt.Sprintf("1.0.%s.pre.%s", a, branchName)
+		v, err := s.versions.Version(ctx, src)
+		if err != nil {
+			s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.StageVersion}, 1)
+			return build.StageFailed(build.StageVersion, err)
 		}
+		version := v.RubyGems()
+		build.RecorderFrom(ctx).Version(version)
 
 		// get all relevant subdirectories (ruby/*) and process them into their own directories to publish
-		dir, err := createGem(ctx, s.fs, s.config, s.logger, path, version, payload, procProps)
+		finish := build.StartStage(ctx, build.StageCreate)
+		stageCtx, cancel := build.WithTimeout(ctx, build.StageCreate, s.config.Timeouts.Template)
+		dir, err := createGem(stageCtx, s.fs, s.config, s.logger, path, version, payload, procProps)
+		err = build.TimedOut(stageCtx, err)
+		cancel()
+		finish(err)
 		if err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "create"}, 1)
-			s.logger.Errorf("%+v\n", errors.WithStack(err))
-			return
+			s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StageCreate, err)}, 1)
+			return build.StageFailed(build.StageCreate, errors.WithStack(err))
 		}
 
-		// publish the gem, either locally or to to a repo based on the config
-		err = publishGem(ctx, s.config, s.logger, dir, version)
+		// build the gem
+		finish = build.StartStage(ctx, build.StageBuild)
+		stageCtx, cancel = build.WithTimeout(ctx, build.StageBuild, s.config.Timeouts.Build)
+		err = buildGem(stageCtx, s.config, s.logger, dir)
+		cancel()
+		finish(err)
 		if err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "publish"}, 1)
-			s.logger.Errorf("%+v\n", errors.WithStack(err))
+			s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StageBuild, err)}, 1)
+			return build.StageFailed(build.StageBuild, errors.WithStack(err))
+		}
+
+		// stop before publishing if the build was cancelled while building,
+		// by a newer push to the branch or by a shutdown
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// leave the gem in the artifact directory, for a build of a local checkout
+		if out := build.ArtifactDir(ctx); out != "" {
+			finish = build.StartStage(ctx, build.StageCollect)
+			err = collectGem(dir, out)
+			finish(err)
+			if err != nil {
+				s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.StageCollect}, 1)
+				return build.StageFailed(build.StageCollect, errors.WithStack(err))
+			}
+		}
+
+		// push the gem to the gem repo, if the config says to
+		if s.config.Publish {
+			finish = build.StartStage(ctx, build.StagePublish)
+			stageCtx, cancel = build.WithTimeout(ctx, build.StagePublish, s.config.Timeouts.Publish)
+			err = pushGem(stageCtx, s.config, s.logger, dir, version)
+			cancel()
+			finish(err)
+			if err != nil {
+				s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StagePublish, err)}, 1)
+				return build.StageFailed(build.StagePublish, errors.WithStack(err))
+			}
 		}
 
 		duration := time.Since(start)
-		s.metrics.AddPackagingProcessDuration(prometheus.Labels{}, duration.Seconds())
+		s.metrics.AddPackagingProcessDuration(prometheus.Labels{"language": language}, duration.Seconds())
 
-		return
+		return nil
 	}
 }
 
@@ -186,25 +223,10 @@ func cleanup(ctx context.Context, fs fs, logger log.FieldLogger, props processor
 	}
 }
 
-func (s *Service) cloneCode(ctx context.Context, payload github.PushPayload, props processorProps) (string, error) {
-	// create tmp dir inside of the parent build directory so it gets cleaned up at the end
-	cloneDir, err := s.fs.CreateUniqueTmpDir(props.BuildDir)
-	if err != nil {
-		return "", errors.Wrap(err, "could not create tmp directory for cloning")
-	}
-	// git clone the project
-	err = s.repo.CloneWithCheckout(cloneDir, payload)
-	if err != nil {
-		return "", errors.Wrap(err, "could not clone directory and checkout branch")
-	}
-
-	return cloneDir, nil
-}
-
 // CreateJars takes a path and finds all directories in the subpath of "ruby" in that path. We package at that level.
 // For those directories it processes the templates in the ruby package to create a directory mirroring the structure
 // of a publishable jar.
-func createGem(ctx context.Context, fs fs, config Config, logger log.FieldLogger, codePath, version string, payload github.PushPayload, props processorProps) (string, error) {
+func createGem(ctx context.Context, fs fs, config Config, logger log.FieldLogger, codePath, version string, payload event.Push, props processorProps) (string, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "create_gem")
 	span.SetTag("directory", codePath)
 	// subdirectories of the language
@@ -217,6 +239,7 @@ func createGem(ctx context.Context, fs fs, config Config, logger log.FieldLogger
 		GemRepoHost: config.GemRepoHost,
 		GRPCVersion: config.GRPCVersion,
 		Homepage:    config.Homepage,
+		SHA:         payload.After,
 		Version:     version,
 	}
 
@@ -247,41 +270,49 @@ func createGem(ctx context.Context, fs fs, config Config, logger log.FieldLogger
 	return gemDir, nil
 }
 
-// PublishGem publishes the gem to the repository defined on the machine.
-// If service.config.Publish is true, it will publish to a live online external repository.
-// If Publish is false it will just build the gem and not push it.
-func publishGem(ctx context.Context, config Config, logger log.FieldLogger, path, version string) error {
+// buildGem builds the gem from the gemspec in the gem directory.
+func buildGem(ctx context.Context, config Config, logger log.FieldLogger, path string) error {
 	span, _ := opentracing.StartSpanFromContext(ctx, "buildGem")
 	span.SetTag("directory", path)
+	defer span.Finish()
 
 	gemspecName := fmt.Sprintf("%s.gemspec", config.GemName)
-	buildCmd := exec.Command("gem", "build", gemspecName)
+	buildCmd := exec.CommandContext(ctx, "gem", "build", gemspecName)
 	buildCmd.Dir = path
-	out, err := buildCmd.CombinedOutput()
+	out, err := build.CombinedOutput(ctx, buildCmd)
 	logger.Debug(fmt.Sprintf("%s", out))
 	if err != nil {
 		errMessage := fmt.Sprintf("error running gem build: %s\n", out)
 		return errors.Wrap(err, errMessage)
 	}
 
-	span.Finish()
+	return nil
+}
 
-	if config.Publish {
-		span, _ := opentracing.StartSpanFromContext(ctx, "push_gem")
-		span.SetTag("directory", path)
+// collectGem copies the gem built in the gem directory to out.
+func collectGem(path, out string) error {
+	_, err := build.CollectArtifacts(path, out, func(rel string) bool {
+		return filepath.Dir(rel) == "." && filepath.Ext(rel) == ".gem"
+	})
+	return err
+}
 
-		gemName := fmt.Sprintf("%s-%s.gem", config.GemName, version)
+// pushGem pushes the gem built in the gem directory to the configured
+// gem repo host.
+func pushGem(ctx context.Context, config Config, logger log.FieldLogger, path, version string) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "push_gem")
+	span.SetTag("directory", path)
+	defer span.Finish()
 
-		publishCmd := exec.Command("gem", "push", gemName, "--host", config.GemRepoHost)
-		publishCmd.Dir = path
-		out, err := publishCmd.CombinedOutput()
-		logger.Debug(fmt.Sprintf("%s", out))
-		if err != nil {
-			errMessage := fmt.Sprintf("error running gem push: %s\n", out)
-			return errors.Wrap(err, errMessage)
-		}
+	gemName := fmt.Sprintf("%s-%s.gem", config.GemName, version)
 
-		span.Finish()
+	publishCmd := exec.CommandContext(ctx, "gem", "push", gemName, "--host", config.GemRepoHost)
+	publishCmd.Dir = path
+	out, err := build.CombinedOutput(ctx, publishCmd)
+	logger.Debug(fmt.Sprintf("%s", out))
+	if err != nil {
+		errMessage := fmt.Sprintf("error running gem push: %s\n", out)
+		return errors.Wrap(err, errMessage)
 	}
 
 	return nil
@@ -97,6 +97,10 @@ func Test_CreateGem(t *testing.T) {
 	assert.Contains(t, files, "Gemfile")
 	assert.Contains(t, files, "protos-demo.gemspec")
 
+	gemspec, err := ioutil.ReadFile(fmt.Sprintf("%s/protos-demo.gemspec", path))
+	assert.Nil(t, err)
+	assert.Contains(t, string(gemspec), fmt.Sprintf(`spec.metadata["git_sha"] = "%s"`, payload.After))
+
 	subDirs, err := fs.GetSubDirectories(path)
 	if err != nil {
 		t.Error(err)
@@ -119,9 +123,9 @@ func Test_CreateGem(t *testing.T) {
 	assert.Contains(t, rubyFiles, "health_pb.rb")
 	assert.Contains(t, rubyFiles, "pagination_pb.rb")
 
-	err = publishGem(ctx, config, logger, path, version)
+	err = buildGem(ctx, config, logger, path)
 	if err != nil {
-		t.Errorf("gem publish failed at path %s: %s", path, err)
+		t.Errorf("gem build failed at path %s: %s", path, err)
 	}
 
 	files, err = fs.GetFileNames(path)
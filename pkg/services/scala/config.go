@@ -1,5 +1,7 @@
 package scala
 
+import "github.com/gospotcheck/protofact/pkg/build"
+
 type Config struct {
 	Description                   string
 	MavenRepoPublishTarget        string
@@ -15,4 +17,5 @@ type Config struct {
 	ScalaVersion                  string
 	LegacyScalaVersion            string
 	ScalaPBRuntimePackageVersion  string
+	Timeouts                      build.Timeouts
 }
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"text/template"
 	"time"
@@ -20,9 +21,15 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/go-playground/webhooks.v5/github"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/versioning"
 )
 
+// language is the name this service is configured and reported under.
+const language = "scala"
+
 type fs interface {
 	CreateUniqueTmpDir(parentPath string) (string, error)
 	DeleteDir(string) error
@@ -30,8 +37,8 @@ type fs interface {
 	CopyFile(src, dest string) error
 }
 
-type repo interface {
-	CloneWithCheckout(tmpDir string, payload github.PushPayload) error
+type versioner interface {
+	Version(ctx context.Context, src build.Source) (versioning.Version, error)
 }
 
 type counters interface {
@@ -42,19 +49,18 @@ type counters interface {
 // Service represents a scala packaging service. It has properties
 // that are the dependencies necessary for the service to function
 // and receives methods allowing it to build the code directory
-// necessary for publishing a jar. It fulfills the LanguageProcessor
-// interface in package main.
+// necessary for publishing a jar. It fulfills the processor
+// interface in package dispatch.
 type Service struct {
-	fs      fs
-	repo    repo
-	logger  log.FieldLogger
-	tracer  opentracing.Tracer
-	metrics counters
-	config  Config
+	fs       fs
+	versions versioner
+	logger   log.FieldLogger
+	tracer   opentracing.Tracer
+	metrics  counters
+	config   Config
 }
 
 type templateValues struct {
-	BuildNumber                   int64
 	Description                   string
 	JarDir                        string
 	MavenRepoPublishTarget        string
@@ -69,7 +75,8 @@ type templateValues struct {
 	ScalaVersion                  string
 	LegacyScalaVersion            string
 	ScalaPBRuntimePackageVersion  string
-	Snapshot                      bool
+	SHA                           string
+	Version                       string
 }
 
 type processorProps struct {
@@ -78,7 +85,7 @@ type processorProps struct {
 }
 
 // New returns a pointer to a scala Service configured with the parameters passed in.
-func New(config Config, fs fs, repo repo, logger log.FieldLogger, metrics counters, tracer opentracing.Tracer) *Service {
+func New(config Config, fs fs, versions versioner, logger log.FieldLogger, metrics counters, tracer opentracing.Tracer) *Service {
 	ptURL, err := url.Parse(config.MavenRepoPublishTarget)
 	if err != nil {
 		err = errors.WithStack(err)
@@ -88,7 +95,7 @@ func New(config Config, fs fs, repo repo, logger log.FieldLogger, metrics counte
 	logger.Debug(config.MavenRepoHost)
 	return &Service{
 		fs,
-		repo,
+		versions,
 		logger,
 		tracer,
 		metrics,
@@ -96,10 +103,16 @@ func New(config Config, fs fs, repo repo, logger log.FieldLogger, metrics counte
 	}
 }
 
+// Install returns the sbt setting that depends on version of the jar.
+func (s *Service) Install(repository, version string) string {
+	return fmt.Sprintf(`libraryDependencies += "%s" %%%% "%s" %% "%s"`, s.config.Organization, s.config.JarName, version)
+}
+
 // Process is the main method for use by the main function of the application, and the only one required
-// by the interface in main.go. It takes a context, used for cancelling itself in the case of a sigterm or sigint,
-// and a Push Event payload. It executes all steps necessary for creating jars and publishing them via sbt.
-func (s *Service) Process(ctx context.Context, payload github.PushPayload) {
+// by the processor interface in package dispatch. It takes a context, used for cancelling itself in the case of a sigterm or sigint,
+// and the shared checkout of the pushed commit. It executes all steps necessary for creating jars and publishing them via sbt.
+// Any error is returned tagged with the stage that produced it so the job queue can retry it.
+func (s *Service) Process(ctx context.Context, src build.Source) error {
 	start := time.Now()
 	// this span is a child of the parent span in the http handler, but since this will finish after
 	// the http handler returns, it follows from that span so it will display correctly.
@@ -113,13 +126,12 @@ func (s *Service) Process(ctx context.Context, payload github.PushPayload) {
 
 	// create a new directory to do all the work of this Process call which can be cleaned up at the end.
 	id := uuid.NewV4().String()
-	buildDir := fmt.Sprintf("/tmp/%s", id)
-	err := os.Mkdir(buildDir, 0750)
+	build.RecorderFrom(ctx).BuildID(id)
+	buildDir := build.WorkDir(id)
+	err := os.MkdirAll(buildDir, 0750)
 	if err != nil {
-		s.metrics.AddPackagingErrors(prometheus.Labels{"type": "mkdir"}, 1)
-		err = errors.WithStack(err)
-		s.logger.Errorf("%+v", err)
-		return
+		s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": "mkdir"}, 1)
+		return build.StageFailed(build.StageMkdir, errors.WithStack(err))
 	}
 
 	// create a struct for passing to other functions referencing the location of the work
@@ -136,58 +148,88 @@ func (s *Service) Process(ctx context.Context, payload github.PushPayload) {
 	// since cleanup is deferred it will still execute after the return statement
 	select {
 	case <-ctx.Done():
-		return
+		return ctx.Err()
 	// otherwise, do our work
 	default:
-		// clone down the repository
-		path, err := s.cloneCode(ctx, payload, procProps)
+		payload := src.Payload
+		path := src.Dir
+
+		v, err := s.versions.Version(ctx, src)
 		if err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "clone"}, 1)
-			s.logger.Errorf("%+v\n", errors.WithStack(err))
-			return
+			s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.StageVersion}, 1)
+			return build.StageFailed(build.StageVersion, err)
 		}
+		version := v.Maven()
+		build.RecorderFrom(ctx).Version(version)
 
 		// get all relevant subdirectories (scala/com/*) and process them into their own directories to publish
-		jarDir, err := createJar(ctx, s.fs, s.config, s.logger, path, payload, procProps)
+
+		finish := build.StartStage(ctx, build.StageCreate)
+		stageCtx, cancel := build.WithTimeout(ctx, build.StageCreate, s.config.Timeouts.Template)
+		jarDir, err := createJar(stageCtx, s.fs, s.config, s.logger, path, version, payload, procProps)
+		err = build.TimedOut(stageCtx, err)
+		cancel()
+		finish(err)
 		if err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "create"}, 1)
-			s.logger.Errorf("%+v\n", errors.WithStack(err))
-			return
+			s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StageCreate, err)}, 1)
+			return build.StageFailed(build.StageCreate, errors.WithStack(err))
 		}
 
-		// for each of those directories, publish the jar, either locally or to to a repo based on the config
-		err = publishJar(ctx, s.config, s.logger, jarDir)
+		// compile the jars for every scala version
+		finish = build.StartStage(ctx, build.StageBuild)
+		stageCtx, cancel = build.WithTimeout(ctx, build.StageBuild, s.config.Timeouts.Build)
+		err = runSBT(stageCtx, s.logger, jarDir, "+compile")
+		cancel()
+		finish(err)
 		if err != nil {
-			s.metrics.AddPackagingErrors(prometheus.Labels{"type": "publish"}, 1)
-			s.logger.Errorf("%+v\n", errors.WithStack(err))
+			s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StageBuild, err)}, 1)
+			return build.StageFailed(build.StageBuild, errors.WithStack(err))
 		}
 
-		duration := time.Since(start)
-		s.metrics.AddPackagingProcessDuration(prometheus.Labels{}, duration.Seconds())
+		// stop before publishing if the build was cancelled while building,
+		// by a newer push to the branch or by a shutdown
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
-		return
-	}
-}
+		// package the jars into the artifact directory, for a build of a
+		// local checkout
+		if out := build.ArtifactDir(ctx); out != "" {
+			finish = build.StartStage(ctx, build.StageCollect)
+			stageCtx, cancel = build.WithTimeout(ctx, build.StageCollect, s.config.Timeouts.Build)
+			err = collectJars(stageCtx, s.logger, jarDir, out)
+			cancel()
+			finish(err)
+			if err != nil {
+				s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StageCollect, err)}, 1)
+				return build.StageFailed(build.StageCollect, errors.WithStack(err))
+			}
+		}
 
-func (s *Service) cloneCode(ctx context.Context, payload github.PushPayload, props processorProps) (string, error) {
-	// create tmp dir inside of the parent build directory so it gets cleaned up at the end
-	cloneDir, err := s.fs.CreateUniqueTmpDir(props.BuildDir)
-	if err != nil {
-		return "", errors.Wrap(err, "could not create tmp directory for cloning")
-	}
-	// git clone the project
-	err = s.repo.CloneWithCheckout(cloneDir, payload)
-	if err != nil {
-		return "", errors.Wrap(err, "could not clone directory and checkout branch")
-	}
+		// publish the jars to the maven repo, if the config says to
+		if s.config.Publish {
+			finish = build.StartStage(ctx, build.StagePublish)
+			stageCtx, cancel = build.WithTimeout(ctx, build.StagePublish, s.config.Timeouts.Publish)
+			err = runSBT(stageCtx, s.logger, jarDir, "+publish")
+			cancel()
+			finish(err)
+			if err != nil {
+				s.metrics.AddPackagingErrors(prometheus.Labels{"language": language, "type": build.ErrorType(build.StagePublish, err)}, 1)
+				return build.StageFailed(build.StagePublish, errors.WithStack(err))
+			}
+		}
 
-	return cloneDir, nil
+		duration := time.Since(start)
+		s.metrics.AddPackagingProcessDuration(prometheus.Labels{"language": language}, duration.Seconds())
+
+		return nil
+	}
 }
 
 // CreateJar takes a path and finds all directories in the subpath of scala/com in that path. We package at that level.
 // For those directories it processes the templates in the scala package to create a directory mirroring the structure
 // of a publishable jar.
-func createJar(ctx context.Context, fs fs, config Config, logger log.FieldLogger, codePath string, payload github.PushPayload, props processorProps) (string, error) {
+func createJar(ctx context.Context, fs fs, config Config, logger log.FieldLogger, codePath, version string, payload event.Push, props processorProps) (string, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "create_jars")
 	span.SetTag("directory", codePath)
 	// subdirectories of the language
@@ -197,11 +239,9 @@ func createJar(ctx context.Context, fs fs, config Config, logger log.FieldLogger
 		return "", errors.Wrap(err, "could not get subdirectories in the clone dir")
 	}
 
-	snapshot := !strings.Contains(payload.Ref, "master")
 	values := templateValues{
 		Name:                          config.JarName,
 		JarDir:                        ".",
-		BuildNumber:                   payload.Repository.PushedAt,
 		Description:                   config.Description,
 		MavenRepoPublishTarget:        config.MavenRepoPublishTarget,
 		MavenRepoHost:                 config.MavenRepoHost,
@@ -214,7 +254,8 @@ func createJar(ctx context.Context, fs fs, config Config, logger log.FieldLogger
 		ScalaVersion:                  config.ScalaVersion,
 		LegacyScalaVersion:            config.LegacyScalaVersion,
 		ScalaPBRuntimePackageVersion:  config.ScalaPBRuntimePackageVersion,
-		Snapshot:                      snapshot,
+		SHA:                           payload.After,
+		Version:                       version,
 	}
 
 	logger.Debug(fmt.Sprintf("%+v", values))
@@ -245,26 +286,19 @@ func createJar(ctx context.Context, fs fs, config Config, logger log.FieldLogger
 	return jarDir, nil
 }
 
-// PublishJar publishes the jar to the repository defined by the target project's files.
-// If service.config.Publish is true, it will publish to a live online external repository.
-// If Publish is false it will publish locally for development and testing purposes.
-func publishJar(ctx context.Context, config Config, logger log.FieldLogger, path string) error {
-	var action string
-	if config.Publish {
-		action = "+publish"
-	} else {
-		action = "+compile"
-	}
-
+// runSBT runs an sbt action, such as +compile or +publish, in the jar
+// directory. Publishing goes to the repository defined by the templated
+// build.sbt.
+func runSBT(ctx context.Context, logger log.FieldLogger, path, action string) error {
 	span, _ := opentracing.StartSpanFromContext(ctx, action)
 	span.SetTag("directory", path)
 	defer span.Finish()
 
 	// run sbt command in the tmp dirs
 	// #nosec
-	cmd := exec.Command("sbt", action)
+	cmd := exec.CommandContext(ctx, "sbt", action)
 	cmd.Dir = path
-	out, err := cmd.CombinedOutput()
+	out, err := build.CombinedOutput(ctx, cmd)
 	logger.Debug(fmt.Sprintf("%s", out))
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("error running sbt %s", action))
@@ -272,6 +306,20 @@ func publishJar(ctx context.Context, config Config, logger log.FieldLogger, path
 	return nil
 }
 
+// collectJars packages the jars for every scala version in the jar
+// directory and copies them to out.
+func collectJars(ctx context.Context, logger log.FieldLogger, path, out string) error {
+	err := runSBT(ctx, logger, path, "+package")
+	if err != nil {
+		return err
+	}
+
+	_, err = build.CollectArtifacts(path, out, func(rel string) bool {
+		return strings.HasPrefix(rel, "target/scala-") && filepath.Ext(rel) == ".jar"
+	})
+	return err
+}
+
 // Cleanup runs a fs.DeleteDir on the build directory created when running Process.
 func cleanup(ctx context.Context, fs fs, logger log.FieldLogger, props processorProps) {
 	span, _ := opentracing.StartSpanFromContext(ctx, "cleanup")
@@ -61,8 +61,8 @@ func Test_CreateJars(t *testing.T) {
 		Realm:                         "Artifactory",
 		SBTVersion:                    "1.5.5",
 		SBTProtocPluginPackageVersion: "0.99.33",
-		ScalaVersion                   "2.12.10",
-		LegacyScalaVersion             "2.11.12",
+		ScalaVersion:                  "2.12.10",
+		LegacyScalaVersion:            "2.11.12",
 		ScalaPBRuntimePackageVersion:  "0.10.0-M4",
 	}
 	if err != nil {
@@ -86,7 +86,7 @@ func Test_CreateJars(t *testing.T) {
 	ctx := context.Background()
 
 	defer cleanup(ctx, fs, logger, procProps)
-	path, err := createJar(ctx, fs, config, logger, "./test-resources", payload, procProps)
+	path, err := createJar(ctx, fs, config, logger, "./test-resources", "1.0.1530281075", payload, procProps)
 	if err != nil {
 		t.Errorf("%+v\n", err)
 	}
@@ -99,6 +99,14 @@ func Test_CreateJars(t *testing.T) {
 	assert.Contains(t, files, "build.sbt")
 	assert.Contains(t, files, "version.sbt")
 
+	buildSBT, err := ioutil.ReadFile(fmt.Sprintf("%s/build.sbt", path))
+	assert.Nil(t, err)
+	assert.Contains(t, string(buildSBT), fmt.Sprintf(`val gitSHA = "%s"`, payload.After))
+
+	versionSBT, err := ioutil.ReadFile(fmt.Sprintf("%s/version.sbt", path))
+	assert.Nil(t, err)
+	assert.Equal(t, "version := \"1.0.1530281075\"\n", string(versionSBT))
+
 	subDirs, err := fs.GetSubDirectories(path)
 	if err != nil {
 		t.Errorf("%+v\n", err)
@@ -143,8 +151,8 @@ func Test_CreateJars(t *testing.T) {
 		assert.Contains(t, healthFiles, "HealthStatus.java")
 	}
 
-	err = publishJar(ctx, config, logger, path)
+	err = runSBT(ctx, logger, path, "+compile")
 	if err != nil {
-		t.Errorf("jar publish failed at path %s: %s", path, err)
+		t.Errorf("jar compile failed at path %s: %s", path, err)
 	}
 }
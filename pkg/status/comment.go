@@ -0,0 +1,50 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+// comment posts the result of a preview of a pull request as a comment
+// on it, or updates the comment posted for an earlier preview, so the
+// pull request only ever has the one comment listing how to install the
+// packages of its latest commit. It does nothing for any other job.
+func (r *Reporter) comment(ctx context.Context, job *queue.Job, results []result) {
+	number, ok := branch.PullRequest(job.Payload.Ref)
+	if !ok || job.State == queue.Superseded {
+		// the newer push will update the comment itself
+		return
+	}
+	owner, name := repository(job)
+	marker := r.marker()
+	body := fmt.Sprintf("%s\n### Preview packages\n\nPackaged from %s. Every commit pushed to this pull request gets its own preview, and this comment is updated for the latest.\n\n%s",
+		marker, job.Payload.After, r.summary(job, results))
+
+	comments, err := r.repo.ListIssueComments(ctx, owner, name, int(number))
+	if err != nil {
+		r.logError(err)
+		return
+	}
+	for _, c := range comments {
+		if strings.HasPrefix(c.GetBody(), marker) {
+			r.logError(r.repo.EditIssueComment(ctx, owner, name, c.GetID(), body))
+			return
+		}
+	}
+	r.logError(r.repo.CreateIssueComment(ctx, owner, name, int(number), body))
+}
+
+// marker is the hidden first line of the preview comment, which finds
+// it again. It names the languages, so processes packaging different
+// languages each keep their own comment.
+func (r *Reporter) marker() string {
+	var names []string
+	for _, l := range r.languages {
+		names = append(names, l.name)
+	}
+	return fmt.Sprintf("<!-- %s preview: %s -->", r.config.Name, strings.Join(names, ","))
+}
@@ -0,0 +1,18 @@
+package status
+
+// Config represents config values for reporting jobs to Github.
+type Config struct {
+	// Mode is how the result of each job is reported on the pushed
+	// commit: off, the default, statuses for a commit status per
+	// language, or checks for a single check run, which needs Protofact
+	// to authenticate as a Github App.
+	Mode string
+	// URL is the base URL Protofact's api is reachable at, such as
+	// https://protofact.example.com. Statuses and check runs link to
+	// the job status and log under it, and have no link while it is
+	// empty.
+	URL string
+	// Name is the name of the check run, and the prefix of the context
+	// of each commit status. It is protofact by default.
+	Name string
+}
@@ -0,0 +1,334 @@
+// Package status reports the progress and result of every job back to
+// Github on the pushed commit, either as a commit status per language
+// or as a check run summarising every language, and comments the
+// packages of a preview on its pull request.
+package status
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v32/github"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+// The ways jobs can be reported to Github.
+const (
+	// Off does not report jobs.
+	Off = "off"
+	// Statuses sets a commit status for each language.
+	Statuses = "statuses"
+	// Checks creates a check run for each job.
+	Checks = "checks"
+)
+
+// maxDescription is the longest description Github accepts on a commit status.
+const maxDescription = 140
+
+type repo interface {
+	CreateStatus(ctx context.Context, owner, repo, sha, state, statusContext, description, targetURL string) error
+	CreateCheckRun(ctx context.Context, owner, repo string, opts github.CreateCheckRunOptions) (int64, error)
+	UpdateCheckRun(ctx context.Context, owner, repo string, id int64, opts github.UpdateCheckRunOptions) error
+	ListIssueComments(ctx context.Context, owner, repo string, number int) ([]*github.IssueComment, error)
+	CreateIssueComment(ctx context.Context, owner, repo string, number int, body string) error
+	EditIssueComment(ctx context.Context, owner, repo string, id int64, body string) error
+}
+
+type installer interface {
+	Install(repository, version string) string
+}
+
+type language struct {
+	name      string
+	installer installer
+}
+
+// result is the outcome of one language of a job, as reported.
+type result struct {
+	language    string
+	state       string
+	description string
+	version     string
+	install     string
+}
+
+// Reporter reports jobs to Github as they start and finish. It fulfills
+// the reporter interface in package queue. A failure to report is
+// logged, and never changes the result of a job.
+type Reporter struct {
+	config    Config
+	repo      repo
+	languages []language
+	logger    log.FieldLogger
+}
+
+// New returns a pointer to a Reporter with no languages registered.
+func New(config Config, repo repo, logger log.FieldLogger) (*Reporter, error) {
+	switch config.Mode {
+	case "", Off, Statuses, Checks:
+	default:
+		return nil, errors.Errorf("status mode %q did not match any mode, must be one of %s, %s or %s", config.Mode, Off, Statuses, Checks)
+	}
+	if config.Name == "" {
+		config.Name = "protofact"
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+
+	return &Reporter{
+		config: config,
+		repo:   repo,
+		logger: logger,
+	}, nil
+}
+
+// Register adds a language to be reported for every job, which gives
+// the command that installs a version of its package.
+func (r *Reporter) Register(name string, i installer) {
+	r.languages = append(r.languages, language{name: name, installer: i})
+}
+
+// Started reports an attempt of a job as started: every language that
+// will run is pending, or the job's check run in progress. The id of a
+// check run created is kept on the job.
+func (r *Reporter) Started(ctx context.Context, job *queue.Job) {
+	if !job.Payload.Github() {
+		return
+	}
+	switch r.config.Mode {
+	case Statuses:
+		for _, l := range r.wanted(job) {
+			if lang := find(job, l.name); lang != nil && lang.State == queue.Succeeded {
+				continue
+			}
+			r.setStatus(ctx, job, l.name, "pending", "packaging")
+		}
+	case Checks:
+		owner, name := repository(job)
+		inProgress := "in_progress"
+		if job.CheckRunID != 0 {
+			err := r.repo.UpdateCheckRun(ctx, owner, name, job.CheckRunID, github.UpdateCheckRunOptions{
+				Name:   r.config.Name,
+				Status: &inProgress,
+			})
+			r.logError(err)
+			return
+		}
+		opts := github.CreateCheckRunOptions{
+			Name:       r.config.Name,
+			HeadSHA:    job.Payload.After,
+			ExternalID: &job.ID,
+			Status:     &inProgress,
+			StartedAt:  &github.Timestamp{Time: time.Now().UTC()},
+		}
+		if url := r.jobURL(job); url != "" {
+			opts.DetailsURL = &url
+		}
+		id, err := r.repo.CreateCheckRun(ctx, owner, name, opts)
+		if err != nil {
+			r.logError(err)
+			return
+		}
+		job.CheckRunID = id
+	}
+}
+
+// Finished reports the result of an attempt of a job: the result of
+// each language as its commit status, or every language in the job's
+// check run. The result of a preview of a pull request is also
+// commented on the pull request, whatever the mode.
+func (r *Reporter) Finished(ctx context.Context, job *queue.Job) {
+	// only Github has statuses, checks and comments to report to
+	if !job.Payload.Github() {
+		return
+	}
+	results := r.results(job)
+	r.comment(ctx, job, results)
+	switch r.config.Mode {
+	case Statuses:
+		for _, res := range results {
+			r.setStatus(ctx, job, res.language, res.state, res.description)
+		}
+	case Checks:
+		owner, name := repository(job)
+		completed := "completed"
+		conclusion := "success"
+		switch {
+		case job.State == queue.Superseded:
+			conclusion = "cancelled"
+		case job.State != queue.Succeeded:
+			conclusion = "failure"
+		}
+		title := title(job, results)
+		summary := r.summary(job, results)
+		output := &github.CheckRunOutput{Title: &title, Summary: &summary}
+		now := &github.Timestamp{Time: time.Now().UTC()}
+
+		if job.CheckRunID == 0 {
+			opts := github.CreateCheckRunOptions{
+				Name:        r.config.Name,
+				HeadSHA:     job.Payload.After,
+				ExternalID:  &job.ID,
+				Status:      &completed,
+				Conclusion:  &conclusion,
+				CompletedAt: now,
+				Output:      output,
+			}
+			if url := r.jobURL(job); url != "" {
+				opts.DetailsURL = &url
+			}
+			id, err := r.repo.CreateCheckRun(ctx, owner, name, opts)
+			r.logError(err)
+			job.CheckRunID = id
+			return
+		}
+		err := r.repo.UpdateCheckRun(ctx, owner, name, job.CheckRunID, github.UpdateCheckRunOptions{
+			Name:        r.config.Name,
+			Status:      &completed,
+			Conclusion:  &conclusion,
+			CompletedAt: now,
+			Output:      output,
+		})
+		r.logError(err)
+	}
+}
+
+// results works out the outcome of every language of the job. A
+// language that did not get to run this attempt shares the job's result.
+func (r *Reporter) results(job *queue.Job) []result {
+	var results []result
+	for _, l := range r.wanted(job) {
+		res := result{language: l.name}
+		lang := find(job, l.name)
+		current := lang != nil && lang.StartedAt != nil && job.StartedAt != nil && !lang.StartedAt.Before(*job.StartedAt)
+		switch {
+		case lang != nil && lang.State == queue.Succeeded:
+			res.state = "success"
+			res.version = lang.Version
+			res.description = fmt.Sprintf("packaged %s", lang.Version)
+			if l.installer != nil {
+				res.install = l.installer.Install(job.Payload.Repository.FullName, lang.Version)
+			}
+		case current && lang.State == queue.Superseded, job.State == queue.Superseded:
+			res.state = "error"
+			res.description = "superseded by a newer push"
+		case current && lang.State == queue.Failed:
+			res.state = "failure"
+			res.version = lang.Version
+			res.description = lang.Error
+		case job.LastError != "":
+			res.state = "failure"
+			res.description = job.LastError
+		default:
+			res.state = "failure"
+			res.description = "did not run"
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// wanted returns the languages run for the job, which is every one of
+// them unless it was started on request for some.
+func (r *Reporter) wanted(job *queue.Job) []language {
+	if len(job.Only) == 0 {
+		return r.languages
+	}
+	var wanted []language
+	for _, l := range r.languages {
+		for _, only := range job.Only {
+			if l.name == only {
+				wanted = append(wanted, l)
+			}
+		}
+	}
+	return wanted
+}
+
+func (r *Reporter) setStatus(ctx context.Context, job *queue.Job, language, state, description string) {
+	owner, name := repository(job)
+	statusContext := fmt.Sprintf("%s/%s", r.config.Name, language)
+	err := r.repo.CreateStatus(ctx, owner, name, job.Payload.After, state, statusContext, truncate(description), r.jobURL(job))
+	r.logError(err)
+}
+
+// summary returns the markdown summary of a check run: the result of
+// each language and the commands installing the packages published.
+func (r *Reporter) summary(job *queue.Job, results []result) string {
+	var b strings.Builder
+	b.WriteString("| Language | Result | Version |\n|----------|--------|---------|\n")
+	var installs []string
+	for _, res := range results {
+		version := ""
+		if res.version != "" {
+			version = fmt.Sprintf("`%s`", res.version)
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s |\n", res.language, strings.ReplaceAll(res.description, "|", "\\|"), version)
+		if res.install != "" {
+			installs = append(installs, res.install)
+		}
+	}
+	if len(installs) > 0 {
+		fmt.Fprintf(&b, "\n### Install\n\n```\n%s\n```\n", strings.Join(installs, "\n"))
+	}
+	if url := r.jobURL(job); url != "" {
+		fmt.Fprintf(&b, "\n[Job status](%s) · [Build log](%s/logs)\n", url, url)
+	}
+	return b.String()
+}
+
+func title(job *queue.Job, results []result) string {
+	if job.State == queue.Superseded {
+		return "Superseded by a newer push"
+	}
+	var failed []string
+	for _, res := range results {
+		if res.state != "success" {
+			failed = append(failed, res.language)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Sprintf("Failed: %s", strings.Join(failed, ", "))
+	}
+	return fmt.Sprintf("Packaged %d languages", len(results))
+}
+
+// jobURL returns the URL of the job's status, or an empty string if
+// the URL of the api is not configured.
+func (r *Reporter) jobURL(job *queue.Job) string {
+	if r.config.URL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/jobs/%s", r.config.URL, job.ID)
+}
+
+func (r *Reporter) logError(err error) {
+	if err != nil {
+		r.logger.Errorf("%+v\n", err)
+	}
+}
+
+func find(job *queue.Job, language string) *queue.Language {
+	for i := range job.Languages {
+		if job.Languages[i].Name == language {
+			return &job.Languages[i]
+		}
+	}
+	return nil
+}
+
+func repository(job *queue.Job) (string, string) {
+	return job.Payload.Repository.Owner.Login, job.Payload.Repository.Name
+}
+
+func truncate(description string) string {
+	runes := []rune(description)
+	if len(runes) <= maxDescription {
+		return description
+	}
+	return string(runes[:maxDescription-1]) + "…"
+}
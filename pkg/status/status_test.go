@@ -0,0 +1,261 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/git"
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+// fakeGithub is a local stand in for the Github API, recording every
+// request made to it.
+type fakeGithub struct {
+	mu       sync.Mutex
+	requests []request
+	// comments is the JSON listing the comments of every pull request
+	comments string
+}
+
+type request struct {
+	method string
+	path   string
+	body   map[string]interface{}
+}
+
+func (f *fakeGithub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	content, _ := ioutil.ReadAll(r.Body)
+	var body map[string]interface{}
+	json.Unmarshal(content, &body)
+
+	f.mu.Lock()
+	f.requests = append(f.requests, request{method: r.Method, path: r.URL.Path, body: body})
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/check-runs"):
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id": 7}`)
+	case r.Method == http.MethodPatch && strings.Contains(r.URL.Path, "/check-runs/"):
+		fmt.Fprint(w, `{"id": 7}`)
+	case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/statuses/"):
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{}`)
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/comments"):
+		if f.comments == "" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, f.comments)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/comments"):
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id": 9}`)
+	case r.Method == http.MethodPatch && strings.Contains(r.URL.Path, "/issues/comments/"):
+		fmt.Fprint(w, `{"id": 9}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type fakeInstaller string
+
+func (f fakeInstaller) Install(repository, version string) string {
+	return fmt.Sprintf("%s %s@%s", f, repository, version)
+}
+
+func newTestReporter(t *testing.T, mode string) (*Reporter, *fakeGithub) {
+	fake := &fakeGithub{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	logger := log.WithField("test", t.Name())
+	repo := git.New(context.Background(), git.Config{Token: "token", APIURL: srv.URL + "/api/v3"}, logger)
+	r, err := New(Config{Mode: mode, URL: "https://protofact.example.com/"}, repo, logger)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	r.Register("npm", fakeInstaller("npm install"))
+	r.Register("ruby", fakeInstaller("gem install"))
+	return r, fake
+}
+
+func newTestJob() *queue.Job {
+	var payload event.Push
+	payload.After = "da6b8c5af1dbbd3f03a49b6d8b5fdf3b3bca9c8c"
+	payload.Repository.Name = "protos"
+	payload.Repository.FullName = "org/protos"
+	payload.Repository.Owner.Login = "org"
+	job := queue.NewJob("job1", payload)
+	now := time.Now().UTC()
+	job.StartedAt = &now
+	return job
+}
+
+func Test_Statuses(t *testing.T) {
+	r, fake := newTestReporter(t, Statuses)
+	job := newTestJob()
+
+	r.Started(context.Background(), job)
+
+	later := job.StartedAt.Add(time.Second)
+	job.State = queue.Running
+	job.LastError = "ruby failed: publish stage failed: registry unavailable"
+	job.Languages = []queue.Language{
+		{Name: "npm", State: queue.Succeeded, Version: "1.0.5", StartedAt: &later},
+		{Name: "ruby", State: queue.Failed, Version: "1.0.5", Error: "publish stage failed: registry unavailable", StartedAt: &later},
+	}
+	r.Finished(context.Background(), job)
+
+	path := "/api/v3/repos/org/protos/statuses/da6b8c5af1dbbd3f03a49b6d8b5fdf3b3bca9c8c"
+	if !assert.Len(t, fake.requests, 4) {
+		return
+	}
+	for _, req := range fake.requests {
+		assert.Equal(t, http.MethodPost, req.method)
+		assert.Equal(t, path, req.path)
+		assert.Equal(t, "https://protofact.example.com/jobs/job1", req.body["target_url"])
+	}
+	assert.Equal(t, "pending", fake.requests[0].body["state"])
+	assert.Equal(t, "protofact/npm", fake.requests[0].body["context"])
+	assert.Equal(t, "protofact/ruby", fake.requests[1].body["context"])
+	assert.Equal(t, "success", fake.requests[2].body["state"])
+	assert.Equal(t, "packaged 1.0.5", fake.requests[2].body["description"])
+	assert.Equal(t, "failure", fake.requests[3].body["state"])
+	assert.Equal(t, "publish stage failed: registry unavailable", fake.requests[3].body["description"])
+
+	// on the retry only the failed language is pending again
+	fake.requests = nil
+	r.Started(context.Background(), job)
+	if assert.Len(t, fake.requests, 1) {
+		assert.Equal(t, "protofact/ruby", fake.requests[0].body["context"])
+	}
+}
+
+func Test_Statuses_JobFailedBeforeLanguages(t *testing.T) {
+	r, fake := newTestReporter(t, Statuses)
+	job := newTestJob()
+	job.Only = []string{"ruby"}
+	job.LastError = "clone stage failed: repository not found"
+
+	r.Finished(context.Background(), job)
+	if assert.Len(t, fake.requests, 1) {
+		assert.Equal(t, "protofact/ruby", fake.requests[0].body["context"])
+		assert.Equal(t, "failure", fake.requests[0].body["state"])
+		assert.Equal(t, job.LastError, fake.requests[0].body["description"])
+	}
+}
+
+func Test_Checks(t *testing.T) {
+	r, fake := newTestReporter(t, Checks)
+	job := newTestJob()
+
+	r.Started(context.Background(), job)
+	assert.Equal(t, int64(7), job.CheckRunID)
+
+	later := job.StartedAt.Add(time.Second)
+	job.State = queue.Succeeded
+	job.Languages = []queue.Language{
+		{Name: "npm", State: queue.Succeeded, Version: "1.0.5", StartedAt: &later},
+		{Name: "ruby", State: queue.Succeeded, Version: "1.0.5", StartedAt: &later},
+	}
+	r.Finished(context.Background(), job)
+
+	if !assert.Len(t, fake.requests, 2) {
+		return
+	}
+	created := fake.requests[0]
+	assert.Equal(t, http.MethodPost, created.method)
+	assert.Equal(t, "/api/v3/repos/org/protos/check-runs", created.path)
+	assert.Equal(t, "protofact", created.body["name"])
+	assert.Equal(t, "in_progress", created.body["status"])
+	assert.Equal(t, job.Payload.After, created.body["head_sha"])
+	assert.Equal(t, "https://protofact.example.com/jobs/job1", created.body["details_url"])
+
+	updated := fake.requests[1]
+	assert.Equal(t, http.MethodPatch, updated.method)
+	assert.Equal(t, "/api/v3/repos/org/protos/check-runs/7", updated.path)
+	assert.Equal(t, "completed", updated.body["status"])
+	assert.Equal(t, "success", updated.body["conclusion"])
+	output := updated.body["output"].(map[string]interface{})
+	assert.Equal(t, "Packaged 2 languages", output["title"])
+	summary := output["summary"].(string)
+	assert.Contains(t, summary, "| npm | packaged 1.0.5 | `1.0.5` |")
+	assert.Contains(t, summary, "npm install org/protos@1.0.5\ngem install org/protos@1.0.5")
+	assert.Contains(t, summary, "[Build log](https://protofact.example.com/jobs/job1/logs)")
+}
+
+func Test_Comment(t *testing.T) {
+	r, fake := newTestReporter(t, Off)
+	job := newTestJob()
+	job.Payload.Ref = "refs/pull/12/head"
+
+	later := job.StartedAt.Add(time.Second)
+	job.State = queue.Succeeded
+	job.Languages = []queue.Language{
+		{Name: "npm", State: queue.Succeeded, Version: "1.0.5-pr.12.da6b8c5", StartedAt: &later},
+		{Name: "ruby", State: queue.Succeeded, Version: "1.0.5.pre.pr.12.da6b8c5", StartedAt: &later},
+	}
+	r.Finished(context.Background(), job)
+
+	if !assert.Len(t, fake.requests, 2) {
+		return
+	}
+	assert.Equal(t, http.MethodGet, fake.requests[0].method)
+	assert.Equal(t, "/api/v3/repos/org/protos/issues/12/comments", fake.requests[0].path)
+	created := fake.requests[1]
+	assert.Equal(t, http.MethodPost, created.method)
+	assert.Equal(t, "/api/v3/repos/org/protos/issues/12/comments", created.path)
+	body := created.body["body"].(string)
+	assert.True(t, strings.HasPrefix(body, "<!-- protofact preview: npm,ruby -->\n"))
+	assert.Contains(t, body, "npm install org/protos@1.0.5-pr.12.da6b8c5\ngem install org/protos@1.0.5.pre.pr.12.da6b8c5")
+
+	// a later preview updates the comment rather than adding another
+	fake.requests = nil
+	fake.comments = `[{"id": 3, "body": "looks good"}, {"id": 9, "body": "<!-- protofact preview: npm,ruby -->\nold"}]`
+	r.Finished(context.Background(), job)
+	if assert.Len(t, fake.requests, 2) {
+		assert.Equal(t, http.MethodPatch, fake.requests[1].method)
+		assert.Equal(t, "/api/v3/repos/org/protos/issues/comments/9", fake.requests[1].path)
+	}
+
+	// a superseded preview leaves the comment to the newer push
+	fake.requests = nil
+	job.State = queue.Superseded
+	r.Finished(context.Background(), job)
+	assert.Len(t, fake.requests, 0)
+}
+
+func Test_New(t *testing.T) {
+	_, err := New(Config{Mode: "comments"}, nil, log.WithField("test", t.Name()))
+	assert.NotNil(t, err)
+
+	r, err := New(Config{}, nil, log.WithField("test", t.Name()))
+	assert.Nil(t, err)
+	// nothing is reported, so the missing repo is never used
+	r.Started(context.Background(), newTestJob())
+	r.Finished(context.Background(), newTestJob())
+}
+
+func Test_NotGithub(t *testing.T) {
+	r, fake := newTestReporter(t, Checks)
+	job := newTestJob()
+	job.Payload.Provider = event.Gitlab
+	job.Payload.Ref = "refs/pull/12/head"
+
+	r.Started(context.Background(), job)
+	r.Finished(context.Background(), job)
+	assert.Len(t, fake.requests, 0)
+}
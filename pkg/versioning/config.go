@@ -0,0 +1,32 @@
+package versioning
+
+// Config represents config values for versioning.
+type Config struct {
+	// Strategy picks where the version of a commit comes from. It is
+	// one of timestamp, the default, gittag, file, counter or buf.
+	Strategy string
+	// Major and Minor are the major and minor version of the strategies
+	// that only work out a patch. They are 1.0 when both are zero. With
+	// Detect they are the lowest version released.
+	Major int
+	Minor int
+	// File is the file the file strategy reads the version from,
+	// relative to the root of the repository. It is VERSION by default.
+	File string
+	// Key is the dotted path to the version in buf.yaml, or in
+	// prototool.yaml if there is no buf.yaml, for the buf strategy. It
+	// is protofact.version by default.
+	Key string
+	// Detect compares the protobuf schema of each commit with that of
+	// the last stable release, and works out the major and minor of the
+	// strategies that only work out a patch from the changes.
+	Detect bool
+	// Gate refuses to publish a stable release of a commit with breaking
+	// schema changes since the last stable release, unless its commit
+	// message holds the AllowBreaking directive or it was built on
+	// request with breaking changes allowed.
+	Gate bool
+	// Protos is the directory the .proto files are in, relative to the
+	// root of the repository. It is the whole repository by default.
+	Protos string
+}
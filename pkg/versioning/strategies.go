@@ -0,0 +1,200 @@
+package versioning
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/gospotcheck/protofact/pkg/build"
+)
+
+// release matches a release version such as 1.2.3 or v1.2, which has
+// no prerelease part.
+var release = regexp.MustCompile(`^v?(\d+)\.(\d+)(?:\.(\d+))?$`)
+
+// timestamp versions a commit with the time it was pushed as the patch.
+func (v *Versioner) timestamp(ctx context.Context, src build.Source) (Version, error) {
+	major, minor := v.base(ctx)
+	return Version{
+		Major: major,
+		Minor: minor,
+		Patch: src.Payload.Repository.PushedAt,
+	}, nil
+}
+
+// counter versions a commit with its build number as the patch.
+func (v *Versioner) counter(ctx context.Context, src build.Source) (Version, error) {
+	number, err := v.store.BuildNumber(src.Payload.Repository.FullName, src.Payload.After)
+	if err != nil {
+		return Version{}, err
+	}
+	major, minor := v.base(ctx)
+	return Version{
+		Major: major,
+		Minor: minor,
+		Patch: number,
+	}, nil
+}
+
+// gitTag versions a commit from the highest release tag it contains,
+// adding the number of commits since the tag to the tag's patch. A
+// commit with no release tag is versioned with the configured major and
+// minor and the number of commits up to it as the patch.
+func (v *Versioner) gitTag(ctx context.Context, src build.Source) (Version, error) {
+	out, err := git(ctx, src.Dir, "tag", "--merged", "HEAD")
+	if err != nil {
+		return Version{}, err
+	}
+
+	var latest Version
+	var latestTag string
+	for _, tag := range strings.Fields(out) {
+		version, ok := parse(tag)
+		// only tags with a patch are releases
+		if !ok || strings.Count(tag, ".") != 2 {
+			continue
+		}
+		if latestTag == "" || less(latest, version) {
+			latest = version
+			latestTag = tag
+		}
+	}
+
+	if latestTag == "" {
+		out, err = git(ctx, src.Dir, "rev-list", "--count", "HEAD")
+		if err != nil {
+			return Version{}, err
+		}
+		count, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+		if err != nil {
+			return Version{}, errors.Wrap(err, "could not count commits")
+		}
+		major, minor := v.base(ctx)
+		return Version{
+			Major: major,
+			Minor: minor,
+			Patch: count,
+		}, nil
+	}
+
+	out, err = git(ctx, src.Dir, "rev-list", "--count", fmt.Sprintf("%s..HEAD", latestTag))
+	if err != nil {
+		return Version{}, err
+	}
+	distance, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return Version{}, errors.Wrap(err, fmt.Sprintf("could not count commits since %s", latestTag))
+	}
+	latest.Patch += distance
+	return latest, nil
+}
+
+// file versions a commit from the version file in the repository.
+func (v *Versioner) file(ctx context.Context, src build.Source) (Version, error) {
+	path := filepath.Join(src.Dir, v.config.File)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Version{}, errors.Wrap(err, fmt.Sprintf("could not read version file %s", v.config.File))
+	}
+	return v.release(strings.TrimSpace(string(content)), src)
+}
+
+// buf versions a commit from the version at the configured key of the
+// buf.yaml, or prototool.yaml, of the repository.
+func (v *Versioner) buf(ctx context.Context, src build.Source) (Version, error) {
+	for _, name := range []string{"buf.yaml", "prototool.yaml"} {
+		content, err := ioutil.ReadFile(filepath.Join(src.Dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return Version{}, errors.Wrap(err, fmt.Sprintf("could not read %s", name))
+		}
+
+		var values map[interface{}]interface{}
+		if err := yaml.Unmarshal(content, &values); err != nil {
+			return Version{}, errors.Wrap(err, fmt.Sprintf("could not parse %s", name))
+		}
+		value, ok := lookup(values, strings.Split(v.config.Key, "."))
+		if !ok {
+			return Version{}, errors.Errorf("%s has no %s", name, v.config.Key)
+		}
+		return v.release(fmt.Sprintf("%v", value), src)
+	}
+	return Version{}, errors.New("found neither buf.yaml nor prototool.yaml")
+}
+
+// release parses a version read from the repository. A version with no
+// patch, such as 1.2, gets the time of the push as its patch.
+func (v *Versioner) release(s string, src build.Source) (Version, error) {
+	version, ok := parse(s)
+	if !ok {
+		return Version{}, errors.Errorf("%q is not a version such as 1.2.3 or 1.2", s)
+	}
+	if strings.Count(s, ".") == 1 {
+		version.Patch = src.Payload.Repository.PushedAt
+	}
+	return version, nil
+}
+
+// parse parses a release version such as 1.2.3, v1.2.3 or 1.2, whose
+// patch is left at zero.
+func parse(s string) (Version, bool) {
+	m := release.FindStringSubmatch(s)
+	if m == nil {
+		return Version{}, false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	var patch int64
+	if m[3] != "" {
+		patch, _ = strconv.ParseInt(m[3], 10, 64)
+	}
+	return Version{Major: major, Minor: minor, Patch: patch}, true
+}
+
+// less reports whether release a is lower than release b.
+func less(a, b Version) bool {
+	if a.Major != b.Major {
+		return a.Major < b.Major
+	}
+	if a.Minor != b.Minor {
+		return a.Minor < b.Minor
+	}
+	return a.Patch < b.Patch
+}
+
+func lookup(values map[interface{}]interface{}, path []string) (interface{}, bool) {
+	value, ok := values[path[0]]
+	if !ok || len(path) == 1 {
+		return value, ok
+	}
+	nested, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, false
+	}
+	return lookup(nested, path[1:])
+}
+
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		msg := fmt.Sprintf("error running git %s", strings.Join(args, " "))
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			msg = fmt.Sprintf("%s: %s", msg, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", errors.Wrap(err, msg)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,362 @@
+// Package versioning works out the one version a commit is released
+// as, and renders it for each ecosystem packages are published to, so
+// a commit maps to the same logical version in every language.
+package versioning
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/queue"
+	"github.com/gospotcheck/protofact/pkg/schema"
+)
+
+// The major and minor version of every release when none are configured.
+const (
+	DefaultMajor = 1
+	DefaultMinor = 0
+)
+
+// AllowBreaking is the directive that lets a commit with breaking schema
+// changes be released when the breaking change gate is on, if it is
+// anywhere in the commit message.
+const AllowBreaking = "[allow-breaking]"
+
+// The strategies a version can be worked out with.
+const (
+	// Timestamp uses the time of the push as the patch.
+	Timestamp = "timestamp"
+	// GitTag uses the latest release tag of the commit, with the number
+	// of commits since the tag added to its patch.
+	GitTag = "gittag"
+	// File reads the version from a file in the repository.
+	File = "file"
+	// Counter uses a build number counted by Protofact as the patch.
+	Counter = "counter"
+	// Buf reads the version from the buf or prototool config of the
+	// repository.
+	Buf = "buf"
+)
+
+type policy interface {
+	Decide(ref string) branch.Decision
+}
+
+type store interface {
+	BuildNumber(repository, sha string) (int64, error)
+	LastRelease(repository string) (queue.Release, bool, error)
+	SetRelease(repository string, release queue.Release) error
+}
+
+// Version is the canonical semantic version of a commit.
+type Version struct {
+	Major int
+	Minor int
+	Patch int64
+	// Pre holds the identifiers of a prerelease, such as feature and x
+	// for a prerelease of the feature/x branch. It is empty for a
+	// stable release.
+	Pre []string
+}
+
+// Versioner works out the version of commits with the configured
+// strategy, releasing them as the branch policy decides.
+type Versioner struct {
+	config   Config
+	branches policy
+	store    store
+	strategy func(ctx context.Context, src build.Source) (Version, error)
+}
+
+// New returns a pointer to a Versioner configured with the parameters
+// passed in. The counter strategy keeps its build numbers in store, and
+// detecting schema changes the last release, so it can only be nil when
+// neither is used.
+func New(config Config, branches policy, store store) (*Versioner, error) {
+	if config.Major == 0 && config.Minor == 0 {
+		config.Major = DefaultMajor
+		config.Minor = DefaultMinor
+	}
+	if config.File == "" {
+		config.File = "VERSION"
+	}
+	if config.Key == "" {
+		config.Key = "protofact.version"
+	}
+
+	v := &Versioner{
+		config:   config,
+		branches: branches,
+		store:    store,
+	}
+	if (config.Detect || config.Gate) && store == nil {
+		return nil, errors.New("detecting schema changes needs the job store to record releases")
+	}
+	switch config.Strategy {
+	case "", Timestamp:
+		v.strategy = v.timestamp
+	case GitTag:
+		v.strategy = v.gitTag
+	case File:
+		v.strategy = v.file
+	case Counter:
+		if store == nil {
+			return nil, errors.New("the counter versioning strategy needs the job store to count builds")
+		}
+		v.strategy = v.counter
+	case Buf:
+		v.strategy = v.buf
+	default:
+		return nil, errors.Errorf("versioning strategy %q did not match any strategy, must be one of %s, %s, %s, %s or %s", config.Strategy, Timestamp, GitTag, File, Counter, Buf)
+	}
+	return v, nil
+}
+
+// Version returns the version the commit checked out in src is
+// released as. It is a prerelease named after the label of the branch
+// policy's decision unless the decision is stable, and a preview of a
+// pull request is also labelled with its commit, such as
+// 1.0.5-pr.123.da6b8c5. A tag the policy releases as the version it
+// names is released as exactly that version.
+func (v *Versioner) Version(ctx context.Context, src build.Source) (Version, error) {
+	release := v.branches.Decide(src.Payload.Ref)
+	if release.Version != "" {
+		// a tag names its version, whatever the strategy
+		version, ok := parse(release.Version)
+		if !ok {
+			return Version{}, errors.Errorf("%q is not a version such as 1.2.3", release.Version)
+		}
+		if !release.Stable() {
+			version.Pre = identifiers(release.Label)
+		}
+		return version, nil
+	}
+
+	version, err := v.strategy(ctx, src)
+	if err != nil {
+		return Version{}, errors.Wrap(err, fmt.Sprintf("could not work out the version with the %s strategy", v.config.Strategy))
+	}
+	if !release.Stable() {
+		version.Pre = identifiers(release.Label)
+	}
+	if release.Channel == branch.Preview {
+		// every commit pushed to a pull request gets its own preview
+		version.Pre = append(version.Pre, identifiers(shortSHA(src.Payload.After))...)
+	}
+	return version, nil
+}
+
+// shortSHA returns the abbreviated commit sha git shows by default.
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// Compare compares the schema of the commit checked out in src with
+// that of the last stable release of its repository, recording the
+// report on the Recorder in ctx. The report is nil if neither detecting
+// schema changes nor the gate is configured. Versions worked out with a
+// context carrying the report, see schema.WithReport, follow from its
+// changes if detecting them is configured.
+func (v *Versioner) Compare(ctx context.Context, src build.Source) (*schema.Report, error) {
+	if !v.config.Detect && !v.config.Gate {
+		return nil, nil
+	}
+	finish := build.StartStage(ctx, build.StageSchema)
+	report, err := v.compare(ctx, src)
+	finish(err)
+	if err != nil {
+		return nil, err
+	}
+	build.RecorderFrom(ctx).Schema(*report)
+	return report, nil
+}
+
+func (v *Versioner) compare(ctx context.Context, src build.Source) (*schema.Report, error) {
+	repository := src.Payload.Repository.FullName
+	last, found, err := v.store.LastRelease(repository)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return &schema.Report{}, nil
+	}
+	report := &schema.Report{Base: last.SHA, BaseVersion: last.Version}
+	if last.SHA == src.Payload.After {
+		return report, nil
+	}
+
+	old, err := schema.LoadCommit(ctx, src.Dir, last.SHA, v.config.Protos)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not read the schema of the last release %s", last.Version))
+	}
+	new, err := schema.Load(filepath.Join(src.Dir, v.config.Protos))
+	if err != nil {
+		return nil, err
+	}
+	report.Changes = schema.Compare(old, new)
+	return report, nil
+}
+
+// Gate checks the schema report carried by ctx against the breaking
+// change gate. It reports whether the commit in src is held to the gate,
+// which is the case for a stable release when the gate is configured,
+// and returns a permanent error if the release has breaking changes
+// that were not allowed.
+func (v *Versioner) Gate(ctx context.Context, src build.Source) (bool, error) {
+	report := schema.ReportFrom(ctx)
+	if !v.config.Gate || report == nil || !v.branches.Decide(src.Payload.Ref).Stable() {
+		return false, nil
+	}
+
+	finish := build.StartStage(ctx, build.StageGate)
+	err := v.gate(ctx, src, report)
+	finish(err)
+	return true, err
+}
+
+func (v *Versioner) gate(ctx context.Context, src build.Source, report *schema.Report) error {
+	if report.Level() != schema.Breaking {
+		return nil
+	}
+	if build.BreakingAllowed(ctx) || strings.Contains(src.Payload.HeadCommit.Message, AllowBreaking) {
+		fmt.Fprintf(build.OutputFrom(ctx), "breaking schema changes since %s allowed by override\n", report.BaseVersion)
+		return nil
+	}
+
+	var breaking []string
+	for _, c := range report.Changes {
+		if c.Level == schema.Breaking {
+			breaking = append(breaking, c.Description)
+		}
+	}
+	return build.Permanent(errors.Errorf("%d breaking schema changes since %s, add %s to the commit message or build it on request allowing breaking changes to release it: %s",
+		len(breaking), report.BaseVersion, AllowBreaking, strings.Join(breaking, "; ")))
+}
+
+// Released records the commit in src as the last stable release of its
+// repository, which later commits are compared with, if it was released
+// as stable. It does nothing if schemas are not compared.
+func (v *Versioner) Released(ctx context.Context, src build.Source) error {
+	if !v.config.Detect && !v.config.Gate {
+		return nil
+	}
+	version, err := v.Version(ctx, src)
+	if err != nil {
+		return err
+	}
+	if !version.Stable() {
+		return nil
+	}
+	return v.store.SetRelease(src.Payload.Repository.FullName, queue.Release{
+		SHA:     src.Payload.After,
+		Version: version.String(),
+	})
+}
+
+// base returns the major and minor version of the strategies that only
+// work out a patch. If ctx carries a schema report they follow from the
+// last release: a breaking change bumps the major, and anything added
+// the minor. The configured version is used if it is higher.
+func (v *Versioner) base(ctx context.Context) (int, int) {
+	configured := Version{Major: v.config.Major, Minor: v.config.Minor}
+	report := schema.ReportFrom(ctx)
+	if !v.config.Detect || report == nil || report.Base == "" {
+		return configured.Major, configured.Minor
+	}
+	last, ok := parse(report.BaseVersion)
+	if !ok {
+		return configured.Major, configured.Minor
+	}
+
+	next := Version{Major: last.Major, Minor: last.Minor}
+	switch report.Level() {
+	case schema.Breaking:
+		next = Version{Major: last.Major + 1}
+	case schema.Minor:
+		next.Minor++
+	}
+	if less(next, configured) {
+		return configured.Major, configured.Minor
+	}
+	return next.Major, next.Minor
+}
+
+// Stable reports whether the version is a full release.
+func (v Version) Stable() bool {
+	return len(v.Pre) == 0
+}
+
+// String returns the semantic version, such as 1.0.5 or 1.0.5-feature.x.
+func (v Version) String() string {
+	core := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Stable() {
+		return core
+	}
+	return fmt.Sprintf("%s-%s", core, strings.Join(v.Pre, "."))
+}
+
+// NPM returns the version for an npm package, which is the semantic
+// version itself.
+func (v Version) NPM() string {
+	return v.String()
+}
+
+// RubyGems returns the version for a gem, such as 1.0.5.pre.feature.x.
+// Gem versions only allow periods between their parts, and any part
+// with a letter makes a version a prerelease.
+func (v Version) RubyGems() string {
+	core := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Stable() {
+		return core
+	}
+	return fmt.Sprintf("%s.pre.%s", core, strings.Join(v.Pre, "."))
+}
+
+// Maven returns the version for a Maven or Ivy artifact, such as
+// 1.0.5-feature.x-SNAPSHOT. Prereleases are snapshots.
+func (v Version) Maven() string {
+	if v.Stable() {
+		return v.String()
+	}
+	return fmt.Sprintf("%s-SNAPSHOT", v.String())
+}
+
+// GoTag returns the git tag a Go module is released under, such as
+// v1.0.5-feature.x.
+func (v Version) GoTag() string {
+	return fmt.Sprintf("v%s", v.String())
+}
+
+// identifiers splits a prerelease label into identifiers every
+// ecosystem accepts: lowercase letters and digits, split at anything
+// else, with no leading zeros on numbers.
+func identifiers(label string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(label), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+
+	var ids []string
+	for _, f := range fields {
+		if strings.Trim(f, "0123456789") == "" {
+			// semver does not allow leading zeros on numeric identifiers
+			f = strings.TrimLeft(f, "0")
+			if f == "" {
+				f = "0"
+			}
+		}
+		ids = append(ids, f)
+	}
+	if len(ids) == 0 {
+		ids = []string{"prerelease"}
+	}
+	return ids
+}
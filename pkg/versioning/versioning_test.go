@@ -0,0 +1,422 @@
+package versioning
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/build"
+	"github.com/gospotcheck/protofact/pkg/queue"
+	"github.com/gospotcheck/protofact/pkg/schema"
+)
+
+func Test_Render(t *testing.T) {
+	tests := []struct {
+		name     string
+		label    string
+		semver   string
+		gem      string
+		maven    string
+		goTag    string
+		isStable bool
+	}{
+		{
+			name:     "stable",
+			semver:   "1.0.1530281075",
+			gem:      "1.0.1530281075",
+			maven:    "1.0.1530281075",
+			goTag:    "v1.0.1530281075",
+			isStable: true,
+		},
+		{
+			name:   "branch",
+			label:  "feature/Add_Users-v2",
+			semver: "1.0.1530281075-feature.add.users.v2",
+			gem:    "1.0.1530281075.pre.feature.add.users.v2",
+			maven:  "1.0.1530281075-feature.add.users.v2-SNAPSHOT",
+			goTag:  "v1.0.1530281075-feature.add.users.v2",
+		},
+		{
+			name:   "leading zeros",
+			label:  "hotfix/007",
+			semver: "1.0.1530281075-hotfix.7",
+			gem:    "1.0.1530281075.pre.hotfix.7",
+			maven:  "1.0.1530281075-hotfix.7-SNAPSHOT",
+			goTag:  "v1.0.1530281075-hotfix.7",
+		},
+		{
+			name:   "nothing usable in the label",
+			label:  "__",
+			semver: "1.0.1530281075-prerelease",
+			gem:    "1.0.1530281075.pre.prerelease",
+			maven:  "1.0.1530281075-prerelease-SNAPSHOT",
+			goTag:  "v1.0.1530281075-prerelease",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := Version{Major: 1, Minor: 0, Patch: 1530281075}
+			if !tt.isStable {
+				v.Pre = identifiers(tt.label)
+			}
+			assert.Equal(t, tt.isStable, v.Stable())
+			assert.Equal(t, tt.semver, v.String())
+			assert.Equal(t, tt.semver, v.NPM())
+			assert.Equal(t, tt.gem, v.RubyGems())
+			assert.Equal(t, tt.maven, v.Maven())
+			assert.Equal(t, tt.goTag, v.GoTag())
+		})
+	}
+}
+
+type fakeStore struct {
+	numbers  map[string]int64
+	releases map[string]queue.Release
+}
+
+func (f *fakeStore) BuildNumber(repository, sha string) (int64, error) {
+	if _, ok := f.numbers[sha]; !ok {
+		f.numbers[sha] = int64(len(f.numbers) + 1)
+	}
+	return f.numbers[sha], nil
+}
+
+func (f *fakeStore) LastRelease(repository string) (queue.Release, bool, error) {
+	release, ok := f.releases[repository]
+	return release, ok, nil
+}
+
+func (f *fakeStore) SetRelease(repository string, release queue.Release) error {
+	f.releases[repository] = release
+	return nil
+}
+
+func newSource(t *testing.T, ref string) build.Source {
+	dir, err := ioutil.TempDir("", "protofact-versioning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	var src build.Source
+	src.Dir = dir
+	src.Payload.Ref = ref
+	src.Payload.After = "da6b8c5af1dbbd3f03a49b6d8b5fdf3b3bca9c8c"
+	src.Payload.Repository.FullName = "org/protos"
+	src.Payload.Repository.PushedAt = 1530281075
+	return src
+}
+
+func newVersioner(t *testing.T, config Config) *Versioner {
+	policy, err := branch.New(branch.Config{Rules: []branch.Rule{{Glob: "develop", Channel: "beta"}}})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	v, err := New(config, policy, &fakeStore{numbers: map[string]int64{}, releases: map[string]queue.Release{}})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return v
+}
+
+func Test_Version_Timestamp(t *testing.T) {
+	v := newVersioner(t, Config{})
+
+	version, err := v.Version(context.Background(), newSource(t, "refs/heads/master"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1.0.1530281075", version.String())
+
+	version, err = v.Version(context.Background(), newSource(t, "refs/heads/develop"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1.0.1530281075-beta", version.String())
+
+	version, err = v.Version(context.Background(), newSource(t, "refs/pull/123/head"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1.0.1530281075-pr.123.da6b8c5", version.String())
+	assert.Equal(t, "1.0.1530281075.pre.pr.123.da6b8c5", version.RubyGems())
+
+	v = newVersioner(t, Config{Strategy: Timestamp, Major: 2, Minor: 3})
+	version, err = v.Version(context.Background(), newSource(t, "refs/heads/master"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2.3.1530281075", version.String())
+}
+
+func Test_Version_Tag(t *testing.T) {
+	policy, err := branch.New(branch.Config{Tags: true})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	v, err := New(Config{Strategy: Counter}, policy, &fakeStore{numbers: map[string]int64{}, releases: map[string]queue.Release{}})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	version, err := v.Version(context.Background(), newSource(t, "refs/tags/v2.3.0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2.3.0", version.String())
+	assert.True(t, version.Stable())
+
+	version, err = v.Version(context.Background(), newSource(t, "refs/tags/v2.3.0-rc.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2.3.0-rc.1", version.String())
+	assert.Equal(t, "2.3.0.pre.rc.1", version.RubyGems())
+}
+
+func Test_Version_Counter(t *testing.T) {
+	v := newVersioner(t, Config{Strategy: Counter, Minor: 4})
+	src := newSource(t, "refs/heads/master")
+
+	version, err := v.Version(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, "0.4.1", version.String())
+
+	// the same commit keeps its number
+	version, err = v.Version(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, "0.4.1", version.String())
+
+	src.Payload.After = "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"
+	version, err = v.Version(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, "0.4.2", version.String())
+}
+
+func Test_Version_File(t *testing.T) {
+	v := newVersioner(t, Config{Strategy: File})
+	src := newSource(t, "refs/heads/feature/x")
+
+	_, err := v.Version(context.Background(), src)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src.Dir, "VERSION"), []byte("v2.1.7\n"), 0640))
+	version, err := v.Version(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, "2.1.7-feature.x", version.String())
+
+	// without a patch the push time is used
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src.Dir, "VERSION"), []byte("2.1"), 0640))
+	version, err = v.Version(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, "2.1.1530281075-feature.x", version.String())
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src.Dir, "VERSION"), []byte("two"), 0640))
+	_, err = v.Version(context.Background(), src)
+	assert.NotNil(t, err)
+}
+
+func Test_Version_Buf(t *testing.T) {
+	v := newVersioner(t, Config{Strategy: Buf})
+	src := newSource(t, "refs/heads/master")
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src.Dir, "prototool.yaml"), []byte("protofact:\n  version: \"3.0.2\"\n"), 0640))
+	version, err := v.Version(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, "3.0.2", version.String())
+
+	// buf.yaml is read before prototool.yaml
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src.Dir, "buf.yaml"), []byte("version: v1\nprotofact:\n  version: \"4.1\"\n"), 0640))
+	version, err = v.Version(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, "4.1.1530281075", version.String())
+
+	v = newVersioner(t, Config{Strategy: Buf, Key: "missing"})
+	_, err = v.Version(context.Background(), src)
+	assert.NotNil(t, err)
+}
+
+func Test_Version_GitTag(t *testing.T) {
+	v := newVersioner(t, Config{Strategy: GitTag, Major: 1, Minor: 2})
+	src := newSource(t, "refs/heads/master")
+
+	run := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.email=dev@org.com", "-c", "user.name=dev"}, args...)...)
+		cmd.Dir = src.Dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+	}
+	run("init", "-q")
+	run("commit", "-q", "--allow-empty", "-m", "first")
+	run("commit", "-q", "--allow-empty", "-m", "second")
+
+	// with no tag the commits are counted
+	version, err := v.Version(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.2", version.String())
+
+	run("tag", "v2.3.4", "HEAD~1")
+	run("tag", "v9.0.0-beta.x", "HEAD")
+	run("tag", "not-a-version", "HEAD")
+	version, err = v.Version(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, "2.3.5", version.String())
+
+	run("tag", "v2.4.0", "HEAD")
+	version, err = v.Version(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, "2.4.0", version.String())
+}
+
+func Test_New(t *testing.T) {
+	policy, err := branch.New(branch.Config{})
+	assert.Nil(t, err)
+
+	_, err = New(Config{Strategy: "semver"}, policy, nil)
+	assert.NotNil(t, err)
+
+	_, err = New(Config{Strategy: Counter}, policy, nil)
+	assert.NotNil(t, err)
+
+	_, err = New(Config{Detect: true}, policy, nil)
+	assert.NotNil(t, err)
+}
+
+func Test_Version_Detect(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		report  *schema.Report
+		version string
+	}{
+		{
+			name:    "no release yet",
+			report:  &schema.Report{},
+			version: "1.0.1530281075",
+		},
+		{
+			name:    "unchanged",
+			report:  &schema.Report{Base: "aaa", BaseVersion: "2.3.1500000000"},
+			version: "2.3.1530281075",
+		},
+		{
+			name:    "added",
+			report:  &schema.Report{Base: "aaa", BaseVersion: "2.3.1500000000", Changes: []schema.Change{{Level: schema.Minor}}},
+			version: "2.4.1530281075",
+		},
+		{
+			name:    "breaking",
+			report:  &schema.Report{Base: "aaa", BaseVersion: "2.3.1500000000", Changes: []schema.Change{{Level: schema.Minor}, {Level: schema.Breaking}}},
+			version: "3.0.1530281075",
+		},
+		{
+			name:    "configured higher",
+			config:  Config{Major: 4, Minor: 1},
+			report:  &schema.Report{Base: "aaa", BaseVersion: "2.3.1500000000", Changes: []schema.Change{{Level: schema.Breaking}}},
+			version: "4.1.1530281075",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Detect = true
+			v := newVersioner(t, tt.config)
+			ctx := schema.WithReport(context.Background(), tt.report)
+			version, err := v.Version(ctx, newSource(t, "refs/heads/master"))
+			assert.Nil(t, err)
+			assert.Equal(t, tt.version, version.String())
+		})
+	}
+}
+
+func Test_Compare(t *testing.T) {
+	v := newVersioner(t, Config{Detect: true, Protos: "proto"})
+	src := newSource(t, "refs/heads/master")
+	run := func(args ...string) string {
+		out, err := git(context.Background(), src.Dir, args...)
+		assert.Nil(t, err)
+		return strings.TrimSpace(out)
+	}
+	commit := func(content string) string {
+		assert.Nil(t, os.MkdirAll(filepath.Join(src.Dir, "proto"), 0750))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(src.Dir, "proto", "demo.proto"), []byte(content), 0640))
+		run("add", "-A")
+		run("commit", "-q", "-m", "change")
+		return run("rev-parse", "HEAD")
+	}
+	run("init", "-q")
+	run("config", "user.email", "test@example.com")
+	run("config", "user.name", "test")
+
+	// the first commit has nothing to compare with
+	src.Payload.After = commit("package demo; message User { string id = 1; string name = 2; }")
+	report, err := v.Compare(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, &schema.Report{}, report)
+	ctx := schema.WithReport(context.Background(), report)
+	assert.Nil(t, v.Released(ctx, src))
+
+	// a prerelease is not recorded as a release
+	first := src.Payload.After
+	prerelease := src
+	prerelease.Payload.Ref = "refs/heads/develop"
+	assert.Nil(t, v.Released(ctx, prerelease))
+
+	src.Payload.After = commit("package demo; message User { string id = 1; }")
+	src.Payload.Repository.PushedAt++
+	report, err = v.Compare(context.Background(), src)
+	assert.Nil(t, err)
+	assert.Equal(t, first, report.Base)
+	assert.Equal(t, "1.0.1530281075", report.BaseVersion)
+	assert.Equal(t, schema.Breaking, report.Level())
+
+	version, err := v.Version(schema.WithReport(context.Background(), report), src)
+	assert.Nil(t, err)
+	assert.Equal(t, "2.0.1530281076", version.String())
+}
+
+func Test_Gate(t *testing.T) {
+	breaking := &schema.Report{
+		Base:        "aaa",
+		BaseVersion: "1.0.1500000000",
+		Changes:     []schema.Change{{Level: schema.Breaking, Description: "field demo.User.name (2) was removed"}},
+	}
+	tests := []struct {
+		name    string
+		config  Config
+		ref     string
+		message string
+		allowed bool
+		report  *schema.Report
+		gated   bool
+		refused bool
+	}{
+		{name: "gate off", ref: "refs/heads/master", report: breaking},
+		{name: "prerelease", config: Config{Gate: true}, ref: "refs/heads/develop", report: breaking},
+		{name: "not compared", config: Config{Gate: true}, ref: "refs/heads/master"},
+		{name: "compatible", config: Config{Gate: true}, ref: "refs/heads/master", report: &schema.Report{Base: "aaa", BaseVersion: "1.0.1500000000"}, gated: true},
+		{name: "breaking", config: Config{Gate: true}, ref: "refs/heads/master", report: breaking, gated: true, refused: true},
+		{name: "allowed by directive", config: Config{Gate: true}, ref: "refs/heads/master", message: "Drop names " + AllowBreaking, report: breaking, gated: true},
+		{name: "allowed on request", config: Config{Gate: true}, ref: "refs/heads/master", allowed: true, report: breaking, gated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVersioner(t, tt.config)
+			src := newSource(t, tt.ref)
+			src.Payload.HeadCommit.Message = tt.message
+			ctx := context.Background()
+			if tt.report != nil {
+				ctx = schema.WithReport(ctx, tt.report)
+			}
+			if tt.allowed {
+				ctx = build.WithBreakingAllowed(ctx)
+			}
+
+			gated, err := v.Gate(ctx, src)
+			assert.Equal(t, tt.gated, gated)
+			if tt.refused {
+				assert.True(t, build.IsPermanent(err))
+				assert.Contains(t, err.Error(), "field demo.User.name (2) was removed")
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+type tagger interface {
+	CreatedTag(ctx context.Context, owner, repo, tag string) (bool, error)
+}
+
+type policy interface {
+	Decide(ref string) branch.Decision
+}
+
+type store interface {
+	Published(repository, sha, language string) (queue.Publication, bool, error)
+	EnqueueDelivery(id string, jobs []*queue.Job, at time.Time) ([]string, bool, error)
+}
+
+type observer interface {
+	Observe(payload event.Push)
+}
+
+type notifier interface {
+	Notify()
+}
+
+// Accepter queues the jobs packaging the pushes of a webhook delivery.
+type Accepter struct {
+	tags      bool
+	repo      tagger
+	branches  policy
+	store     store
+	observer  observer
+	pool      notifier
+	languages []string
+	logger    log.FieldLogger
+}
+
+// NewAccepter returns a pointer to an Accepter configured with the
+// parameters passed in. Tags are only packaged when tags is set, and
+// languages are those the process packages.
+func NewAccepter(tags bool, repo tagger, branches policy, store store, observer observer, pool notifier, languages []string, logger log.FieldLogger) *Accepter {
+	return &Accepter{
+		tags:      tags,
+		repo:      repo,
+		branches:  branches,
+		store:     store,
+		observer:  observer,
+		pool:      pool,
+		languages: languages,
+		logger:    logger,
+	}
+}
+
+// Accept queues a job for each push of a delivery that is packaged, the
+// first of which has the id of the request, and returns the ids of the
+// jobs. The jobs are written to disk before we respond, so once the
+// provider has its 200 the pushes will be packaged even if we restart.
+//
+// A delivery that was accepted before, such as one Github redelivered
+// after a timeout, is answered with the jobs it was queued as rather
+// than queued again. It is only remembered once it was accepted, so one
+// that failed is queued when it is redelivered. If the queue is full
+// it returns queue.ErrQueueFull and nothing is queued.
+func (a *Accepter) Accept(ctx context.Context, delivery, requestID string, pushes []event.Push) ([]string, error) {
+	var jobs []*queue.Job
+	for _, payload := range pushes {
+		payload, ok, err := a.packaged(ctx, payload)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		id := requestID
+		if len(jobs) > 0 {
+			id = uuid.NewV4().String()
+		}
+		jobs = append(jobs, queue.NewJob(id, payload))
+	}
+
+	ids, seen, err := a.store.EnqueueDelivery(delivery, jobs, time.Now().UTC())
+	if err == queue.ErrQueueFull {
+		// turn the delivery away rather than let builds pile up, the
+		// provider shows it as failed so it can be redelivered
+		a.logger.Warnf("job queue is full, turned away delivery %s", delivery)
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error enqueueing push event")
+	}
+	if seen {
+		a.logger.Infof("delivery %s was already accepted, not queueing it again", delivery)
+		return ids, nil
+	}
+
+	for _, job := range jobs {
+		a.observer.Observe(job.Payload)
+		a.pool.Notify()
+	}
+	return ids, nil
+}
+
+// packaged returns the push a job is queued for, and false if it is not
+// packaged at all.
+func (a *Accepter) packaged(ctx context.Context, payload event.Push) (event.Push, bool, error) {
+	// a push that deletes a branch or tag has no commit to package
+	if payload.Deleted {
+		return payload, false, nil
+	}
+
+	// tags are only packaged when the branch policy releases them,
+	// and never those the release package pushed itself, as
+	// otherwise it gets into a loop, packaging everything in other
+	// languages twice.
+	if tag, ok := branch.Tag(payload.Ref); ok {
+		if !a.tags {
+			return payload, false, nil
+		}
+		// the release package only tags Github repositories
+		if payload.Github() {
+			created, err := a.repo.CreatedTag(ctx, payload.Repository.Owner.Login, payload.Repository.Name, tag)
+			if err != nil {
+				// the provider shows the delivery as failed so it can be
+				// redelivered
+				return payload, false, err
+			}
+			if created {
+				return payload, false, nil
+			}
+		}
+		// the push of an annotated tag is of the tag object, and
+		// the commit it tags is the head commit
+		if payload.HeadCommit.ID != "" {
+			payload.After = payload.HeadCommit.ID
+		}
+	}
+
+	// nor does a push to a branch the branch policy skips
+	if a.branches.Decide(payload.Ref).Skipped() {
+		return payload, false, nil
+	}
+
+	// nor a commit already published from the ref in every language,
+	// such as one pushed again under a delivery of its own. A commit
+	// missing a language is packaged, and the workers skip the
+	// languages it was published in.
+	if len(a.languages) == 0 || payload.Repository.FullName == "" {
+		return payload, true, nil
+	}
+	for _, language := range a.languages {
+		publication, found, err := a.store.Published(payload.Repository.FullName, payload.After, language)
+		if err != nil {
+			return payload, false, err
+		}
+		if !found || publication.Ref != payload.Ref {
+			return payload, true, nil
+		}
+	}
+	a.logger.Infof("%s of %s at %s was already published, not queueing it again", payload.Ref, payload.Repository.FullName, payload.After)
+	return payload, false, nil
+}
@@ -0,0 +1,250 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/event"
+	"github.com/gospotcheck/protofact/pkg/queue"
+)
+
+// fakeTagger reports the tags in created as created by Protofact, and
+// fails for every tag once err is set.
+type fakeTagger struct {
+	created map[string]bool
+	err     error
+}
+
+func (f *fakeTagger) CreatedTag(ctx context.Context, owner, repo, tag string) (bool, error) {
+	if f.err != nil {
+		return false, f.err
+	}
+	return f.created[tag], nil
+}
+
+type fakeObserver struct {
+	mu       sync.Mutex
+	observed []event.Push
+}
+
+func (f *fakeObserver) Observe(payload event.Push) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.observed = append(f.observed, payload)
+}
+
+type fakeNotifier struct {
+	mu       sync.Mutex
+	notified int
+}
+
+func (f *fakeNotifier) Notify() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.notified++
+}
+
+func openTestStore(t *testing.T, config queue.Config) *queue.Store {
+	dir, err := ioutil.TempDir("", "protofact-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.DataDir = dir
+	store, err := queue.Open(config)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll(dir)
+	})
+	return store
+}
+
+func newTestAccepter(t *testing.T, tags bool, repo *fakeTagger, store *queue.Store) (*Accepter, *fakeObserver, *fakeNotifier) {
+	policy, err := branch.New(branch.Config{
+		Rules: []branch.Rule{{Glob: "wip/*", Channel: "skip"}},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	observer := &fakeObserver{}
+	pool := &fakeNotifier{}
+	a := NewAccepter(tags, repo, policy, store, observer, pool, []string{"npm", "ruby"}, log.WithField("test", t.Name()))
+	return a, observer, pool
+}
+
+var pushedAt = time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func TestAcceptRedelivery(t *testing.T) {
+	store := openTestStore(t, queue.Config{})
+	a, observer, pool := newTestAccepter(t, false, &fakeTagger{}, store)
+	push := event.GithubPush("org", "protos", "refs/heads/master", "aaa", pushedAt)
+
+	ids, err := a.Accept(context.Background(), "github/1", "a", []event.Push{push})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, ids)
+	assert.Len(t, observer.observed, 1)
+	assert.Equal(t, 1, pool.notified)
+
+	// a redelivery is answered with the job of the first delivery
+	ids, err = a.Accept(context.Background(), "github/1", "b", []event.Push{push})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, ids)
+	assert.Len(t, observer.observed, 1)
+	assert.Equal(t, 1, pool.notified)
+	_, err = store.Get("b")
+	assert.Equal(t, queue.ErrNotFound, err)
+
+	// a delivery that queued nothing is acknowledged again as well
+	wip := event.GithubPush("org", "protos", "refs/heads/wip/x", "bbb", pushedAt)
+	ids, err = a.Accept(context.Background(), "github/2", "c", []event.Push{wip})
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+	ids, err = a.Accept(context.Background(), "github/2", "d", []event.Push{wip})
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+
+	jobs, err := store.List()
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+}
+
+func TestAcceptConcurrentRedelivery(t *testing.T) {
+	store := openTestStore(t, queue.Config{})
+	a, observer, _ := newTestAccepter(t, false, &fakeTagger{}, store)
+	push := event.GithubPush("org", "protos", "refs/heads/master", "aaa", pushedAt)
+
+	// of the same delivery arriving at once only one is queued, and
+	// every one is answered with its job
+	var wg sync.WaitGroup
+	accepted := make([][]string, 10)
+	for i := range accepted {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids, err := a.Accept(context.Background(), "github/1", fmt.Sprintf("job-%d", i), []event.Push{push})
+			assert.Nil(t, err)
+			accepted[i] = ids
+		}(i)
+	}
+	wg.Wait()
+
+	jobs, err := store.List()
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Len(t, observer.observed, 1)
+	for _, ids := range accepted {
+		assert.Equal(t, []string{jobs[0].ID}, ids)
+	}
+}
+
+func TestAcceptPublishedCommit(t *testing.T) {
+	store := openTestStore(t, queue.Config{})
+	a, observer, _ := newTestAccepter(t, false, &fakeTagger{}, store)
+	push := event.GithubPush("org", "protos", "refs/heads/master", "aaa", pushedAt)
+
+	// a commit published in one language is packaged for the other
+	assert.Nil(t, store.SetPublished("org/protos", "aaa", "npm", queue.Publication{Ref: "refs/heads/master", JobID: "x"}))
+	ids, err := a.Accept(context.Background(), "github/1", "a", []event.Push{push})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, ids)
+
+	// and one published in every language is acknowledged without a job,
+	// even under a delivery of its own
+	assert.Nil(t, store.SetPublished("org/protos", "aaa", "ruby", queue.Publication{Ref: "refs/heads/master", JobID: "a"}))
+	ids, err = a.Accept(context.Background(), "github/2", "b", []event.Push{push})
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+	assert.Len(t, observer.observed, 1)
+
+	// but the same commit pushed to another ref is packaged for it
+	release := event.GithubPush("org", "protos", "refs/heads/release", "aaa", pushedAt)
+	ids, err = a.Accept(context.Background(), "github/3", "c", []event.Push{release})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c"}, ids)
+}
+
+func TestAcceptTags(t *testing.T) {
+	repo := &fakeTagger{created: map[string]bool{"v1.0.1530281075": true}}
+	push := func(tag, sha string) event.Push {
+		payload := event.GithubPush("org", "protos", "refs/tags/"+tag, "tagobject", pushedAt)
+		payload.HeadCommit.ID = sha
+		return payload
+	}
+
+	// tags are not packaged unless the branch policy releases them
+	store := openTestStore(t, queue.Config{})
+	a, _, _ := newTestAccepter(t, false, repo, store)
+	ids, err := a.Accept(context.Background(), "github/1", "a", []event.Push{push("v2.3.0", "aaa")})
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+
+	a, _, _ = newTestAccepter(t, true, repo, store)
+	// a tag Protofact pushed itself is never packaged, as otherwise it
+	// gets into a loop
+	ids, err = a.Accept(context.Background(), "github/2", "b", []event.Push{push("v1.0.1530281075", "aaa")})
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+
+	// a tag pushed by someone else is packaged at the commit it tags
+	ids, err = a.Accept(context.Background(), "github/3", "c", []event.Push{push("v2.3.0", "aaa")})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c"}, ids)
+	job, err := store.Get("c")
+	assert.Nil(t, err)
+	assert.Equal(t, "aaa", job.Payload.After)
+
+	// a tag whose creator cannot be told fails the delivery, which is
+	// not remembered so its redelivery is queued
+	repo.err = errors.New("github unavailable")
+	_, err = a.Accept(context.Background(), "github/4", "d", []event.Push{push("v2.4.0", "bbb")})
+	assert.NotNil(t, err)
+	repo.err = nil
+	ids, err = a.Accept(context.Background(), "github/4", "e", []event.Push{push("v2.4.0", "bbb")})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"e"}, ids)
+}
+
+func TestAcceptSeveralPushes(t *testing.T) {
+	store := openTestStore(t, queue.Config{})
+	a, _, pool := newTestAccepter(t, false, &fakeTagger{}, store)
+	pushes := []event.Push{
+		event.GithubPush("org", "protos", "refs/heads/wip/x", "aaa", pushedAt),
+		event.GithubPush("org", "protos", "refs/heads/master", "bbb", pushedAt),
+		event.GithubPush("org", "protos", "refs/heads/develop", "ccc", pushedAt),
+	}
+
+	// the first job queued has the id of the request
+	ids, err := a.Accept(context.Background(), "bitbucket/1", "a", pushes)
+	assert.Nil(t, err)
+	assert.Len(t, ids, 2)
+	assert.Equal(t, "a", ids[0])
+	assert.Equal(t, 2, pool.notified)
+}
+
+func TestAcceptWhenFull(t *testing.T) {
+	store := openTestStore(t, queue.Config{MaxQueued: 1})
+	a, observer, _ := newTestAccepter(t, false, &fakeTagger{}, store)
+	pushes := []event.Push{
+		event.GithubPush("org", "protos", "refs/heads/master", "aaa", pushedAt),
+		event.GithubPush("org", "protos", "refs/heads/develop", "bbb", pushedAt),
+	}
+
+	_, err := a.Accept(context.Background(), "bitbucket/1", "a", pushes)
+	assert.Equal(t, queue.ErrQueueFull, err)
+	assert.Empty(t, observer.observed)
+	jobs, err := store.List()
+	assert.Nil(t, err)
+	assert.Empty(t, jobs)
+}
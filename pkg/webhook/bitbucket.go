@@ -0,0 +1,146 @@
+package webhook
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/go-playground/webhooks.v5/bitbucket"
+	bitbucketserver "gopkg.in/go-playground/webhooks.v5/bitbucket-server"
+
+	"github.com/gospotcheck/protofact/pkg/event"
+)
+
+// bitbucketURL is where every Bitbucket Cloud repository is hosted.
+const bitbucketURL = "https://bitbucket.org/"
+
+// validateAndParseBitbucket receives a Bitbucket Cloud delivery, ensuring
+// it is a Push Event signed with the configured secret, and returns a push
+// for every ref it changed.
+func (p *Parser) validateAndParseBitbucket(r *http.Request) ([]event.Push, error) {
+	if err := p.configured(event.Bitbucket, p.config.BitbucketSecret); err != nil {
+		return nil, err
+	}
+	if _, err := readSigned(r, "X-Hub-Signature", p.config.BitbucketSecret); err != nil {
+		return nil, err
+	}
+
+	payload, err := p.bitbucket.Parse(r, bitbucket.RepoPushEvent)
+	if err != nil {
+		if err == bitbucket.ErrEventNotFound {
+			return nil, errors.Wrap(err, "event was not a push event")
+		}
+
+		return nil, errors.Wrap(err, "error parsing webhook payload")
+	}
+	push := payload.(bitbucket.RepoPushPayload)
+
+	var pushes []event.Push
+	for _, change := range push.Push.Changes {
+		var payload event.Push
+		payload.Provider = event.Bitbucket
+		payload.Before = change.Old.Target.Hash
+		if change.Closed {
+			// a deleted ref has no new side
+			payload.Ref = bitbucketRef(change.Old.Type, change.Old.Name)
+			payload.After = zeroSHA
+			payload.Deleted = true
+		} else {
+			payload.Ref = bitbucketRef(change.New.Type, change.New.Name)
+			payload.After = change.New.Target.Hash
+			payload.HeadCommit.ID = change.New.Target.Hash
+			payload.HeadCommit.Message = change.New.Target.Message
+		}
+		payload.Pusher.Name = push.Actor.NickName
+
+		// the full name of a repository is its workspace followed by
+		// its slug, which it is cloned by
+		fullName := push.Repository.FullName
+		payload.Repository.FullName = fullName
+		payload.Repository.Name = fullName[strings.LastIndex(fullName, "/")+1:]
+		if i := strings.LastIndex(fullName, "/"); i >= 0 {
+			payload.Repository.Owner.Login = fullName[:i]
+		}
+		payload.Repository.HTMLURL = bitbucketURL + fullName
+		payload.Repository.CloneURL = bitbucketURL + fullName + ".git"
+		// Bitbucket does not send when a ref was pushed, so versions
+		// follow when the push was received
+		payload.Repository.PushedAt = time.Now().Unix()
+		pushes = append(pushes, payload)
+	}
+	return pushes, nil
+}
+
+// bitbucketRef returns the full ref of a branch or tag Bitbucket Cloud
+// names by its type and short name.
+func bitbucketRef(kind, name string) string {
+	if kind == "tag" || kind == "annotated_tag" {
+		return "refs/tags/" + name
+	}
+	return "refs/heads/" + name
+}
+
+// validateAndParseBitbucketServer receives a Bitbucket Server delivery,
+// ensuring it is a Push Event signed with the configured secret, and
+// returns a push for every ref it changed. The ping Bitbucket Server sends
+// to test a webhook changes none.
+func (p *Parser) validateAndParseBitbucketServer(r *http.Request) ([]event.Push, error) {
+	if err := p.configured(event.BitbucketServer, p.config.BitbucketServerSecret); err != nil {
+		return nil, err
+	}
+
+	payload, err := p.bitbucketServer.Parse(r, bitbucketserver.RepositoryReferenceChangedEvent, bitbucketserver.DiagnosticsPingEvent)
+	if err != nil {
+		if err == bitbucketserver.ErrEventNotFound {
+			return nil, errors.Wrap(err, "event was not a push event")
+		}
+
+		return nil, errors.Wrap(err, "error parsing webhook payload")
+	}
+	push, ok := payload.(bitbucketserver.RepositoryReferenceChangedPayload)
+	if !ok {
+		return nil, nil
+	}
+
+	var pushes []event.Push
+	for _, change := range push.Changes {
+		var payload event.Push
+		payload.Provider = event.BitbucketServer
+		payload.Ref = change.ReferenceId
+		payload.Before = change.FromHash
+		payload.After = change.ToHash
+		payload.Deleted = change.Type == "DELETE"
+		payload.HeadCommit.ID = change.ToHash
+		payload.Pusher.Name = push.Actor.Name
+		payload.Pusher.Email = push.Actor.EmailAddress
+
+		// repositories are named by the key of their project and their
+		// slug, as in their urls
+		repo := push.Repository
+		payload.Repository.Name = repo.Slug
+		payload.Repository.FullName = repo.Project.Key + "/" + repo.Slug
+		payload.Repository.Owner.Login = repo.Project.Key
+		payload.Repository.HTMLURL = serverLink(repo.Links, "self", "")
+		payload.Repository.CloneURL = serverLink(repo.Links, "clone", "http")
+		payload.Repository.PushedAt = time.Time(push.Date).Unix()
+		pushes = append(pushes, payload)
+	}
+	return pushes, nil
+}
+
+// serverLink returns the first of the links of a kind, such as clone,
+// that Bitbucket Server sends with a repository, or the one named name
+// if name is set.
+func serverLink(links map[string]interface{}, kind, name string) string {
+	list, _ := links[kind].([]interface{})
+	for _, l := range list {
+		link, _ := l.(map[string]interface{})
+		if name != "" && link["name"] != name {
+			continue
+		}
+		href, _ := link["href"].(string)
+		return href
+	}
+	return ""
+}
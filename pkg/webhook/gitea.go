@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gospotcheck/protofact/pkg/event"
+)
+
+// giteaPush is the part of a Gitea Push Event a push is mapped from.
+type giteaPush struct {
+	Ref        string       `json:"ref"`
+	Before     string       `json:"before"`
+	After      string       `json:"after"`
+	HeadCommit *giteaCommit `json:"head_commit"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+		Owner    struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+		HTMLURL       string `json:"html_url"`
+		CloneURL      string `json:"clone_url"`
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repository"`
+	Pusher struct {
+		Login string `json:"login"`
+		Email string `json:"email"`
+	} `json:"pusher"`
+}
+
+type giteaCommit struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+// validateAndParseGitea receives a Gitea delivery, ensuring it is a Push
+// Event signed with the configured secret, and returns it as a push.
+func (p *Parser) validateAndParseGitea(r *http.Request) (event.Push, error) {
+	if err := p.configured(event.Gitea, p.config.GiteaSecret); err != nil {
+		return event.Push{}, err
+	}
+	if r.Method != http.MethodPost {
+		return event.Push{}, errors.New("invalid HTTP Method")
+	}
+	if e := r.Header.Get("X-Gitea-Event"); e != "push" {
+		return event.Push{}, errors.Errorf("event was not a push event: %s", e)
+	}
+	body, err := readSigned(r, "X-Gitea-Signature", p.config.GiteaSecret)
+	if err != nil {
+		return event.Push{}, err
+	}
+
+	var gitea giteaPush
+	if err := json.Unmarshal(body, &gitea); err != nil {
+		return event.Push{}, errors.Wrap(err, "error parsing webhook payload")
+	}
+
+	var payload event.Push
+	payload.Provider = event.Gitea
+	payload.Ref = gitea.Ref
+	payload.Before = gitea.Before
+	payload.After = gitea.After
+	payload.Deleted = gitea.After == zeroSHA
+	if gitea.HeadCommit != nil {
+		payload.HeadCommit.ID = gitea.HeadCommit.ID
+		payload.HeadCommit.Message = gitea.HeadCommit.Message
+	} else {
+		payload.HeadCommit.ID = gitea.After
+	}
+	payload.Pusher.Name = gitea.Pusher.Login
+	payload.Pusher.Email = gitea.Pusher.Email
+
+	repo := gitea.Repository
+	payload.Repository.Name = repo.Name
+	payload.Repository.FullName = repo.FullName
+	payload.Repository.Owner.Login = repo.Owner.Login
+	payload.Repository.HTMLURL = repo.HTMLURL
+	payload.Repository.CloneURL = repo.CloneURL
+	payload.Repository.DefaultBranch = repo.DefaultBranch
+	// Gitea does not send when a ref was pushed, so versions follow when
+	// the push was received
+	payload.Repository.PushedAt = time.Now().Unix()
+	return payload, nil
+}
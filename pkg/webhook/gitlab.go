@@ -0,0 +1,80 @@
+package webhook
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/go-playground/webhooks.v5/gitlab"
+
+	"github.com/gospotcheck/protofact/pkg/event"
+)
+
+// validateAndParseGitlab receives a Gitlab delivery, ensuring it is a Push
+// or Tag Push Event with the configured token, and returns it as a push.
+func (p *Parser) validateAndParseGitlab(r *http.Request) (event.Push, error) {
+	if err := p.configured(event.Gitlab, p.config.GitlabToken); err != nil {
+		return event.Push{}, err
+	}
+
+	payload, err := p.gitlab.Parse(r, gitlab.PushEvents, gitlab.TagEvents)
+	if err != nil {
+		if err == gitlab.ErrEventNotFound {
+			return event.Push{}, errors.Wrap(err, "event was not a push event")
+		}
+
+		return event.Push{}, errors.Wrap(err, "error parsing webhook payload")
+	}
+
+	switch payload := payload.(type) {
+	case gitlab.PushEventPayload:
+		push := gitlabPush(payload.Ref, payload.Before, payload.After, payload.CheckoutSHA, payload.Project, payload.Commits)
+		push.Pusher.Name = payload.UserName
+		push.Pusher.Email = payload.UserEmail
+		return push, nil
+	case gitlab.TagEventPayload:
+		push := gitlabPush(payload.Ref, payload.Before, payload.After, payload.CheckoutSHA, payload.Project, payload.Commits)
+		push.Pusher.Name = payload.UserName
+		return push, nil
+	}
+	return event.Push{}, errors.New("event was not a push event")
+}
+
+// gitlabPush maps the fields shared by Gitlab's Push and Tag Push Events
+// onto a push.
+func gitlabPush(ref, before, after, checkout string, project gitlab.Project, commits []gitlab.Commit) event.Push {
+	var payload event.Push
+	payload.Provider = event.Gitlab
+	payload.Ref = ref
+	payload.Before = before
+	payload.After = after
+	payload.Deleted = after == zeroSHA
+	// the after of a tag push is the sha of an annotated tag, the checkout
+	// sha is the commit it points at
+	if checkout != "" {
+		payload.After = checkout
+	}
+	payload.HeadCommit.ID = payload.After
+	for _, commit := range commits {
+		if commit.ID == payload.After {
+			payload.HeadCommit.Message = commit.Message
+		}
+	}
+
+	// a project path is its namespace, which may hold subgroups, followed
+	// by the project itself
+	path := project.PathWithNamespace
+	payload.Repository.FullName = path
+	payload.Repository.Name = path[strings.LastIndex(path, "/")+1:]
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		payload.Repository.Owner.Login = path[:i]
+	}
+	payload.Repository.HTMLURL = project.WebURL
+	payload.Repository.CloneURL = project.GitHTTPURL
+	payload.Repository.DefaultBranch = project.DefaultBranch
+	// Gitlab does not send when a ref was pushed, so versions follow when
+	// the push was received
+	payload.Repository.PushedAt = time.Now().Unix()
+	return payload
+}
@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// readBody reads the body of a delivery, putting it back so the delivery
+// can still be parsed.
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read webhook payload")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// validHMAC reports whether signature, hex encoded, is the HMAC of body
+// with any of secrets.
+func validHMAC(h func() hash.Hash, signature string, body []byte, secrets []string) bool {
+	for _, secret := range secrets {
+		mac := hmac.New(h, []byte(secret))
+		mac.Write(body)
+		if hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyGithub checks that a Github delivery is signed with any of
+// secrets. Github signs deliveries with both SHA-256, in
+// X-Hub-Signature-256, and SHA-1, in X-Hub-Signature, and the SHA-256
+// signature is checked whenever it is sent.
+func verifyGithub(r *http.Request, secrets []string) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+
+	if signature := r.Header.Get("X-Hub-Signature-256"); signature != "" {
+		if !strings.HasPrefix(signature, "sha256=") || !validHMAC(sha256.New, signature[len("sha256="):], body, secrets) {
+			return errors.New("X-Hub-Signature-256 verification failed")
+		}
+		return nil
+	}
+	if signature := r.Header.Get("X-Hub-Signature"); signature != "" {
+		if !strings.HasPrefix(signature, "sha1=") || !validHMAC(sha1.New, signature[len("sha1="):], body, secrets) {
+			return errors.New("X-Hub-Signature verification failed")
+		}
+		return nil
+	}
+	return errors.New("missing X-Hub-Signature-256 and X-Hub-Signature headers")
+}
+
+// readSigned reads the body of a delivery signed with an HMAC-SHA256 of
+// it, hex encoded in the header named, and checks the signature if secret
+// is set.
+func readSigned(r *http.Request, header, secret string) ([]byte, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		return body, nil
+	}
+
+	signature := r.Header.Get(header)
+	if signature == "" {
+		return nil, errors.Errorf("missing %s header", header)
+	}
+	if !validHMAC(sha256.New, strings.TrimPrefix(signature, "sha256="), body, []string{secret}) {
+		return nil, errors.Errorf("%s verification failed", header)
+	}
+	return body, nil
+}
@@ -2,50 +2,173 @@ package webhook
 
 import (
 	"net/http"
-	"strings"
 
 	"github.com/pkg/errors"
+	"gopkg.in/go-playground/webhooks.v5/bitbucket"
+	bitbucketserver "gopkg.in/go-playground/webhooks.v5/bitbucket-server"
 	"gopkg.in/go-playground/webhooks.v5/github"
+	"gopkg.in/go-playground/webhooks.v5/gitlab"
+
+	"github.com/gospotcheck/protofact/pkg/branch"
+	"github.com/gospotcheck/protofact/pkg/event"
 )
 
-// Config represents config values for the webhook parser.
+// zeroSHA is the sha a push reports as the head of a ref it deleted.
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+// previewActions are the pull request actions that change its head,
+// which are packaged as previews.
+var previewActions = map[string]bool{
+	"opened":      true,
+	"reopened":    true,
+	"synchronize": true,
+}
+
+// Config represents config values for the webhook parser. The secret of
+// every provider other than Github is checked whenever it is set. A
+// secure parser checks the signature of every Github delivery, and
+// refuses the deliveries of a provider while it has no secret.
 type Config struct {
+	// Secret is the secret of the Github webhooks, which sign every
+	// delivery in the X-Hub-Signature-256 and X-Hub-Signature headers.
 	Secret string
+	// Secrets are more secrets Github deliveries are accepted with, so a
+	// new secret can be rolled out to every webhook before the old one
+	// is retired.
+	Secrets []string
+	// Insecure accepts Github deliveries without checking their signature,
+	// and those of other hosts whose secret is empty. It is only meant for
+	// local development, as anyone who can reach the webhook route can then
+	// have packages published.
+	Insecure bool
+	// GitlabToken is the secret token of the Gitlab webhooks, checked
+	// against the X-Gitlab-Token header of every Gitlab delivery.
+	GitlabToken string
+	// BitbucketSecret is the secret of the Bitbucket Cloud webhooks,
+	// which sign every delivery in the X-Hub-Signature header.
+	BitbucketSecret string
+	// BitbucketServerSecret is the secret of the Bitbucket Server
+	// webhooks, which sign every delivery in the X-Hub-Signature header.
+	BitbucketServerSecret string
+	// GiteaSecret is the secret of the Gitea webhooks, which sign every
+	// delivery in the X-Gitea-Signature header.
+	GiteaSecret string
 }
 
-// Parser represents a service wrapping the github package
-// providing convenience methods for interacting with Push Events.
+// Parser represents a service wrapping the webhook packages of every
+// provider, providing convenience methods for interacting with Push Events.
 type Parser struct {
-	webhook *github.Webhook
+	secure          bool
+	config          Config
+	secrets         []string
+	webhook         *github.Webhook
+	gitlab          *gitlab.Webhook
+	bitbucket       *bitbucket.Webhook
+	bitbucketServer *bitbucketserver.Webhook
 }
 
 // NewParser creates a Parser struct with injection of options.
 // In production, secure should be true, but for testing and local development
-// it can be false.
+// it can be false. A secure parser without a Github secret refuses every
+// Github delivery, for a deployment that only takes pushes from other hosts.
 func NewParser(secure bool, config Config) (*Parser, error) {
-	var webhook *github.Webhook
-	var err error
-	if secure {
-		if strings.Compare(config.Secret, "") == 0 {
-			return &Parser{}, errors.New("if parser is secure, you must pass through a non-empty string")
+	var secrets []string
+	for _, s := range append([]string{config.Secret}, config.Secrets...) {
+		if s != "" {
+			secrets = append(secrets, s)
 		}
-		webhook, err = github.New(github.Options.Secret(config.Secret))
-	} else {
-		webhook, err = github.New()
 	}
+	// Github signatures are checked before its webhook parses a delivery,
+	// as it only knows of a single secret and the older SHA-1 signature
+	webhook, err := github.New()
 	if err != nil {
 		return &Parser{}, errors.Wrap(err, "could not create new github webhook")
 	}
+	// the other webhooks only check their secret when it is set
+	lab, err := gitlab.New(gitlab.Options.Secret(config.GitlabToken))
+	if err != nil {
+		return &Parser{}, errors.Wrap(err, "could not create new gitlab webhook")
+	}
+	// Bitbucket Cloud signatures are checked before its webhook parses
+	// a delivery, as it only knows of the older uuid check
+	cloud, err := bitbucket.New()
+	if err != nil {
+		return &Parser{}, errors.Wrap(err, "could not create new bitbucket webhook")
+	}
+	server, err := bitbucketserver.New(bitbucketserver.Options.Secret(config.BitbucketServerSecret))
+	if err != nil {
+		return &Parser{}, errors.Wrap(err, "could not create new bitbucket server webhook")
+	}
 
 	return &Parser{
-		webhook: webhook,
+		secure:          secure,
+		config:          config,
+		secrets:         secrets,
+		webhook:         webhook,
+		gitlab:          lab,
+		bitbucket:       cloud,
+		bitbucketServer: server,
 	}, nil
 }
 
+// Provider returns the provider a delivery comes from, told by the
+// headers each of them sets.
+func Provider(r *http.Request) string {
+	switch {
+	case r.Header.Get("X-Gitlab-Event") != "":
+		return event.Gitlab
+	case r.Header.Get("X-Gitea-Event") != "":
+		return event.Gitea
+	// Bitbucket Cloud and Server both name the event in X-Event-Key,
+	// but only Cloud sends the uuid of the webhook
+	case r.Header.Get("X-Hook-UUID") != "":
+		return event.Bitbucket
+	case r.Header.Get("X-Event-Key") != "":
+		return event.BitbucketServer
+	}
+	return event.Github
+}
+
+// deliveryHeaders are the headers each provider sends the unique id of a
+// delivery in, which a redelivery of it keeps.
+var deliveryHeaders = map[string]string{
+	event.Github:          "X-GitHub-Delivery",
+	event.Gitlab:          "X-Gitlab-Event-UUID",
+	event.Bitbucket:       "X-Request-UUID",
+	event.BitbucketServer: "X-Request-Id",
+	event.Gitea:           "X-Gitea-Delivery",
+}
+
+// DeliveryID returns the id of a delivery from provider, prefixed with
+// the provider so the ids of different providers do not collide, or an
+// empty string if the delivery has none.
+func DeliveryID(provider string, r *http.Request) string {
+	id := r.Header.Get(deliveryHeaders[provider])
+	if id == "" {
+		return ""
+	}
+	return provider + "/" + id
+}
+
+// configured returns an error if the deliveries of provider are refused,
+// as the parser is secure and provider has none of secrets to check them
+// with.
+func (p *Parser) configured(provider string, secrets ...string) error {
+	if !p.secure {
+		return nil
+	}
+	for _, s := range secrets {
+		if s != "" {
+			return nil
+		}
+	}
+	return errors.Errorf("%s webhooks are not configured", provider)
+}
+
 // IsPingEvent determines if the event is a Ping event by attempting
 // to parse it.
 func (p *Parser) IsPingEvent(r *http.Request) bool {
-	_, err := p.webhook.Parse(r, github.PingEvent)
+	_, err := p.parseGithub(r, github.PingEvent)
 	if err != nil {
 		return false
 	}
@@ -53,16 +176,125 @@ func (p *Parser) IsPingEvent(r *http.Request) bool {
 }
 
 // ValidateAndParsePushEvent is a convenience method for receiving an http request,
-// ensuring it is specifically a Push Event payload and returning it as that struct.
-func (p *Parser) ValidateAndParsePushEvent(r *http.Request) (github.PushPayload, error) {
-	payload, err := p.webhook.Parse(r, github.PushEvent)
+// ensuring it is specifically a Github Push Event payload and returning it as a push.
+func (p *Parser) ValidateAndParsePushEvent(r *http.Request) (event.Push, error) {
+	payload, err := p.parseGithub(r, github.PushEvent)
+	if err != nil {
+		if err == github.ErrEventNotFound {
+			return event.Push{}, errors.Wrap(err, "event was not a push event")
+		}
+
+		return event.Push{}, errors.Wrap(err, "error parsing webhook payload")
+	}
+	return githubPush(payload.(github.PushPayload)), nil
+}
+
+// ValidateAndParseEvent receives an http request from any provider, told
+// apart by its headers, and returns its payload as ValidateAndParseProviderEvent
+// does.
+func (p *Parser) ValidateAndParseEvent(r *http.Request) (interface{}, error) {
+	return p.ValidateAndParseProviderEvent(Provider(r), r)
+}
+
+// ValidateAndParseProviderEvent receives an http request from provider and
+// returns its payload if it is a Push Event, as an event.Push, or a list
+// of them for a Bitbucket push of several refs, or a Github Pull Request
+// Event, as a github.PullRequestPayload.
+func (p *Parser) ValidateAndParseProviderEvent(provider string, r *http.Request) (interface{}, error) {
+	switch provider {
+	case event.Github:
+	case event.Gitlab:
+		return p.validateAndParseGitlab(r)
+	case event.Bitbucket:
+		return p.validateAndParseBitbucket(r)
+	case event.BitbucketServer:
+		return p.validateAndParseBitbucketServer(r)
+	case event.Gitea:
+		return p.validateAndParseGitea(r)
+	default:
+		return nil, errors.Errorf("unknown provider %q", provider)
+	}
+
+	payload, err := p.parseGithub(r, github.PushEvent, github.PullRequestEvent)
 	if err != nil {
 		if err == github.ErrEventNotFound {
-			return github.PushPayload{}, errors.Wrap(err, "event was not a push event")
+			return nil, errors.Wrap(err, "event was not a push or pull request event")
 		}
 
-		return github.PushPayload{}, errors.Wrap(err, "error parsing webhook payload")
+		return nil, errors.Wrap(err, "error parsing webhook payload")
+	}
+	if push, ok := payload.(github.PushPayload); ok {
+		return githubPush(push), nil
+	}
+	return payload, nil
+}
+
+// parseGithub parses a Github delivery as one of events once its signature
+// has been checked, if the parser is secure.
+func (p *Parser) parseGithub(r *http.Request, events ...github.Event) (interface{}, error) {
+	if err := p.configured(event.Github, p.secrets...); err != nil {
+		return nil, err
+	}
+	if p.secure {
+		if err := verifyGithub(r, p.secrets); err != nil {
+			return nil, err
+		}
 	}
-	event := payload.(github.PushPayload)
-	return event, nil
+	return p.webhook.Parse(r, events...)
+}
+
+// Previewed reports whether a Pull Request Event changed the head of an
+// open pull request, which is then packaged as a preview.
+func Previewed(pr github.PullRequestPayload) bool {
+	return previewActions[pr.Action] && pr.PullRequest.State == "open"
+}
+
+// PullRequestPush returns the push of the head commit of a pull request
+// to its ref in the base repository, refs/pull/<number>/head, so it is
+// packaged like any other push. The head is fetched from the base
+// repository, where Github keeps it even for a pull request from a fork.
+func PullRequestPush(pr github.PullRequestPayload) event.Push {
+	var payload event.Push
+	payload.Provider = event.Github
+	payload.Ref = branch.PullRef(pr.Number)
+	payload.After = pr.PullRequest.Head.Sha
+	payload.HeadCommit.ID = pr.PullRequest.Head.Sha
+	payload.HeadCommit.Message = pr.PullRequest.Title
+	payload.Pusher.Name = pr.Sender.Login
+
+	repo := pr.Repository
+	payload.Repository.Name = repo.Name
+	payload.Repository.FullName = repo.FullName
+	payload.Repository.Owner.Login = repo.Owner.Login
+	payload.Repository.HTMLURL = repo.HTMLURL
+	payload.Repository.CloneURL = repo.CloneURL
+	payload.Repository.DefaultBranch = repo.DefaultBranch
+	// pushes to a ref are ordered by when they were pushed, and a pull
+	// request is updated whenever its head is
+	payload.Repository.PushedAt = pr.PullRequest.UpdatedAt.Unix()
+	return payload
+}
+
+// githubPush maps a Github Push Event onto a push.
+func githubPush(gh github.PushPayload) event.Push {
+	var payload event.Push
+	payload.Provider = event.Github
+	payload.Ref = gh.Ref
+	payload.Before = gh.Before
+	payload.After = gh.After
+	payload.Deleted = gh.Deleted
+	payload.HeadCommit.ID = gh.HeadCommit.ID
+	payload.HeadCommit.Message = gh.HeadCommit.Message
+	payload.Pusher.Name = gh.Pusher.Name
+	payload.Pusher.Email = gh.Pusher.Email
+
+	repo := gh.Repository
+	payload.Repository.Name = repo.Name
+	payload.Repository.FullName = repo.FullName
+	payload.Repository.Owner.Login = repo.Owner.Login
+	payload.Repository.HTMLURL = repo.HTMLURL
+	payload.Repository.CloneURL = repo.CloneURL
+	payload.Repository.DefaultBranch = repo.DefaultBranch
+	payload.Repository.PushedAt = repo.PushedAt
+	return payload
 }
@@ -2,13 +2,23 @@ package webhook
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
 	"io/ioutil"
 	"net/http"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/go-playground/webhooks.v5/github"
+
+	"github.com/gospotcheck/protofact/pkg/event"
 )
 
 func TestNewSecureParser(t *testing.T) {
-	c := Config{"IfWishesWereHorsesWedAllBeEatingSteak!"}
+	c := Config{Secret: "IfWishesWereHorsesWedAllBeEatingSteak!"}
 	_, err := NewParser(true, c)
 	if err != nil {
 		t.Errorf("could not create new parser: %s\n", err)
@@ -16,23 +26,72 @@ func TestNewSecureParser(t *testing.T) {
 }
 
 func TestNewInsecureParser(t *testing.T) {
-	c := Config{""}
+	c := Config{Secret: ""}
 	_, err := NewParser(false, c)
 	if err != nil {
 		t.Errorf("could not create new parser: %s\n", err)
 	}
 }
 
-func TestNewSecureParserEmptySecret(t *testing.T) {
-	c := Config{""}
-	_, err := NewParser(true, c)
-	if err == nil {
-		t.Errorf("should have disallowed empty string secret but didn't")
+func TestSecureParserWithoutGithubSecret(t *testing.T) {
+	// a deployment taking pushes from Gitea alone needs no Github secret
+	p, err := NewParser(true, Config{GiteaSecret: "giteasecret"})
+	if err != nil {
+		t.Fatalf("could not create new parser: %s\n", err)
+	}
+
+	// but every Github delivery is refused, signed or not
+	_, err = p.ValidateAndParseEvent(newRequest(t, "push.json", map[string]string{"X-Github-Event": "push"}))
+	assert.NotNil(t, err)
+	_, err = p.ValidateAndParseEvent(newRequest(t, "push.json", map[string]string{
+		"X-Github-Event":      "push",
+		"X-Hub-Signature-256": "sha256=" + sign(t, "push.json", ""),
+	}))
+	assert.NotNil(t, err)
+	assert.False(t, p.IsPingEvent(newRequest(t, "push.json", map[string]string{"X-Github-Event": "ping"})))
+
+	_, err = p.ValidateAndParseEvent(newRequest(t, "gitea-push.json", map[string]string{
+		"X-Gitea-Event":     "push",
+		"X-Gitea-Signature": sign(t, "gitea-push.json", "giteasecret"),
+	}))
+	assert.Nil(t, err)
+}
+
+func TestSecureParserSignatures(t *testing.T) {
+	// the old secret is still accepted while the new one is rolled out
+	p, err := NewParser(true, Config{Secret: "old", Secrets: []string{"new"}})
+	if err != nil {
+		t.Fatalf("could not create new parser: %s\n", err)
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		valid   bool
+	}{
+		{"sha256 with the new secret", map[string]string{"X-Hub-Signature-256": "sha256=" + signWith(t, sha256.New, "push.json", "new")}, true},
+		{"sha256 with the old secret", map[string]string{"X-Hub-Signature-256": "sha256=" + signWith(t, sha256.New, "push.json", "old")}, true},
+		{"sha1 with the new secret", map[string]string{"X-Hub-Signature": "sha1=" + signWith(t, sha1.New, "push.json", "new")}, true},
+		{"sha256 with another secret", map[string]string{"X-Hub-Signature-256": "sha256=" + signWith(t, sha256.New, "push.json", "other")}, false},
+		{"sha1 with another secret", map[string]string{"X-Hub-Signature": "sha1=" + signWith(t, sha1.New, "push.json", "other")}, false},
+		{"sha256 checked over sha1", map[string]string{
+			"X-Hub-Signature-256": "sha256=" + signWith(t, sha256.New, "push.json", "other"),
+			"X-Hub-Signature":     "sha1=" + signWith(t, sha1.New, "push.json", "new"),
+		}, false},
+		{"sha1 sent as sha256", map[string]string{"X-Hub-Signature-256": "sha1=" + signWith(t, sha1.New, "push.json", "new")}, false},
+		{"unsigned", map[string]string{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.headers["X-Github-Event"] = "push"
+			_, err := p.ValidateAndParseEvent(newRequest(t, "push.json", tt.headers))
+			assert.Equal(t, tt.valid, err == nil, "%v", err)
+		})
 	}
 }
 
 func TestPushEventParse(t *testing.T) {
-	c := Config{""}
+	c := Config{Secret: ""}
 	p, err := NewParser(false, c)
 	if err != nil {
 		t.Errorf("could not create new parser: %s\n", err)
@@ -52,14 +111,18 @@ func TestPushEventParse(t *testing.T) {
 	req.Header.Set("X-Github-Event", "push")
 	req.Header.Set("X-Hub-Signature", "sha1=156404ad5f721c53151147f3d3d302329f95a3ab")
 
-	_, err = p.ValidateAndParsePushEvent(req)
+	payload, err := p.ValidateAndParsePushEvent(req)
 	if err != nil {
 		t.Errorf("error validating and parsing payload: %s\n", err)
 	}
+	assert.True(t, payload.Github())
+	assert.Equal(t, "fd489864e7642b48eaad6e3f155c10e46810ec72", payload.HeadCommit.ID)
+	assert.Equal(t, "binkkatal", payload.Pusher.Name)
+	assert.Equal(t, int64(1530281075), payload.Repository.PushedAt)
 }
 
 func TestNonPushEventParse(t *testing.T) {
-	c := Config{""}
+	c := Config{Secret: ""}
 	p, err := NewParser(false, c)
 	if err != nil {
 		t.Errorf("could not create new parser: %s\n", err)
@@ -86,7 +149,7 @@ func TestNonPushEventParse(t *testing.T) {
 }
 
 func TestOtherParseError(t *testing.T) {
-	c := Config{""}
+	c := Config{Secret: ""}
 	p, err := NewParser(false, c)
 	if err != nil {
 		t.Errorf("could not create new parser: %s\n", err)
@@ -110,3 +173,301 @@ func TestOtherParseError(t *testing.T) {
 		t.Error("should have created an error because of missing headers, but didn't")
 	}
 }
+
+func TestPullRequestEventParse(t *testing.T) {
+	c := Config{Secret: ""}
+	p, err := NewParser(false, c)
+	if err != nil {
+		t.Errorf("could not create new parser: %s\n", err)
+	}
+
+	fileContent, err := ioutil.ReadFile("./testdata/pull-request.json")
+	if err != nil {
+		t.Errorf("could not read test data file: %s\n", err)
+	}
+	reader := bytes.NewReader(fileContent)
+
+	req, err := http.NewRequest("POST", "/webhook", reader)
+	if err != nil {
+		t.Errorf("error making new http request: %s\n", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Github-Event", "pull_request")
+
+	parsed, err := p.ValidateAndParseEvent(req)
+	if err != nil {
+		t.Fatalf("error validating and parsing payload: %s\n", err)
+	}
+	pr, ok := parsed.(github.PullRequestPayload)
+	if !ok {
+		t.Fatalf("expected a pull request payload, got %T", parsed)
+	}
+	assert.True(t, Previewed(pr))
+
+	payload := PullRequestPush(pr)
+	assert.Equal(t, "refs/pull/1/head", payload.Ref)
+	assert.Equal(t, "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c", payload.After)
+	assert.Equal(t, "baxterthehacker/public-repo", payload.Repository.FullName)
+	assert.Equal(t, "baxterthehacker", payload.Repository.Owner.Login)
+	assert.Equal(t, "https://github.com/baxterthehacker/public-repo.git", payload.Repository.CloneURL)
+	assert.Equal(t, int64(1430869227), payload.Repository.PushedAt)
+
+	pr.Action = "closed"
+	assert.False(t, Previewed(pr))
+}
+
+// newRequest returns a delivery of a fixture in testdata with headers.
+func newRequest(t *testing.T, fixture string, headers map[string]string) *http.Request {
+	fileContent, err := ioutil.ReadFile("./testdata/" + fixture)
+	if err != nil {
+		t.Fatalf("could not read test data file: %s\n", err)
+	}
+
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewReader(fileContent))
+	if err != nil {
+		t.Fatalf("error making new http request: %s\n", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+// sign returns the hex HMAC-SHA256 of a fixture in testdata with secret.
+func sign(t *testing.T, fixture, secret string) string {
+	return signWith(t, sha256.New, fixture, secret)
+}
+
+// signWith returns the hex HMAC of a fixture in testdata with secret.
+func signWith(t *testing.T, h func() hash.Hash, fixture, secret string) string {
+	fileContent, err := ioutil.ReadFile("./testdata/" + fixture)
+	if err != nil {
+		t.Fatalf("could not read test data file: %s\n", err)
+	}
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(fileContent)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newGitlabRequest(t *testing.T, token string) *http.Request {
+	return newRequest(t, "gitlab-push.json", map[string]string{
+		"X-Gitlab-Event": "Push Hook",
+		"X-Gitlab-Token": token,
+	})
+}
+
+func TestGitlabPushEventParse(t *testing.T) {
+	p, err := NewParser(true, Config{Secret: "secret", GitlabToken: "gitlabtoken"})
+	if err != nil {
+		t.Fatalf("could not create new parser: %s\n", err)
+	}
+
+	parsed, err := p.ValidateAndParseEvent(newGitlabRequest(t, "gitlabtoken"))
+	if err != nil {
+		t.Fatalf("error validating and parsing payload: %+v\n", err)
+	}
+	payload, ok := parsed.(event.Push)
+	if !ok {
+		t.Fatalf("expected a push, got %T", parsed)
+	}
+	assert.False(t, payload.Github())
+	assert.Equal(t, event.Gitlab, payload.Provider)
+	assert.Equal(t, "refs/heads/master", payload.Ref)
+	assert.Equal(t, "da1560886d4f094c3e6c9ef40349f7d38b5d27d7", payload.After)
+	assert.Equal(t, "da1560886d4f094c3e6c9ef40349f7d38b5d27d7", payload.HeadCommit.ID)
+	assert.NotEmpty(t, payload.HeadCommit.Message)
+	assert.False(t, payload.Deleted)
+	assert.Equal(t, "John Smith", payload.Pusher.Name)
+	assert.Equal(t, "john@example.com", payload.Pusher.Email)
+	assert.Equal(t, "mike/diaspora", payload.Repository.FullName)
+	assert.Equal(t, "diaspora", payload.Repository.Name)
+	assert.Equal(t, "mike", payload.Repository.Owner.Login)
+	assert.Equal(t, "http://example.com/mike/diaspora.git", payload.Repository.CloneURL)
+	assert.Equal(t, "http://example.com/mike/diaspora", payload.Repository.HTMLURL)
+	assert.Equal(t, "master", payload.Repository.DefaultBranch)
+	assert.NotZero(t, payload.Repository.PushedAt)
+
+	_, err = p.ValidateAndParseEvent(newGitlabRequest(t, "wrongtoken"))
+	assert.NotNil(t, err)
+
+	// the token is checked even when the parser is not secure
+	p, err = NewParser(false, Config{GitlabToken: "gitlabtoken"})
+	if err != nil {
+		t.Fatalf("could not create new parser: %s\n", err)
+	}
+	_, err = p.ValidateAndParseEvent(newGitlabRequest(t, "wrongtoken"))
+	assert.NotNil(t, err)
+	_, err = p.ValidateAndParseEvent(newGitlabRequest(t, "gitlabtoken"))
+	assert.Nil(t, err)
+}
+
+func TestGitlabNotConfigured(t *testing.T) {
+	p, err := NewParser(true, Config{Secret: "secret"})
+	if err != nil {
+		t.Fatalf("could not create new parser: %s\n", err)
+	}
+
+	// a secure parser takes no Gitlab deliveries without a token to check
+	_, err = p.ValidateAndParseEvent(newGitlabRequest(t, ""))
+	assert.NotNil(t, err)
+}
+
+func TestProvider(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"X-Github-Event", event.Github},
+		{"X-Gitlab-Event", event.Gitlab},
+		{"X-Gitea-Event", event.Gitea},
+		{"X-Hook-UUID", event.Bitbucket},
+		{"X-Event-Key", event.BitbucketServer},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/webhook", nil)
+		req.Header.Set(tt.header, "push")
+		assert.Equal(t, tt.want, Provider(req), tt.header)
+	}
+}
+
+func TestDeliveryID(t *testing.T) {
+	tests := []struct {
+		provider string
+		header   string
+	}{
+		{event.Github, "X-GitHub-Delivery"},
+		{event.Gitlab, "X-Gitlab-Event-UUID"},
+		{event.Bitbucket, "X-Request-UUID"},
+		{event.BitbucketServer, "X-Request-Id"},
+		{event.Gitea, "X-Gitea-Delivery"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/webhook", nil)
+		assert.Equal(t, "", DeliveryID(tt.provider, req), tt.provider)
+		req.Header.Set(tt.header, "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		assert.Equal(t, tt.provider+"/72d3162e-cc78-11e3-81ab-4c9367dc0958", DeliveryID(tt.provider, req), tt.provider)
+	}
+}
+
+func TestBitbucketPushEventParse(t *testing.T) {
+	p, err := NewParser(true, Config{Secret: "secret", BitbucketSecret: "bitbucketsecret"})
+	if err != nil {
+		t.Fatalf("could not create new parser: %s\n", err)
+	}
+	headers := map[string]string{
+		"X-Event-Key":     "repo:push",
+		"X-Hook-UUID":     "d3c8e5a2-0b2c-4e8e-9d2f-2f4e1c6b3a1d",
+		"X-Hub-Signature": "sha256=" + sign(t, "bitbucket-push.json", "bitbucketsecret"),
+	}
+
+	parsed, err := p.ValidateAndParseEvent(newRequest(t, "bitbucket-push.json", headers))
+	if err != nil {
+		t.Fatalf("error validating and parsing payload: %+v\n", err)
+	}
+	pushes, ok := parsed.([]event.Push)
+	if !ok || !assert.Len(t, pushes, 1) {
+		t.Fatalf("expected one push, got %#v", parsed)
+	}
+	payload := pushes[0]
+	assert.Equal(t, event.Bitbucket, payload.Provider)
+	assert.Equal(t, "refs/heads/name-of-branch", payload.Ref)
+	assert.Equal(t, "709d658dc5b6d6afcd46049c2f332ee3f515a67d", payload.After)
+	assert.Equal(t, "709d658dc5b6d6afcd46049c2f332ee3f515a67d", payload.HeadCommit.ID)
+	assert.Equal(t, "new commit message\n", payload.HeadCommit.Message)
+	assert.False(t, payload.Deleted)
+	assert.Equal(t, "emmap1", payload.Pusher.Name)
+	assert.Equal(t, "team_name/repo_name", payload.Repository.FullName)
+	assert.Equal(t, "repo_name", payload.Repository.Name)
+	assert.Equal(t, "team_name", payload.Repository.Owner.Login)
+	assert.Equal(t, "https://bitbucket.org/team_name/repo_name.git", payload.Repository.CloneURL)
+
+	headers["X-Hub-Signature"] = "sha256=" + sign(t, "bitbucket-push.json", "wrongsecret")
+	_, err = p.ValidateAndParseEvent(newRequest(t, "bitbucket-push.json", headers))
+	assert.NotNil(t, err)
+}
+
+func TestBitbucketServerPushEventParse(t *testing.T) {
+	p, err := NewParser(true, Config{Secret: "secret", BitbucketServerSecret: "serversecret"})
+	if err != nil {
+		t.Fatalf("could not create new parser: %s\n", err)
+	}
+	headers := map[string]string{
+		"X-Event-Key":     "repo:refs_changed",
+		"X-Request-Id":    "b1e1a6ad-5b5c-4c5a-9d5e-3b3f1c9b7d41",
+		"X-Hub-Signature": "sha256=" + sign(t, "bitbucket-server-push.json", "serversecret"),
+	}
+
+	parsed, err := p.ValidateAndParseEvent(newRequest(t, "bitbucket-server-push.json", headers))
+	if err != nil {
+		t.Fatalf("error validating and parsing payload: %+v\n", err)
+	}
+	pushes, ok := parsed.([]event.Push)
+	if !ok || !assert.Len(t, pushes, 1) {
+		t.Fatalf("expected one push, got %#v", parsed)
+	}
+	payload := pushes[0]
+	assert.Equal(t, event.BitbucketServer, payload.Provider)
+	assert.Equal(t, "refs/heads/feature/wip", payload.Ref)
+	assert.Equal(t, "32a0b8a740c2963c6f56bd8baf3dc05683d299e0", payload.Before)
+	assert.True(t, payload.Deleted)
+	assert.Equal(t, "gopher", payload.Pusher.Name)
+	assert.Equal(t, "foo@bar.com", payload.Pusher.Email)
+	assert.Equal(t, "~gopher/webhook-test", payload.Repository.FullName)
+	assert.Equal(t, "webhook-test", payload.Repository.Name)
+	assert.Equal(t, "~gopher", payload.Repository.Owner.Login)
+	assert.Equal(t, "https://server.bitbucket.local/scm/~gopher/webhook-test.git", payload.Repository.CloneURL)
+	assert.Equal(t, "https://server.bitbucket.local/users/gopher/repos/webhook-test/browse", payload.Repository.HTMLURL)
+	assert.Equal(t, int64(1551433034), payload.Repository.PushedAt)
+
+	// the provider can be set rather than told from the headers
+	delete(headers, "X-Request-Id")
+	parsed, err = p.ValidateAndParseProviderEvent(event.BitbucketServer, newRequest(t, "bitbucket-server-push.json", headers))
+	assert.Nil(t, err)
+	assert.Len(t, parsed, 1)
+
+	headers["X-Hub-Signature"] = "sha256=" + sign(t, "bitbucket-server-push.json", "wrongsecret")
+	_, err = p.ValidateAndParseEvent(newRequest(t, "bitbucket-server-push.json", headers))
+	assert.NotNil(t, err)
+}
+
+func TestGiteaPushEventParse(t *testing.T) {
+	p, err := NewParser(true, Config{Secret: "secret", GiteaSecret: "giteasecret"})
+	if err != nil {
+		t.Fatalf("could not create new parser: %s\n", err)
+	}
+	headers := map[string]string{
+		"X-Gitea-Event":     "push",
+		"X-Gitea-Signature": sign(t, "gitea-push.json", "giteasecret"),
+	}
+
+	parsed, err := p.ValidateAndParseEvent(newRequest(t, "gitea-push.json", headers))
+	if err != nil {
+		t.Fatalf("error validating and parsing payload: %+v\n", err)
+	}
+	payload, ok := parsed.(event.Push)
+	if !ok {
+		t.Fatalf("expected a push, got %T", parsed)
+	}
+	assert.Equal(t, event.Gitea, payload.Provider)
+	assert.Equal(t, "refs/heads/develop", payload.Ref)
+	assert.Equal(t, "bffeb74224043ba2feb48d137756c8a9331c449a", payload.After)
+	assert.Equal(t, "Webhooks Yay!", payload.HeadCommit.Message)
+	assert.Equal(t, "gitea", payload.Pusher.Name)
+	assert.Equal(t, "gitea/webhooks", payload.Repository.FullName)
+	assert.Equal(t, "gitea", payload.Repository.Owner.Login)
+	assert.Equal(t, "https://gitea.example.com/gitea/webhooks.git", payload.Repository.CloneURL)
+	assert.Equal(t, "master", payload.Repository.DefaultBranch)
+
+	headers["X-Gitea-Signature"] = sign(t, "gitea-push.json", "wrongsecret")
+	_, err = p.ValidateAndParseEvent(newRequest(t, "gitea-push.json", headers))
+	assert.NotNil(t, err)
+
+	// a secure parser without the secret refuses Gitea deliveries
+	p, err = NewParser(true, Config{Secret: "secret"})
+	if err != nil {
+		t.Fatalf("could not create new parser: %s\n", err)
+	}
+	_, err = p.ValidateAndParseEvent(newRequest(t, "gitea-push.json", headers))
+	assert.NotNil(t, err)
+}